@@ -12,6 +12,18 @@ func NewApiV1Server(env lib.EnvInfo) *Server {
 	api := handler.NewPushApi(server)
 	server.HandleFunc("/api/v1/send", api.Send)
 	server.HandleFunc("/api/v1/add-device", api.AddDevice)
+	server.HandleFunc("/api/v1/report", api.Report)
+	server.HandleFunc("/api/v1/report/export", api.Export)
+	server.HandleFunc("/api/v1/open", api.Open)
+	server.HandleFunc("/api/v1/rollout", api.Rollout)
+
+	admin := handler.NewAdminApi(server)
+	server.HandleFunc("/api/v1/admin/throttle", admin.Throttle)
+	server.HandleFunc("/api/v1/admin/workers", admin.Workers)
+	server.HandleFunc("/api/v1/admin/tasks", admin.Tasks)
+	server.HandleFunc("/api/v1/admin/pools", admin.Pools)
+	server.HandleFunc("/api/v1/admin/pool-config", admin.PoolConfig)
+	server.HandleFunc("/api/v1/admin/reload", admin.Reload)
 
 	return server
 }
\ No newline at end of file
@@ -0,0 +1,18 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package api
+
+import (
+	"gopush/api/handler"
+	"gopush/lib"
+)
+
+// v2 server, v1 api is still available
+func NewApiV2Server(env lib.EnvInfo) *Server {
+	server := NewApiV1Server(env)
+
+	api := handler.NewPushApi(server)
+	server.HandleFunc("/api/v2/send", api.SendV2)
+	server.HandleFunc("/api/v2/batch", api.BatchV2)
+
+	return server
+}
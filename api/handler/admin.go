@@ -0,0 +1,342 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopush/lib"
+)
+
+const (
+	ADMIN_POOL_ACTION_RESIZE = "resize"
+	//release workers of a spare pool
+	ADMIN_POOL_ACTION_STOP = "stop"
+	//cancel tasks of a sending pool
+	ADMIN_POOL_ACTION_CANCEL = "cancel"
+)
+
+type AdminApi struct {
+	PushApi
+}
+
+func NewAdminApi(server lib.Server) *AdminApi {
+	return &AdminApi{PushApi{server:server}}
+}
+
+// Throttle API
+//
+// DESC: Show or change outbound push throttle at runtime, GET to show, POST to change.
+// Params:
+//		rate: global pushes per second, 0 for unlimited
+//		burst: global burst, default max(1, rate)
+//		task_rate: default pushes per second of new tasks
+//		push-id: with rate, change the rate of a waiting or sending task instead of global
+func (api *AdminApi) Throttle(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	if !api.authorize(w, r, lib.API_SCOPE_ADMIN) {
+		return
+	}
+
+	throttle := api.server.GetEnv().GetThrottle()
+
+	if r.Method == lib.HTTP_METHOD_POST {
+		api.server.GetEnv().GetLogger().Println("Receive request from " + GetClientName(r) + ": ", r.Form)
+
+		rate, rateErr := GetParamFloat(r, "rate")
+		if rateErr == nil && rate < 0 {
+			api.OutputResponse(w, &Response{Error:true, Message:"Param rate must >=0.", Code:API_CODE_PARAM_ERROR})
+			return
+		}
+
+		pushID, err := GetParamString(r, "push-id")
+		if err == nil {
+			if rateErr != nil {
+				api.OutputResponse(w, &Response{Error:true, Message:"Param rate is required with push-id.", Code:API_CODE_PARAM_REQUIRED})
+				return
+			}
+
+			task, err := api.server.GetTaskQueue().GetTaskByPushID(pushID)
+			if err != nil {
+				api.OutputResponse(w, &Response{Error:true, Message:err.Error(), Code:API_CODE_TASK_NOT_FOUND})
+				return
+			}
+			task.SetRate(rate)
+			api.server.GetEnv().GetLogger().Println("Throttle of task " + pushID + " changed to", rate, "by", GetClientName(r))
+		} else {
+			if rateErr == nil {
+				burst, err := GetParamInt(r, "burst")
+				if err != nil || burst < 0 {
+					burst = 0
+				}
+				throttle.SetRate(rate, burst)
+				api.server.GetEnv().GetLogger().Println("Throttle global rate changed to", rate, "burst", burst, "by", GetClientName(r))
+			}
+
+			taskRate, err := GetParamFloat(r, "task_rate")
+			if err == nil && taskRate >= 0 {
+				throttle.SetTaskRate(taskRate)
+				api.server.GetEnv().GetLogger().Println("Throttle default task rate changed to", taskRate, "by", GetClientName(r))
+			}
+		}
+	}
+
+	resp := new(ThrottleResponse)
+	resp.Rate = throttle.GetRate()
+	resp.TaskRate = throttle.GetTaskRate()
+	resp.Error = false
+	resp.Message = "Throttle rate:" + strconv.FormatFloat(resp.Rate, 'f', -1, 64) + " task_rate:" + strconv.FormatFloat(resp.TaskRate, 'f', -1, 64)
+	resp.Code = API_CODE_OK
+
+	api.OutputResponse(w, resp)
+	return
+}
+
+// Workers API
+//
+// DESC: List workers of all pools and harvested ones, with status, pool, age and push counts.
+// Params:
+//		pool: only workers of pool id, -1 for harvested ones
+func (api *AdminApi) Workers(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	if !api.authorize(w, r, lib.API_SCOPE_ADMIN) {
+		return
+	}
+
+	wp := api.server.GetEnv().GetWorkerPool()
+
+	resp := new(WorkersResponse)
+	resp.Max = wp.GetMaxWorkers()
+	resp.Workers = wp.List()
+
+	poolID, err := GetParamInt(r, "pool")
+	if err == nil {
+		workers := []*lib.WorkerInfo{}
+		for _, info := range resp.Workers {
+			if info.PoolID == poolID {
+				workers = append(workers, info)
+			}
+		}
+		resp.Workers = workers
+	}
+	resp.Error = false
+	resp.Message = "Workers: " + strconv.Itoa(len(resp.Workers))
+	resp.Code = API_CODE_OK
+
+	api.OutputResponse(w, resp)
+	return
+}
+
+// Tasks API
+//
+// DESC: List waiting tasks of TaskQueue with positions, position 0 is the next to send.
+func (api *AdminApi) Tasks(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	if !api.authorize(w, r, lib.API_SCOPE_ADMIN) {
+		return
+	}
+
+	tq := api.server.GetTaskQueue()
+
+	resp := new(TasksResponse)
+	resp.Tasks = tq.List()
+	resp.Sending = tq.GetSending()
+	resp.Error = false
+	resp.Message = "Tasks waiting: " + strconv.Itoa(len(resp.Tasks)) + " sending: " + strconv.Itoa(resp.Sending)
+	resp.Code = API_CODE_OK
+
+	api.OutputResponse(w, resp)
+	return
+}
+
+// Pools API
+//
+// DESC: List created pools with status, workers, config and tasks, GET to show, POST to control a pool.
+// Params:
+//		pool: pool id, required by POST
+//		action: resize, change workers of pool; stop, release workers of a spare pool, created again when allocated;
+//			cancel, cancel tasks of a sending pool, pushes in flight finish, devices not sent returned by push-id
+//		size: workers of resize, between pool spare.mini and capacity, can not shrink when sending
+func (api *AdminApi) Pools(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	if !api.authorize(w, r, lib.API_SCOPE_ADMIN) {
+		return
+	}
+
+	tq := api.server.GetTaskQueue()
+
+	var cancelled map[string]int
+	if r.Method == lib.HTTP_METHOD_POST {
+		api.server.GetEnv().GetLogger().Println("Receive request from " + GetClientName(r) + ": ", r.Form)
+
+		poolID, err := GetParamInt(r, "pool")
+		if err != nil {
+			api.OutputResponse(w, &Response{Error:true, Message:"Param pool is required.", Code:API_CODE_PARAM_REQUIRED})
+			return
+		}
+
+		pool, err := tq.GetPool(poolID)
+		if err != nil {
+			api.OutputResponse(w, &Response{Error:true, Message:err.Error(), Code:API_CODE_POOL_NOT_FOUND})
+			return
+		}
+
+		action, _ := GetParamString(r, "action")
+		switch action {
+		case ADMIN_POOL_ACTION_RESIZE:
+			size, sizeErr := GetParamInt(r, "size")
+			if sizeErr != nil {
+				api.OutputResponse(w, &Response{Error:true, Message:"Param size is required with resize.", Code:API_CODE_PARAM_REQUIRED})
+				return
+			}
+			err = pool.ResizeTo(size)
+		case ADMIN_POOL_ACTION_STOP:
+			err = pool.Stop()
+		case ADMIN_POOL_ACTION_CANCEL:
+			cancelled, err = pool.Cancel()
+		default:
+			api.OutputResponse(w, &Response{Error:true, Message:"Param action must be " + ADMIN_POOL_ACTION_RESIZE + ", " + ADMIN_POOL_ACTION_STOP + " or " + ADMIN_POOL_ACTION_CANCEL + ".", Code:API_CODE_PARAM_ERROR})
+			return
+		}
+		if err != nil {
+			api.OutputResponse(w, &Response{Error:true, Message:"Pool " + action + " error:" + err.Error(), Code:API_CODE_POOL_ERROR})
+			return
+		}
+		api.server.GetEnv().GetLogger().Println(pool.GetPoolName() + " " + action + " by " + GetClientName(r))
+		for pushID, notSent := range cancelled {
+			api.server.GetEnv().GetLogger().Println(pool.GetPoolName() + " cancelled task " + pushID + ", devices not sent: " + strconv.Itoa(notSent))
+		}
+	}
+
+	resp := new(PoolsResponse)
+	resp.Pools = tq.ListPools()
+	resp.Cancelled = cancelled
+	resp.Error = false
+	resp.Message = "Pools: " + strconv.Itoa(len(resp.Pools))
+	resp.Code = API_CODE_OK
+
+	api.OutputResponse(w, resp)
+	return
+}
+
+// PoolConfig API
+//
+// DESC: Show or change default PoolConfig at runtime, GET to show, POST to change.
+//		only pools created after use the new defaults, resize created pools by pools api.
+// Params:
+//		size, capacity, spare.mini, spare.max: same to command line flags, not changed if empty
+//		autoscale: true or false
+//		autoscale.interval: seconds
+func (api *AdminApi) PoolConfig(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	if !api.authorize(w, r, lib.API_SCOPE_ADMIN) {
+		return
+	}
+
+	env := api.server.GetEnv()
+
+	if r.Method == lib.HTTP_METHOD_POST {
+		env.GetLogger().Println("Receive request from " + GetClientName(r) + ": ", r.Form)
+
+		current := *env.GetPoolConfig()
+		values := map[string]*int{"size":&current.Size, "capacity":&current.Capacity, "spare.mini":&current.MiniSpare, "spare.max":&current.MaxSpare}
+		for name, value := range values {
+			if _, ok := r.Form[name]; !ok {
+				continue
+			}
+
+			param, err := GetParamInt(r, name)
+			if err != nil {
+				api.OutputResponse(w, &Response{Error:true, Message:"Param " + name + " must be an integer.", Code:API_CODE_PARAM_ERROR})
+				return
+			}
+			*value = param
+		}
+
+		config, err := lib.NewPoolConfig(current.Size, current.Capacity, current.MiniSpare, current.MaxSpare)
+		if err != nil {
+			api.OutputResponse(w, &Response{Error:true, Message:"PoolConfig error:" + err.Error(), Code:API_CODE_PARAM_ERROR})
+			return
+		}
+		config.AutoScale = current.AutoScale
+		config.AutoScaleInterval = current.AutoScaleInterval
+
+		tmpStr, err := GetParamString(r, "autoscale")
+		if err == nil {
+			config.AutoScale, err = strconv.ParseBool(tmpStr)
+			if err != nil {
+				api.OutputResponse(w, &Response{Error:true, Message:"Param autoscale must be true or false.", Code:API_CODE_PARAM_ERROR})
+				return
+			}
+		}
+
+		seconds, err := GetParamInt(r, "autoscale.interval")
+		if err == nil {
+			if seconds <= 0 {
+				api.OutputResponse(w, &Response{Error:true, Message:"Param autoscale.interval must be seconds >0.", Code:API_CODE_PARAM_ERROR})
+				return
+			}
+			config.AutoScaleInterval = time.Duration(seconds) * time.Second
+		}
+
+		env.SetPoolConfig(config)
+		env.GetLogger().Println("PoolConfig changed to", *config, "by", GetClientName(r))
+	}
+
+	resp := new(PoolConfigResponse)
+	resp.Config = env.GetPoolConfig()
+	resp.Error = false
+	resp.Message = "PoolConfig size:" + strconv.Itoa(resp.Config.Size) + " capacity:" + strconv.Itoa(resp.Config.Capacity)
+	resp.Code = API_CODE_OK
+
+	api.OutputResponse(w, resp)
+	return
+}
+
+// Reload API
+//
+// DESC: Re-read config file, validate and swap credentials and queue source, same to SIGHUP.
+//		new connections use the new certificate, in-flight pushes finish on the old ones.
+func (api *AdminApi) Reload(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	if !api.authorize(w, r, lib.API_SCOPE_ADMIN) {
+		return
+	}
+
+	env := api.server.GetEnv()
+	env.GetLogger().Println("Receive request from " + GetClientName(r) + ": ", r.Form)
+
+	if r.Method != lib.HTTP_METHOD_POST {
+		api.OutputResponse(w, &Response{Error:true, Message:"HTTP method POST is required.", Code:API_CODE_POST_NEEDED})
+		return
+	}
+
+	changed, err := env.Reload()
+	if err != nil {
+		env.GetLogger().Println("Reload error: " + err.Error())
+		api.OutputResponse(w, &Response{Error:true, Message:"Reload error:" + err.Error(), Code:API_CODE_RELOAD_ERROR})
+		return
+	}
+
+	resp := new(ReloadResponse)
+	resp.Changed = changed
+	resp.Error = false
+	resp.Message = "Reload done, changed: " + strconv.Itoa(len(changed))
+	resp.Code = API_CODE_OK
+
+	api.OutputResponse(w, resp)
+	return
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"gopush/lib"
+)
+
+const (
+	//api key authentication
+	API_KEY_HEADER = "X-Api-Key"
+
+	//HMAC signature authentication, @see lib.ApiSignaturePayload()
+	API_CLIENT_HEADER = "X-Api-Client"
+	API_TIMESTAMP_HEADER = "X-Api-Timestamp"
+	API_SIGNATURE_HEADER = "X-Api-Signature"
+
+	//client name in logs when authentication disabled
+	API_CLIENT_ANONYMOUS = "anonymous"
+)
+
+type contextKey int
+
+const (
+	clientContextKey contextKey = iota
+)
+
+// Authenticate every request by api key or HMAC signature, attach client to request context.
+// Authentication is disabled if no client configured (api.auth = off), admin api is forbidden then.
+type AuthHandler struct {
+	next   http.Handler
+	server lib.Server
+}
+
+func NewAuthHandler(next http.Handler, server lib.Server) *AuthHandler {
+	return &AuthHandler{next:next, server:server}
+}
+
+func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	store := h.server.GetEnv().GetApiKeyStore()
+	if store == nil || store.Len() == 0 {
+		h.server.GetEnv().GetLogger().Println("Request from " + API_CLIENT_ANONYMOUS + ": " + r.Method + " " + r.URL.Path + " " + r.RemoteAddr)
+		if h.allow(w, r, nil) {
+			h.next.ServeHTTP(w, r)
+		}
+		return
+	}
+
+	var client *lib.ApiClient
+	var err error
+	if key := r.Header.Get(API_KEY_HEADER); key != "" {
+		client, err = store.AuthenticateKey(key)
+	} else if name := r.Header.Get(API_CLIENT_HEADER); name != "" {
+		var body []byte
+		body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_V2_MAX_BODY))
+		if err == nil {
+			//body is consumed, restore for handler
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			client, err = store.AuthenticateSignature(name, r.Header.Get(API_TIMESTAMP_HEADER), r.Header.Get(API_SIGNATURE_HEADER), r.Method, r.URL.RequestURI(), body)
+		}
+	} else {
+		err = errors.New("Authentication required, header " + API_KEY_HEADER + " or " + API_CLIENT_HEADER + " signature not found.")
+	}
+
+	if err != nil {
+		h.server.GetEnv().GetLogger().Println("Request unauthorized: " + r.Method + " " + r.URL.Path + " " + r.RemoteAddr + ": " + err.Error())
+		outputStatus(w, http.StatusUnauthorized, &Response{Error:true, Message:err.Error(), Code:API_CODE_UNAUTHORIZED})
+		return
+	}
+
+	h.server.GetEnv().GetLogger().Println("Request from " + client.Name + ": " + r.Method + " " + r.URL.Path + " " + r.RemoteAddr)
+	if !h.allow(w, r, client) {
+		return
+	}
+
+	h.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientContextKey, client)))
+}
+
+// request rate limit of client and app, output 429 if false
+func (h *AuthHandler) allow(w http.ResponseWriter, r *http.Request, client *lib.ApiClient) bool {
+	limiter := h.server.GetEnv().GetRateLimiter()
+	if limiter == nil {
+		return true
+	}
+
+	err := limiter.AllowRequest(client)
+	if err == nil {
+		return true
+	}
+
+	limitErr := err.(*lib.LimitError)
+	h.server.GetEnv().GetLogger().Println("Request rate limited: " + r.Method + " " + r.URL.Path + " " + r.RemoteAddr + ": " + err.Error())
+	setRetryAfter(w, limitErr)
+	outputStatus(w, http.StatusTooManyRequests, &Response{Error:true, Message:err.Error(), Code:getLimitCode(limitErr)})
+	return false
+}
+
+// output json response without PushApi
+func outputStatus(w http.ResponseWriter, status int, resp *Response) {
+	formatNormalResponceHeader(w)
+	content, _ := json.Marshal(resp)
+	w.WriteHeader(status)
+	fmt.Fprintln(w, string(content))
+}
+
+// authenticated client, nil if authentication disabled
+func GetClient(r *http.Request) *lib.ApiClient {
+	client, _ := r.Context().Value(clientContextKey).(*lib.ApiClient)
+	return client
+}
+
+func GetClientName(r *http.Request) string {
+	if client := GetClient(r); client != nil {
+		return client.Name
+	}
+
+	return API_CLIENT_ANONYMOUS
+}
+
+// check client scope, output 403 if false
+// admin scope is forbidden when authentication disabled
+func (api *PushApi) authorize(w http.ResponseWriter, r *http.Request, scope string) bool {
+	store := api.server.GetEnv().GetApiKeyStore()
+	if (store == nil || store.Len() == 0) && scope != lib.API_SCOPE_ADMIN {
+		return true
+	}
+
+	client := GetClient(r)
+	if client != nil && client.HasScope(scope) {
+		return true
+	}
+
+	api.server.GetEnv().GetLogger().Println("Request forbidden, client " + GetClientName(r) + " has no scope " + scope + ": " + r.URL.Path)
+	api.OutputResponseStatus(w, http.StatusForbidden, &Response{Error:true, Message:"Client " + GetClientName(r) + " has no scope: " + scope, Code:API_CODE_FORBIDDEN})
+	return false
+}
+
+// send to a queue or default all users is broadcast
+func getSendScope(queue string, deviceids []string) string {
+	if queue != "" || len(deviceids) == 0 {
+		return lib.API_SCOPE_BROADCAST
+	}
+
+	return lib.API_SCOPE_SEND
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"encoding/json"
 	"bytes"
+	"errors"
 	"strings"
 	"gopush/lib"
 
 	"github.com/twinj/uuid"
 	"strconv"
+	"time"
 )
 
 type PushApi struct {
@@ -25,34 +27,75 @@ func NewPushApi(server lib.Server) *PushApi {
 //
 // DESC: Send an notification to the pool
 // Params:
-//		title: notification title
-//		body: notification body info
+//		title: notification title, not required if locales has default locale
+//		body: notification body info, not required if locales has default locale
+//		locales: json string, locale -> title and body, eg. locales={"zh-CN": {"title": "标题", "body": "内容"}, "en": {"title": "Title", "body": "Body"}}
+//		locale: default locale if device locale not matched, default config message.locale.default
 //		custom: json string, map[string][string], eg. custom={"payload": "haimi-590"}
+//		variants: A/B testing json string, percent of audience per variant, the rest is holdout.
+//			eg. variants=[{"name": "a", "percent": 10, "title": "A", "body": "A"}, {"name": "b", "percent": 10, "title": "B", "body": "B"}]
+//			variant replaces locales too, base locales are not sent to variants
+//		seed: A/B testing split seed, same seed assigns a device to the same variant, default push-id
 //		sound: notification sound
+//		category: message category, eg. marketing, capped by config frequency.cap if in frequency.categories
 //		queue: send queue, empty will use default all users.
 //			depends on runtime/config/config.ini queue.method value, file, sql, api has different meanings.
 //		deviceids: Send to specified id, not required. delimited by ","
+//		rate: task pushes per second, default config throttle.task.rate
+//		callback_url: POST signed task summary when task finished or failed, see lib.TaskSummary
+//			host must be public or in config callback.hosts
+//		idempotency_key: or header Idempotency-Key, repeats within retention return the original push-id and position
+//			1~255 characters, blank is a param error
 func (api *PushApi) Send(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
 	formatNormalResponceHeader(w)
 	r.ParseForm()
 
-	api.server.GetEnv().GetLogger().Println("Receive request: ", r.Form)
+	api.server.GetEnv().GetLogger().Println("Receive request from " + GetClientName(r) + ": ", r.Form)
 
 	if r.Method != lib.HTTP_METHOD_POST {
 		api.OutputResponse(w, &Response{Error:true, Message:"HTTP method POST is required.", Code:API_CODE_POST_NEEDED})
 		return
 	}
 
+	var locales map[string]*lib.MessageLocale
+	tmpStr, err := GetParamString(r, "locales")
+	if err == nil {
+		err = json.Unmarshal(bytes.NewBufferString(tmpStr).Bytes(), &locales)
+		if err != nil {
+			api.OutputResponse(w, &Response{Error:true, Message:"Param locales json parse failed:" + err.Error(), Code:API_CODE_PARAM_ERROR})
+			return
+		}
+		for locale, variant := range locales {
+			if variant == nil || variant.Title == "" || variant.Body == "" {
+				api.OutputResponse(w, &Response{Error:true, Message:"Param locales " + locale + " title and body are required.", Code:API_CODE_PARAM_ERROR})
+				return
+			}
+		}
+	}
+
+	defaultLocale, err := GetParamString(r, "locale")
+	if err != nil {
+		defaultLocale = api.server.GetEnv().GetDefaultLocale()
+	}
+	defaultVariant, hasDefault := locales[defaultLocale]
+
 	title, err := GetParamString(r, "title")
 	if err != nil {
-		api.OutputResponse(w, &Response{Error:true, Message:"Param title is required.", Code:API_CODE_PARAM_REQUIRED})
-		return
+		if !hasDefault {
+			api.OutputResponse(w, &Response{Error:true, Message:"Param title is required.", Code:API_CODE_PARAM_REQUIRED})
+			return
+		}
+		title = defaultVariant.Title
 	}
 
 	body, err := GetParamString(r, "body")
 	if err != nil {
-		api.OutputResponse(w, &Response{Error:true, Message:"Param body is required.", Code:API_CODE_PARAM_REQUIRED})
-		return
+		if !hasDefault {
+			api.OutputResponse(w, &Response{Error:true, Message:"Param body is required.", Code:API_CODE_PARAM_REQUIRED})
+			return
+		}
+		body = defaultVariant.Body
 	}
 
 	tmpArr, err := GetParamString(r, "custom")
@@ -74,6 +117,9 @@ func (api *PushApi) Send(w http.ResponseWriter, r *http.Request) {
 		sound = ""
 	}
 
+	//can be empty
+	category, _ := GetParamString(r, "category")
+
 	str, err = GetParamString(r, "queue")
 	var queue string
 	if err == nil {
@@ -95,12 +141,91 @@ func (api *PushApi) Send(w http.ResponseWriter, r *http.Request) {
 		deviceids = nil
 	}
 
+	rate, err := GetParamFloat(r, "rate")
+	if err != nil {
+		if _, ok := r.Form["rate"]; ok {
+			api.OutputResponse(w, &Response{Error:true, Message:"Param rate must be a number >=0.", Code:API_CODE_PARAM_ERROR})
+			return
+		}
+		rate = 0
+	} else if rate < 0 {
+		api.OutputResponse(w, &Response{Error:true, Message:"Param rate must be a number >=0.", Code:API_CODE_PARAM_ERROR})
+		return
+	}
+
+	//can be empty
+	callbackUrl, _ := GetParamString(r, "callback_url")
+	if callbackUrl != "" {
+		err = api.checkCallbackUrl(callbackUrl)
+		if err != nil {
+			api.OutputResponse(w, &Response{Error:true, Message:"Param callback_url error:" + err.Error(), Code:API_CODE_PARAM_ERROR})
+			return
+		}
+	}
+
+	scope := getSendScope(queue, deviceids)
+	if !api.authorize(w, r, scope) {
+		return
+	}
+
 	//V1 error: uuid.State.init error: binary.Read: invalid type uuid.Sequence
-	msg := &lib.Message{Title:title, Body:body, Sound:sound, Custom:custom, Uuid:uuid.NewV4().String()}
+	msg := &lib.Message{Title:title, Body:body, Sound:sound, Custom:custom, Uuid:uuid.NewV4().String(), Locales:locales, DefaultLocale:defaultLocale, Category:category}
 	qb := lib.NewQueueBuilder(queue, deviceids, api.server)
+	qb.Rate = rate
+	qb.CallbackUrl = callbackUrl
+
+	span := api.startTrace(r, "PushApi.Send", msg.Uuid, received)
+	defer span.Finish()
+	qb.Trace = span
+
+	tmpStr, err = GetParamString(r, "variants")
+	if err == nil {
+		err = json.Unmarshal(bytes.NewBufferString(tmpStr).Bytes(), &msg.Variants)
+		if err != nil {
+			api.OutputResponse(w, &Response{Error:true, Message:"Param variants json parse failed:" + err.Error(), Code:API_CODE_PARAM_ERROR})
+			return
+		}
 
-	position, err := api.server.GetTaskQueue().AddByQueueBuilder(qb, msg, api.server)
+		seed, err := GetParamString(r, "seed")
+		if err != nil {
+			seed = msg.Uuid
+		}
+
+		qb.Split, err = lib.NewAudienceSplit(seed, msg.Variants)
+		if err != nil {
+			span.SetError(err)
+			api.OutputResponse(w, &Response{Error:true, Message:"Param variants error:" + err.Error(), Code:API_CODE_PARAM_ERROR})
+			return
+		}
+	}
+
+	pushID, position, repeated, err := api.addTaskOnce(r, GetFormFingerprint(r), func() (string, int, error) {
+		err := api.limitTask(r, qb, scope)
+		if err != nil {
+			return "", 0, err
+		}
+
+		position, err := api.server.GetTaskQueue().AddByQueueBuilder(qb, msg, api.server)
+		if err != nil {
+			api.refundTask(r, scope)
+		}
+		return msg.Uuid, position, err
+	})
+	span.SetAttribute("repeated", repeated)
+	span.SetError(err)
 	if err != nil {
+		if limitErr, ok := err.(*lib.LimitError); ok {
+			api.outputLimitError(w, limitErr)
+			return
+		}
+		if _, ok := err.(*lib.IdempotencyConflictError); ok {
+			api.OutputResponse(w, &Response{Error:true, Message:err.Error(), Code:API_CODE_IDEMPOTENCY_CONFLICT})
+			return
+		}
+		if _, ok := err.(*lib.IdempotencyKeyError); ok {
+			api.OutputResponse(w, &Response{Error:true, Message:"Param " + IDEMPOTENCY_KEY_PARAM + " error:" + err.Error(), Code:API_CODE_PARAM_ERROR})
+			return
+		}
 		api.OutputResponse(w, &Response{Error:true, Message:"Add to taskqueue error:" + err.Error(), Code:API_CODE_TASK_ERROR})
 		return
 	}
@@ -108,17 +233,326 @@ func (api *PushApi) Send(w http.ResponseWriter, r *http.Request) {
 	//Send Response
 	resp := new(SendResponse)
 	resp.Position = position
-	resp.PushID = msg.Uuid
+	resp.PushID = pushID
+	resp.Repeated = repeated
 	resp.Error = false
-	resp.Message = "Sent:" + msg.Uuid + " Position:" + strconv.Itoa(position)
+	resp.Message = "Sent:" + pushID + " Position:" + strconv.Itoa(position)
 	resp.Code = API_CODE_OK
 
 	api.OutputResponse(w, resp)
 	return
 }
 
+// host of callback url allowed by sender, callbacks disabled without callback.secret
+func (api *PushApi) checkCallbackUrl(callbackUrl string) error {
+	sender := api.server.GetEnv().GetCallbackSender()
+	if sender == nil {
+		return errors.New("callbacks disabled, callback.secret not configured")
+	}
+
+	return sender.CheckUrl(callbackUrl)
+}
+
+// root span of push-id since request received, nil if trace disabled
+func (api *PushApi) startTrace(r *http.Request, name, pushID string, received time.Time) *lib.Span {
+	span := api.server.GetEnv().GetTracer().StartTrace(pushID, name, received)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.path", r.URL.Path)
+	span.SetAttribute("client", GetClientName(r))
+
+	return span
+}
+
+// AddDevice API
+//
+// DESC: Register a device to registry, update locale if exists
+// Params:
+//		deviceid: device token
+//		locale: device locale, eg. zh-CN, en
+//		userid: device owner, batch item can send to all devices of a user
 func (api *PushApi) AddDevice(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	api.server.GetEnv().GetLogger().Println("Receive request from " + GetClientName(r) + ": ", r.Form)
+
+	if r.Method != lib.HTTP_METHOD_POST {
+		api.OutputResponse(w, &Response{Error:true, Message:"HTTP method POST is required.", Code:API_CODE_POST_NEEDED})
+		return
+	}
+
+	if !api.authorize(w, r, lib.API_SCOPE_SEND) {
+		return
+	}
+
+	deviceid, err := GetParamString(r, "deviceid")
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:"Param deviceid is required.", Code:API_CODE_PARAM_REQUIRED})
+		return
+	}
+
+	err = api.server.GetEnv().GetTokenValidator().Validate(deviceid)
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:"Param deviceid error: " + err.Error(), Code:API_CODE_DEVICE_ERROR})
+		return
+	}
+
+	locale, err := GetParamString(r, "locale")
+	if err != nil {
+		locale = ""
+	}
 
+	userid, err := GetParamString(r, "userid")
+	if err != nil {
+		userid = ""
+	}
+
+	err = api.server.GetEnv().GetDeviceRegistry().Register(deviceid, locale, userid)
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:"Add device error:" + err.Error(), Code:API_CODE_DEVICE_ERROR})
+		return
+	}
+
+	api.OutputResponse(w, &Response{Error:false, Message:"Device added:" + deviceid, Code:API_CODE_OK})
+	return
+}
+
+// Open API
+//
+// DESC: Notification opened callback from app, count by A/B testing variant
+//		counted once a device, devices not sent by the split are ignored
+// Params:
+//		push-id: push-id of notification
+//		deviceid: device token
+func (api *PushApi) Open(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	if !api.authorize(w, r, lib.API_SCOPE_SEND) {
+		return
+	}
+
+	pushID, err := GetParamString(r, "push-id")
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:"Param push-id is required.", Code:API_CODE_PARAM_REQUIRED})
+		return
+	}
+
+	deviceid, err := GetParamString(r, "deviceid")
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:"Param deviceid is required.", Code:API_CODE_PARAM_REQUIRED})
+		return
+	}
+
+	task, err := api.server.GetTaskQueue().GetTaskByPushID(pushID)
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:err.Error(), Code:API_CODE_TASK_NOT_FOUND})
+		return
+	}
+	if !task.RecordOpen(deviceid) {
+		api.OutputResponse(w, &Response{Error:false, Message:"Open ignored, repeated or not in audience:" + pushID, Code:API_CODE_OK})
+		return
+	}
+
+	api.OutputResponse(w, &Response{Error:false, Message:"Opened:" + pushID, Code:API_CODE_OK})
+	return
+}
+
+// Rollout API
+//
+// DESC: Send A/B testing winner variant to the holdout audience, only once per push-id
+// Params:
+//		push-id: push-id of A/B testing send
+//		variant: winner variant name, default best open rate
+func (api *PushApi) Rollout(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	api.server.GetEnv().GetLogger().Println("Receive request from " + GetClientName(r) + ": ", r.Form)
+
+	if r.Method != lib.HTTP_METHOD_POST {
+		api.OutputResponse(w, &Response{Error:true, Message:"HTTP method POST is required.", Code:API_CODE_POST_NEEDED})
+		return
+	}
+
+	if !api.authorize(w, r, lib.API_SCOPE_BROADCAST) {
+		return
+	}
+
+	pushID, err := GetParamString(r, "push-id")
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:"Param push-id is required.", Code:API_CODE_PARAM_REQUIRED})
+		return
+	}
+
+	variant, err := GetParamString(r, "variant")
+	if err != nil {
+		variant = ""
+	}
+
+	if limiter := api.server.GetEnv().GetRateLimiter(); limiter != nil {
+		err = limiter.AllowBroadcast(GetClient(r))
+		if err != nil {
+			api.outputLimitError(w, err.(*lib.LimitError))
+			return
+		}
+	}
+
+	position, msg, err := api.server.GetTaskQueue().AddRollout(pushID, variant, uuid.NewV4().String())
+	if err != nil {
+		api.refundTask(r, lib.API_SCOPE_BROADCAST)
+		api.OutputResponse(w, &Response{Error:true, Message:"Rollout error:" + err.Error(), Code:API_CODE_TASK_ERROR})
+		return
+	}
+
+	resp := new(SendResponse)
+	resp.Position = position
+	resp.PushID = msg.Uuid
+	resp.Error = false
+	resp.Message = "Rollout:" + msg.Uuid + " Position:" + strconv.Itoa(position)
+	resp.Code = API_CODE_OK
+
+	api.OutputResponse(w, resp)
+	return
+}
+
+// Report API
+//
+// DESC: Status and delivery stats of a push task, break down by locale, with per-item results of batch task and invalid devices skipped,
+// failed task has the reason, eg. queue source error
+// Params:
+//		push-id: push-id returned by send
+func (api *PushApi) Report(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	if !api.authorize(w, r, lib.API_SCOPE_STATS) {
+		return
+	}
+
+	pushID, err := GetParamString(r, "push-id")
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:"Param push-id is required.", Code:API_CODE_PARAM_REQUIRED})
+		return
+	}
+
+	task, err := api.server.GetTaskQueue().GetTaskByPushID(pushID)
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:err.Error(), Code:API_CODE_TASK_NOT_FOUND})
+		return
+	}
+
+	resp := new(ReportResponse)
+	resp.PushID = pushID
+	resp.Status = task.GetStatus()
+	if err := task.GetError(); err != nil {
+		resp.Reason = err.Error()
+	}
+	resp.Stats = task.GetStats().Snapshot()
+	resp.Items = task.GetBatchItems()
+	resp.Rejected = task.GetList().GetRejections()
+	resp.Error = false
+	resp.Message = "Report:" + pushID
+	resp.Code = API_CODE_OK
+
+	api.OutputResponse(w, resp)
+	return
+}
+
+// Export API
+//
+// DESC: Delivery report of a push-id from delivery records, totals, failures by reason, latency percentiles,
+// duration, throughput and failed tokens for re-targeting, also available by command: gopush report
+// Params:
+//		push-id: push-id returned by send
+//		format: json or csv, default json
+func (api *PushApi) Export(w http.ResponseWriter, r *http.Request) {
+	formatNormalResponceHeader(w)
+	r.ParseForm()
+
+	if !api.authorize(w, r, lib.API_SCOPE_STATS) {
+		return
+	}
+
+	format, err := GetParamString(r, "format")
+	if err != nil || format == "" {
+		format = lib.REPORT_FORMAT_JSON
+	}
+	if format != lib.REPORT_FORMAT_JSON && format != lib.REPORT_FORMAT_CSV {
+		api.OutputResponse(w, &Response{Error:true, Message:"Param format must be json or csv.", Code:API_CODE_PARAM_ERROR})
+		return
+	}
+
+	pushID, err := GetParamString(r, "push-id")
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:"Param push-id is required.", Code:API_CODE_PARAM_REQUIRED})
+		return
+	}
+
+	sink := api.server.GetEnv().GetDeliverySink()
+	if sink == nil {
+		api.OutputResponse(w, &Response{Error:true, Message:"Delivery records disabled, config delivery.format is empty.", Code:API_CODE_REPORT_ERROR})
+		return
+	}
+
+	//days of task if known, or all days kept
+	var from, to time.Time
+	if task, err := api.server.GetTaskQueue().GetTaskByPushID(pushID); err == nil {
+		from, to = task.GetPeriod()
+	}
+	report, err := sink.Report(pushID, from, to)
+	if err != nil {
+		api.OutputResponse(w, &Response{Error:true, Message:"Report error:" + err.Error(), Code:API_CODE_REPORT_ERROR})
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename=\"report-" + pushID + "." + format + "\"")
+	if format == lib.REPORT_FORMAT_CSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = report.WriteCsv(w)
+		if err != nil {
+			api.server.GetEnv().GetLogger().Println("Found error:", err)
+		}
+		return
+	}
+
+	resp := new(ExportResponse)
+	resp.Report = report
+	resp.Error = false
+	resp.Message = "Export:" + pushID
+	resp.Code = API_CODE_OK
+
+	api.OutputResponse(w, resp)
+	return
+}
+
+// add task only once for request idempotency key, no key will always add, blank or too long key is lib.IdempotencyKeyError.
+// key is scoped by api client, return push-id, position and whether key repeated.
+func (api *PushApi) addTaskOnce(r *http.Request, fingerprint string, add func() (string, int, error)) (string, int, bool, error) {
+	key, ok := GetIdempotencyKey(r)
+	if !ok {
+		pushID, position, err := add()
+		return pushID, position, false, err
+	}
+	err := lib.CheckIdempotencyKey(key)
+	if err != nil {
+		return "", 0, false, err
+	}
+	key = GetClientName(r) + ":" + key
+
+	record, repeated, err := api.server.GetEnv().GetIdempotencyStore().Do(key, fingerprint, add)
+	if record == nil {
+		return "", 0, false, err
+	}
+	if err != nil {
+		//task added, only key persist failed
+		api.server.GetEnv().GetLogger().Println("Found error while persist idempotency key " + key + ":", err)
+	}
+	if repeated {
+		api.server.GetEnv().GetLogger().Println("Idempotency key " + key + " repeated, original push-id: " + record.PushID)
+	}
+
+	return record.PushID, record.Position, repeated, nil
 }
 
 func (api *PushApi) FormatResponseJson(resp interface{}) (string, error) {
@@ -131,8 +565,14 @@ func (api *PushApi) FormatResponseJson(resp interface{}) (string, error) {
 }
 
 func (api *PushApi) OutputResponse(w http.ResponseWriter, resp interface{}) {
+	api.OutputResponseStatus(w, http.StatusOK, resp)
+}
+
+// output with http status code, v1 always use http.StatusOK
+func (api *PushApi) OutputResponseStatus(w http.ResponseWriter, status int, resp interface{}) {
 	resp, err := api.FormatResponseJson(resp)
 	if err == nil {
+		w.WriteHeader(status)
 		fmt.Fprintln(w, resp)
 		api.server.GetEnv().GetLogger().Println("Resp:", resp)
 	}else {
@@ -0,0 +1,258 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopush/lib"
+
+	"github.com/twinj/uuid"
+)
+
+const (
+	//max request body bytes of v2 api
+	API_V2_MAX_BODY = 10 << 20
+
+	API_V2_CONTENT_TYPE = "application/json"
+
+	//max items of a batch request
+	API_V2_MAX_BATCH_ITEMS = 10000
+)
+
+// Send API v2
+//
+// DESC: Send an notification to the pool, application/json body of SendRequestV2
+// Header Idempotency-Key: repeats within retention return the original push-id and position
+// HTTP status:
+//		202: accepted to taskqueue
+//		400: body is not valid json, or Idempotency-Key blank or longer than 255
+//		405: POST is required
+//		415: Content-Type is not application/json
+//		422: field validation failed, with field path errors
+//		409: idempotency key is used by another request
+//		422: audience size exceeds client or app limit
+//		429: client or app broadcast quota exceeded, with Retry-After header
+//		503: taskqueue is full or can not accept
+func (api *PushApi) SendV2(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	formatNormalResponceHeader(w)
+
+	req := new(SendRequestV2)
+	content, ok := api.readJsonBody(w, r, req)
+	if !ok {
+		return
+	}
+
+	if !api.authorize(w, r, req.Scope()) {
+		return
+	}
+
+	errs := req.Validate(api.server.GetEnv().GetDefaultLocale())
+	if len(errs) == 0 && req.Options.CallbackUrl != "" {
+		if err := api.checkCallbackUrl(req.Options.CallbackUrl); err != nil {
+			errs = append(errs, &FieldError{Field:"options.callback_url", Message:err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		api.outputValidationErrors(w, errs)
+		return
+	}
+
+	msg := req.ToMessage(uuid.NewV4().String())
+	qb := lib.NewQueueBuilder(req.Audience.Queue, req.Audience.DeviceIDs, api.server)
+	qb.Rate = req.Options.Rate
+	qb.CallbackUrl = req.Options.CallbackUrl
+
+	span := api.startTrace(r, "PushApi.SendV2", msg.Uuid, received)
+	defer span.Finish()
+	qb.Trace = span
+
+	if len(msg.Variants) > 0 {
+		seed := req.Options.Seed
+		if seed == "" {
+			seed = msg.Uuid
+		}
+
+		var err error
+		qb.Split, err = lib.NewAudienceSplit(seed, msg.Variants)
+		if err != nil {
+			span.SetError(err)
+			api.outputValidationErrors(w, []*FieldError{{Field:"message.variants", Message:err.Error()}})
+			return
+		}
+	}
+
+	pushID, position, repeated, err := api.addTaskOnce(r, GetFingerprint(content), func() (string, int, error) {
+		err := api.limitTask(r, qb, req.Scope())
+		if err != nil {
+			return "", 0, err
+		}
+
+		position, err := api.server.GetTaskQueue().AddByQueueBuilder(qb, msg, api.server)
+		if err != nil {
+			api.refundTask(r, req.Scope())
+		}
+		return msg.Uuid, position, err
+	})
+	span.SetAttribute("repeated", repeated)
+	span.SetError(err)
+	if err != nil {
+		api.outputAddTaskError(w, err)
+		return
+	}
+
+	resp := new(SendResponse)
+	resp.Position = position
+	resp.PushID = pushID
+	resp.Repeated = repeated
+	resp.Error = false
+	resp.Message = "Sent:" + pushID + " Position:" + strconv.Itoa(position)
+	resp.Code = API_CODE_OK
+
+	api.OutputResponseStatus(w, http.StatusAccepted, resp)
+	return
+}
+
+// Batch API v2
+//
+// DESC: Send many personalized pushes as one task, application/json body of BatchRequestV2.
+//		Every item has its own message and item push-id, results by /api/v1/report?push-id=
+// HTTP status: same as SendV2
+func (api *PushApi) BatchV2(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	formatNormalResponceHeader(w)
+
+	if !api.authorize(w, r, lib.API_SCOPE_SEND) {
+		return
+	}
+
+	req := new(BatchRequestV2)
+	content, ok := api.readJsonBody(w, r, req)
+	if !ok {
+		return
+	}
+
+	errs := req.Validate(api.server.GetEnv().GetDefaultLocale(), API_V2_MAX_BATCH_ITEMS)
+	if len(errs) == 0 && req.Options.CallbackUrl != "" {
+		if err := api.checkCallbackUrl(req.Options.CallbackUrl); err != nil {
+			errs = append(errs, &FieldError{Field:"options.callback_url", Message:err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		api.outputValidationErrors(w, errs)
+		return
+	}
+
+	items := req.ToBatchItems(func() string {
+		return uuid.NewV4().String()
+	})
+
+	msg := &lib.Message{Title:"batch", Body:strconv.Itoa(len(items)) + " items", Uuid:uuid.NewV4().String(), DefaultLocale:req.Options.Locale}
+	qb := lib.NewBatchQueueBuilder(items, api.server)
+	qb.Rate = req.Options.Rate
+	qb.CallbackUrl = req.Options.CallbackUrl
+
+	span := api.startTrace(r, "PushApi.BatchV2", msg.Uuid, received)
+	span.SetAttribute("items", len(items))
+	defer span.Finish()
+	qb.Trace = span
+
+	pushID, position, repeated, err := api.addTaskOnce(r, GetFingerprint(content), func() (string, int, error) {
+		err := api.limitTask(r, qb, lib.API_SCOPE_SEND)
+		if err != nil {
+			return "", 0, err
+		}
+
+		position, err := api.server.GetTaskQueue().AddByQueueBuilder(qb, msg, api.server)
+		return msg.Uuid, position, err
+	})
+	span.SetAttribute("repeated", repeated)
+	span.SetError(err)
+	if err != nil {
+		api.outputAddTaskError(w, err)
+		return
+	}
+
+	resp := new(BatchResponse)
+	if repeated {
+		//item push-ids of the original request
+		if task, err := api.server.GetTaskQueue().GetTaskByPushID(pushID); err == nil {
+			items = task.GetBatchItems()
+		}
+	}
+	for _, item := range items {
+		resp.ItemIDs = append(resp.ItemIDs, item.Message.Uuid)
+	}
+	resp.Position = position
+	resp.PushID = pushID
+	resp.Repeated = repeated
+	resp.Error = false
+	resp.Message = "Sent batch:" + pushID + " Items:" + strconv.Itoa(len(items)) + " Position:" + strconv.Itoa(position)
+	resp.Code = API_CODE_OK
+
+	api.OutputResponseStatus(w, http.StatusAccepted, resp)
+	return
+}
+
+// read json body of POST request to v, output error response if false
+func (api *PushApi) readJsonBody(w http.ResponseWriter, r *http.Request, v interface{}) ([]byte, bool) {
+	if r.Method != lib.HTTP_METHOD_POST {
+		w.Header().Set("Allow", lib.HTTP_METHOD_POST)
+		api.OutputResponseStatus(w, http.StatusMethodNotAllowed, &Response{Error:true, Message:"HTTP method POST is required.", Code:API_CODE_POST_NEEDED})
+		return nil, false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != API_V2_CONTENT_TYPE {
+		api.OutputResponseStatus(w, http.StatusUnsupportedMediaType, &Response{Error:true, Message:"Content-Type " + API_V2_CONTENT_TYPE + " is required.", Code:API_CODE_PARAM_ERROR})
+		return nil, false
+	}
+
+	content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_V2_MAX_BODY))
+	if err != nil {
+		api.OutputResponseStatus(w, http.StatusBadRequest, &Response{Error:true, Message:"Read request body failed:" + err.Error(), Code:API_CODE_PARAM_ERROR})
+		return nil, false
+	}
+
+	api.server.GetEnv().GetLogger().Println("Receive request from " + GetClientName(r) + ": ", string(content))
+
+	err = json.Unmarshal(content, v)
+	if err != nil {
+		api.OutputResponseStatus(w, http.StatusBadRequest, &Response{Error:true, Message:"Request body json parse failed:" + err.Error(), Code:API_CODE_PARAM_ERROR})
+		return nil, false
+	}
+
+	return content, true
+}
+
+// 400 for bad idempotency key, 409 for idempotency conflict, 429 or 422 for limits, 503 for taskqueue
+func (api *PushApi) outputAddTaskError(w http.ResponseWriter, err error) {
+	if limitErr, ok := err.(*lib.LimitError); ok {
+		setRetryAfter(w, limitErr)
+		api.OutputResponseStatus(w, getLimitStatus(limitErr), &Response{Error:true, Message:err.Error(), Code:getLimitCode(limitErr)})
+		return
+	}
+	if _, ok := err.(*lib.IdempotencyConflictError); ok {
+		api.OutputResponseStatus(w, http.StatusConflict, &Response{Error:true, Message:err.Error(), Code:API_CODE_IDEMPOTENCY_CONFLICT})
+		return
+	}
+	if _, ok := err.(*lib.IdempotencyKeyError); ok {
+		api.OutputResponseStatus(w, http.StatusBadRequest, &Response{Error:true, Message:"Header " + IDEMPOTENCY_KEY_HEADER + " error:" + err.Error(), Code:API_CODE_PARAM_ERROR})
+		return
+	}
+
+	api.OutputResponseStatus(w, http.StatusServiceUnavailable, &Response{Error:true, Message:"Add to taskqueue error:" + err.Error(), Code:API_CODE_TASK_ERROR})
+}
+
+func (api *PushApi) outputValidationErrors(w http.ResponseWriter, errs []*FieldError) {
+	resp := &ValidationResponse{Errors:errs}
+	resp.Error = true
+	resp.Message = "Request validation failed."
+	resp.Code = API_CODE_PARAM_ERROR
+	api.OutputResponseStatus(w, http.StatusUnprocessableEntity, resp)
+}
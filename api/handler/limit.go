@@ -0,0 +1,80 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"gopush/lib"
+)
+
+const (
+	RETRY_AFTER_HEADER = "Retry-After"
+)
+
+// apply client audience limit to builder and count broadcast quota, call when adding task.
+// refundTask if the task is not accepted after.
+func (api *PushApi) limitTask(r *http.Request, qb *lib.QueueBuilder, scope string) error {
+	limiter := api.server.GetEnv().GetRateLimiter()
+	if limiter == nil {
+		return nil
+	}
+	client := GetClient(r)
+
+	//queue audience is checked after built
+	qb.MaxAudience = limiter.GetAudienceMax(client)
+	err := lib.CheckAudience(len(qb.DeviceIDs) + len(qb.Items), qb.MaxAudience)
+	if err != nil {
+		return err
+	}
+
+	if scope == lib.API_SCOPE_BROADCAST {
+		return limiter.AllowBroadcast(client)
+	}
+
+	return nil
+}
+
+// give back broadcast quota of limitTask, task not added
+func (api *PushApi) refundTask(r *http.Request, scope string) {
+	limiter := api.server.GetEnv().GetRateLimiter()
+	if limiter == nil || scope != lib.API_SCOPE_BROADCAST {
+		return
+	}
+
+	limiter.RefundBroadcast(GetClient(r))
+}
+
+func getLimitCode(err *lib.LimitError) int {
+	if err.Type == lib.LIMIT_TYPE_RATE {
+		return API_CODE_RATE_LIMITED
+	}
+
+	return API_CODE_QUOTA_EXCEEDED
+}
+
+// v2 status: 429 for rate and broadcast quota, 422 for audience size
+func getLimitStatus(err *lib.LimitError) int {
+	if err.Type == lib.LIMIT_TYPE_AUDIENCE {
+		return http.StatusUnprocessableEntity
+	}
+
+	return http.StatusTooManyRequests
+}
+
+func setRetryAfter(w http.ResponseWriter, err *lib.LimitError) {
+	if err.RetryAfter > 0 {
+		w.Header().Set(RETRY_AFTER_HEADER, strconv.Itoa(err.RetryAfterSeconds()))
+	}
+}
+
+// v1 output limit error with http.StatusOK
+func (api *PushApi) outputLimitError(w http.ResponseWriter, err *lib.LimitError) {
+	setRetryAfter(w, err)
+
+	message := err.Error()
+	if err.RetryAfter > 0 {
+		message += " Retry after " + strconv.Itoa(err.RetryAfterSeconds()) + "s."
+	}
+	api.OutputResponse(w, &Response{Error:true, Message:message, Code:getLimitCode(err)})
+}
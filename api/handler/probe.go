@@ -0,0 +1,87 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"gopush/lib"
+)
+
+const (
+	//process up and publish loop alive
+	PROBE_PATH_HEALTH = "/healthz"
+	//credentials, provider, queue source and taskqueue capacity
+	PROBE_PATH_READY = "/readyz"
+	//prometheus gauges, eg. cert expiry
+	PROBE_PATH_METRICS = "/metrics"
+)
+
+// Liveness and readiness probes for load balancer and supervisor, metrics for monitoring.
+// served before authentication, only failures are logged.
+type ProbeHandler struct {
+	next    http.Handler
+	server  lib.Server
+	started time.Time
+}
+
+func NewProbeHandler(next http.Handler, server lib.Server) *ProbeHandler {
+	return &ProbeHandler{next:next, server:server, started:time.Now()}
+}
+
+func (h *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case PROBE_PATH_HEALTH:
+		h.output(w, r, lib.RunHealthChecks([]*lib.HealthCheck{h.processCheck(), h.server.GetTaskQueue().PublishCheck()}, lib.HEALTH_CHECK_DEFAULT_TIMEOUT))
+	case PROBE_PATH_READY:
+		h.output(w, r, h.server.GetEnv().GetReadiness().Run(h.server.GetTaskQueue().CapacityCheck()))
+	case PROBE_PATH_METRICS:
+		h.metrics(w)
+	default:
+		h.next.ServeHTTP(w, r)
+	}
+}
+
+func (h *ProbeHandler) processCheck() *lib.HealthCheck {
+	return lib.NewHealthCheck("process", func(ctx context.Context) (string, error) {
+		return "pid " + strconv.Itoa(os.Getpid()) + " up for " + time.Since(h.started).Truncate(time.Second).String(), nil
+	})
+}
+
+func (h *ProbeHandler) metrics(w http.ResponseWriter) {
+	w.Header().Add("server", "gopush")
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	info := h.server.GetEnv().GetCertInfo()
+	if info != nil {
+		info.WriteMetrics(w, time.Now())
+	}
+}
+
+// 200 if all checks ok, else 503
+func (h *ProbeHandler) output(w http.ResponseWriter, r *http.Request, report *lib.HealthReport) {
+	resp := &HealthResponse{HealthReport:report}
+	resp.Message = r.URL.Path + " " + report.Status
+	status := http.StatusOK
+	if report.OK() {
+		resp.Code = API_CODE_OK
+	} else {
+		resp.Error = true
+		resp.Code = API_CODE_NOT_READY
+		status = http.StatusServiceUnavailable
+	}
+
+	content, _ := json.Marshal(resp)
+	if !report.OK() {
+		h.server.GetEnv().GetLogger().Println("Probe " + r.URL.Path + " failed: " + string(content))
+	}
+
+	formatNormalResponceHeader(w)
+	w.WriteHeader(status)
+	fmt.Fprintln(w, string(content))
+}
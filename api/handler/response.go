@@ -1,6 +1,8 @@
 package handler
 
-import ()
+import (
+	"gopush/lib"
+)
 
 type Response struct {
 	//fail or success
@@ -17,6 +19,99 @@ type SendResponse struct {
 	//uuid
 	PushID   string `json:"push-id"`
 	Position int `json:"position"`
+
+	//idempotency key repeated, push-id and position are the original
+	Repeated bool `json:"repeated,omitempty"`
+}
+
+type ThrottleResponse struct {
+	Response
+
+	//global pushes per second, 0 for unlimited
+	Rate     float64 `json:"rate"`
+	//default rate of new tasks
+	TaskRate float64 `json:"task_rate"`
+}
+
+type WorkersResponse struct {
+	Response
+
+	//max workers of all pools, 0 for unlimited
+	Max     int `json:"max"`
+	Workers []*lib.WorkerInfo `json:"workers"`
+}
+
+type TasksResponse struct {
+	Response
+
+	//waiting tasks in sending order
+	Tasks   []*lib.TaskInfo `json:"tasks"`
+	//tasks sending now
+	Sending int `json:"sending"`
+}
+
+type PoolsResponse struct {
+	Response
+
+	Pools     []*lib.PoolInfo `json:"pools"`
+	//devices not sent by push-id of cancel action
+	Cancelled map[string]int `json:"cancelled,omitempty"`
+}
+
+type PoolConfigResponse struct {
+	Response
+
+	//defaults of pools created after
+	Config *lib.PoolConfig `json:"config"`
+}
+
+type ReloadResponse struct {
+	Response
+
+	//names of reloaded settings, eg. credentials, queue_source
+	Changed []string `json:"changed"`
+}
+
+// body of /healthz and /readyz
+type HealthResponse struct {
+	Response
+	*lib.HealthReport
+}
+
+type ValidationResponse struct {
+	Response
+
+	Errors []*FieldError `json:"errors"`
+}
+
+type ReportResponse struct {
+	Response
+
+	PushID string `json:"push-id"`
+	//waiting, sending, finished or failed
+	Status string `json:"status"`
+	//failure reason of failed task, eg. queue source error
+	Reason string `json:"reason,omitempty"`
+	Stats  *lib.TaskStats `json:"stats"`
+
+	//batch task item results
+	Items  []*lib.BatchItem `json:"items,omitempty"`
+
+	//invalid devices skipped
+	Rejected *lib.RejectionReport `json:"rejected,omitempty"`
+}
+
+type ExportResponse struct {
+	Response
+
+	Report *lib.DeliveryReport `json:"report"`
+}
+
+type BatchResponse struct {
+	SendResponse
+
+	//item push-ids in request order
+	ItemIDs []string `json:"item-ids"`
 }
 
 
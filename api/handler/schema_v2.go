@@ -0,0 +1,266 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package handler
+
+import (
+	"strconv"
+
+	"gopush/lib"
+)
+
+// V2 send request body, application/json
+//
+// eg. {
+//	"message": {"title": "Title", "body": "Body", "sound": "default", "custom": {"payload": "haimi-590"}},
+//	"audience": {"queue": "test", "deviceids": ["038a..."]},
+//	"options": {"locale": "en", "seed": "campaign-1"}
+// }
+type SendRequestV2 struct {
+	Message  *MessageV2 `json:"message"`
+	Audience *AudienceV2 `json:"audience"`
+	Options  *OptionsV2 `json:"options"`
+}
+
+type MessageV2 struct {
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+	Sound    string `json:"sound"`
+	Custom   map[string]string `json:"custom"`
+
+	//eg. marketing, capped by config frequency.cap if in frequency.categories
+	Category string `json:"category"`
+
+	//locale -> title and body
+	Locales  map[string]*lib.MessageLocale `json:"locales"`
+
+	//A/B testing variants
+	Variants []*lib.MessageVariant `json:"variants"`
+}
+
+type AudienceV2 struct {
+	//empty will use default queue if no deviceids
+	Queue     string `json:"queue"`
+	DeviceIDs []string `json:"deviceids"`
+}
+
+type OptionsV2 struct {
+	//default locale, default config message.locale.default
+	Locale string `json:"locale"`
+
+	//A/B testing split seed, default push-id
+	Seed   string `json:"seed"`
+
+	//task pushes per second, default config throttle.task.rate
+	Rate   float64 `json:"rate"`
+
+	//POST signed task summary when task finished or failed
+	CallbackUrl string `json:"callback_url"`
+}
+
+// A validation error of request field
+type FieldError struct {
+	//field path, eg. message.locales.en.title
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (req *SendRequestV2) Validate(defaultLocale string) []*FieldError {
+	var errs []*FieldError
+
+	if req.Message == nil {
+		return append(errs, &FieldError{Field:"message", Message:"is required"})
+	}
+	if req.Audience == nil {
+		req.Audience = &AudienceV2{}
+	}
+	if req.Options == nil {
+		req.Options = &OptionsV2{}
+	}
+	if req.Options.Locale == "" {
+		req.Options.Locale = defaultLocale
+	}
+
+	errs = req.Message.validate("message", req.Options.Locale, errs)
+
+	for iter, variant := range req.Message.Variants {
+		path := "message.variants[" + strconv.Itoa(iter) + "]"
+		if variant == nil {
+			errs = append(errs, &FieldError{Field:path, Message:"is null"})
+			continue
+		}
+		if variant.Name == "" {
+			errs = append(errs, &FieldError{Field:path + ".name", Message:"is required"})
+		}
+		if variant.Percent <= 0 {
+			errs = append(errs, &FieldError{Field:path + ".percent", Message:"must >0"})
+		}
+		if variant.Title == "" {
+			errs = append(errs, &FieldError{Field:path + ".title", Message:"is required"})
+		}
+		if variant.Body == "" {
+			errs = append(errs, &FieldError{Field:path + ".body", Message:"is required"})
+		}
+	}
+
+	if req.Options.Rate < 0 {
+		errs = append(errs, &FieldError{Field:"options.rate", Message:"must >=0"})
+	}
+	if req.Options.CallbackUrl != "" {
+		if err := lib.ValidateCallbackUrl(req.Options.CallbackUrl); err != nil {
+			errs = append(errs, &FieldError{Field:"options.callback_url", Message:err.Error()})
+		}
+	}
+
+	for iter, deviceid := range req.Audience.DeviceIDs {
+		if deviceid == "" {
+			errs = append(errs, &FieldError{Field:"audience.deviceids[" + strconv.Itoa(iter) + "]", Message:"is empty"})
+		}
+	}
+
+	return errs
+}
+
+// api scope needed, broadcast if audience is a queue or default all users
+func (req *SendRequestV2) Scope() string {
+	if req.Audience == nil {
+		return getSendScope("", nil)
+	}
+
+	return getSendScope(req.Audience.Queue, req.Audience.DeviceIDs)
+}
+
+// lib.Message of request, need Validate() first
+func (req *SendRequestV2) ToMessage(uuid string) *lib.Message {
+	msg := req.Message.toMessage(uuid, req.Options.Locale)
+	msg.Variants = req.Message.Variants
+
+	return msg
+}
+
+// title, body and locales validation, path is the field path of message
+func (m *MessageV2) validate(path, defaultLocale string, errs []*FieldError) []*FieldError {
+	for locale, variant := range m.Locales {
+		pathLocale := path + ".locales." + locale
+		if variant == nil {
+			errs = append(errs, &FieldError{Field:pathLocale, Message:"is null"})
+			continue
+		}
+		if variant.Title == "" {
+			errs = append(errs, &FieldError{Field:pathLocale + ".title", Message:"is required"})
+		}
+		if variant.Body == "" {
+			errs = append(errs, &FieldError{Field:pathLocale + ".body", Message:"is required"})
+		}
+	}
+
+	//title and body can be omitted if locales has default locale
+	_, hasDefault := m.Locales[defaultLocale]
+	if m.Title == "" && !hasDefault {
+		errs = append(errs, &FieldError{Field:path + ".title", Message:"is required"})
+	}
+	if m.Body == "" && !hasDefault {
+		errs = append(errs, &FieldError{Field:path + ".body", Message:"is required"})
+	}
+
+	return errs
+}
+
+func (m *MessageV2) toMessage(uuid, defaultLocale string) *lib.Message {
+	msg := &lib.Message{Title:m.Title, Body:m.Body, Sound:m.Sound, Custom:m.Custom,
+		Uuid:uuid, Locales:m.Locales, DefaultLocale:defaultLocale, Category:m.Category}
+
+	if variant, ok := msg.Locales[msg.DefaultLocale]; ok {
+		if msg.Title == "" {
+			msg.Title = variant.Title
+		}
+		if msg.Body == "" {
+			msg.Body = variant.Body
+		}
+	}
+	if msg.Custom == nil {
+		msg.Custom = make(map[string]string)
+	}
+
+	return msg
+}
+
+
+// V2 batch request body, application/json, every item is a personalized push
+//
+// eg. {
+//	"items": [
+//		{"deviceid": "038a...", "message": {"title": "Order shipped", "body": "Your order X shipped"}},
+//		{"userid": "10086", "message": {"title": "Order shipped", "body": "Your order Y shipped"}}
+//	],
+//	"options": {"locale": "en"}
+// }
+type BatchRequestV2 struct {
+	Items   []*BatchItemV2 `json:"items"`
+	Options *OptionsV2 `json:"options"`
+}
+
+type BatchItemV2 struct {
+	//device token, or userid for all devices registered by /api/v1/add-device
+	DeviceID string `json:"deviceid"`
+	UserID   string `json:"userid"`
+
+	Message  *MessageV2 `json:"message"`
+}
+
+func (req *BatchRequestV2) Validate(defaultLocale string, maxItems int) []*FieldError {
+	var errs []*FieldError
+
+	if req.Options == nil {
+		req.Options = &OptionsV2{}
+	}
+	if req.Options.Locale == "" {
+		req.Options.Locale = defaultLocale
+	}
+
+	if len(req.Items) == 0 {
+		return append(errs, &FieldError{Field:"items", Message:"is required"})
+	}
+	if len(req.Items) > maxItems {
+		return append(errs, &FieldError{Field:"items", Message:"must <=" + strconv.Itoa(maxItems) + " items"})
+	}
+
+	if req.Options.Rate < 0 {
+		errs = append(errs, &FieldError{Field:"options.rate", Message:"must >=0"})
+	}
+	if req.Options.CallbackUrl != "" {
+		if err := lib.ValidateCallbackUrl(req.Options.CallbackUrl); err != nil {
+			errs = append(errs, &FieldError{Field:"options.callback_url", Message:err.Error()})
+		}
+	}
+
+	for iter, item := range req.Items {
+		path := "items[" + strconv.Itoa(iter) + "]"
+		if item == nil {
+			errs = append(errs, &FieldError{Field:path, Message:"is null"})
+			continue
+		}
+		if item.DeviceID == "" && item.UserID == "" {
+			errs = append(errs, &FieldError{Field:path + ".deviceid", Message:"deviceid or userid is required"})
+		}
+		if item.Message == nil {
+			errs = append(errs, &FieldError{Field:path + ".message", Message:"is required"})
+			continue
+		}
+		if len(item.Message.Variants) > 0 {
+			errs = append(errs, &FieldError{Field:path + ".message.variants", Message:"is not supported in batch"})
+		}
+
+		errs = item.Message.validate(path + ".message", req.Options.Locale, errs)
+	}
+
+	return errs
+}
+
+// lib.BatchItem of request, need Validate() first, newUuid for every item push-id
+func (req *BatchRequestV2) ToBatchItems(newUuid func() string) []*lib.BatchItem {
+	items := make([]*lib.BatchItem, len(req.Items))
+	for iter, item := range req.Items {
+		items[iter] = &lib.BatchItem{DeviceID:item.DeviceID, UserID:item.UserID, Message:item.Message.toMessage(newUuid(), req.Options.Locale)}
+	}
+
+	return items
+}
\ No newline at end of file
@@ -2,9 +2,13 @@
 package handler
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"net/http"
+	"net/url"
 	"errors"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -17,8 +21,23 @@ const (
 	API_CODE_PARAM_ERROR
 	API_CODE_QUEUE_BUILD
 	API_CODE_TASK_ERROR
+	API_CODE_DEVICE_ERROR
+	API_CODE_TASK_NOT_FOUND
+	API_CODE_IDEMPOTENCY_CONFLICT
+	API_CODE_UNAUTHORIZED
+	API_CODE_FORBIDDEN
+	API_CODE_RATE_LIMITED
+	API_CODE_QUOTA_EXCEEDED
+	API_CODE_REPORT_ERROR
+	API_CODE_POOL_NOT_FOUND
+	API_CODE_POOL_ERROR
+	API_CODE_NOT_READY
+	API_CODE_RELOAD_ERROR
 
 	DEVICEID_SEP = ","
+
+	IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+	IDEMPOTENCY_KEY_PARAM = "idempotency_key"
 )
 
 
@@ -27,6 +46,38 @@ func formatNormalResponceHeader(w http.ResponseWriter) {
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
 }
 
+// idempotency key of header, or param if header not set, trimmed.
+// false if neither set, a set but blank key is empty and true.
+func GetIdempotencyKey(r *http.Request) (string, bool) {
+	if values, ok := r.Header[http.CanonicalHeaderKey(IDEMPOTENCY_KEY_HEADER)]; ok && len(values) > 0 {
+		return strings.TrimSpace(values[0]), true
+	}
+
+	key, err := GetParamString(r, IDEMPOTENCY_KEY_PARAM)
+	if err != nil {
+		return "", false
+	}
+
+	return strings.TrimSpace(key), true
+}
+
+// sha1 of sorted form params without idempotency key, need r.ParseForm() first
+func GetFormFingerprint(r *http.Request) string {
+	form := url.Values{}
+	for key, value := range r.Form {
+		if key != IDEMPOTENCY_KEY_PARAM {
+			form[key] = value
+		}
+	}
+
+	return GetFingerprint([]byte(r.Method + " " + r.URL.Path + "?" + form.Encode()))
+}
+
+func GetFingerprint(content []byte) string {
+	sum := sha1.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
 func GetParamString(r *http.Request, name string) (string, error) {
 	if param, ok := r.Form[name]; ok {
 		// fetch first one
@@ -56,6 +107,15 @@ func GetParamInt(r *http.Request, name string) (int, error) {
 	}
 }
 
+func GetParamFloat(r *http.Request, name string) (float64, error) {
+	param, err := GetParamString(r, name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseFloat(param, 64)
+}
+
 func GetParamArrayString(r *http.Request, name string) ([]string, error) {
 	if param, ok := r.Form[name]; ok {
 		var result []string
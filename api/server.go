@@ -4,6 +4,7 @@ package api
 import (
 	"net/http"
 
+	"gopush/api/handler"
 	"gopush/lib"
 )
 
@@ -22,7 +23,9 @@ type Server struct {
 
 func NewServer(env lib.EnvInfo) *Server {
 	handle := http.NewServeMux()
-	server := &Server{handler:handle, server:&http.Server{Handler:handle}, env:env}
+	server := &Server{handler:handle, env:env}
+	//probes before authentication
+	server.server = &http.Server{Handler:handler.NewProbeHandler(handler.NewAuthHandler(handle, server), server)}
 	server.task = lib.NewTaskQueue(server)
 	return server
 }
@@ -31,6 +34,9 @@ func (s *Server) Start() error {
 	s.server.Addr = s.env.GetServerAddr()
 
 	s.env.GetLogger().Println("Server http://" + s.server.Addr + " started...")
+	if s.env.GetApiKeyStore() == nil || s.env.GetApiKeyStore().Len() == 0 {
+		s.env.GetLogger().Println("WARNING: api.auth is off, anyone can reach " + s.server.Addr + " can send, admin api is forbidden.")
+	}
 
 	//Server taskqueue run
 	go s.task.Run()
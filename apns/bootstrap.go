@@ -12,6 +12,10 @@ import (
 
 const (
 	CONFIG_SECTION = "system.apns"
+	//api client sections, eg. [client.ops]
+	CONFIG_SECTION_CLIENT_PREFIX = "client."
+	//result sink sections, eg. [sink.etl]
+	CONFIG_SECTION_SINK_PREFIX = "sink."
 )
 
 var (
@@ -23,6 +27,7 @@ func Bootstrap(c *cli.Context) {
 	iniobj := config.GetConfigInstance(fname)
 
 	env = NewEnvInfo(iniobj, c)
+	env.configFile = fname
 
 	//flush last log info
 	defer env.Logger.Sync()
@@ -43,8 +48,26 @@ func Bootstrap(c *cli.Context) {
 	env.GetLogger().Println("Push Worker MiniSpare:", poolCfg.MiniSpare)
 	env.GetLogger().Println("Push Worker MaxSpare:", poolCfg.MaxSpare)
 
+	poolCfg.AutoScale = env.AutoScale
+	poolCfg.AutoScaleInterval = env.AutoScaleInterval
+	env.GetLogger().Println("Push Worker AutoScale:", poolCfg.AutoScale)
+
 	env.PoolConfig = poolCfg
 
+	//runs with ping disabled too, a failed reconnect is only retried by it
+	go NewHealthChecker(env.HealthInterval, env.HealthTimeout).Run()
+
+	//credentials and queue source reload on SIGHUP
+	go WatchReload()
+	//buffered records flushed before exit
+	go WatchShutdown()
+
+	if certInfo := env.GetCertInfo(); certInfo != nil {
+		env.GetLogger().Println("Push cert:", certInfo.Subject, "env:", certInfo.Env, "topics:", certInfo.Topics, "not after:", certInfo.NotAfter)
+		env.CertMonitor = NewCertMonitor(env.CertWarningDays, env.CertCriticalDays)
+		go env.CertMonitor.Run()
+	}
+
 	env.GetLogger().Println("GoPush queue.method:", env.QueueSourceConfig.Method)
 	env.GetLogger().Println("GoPush queue.cache.path:", env.QueueSourceConfig.CachePath)
 	if env.QueueSourceConfig.Method==lib.QUEUE_SOURCE_METHOD_API {
@@ -59,7 +82,7 @@ func Bootstrap(c *cli.Context) {
 	}
 
 	// no need next
-	server := api.NewApiV1Server(env)
+	server := api.NewApiV2Server(env)
 	err = server.Start()
 
 	if err != nil {
@@ -0,0 +1,118 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package apns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	apns "github.com/sideshow/apns2"
+	"golang.org/x/net/http2"
+
+	"gopush/lib"
+)
+
+const (
+	CONNECTION_DIAL_TIMEOUT = 10 * time.Second
+)
+
+// A http2 connection to apns, dialed by ourselves so ping, GOAWAY and server settings are visible.
+type Connection struct {
+	Client      *apns.Client
+	//dialed with, pushes use its topic while a reload drains this connection
+	Credentials *Credentials
+
+	conn        *http2.ClientConn
+}
+
+// Create the http2 connections shared by all workers.
+// every Connection is a separate connection multiplexing streams.
+func NewConnections(env *EnvInfo) (*lib.StreamPool, error) {
+	creds := env.GetCredentials()
+
+	conns := make([]interface{}, env.ConnectionCount)
+	for iter := range conns {
+		conn, err := DialConnection(creds)
+		if err != nil {
+			return nil, err
+		}
+		conns[iter] = conn
+	}
+
+	return lib.NewStreamPool(env.StreamsMax, conns)
+}
+
+func NewClient(cert tls.Certificate, certENV string) (*apns.Client, error) {
+	client := apns.NewClient(cert)
+	if certENV == WORKER_ENV_PRODUCTION {
+		client.Production()
+	}else if certENV == WORKER_ENV_DEVELOPMENT {
+		client.Development()
+	}else {
+		return nil, errors.New("Unsupport worker environment: " + certENV)
+	}
+
+	return client, nil
+}
+
+func DialConnection(creds *Credentials) (*Connection, error) {
+	cert := creds.Cert
+	client, err := NewClient(cert, creds.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := url.Parse(client.Host)
+	if err != nil {
+		return nil, errors.New("Apns host error: " + err.Error())
+	}
+
+	tlsConfig := &tls.Config{Certificates:[]tls.Certificate{cert}, ServerName:host.Hostname(), NextProtos:[]string{http2.NextProtoTLS}}
+	dialer := &net.Dialer{Timeout:CONNECTION_DIAL_TIMEOUT}
+	tlsConn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host.Hostname(), "443"), tlsConfig)
+	if err != nil {
+		return nil, errors.New("Dial apns error: " + err.Error())
+	}
+
+	transport := &http2.Transport{TLSClientConfig:tlsConfig}
+	cc, err := transport.NewClientConn(tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, errors.New("Apns http2 connection error: " + err.Error())
+	}
+
+	//requests only on this connection, keep apns2 timeout or a push on a stalled connection never returns
+	client.HTTPClient = &http.Client{Transport:cc, Timeout:apns.HTTPClientTimeout}
+
+	return &Connection{Client:client, Credentials:creds, conn:cc}, nil
+}
+
+// http2 PING
+func (c *Connection) Ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return c.PingContext(ctx)
+}
+
+func (c *Connection) PingContext(ctx context.Context) error {
+	return c.conn.Ping(ctx)
+}
+
+// false after GOAWAY received or connection closed
+func (c *Connection) Usable() bool {
+	return c.conn.CanTakeNewRequest()
+}
+
+// server SETTINGS_MAX_CONCURRENT_STREAMS
+func (c *Connection) MaxStreams() int {
+	return int(c.conn.State().MaxConcurrentStreams)
+}
+
+func (c *Connection) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package apns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+
+	"github.com/go-ini/ini"
+	"github.com/codegangsta/cli"
+
+	"zooinit/config"
+	"gopush/lib"
+)
+
+// Apns certificate and its config, replaced as a whole by reload.
+type Credentials struct {
+	Path     string
+	Password string
+	//production or development
+	Env      string
+	Topic    string
+
+	//loaded of Path
+	Cert     tls.Certificate
+	//expiry, topics and env of Cert
+	Info     *lib.CertInfo
+}
+
+// parse cert.* config and load the certificate
+func NewCredentials(sec *ini.Section, c *cli.Context) (*Credentials, error) {
+	creds := &Credentials{}
+
+	keyNow := "cert.env"
+	creds.Env = config.GetValueString(keyNow, sec, c)
+	if creds.Env == "" {
+		return nil, errors.New("Config of " + keyNow + " is empty.")
+	}
+
+	keyNow = "cert.path"
+	creds.Path = config.GetValueString(keyNow, sec, c)
+	if creds.Path == "" {
+		return nil, errors.New("Config of " + keyNow + " is empty.")
+	}
+
+	keyNow = "cert.password"
+	creds.Password = config.GetValueString(keyNow, sec, c)
+	if creds.Password == "" {
+		return nil, errors.New("Config of " + keyNow + " is empty.")
+	}
+
+	keyNow = "cert.topic"
+	creds.Topic = config.GetValueString(keyNow, sec, c)
+	if creds.Topic == "" {
+		return nil, errors.New("Config of " + keyNow + " is empty.")
+	}
+
+	cert, err := GetCerts(creds.Path, creds.Password)
+	if err != nil {
+		return nil, errors.New("Load " + creds.Path + " error: " + err.Error())
+	}
+	creds.Cert = cert
+
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("Load " + creds.Path + " error: no certificate found.")
+	}
+	creds.Info, err = lib.ParseApnsCert(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.New("Load " + creds.Path + " error: " + err.Error())
+	}
+
+	//a wrong cert.env or cert.topic fails every push
+	err = creds.Info.Validate(creds.Env, creds.Topic)
+	if err != nil {
+		return nil, errors.New("Config of cert.env or cert.topic error: " + err.Error())
+	}
+
+	return creds, nil
+}
+
+// same config and certificate, a rotated .p12 of same path is a change
+func (cr *Credentials) Equal(other *Credentials) bool {
+	if other == nil || cr.Path != other.Path || cr.Password != other.Password || cr.Env != other.Env || cr.Topic != other.Topic {
+		return false
+	}
+	if len(cr.Cert.Certificate) == 0 || len(other.Cert.Certificate) == 0 {
+		return len(cr.Cert.Certificate) == len(other.Cert.Certificate)
+	}
+
+	return bytes.Equal(cr.Cert.Certificate[0], other.Cert.Certificate[0])
+}
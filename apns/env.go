@@ -2,7 +2,12 @@
 package apns
 
 import (
+	"errors"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-ini/ini"
 	"github.com/codegangsta/cli"
@@ -16,16 +21,73 @@ import (
 type EnvInfo struct {
 	cluster.BaseInfo
 
-	CertPath          string
-	CertPassword      string
-	CertENV           string
-	CertTopic         string
-
 	PoolConfig        *lib.PoolConfig
 
+	TaskQueueConfig   *lib.TaskQueueConfig
+
 	QueueSourceConfig *lib.QueueSourceConfig
 
 	WorkerPool        *lib.WorkerPool
+
+	DeviceRegistry    *lib.DeviceRegistry
+
+	//fallback locale of localized message
+	DefaultLocale     string
+
+	IdempotencyStore  *lib.IdempotencyStore
+
+	ApiKeyStore       *lib.ApiKeyStore
+
+	RateLimiter       *lib.RateLimiter
+
+	Throttle          *lib.Throttle
+
+	FrequencyCap      *lib.FrequencyCap
+
+	TokenValidator    lib.TokenValidator
+
+	//per device push records, nil for disabled
+	DeliverySink      *lib.DeliverySink
+
+	//delivery records to mysql, webhook or message log, nil for none
+	ResultSinks       *lib.ResultSinks
+
+	//task completion callbacks of send param callback_url
+	CallbackSender    *lib.CallbackSender
+
+	//traces of push-ids, nil for disabled
+	Tracer            *lib.Tracer
+
+	//http2 connections shared by workers, each carry StreamsMax concurrent streams
+	ConnectionCount   int
+	StreamsMax        int
+	Connections       *lib.StreamPool
+	//idle connection ping interval, 0 for disabled
+	HealthInterval    time.Duration
+	HealthTimeout     time.Duration
+
+	//checks of /readyz
+	Readiness         *lib.Readiness
+
+	//days before cert expiry to log warnings, critical ones logged hourly
+	CertWarningDays   int
+	CertCriticalDays  int
+	//started by Bootstrap, reset by Reload
+	CertMonitor       *CertMonitor
+
+	//pool autoscale while sending, applied to PoolConfig by Bootstrap
+	AutoScale         bool
+	AutoScaleInterval time.Duration
+
+	//apns certificate, swapped by Reload
+	credentials       *Credentials
+
+	//runtime changes of PoolConfig by admin api, Reload of credentials and queue source
+	configLock        sync.RWMutex
+	//serialize reloads, config file and flags re-read by Reload
+	reloadLock        sync.Mutex
+	configFile        string
+	cliContext        *cli.Context
 }
 
 func NewEnvInfo(iniobj *ini.File, c *cli.Context) *EnvInfo {
@@ -40,45 +102,569 @@ func NewEnvInfo(iniobj *ini.File, c *cli.Context) *EnvInfo {
 	// parse base info
 	env.ParseConfigFile(sec, c)
 
-	keyNow := "cert.env"
-	env.CertENV = config.GetValueString(keyNow, sec, c)
-	if env.CertENV == "" {
-		log.Fatalln("Config of " + keyNow + " is empty.")
+	var err error
+	env.credentials, err = NewCredentials(sec, c)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	env.QueueSourceConfig, err = NewQueueSourceConfig(sec, c)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	//for reload
+	env.cliContext = c
+
+	var keyNow, tmpStr string
+
+	//can be empty
+	keyNow = "message.locale.default"
+	env.DefaultLocale = config.GetValueString(keyNow, sec, c)
+
+	//can be empty, registry will be memory only
+	keyNow = "device.registry.path"
+	dr, err := lib.NewDeviceRegistry(config.GetValueString(keyNow, sec, c))
+	if err != nil {
+		log.Fatalln("Create lib.NewDeviceRegistry error: " + err.Error())
+	}
+	env.DeviceRegistry = dr
+
+	//can be empty, default 24 hours
+	retention := lib.IDEMPOTENCY_DEFAULT_RETENTION
+	keyNow = "idempotency.retention"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		seconds, err := strconv.Atoi(tmpStr)
+		if err != nil || seconds <= 0 {
+			log.Fatalln("Config of " + keyNow + " must be seconds >0: " + tmpStr)
+		}
+		retention = time.Duration(seconds) * time.Second
+	}
+
+	//can be empty, keys will be memory only
+	keyNow = "idempotency.path"
+	is, err := lib.NewIdempotencyStore(config.GetValueString(keyNow, sec, c), retention)
+	if err != nil {
+		log.Fatalln("Create lib.NewIdempotencyStore error: " + err.Error())
+	}
+	env.IdempotencyStore = is
+
+	env.ApiKeyStore, err = NewApiKeyStore(iniobj, sec, c)
+	if err != nil {
+		log.Fatalln("Create api key store error: " + err.Error())
+	}
+
+	//fail closed, no client needs authentication explicitly off
+	keyNow = "api.auth"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr == "" {
+		tmpStr = lib.API_AUTH_ON
+	}
+	if tmpStr != lib.API_AUTH_ON && tmpStr != lib.API_AUTH_OFF {
+		log.Fatalln("Config of " + keyNow + " must be on or off: " + tmpStr)
+	}
+	if tmpStr == lib.API_AUTH_ON && env.ApiKeyStore.Len() == 0 {
+		log.Fatalln("Config of " + keyNow + " is on but no api client configured, add [client.*] sections or auth.keys.path, or set api.auth = off.")
+	}
+	//clients kept in config while auth off for a while, not loaded
+	if tmpStr == lib.API_AUTH_OFF && env.ApiKeyStore.Len() > 0 {
+		log.Println("Config of " + keyNow + " is off, " + strconv.Itoa(env.ApiKeyStore.Len()) + " api clients configured are ignored.")
+		env.ApiKeyStore = lib.NewApiKeyStore()
+	}
+
+	//app limits, can be empty for unlimited
+	appLimits, err := NewLimits(config.GetValueString("limit.rps", sec, c), config.GetValueString("limit.broadcasts.daily", sec, c),
+		config.GetValueString("limit.audience.max", sec, c))
+	if err != nil {
+		log.Fatalln("Config of limit.* error: " + err.Error())
+	}
+	env.RateLimiter = lib.NewRateLimiter(appLimits)
+
+	//can be empty for unlimited
+	var throttleRate, throttleTaskRate float64
+	var throttleBurst int
+	keyNow = "throttle.rate"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		throttleRate, err = strconv.ParseFloat(tmpStr, 64)
+		if err != nil || throttleRate < 0 {
+			log.Fatalln("Config of " + keyNow + " must be a number >=0: " + tmpStr)
+		}
+	}
+
+	keyNow = "throttle.burst"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		throttleBurst, err = strconv.Atoi(tmpStr)
+		if err != nil || throttleBurst < 0 {
+			log.Fatalln("Config of " + keyNow + " must be an integer >=0: " + tmpStr)
+		}
+	}
+
+	keyNow = "throttle.task.rate"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		throttleTaskRate, err = strconv.ParseFloat(tmpStr, 64)
+		if err != nil || throttleTaskRate < 0 {
+			log.Fatalln("Config of " + keyNow + " must be a number >=0: " + tmpStr)
+		}
+	}
+	env.Throttle = lib.NewThrottle(throttleRate, throttleBurst, throttleTaskRate)
+
+	keyNow = "device.token.provider"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr == "" {
+		tmpStr = lib.PROVIDER_APNS
+	}
+	env.TokenValidator, err = lib.GetTokenValidator(tmpStr)
+	if err != nil {
+		log.Fatalln("Config of " + keyNow + " error: " + err.Error())
+	}
+
+	//can be empty for disabled
+	keyNow = "frequency.cap"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" && tmpStr != "0" {
+		frequencyLimit, err := strconv.Atoi(tmpStr)
+		if err != nil || frequencyLimit < 0 {
+			log.Fatalln("Config of " + keyNow + " must be an integer >=0: " + tmpStr)
+		}
+
+		frequencyWindow := lib.FREQUENCY_DEFAULT_WINDOW
+		keyNow = "frequency.window"
+		tmpStr = config.GetValueString(keyNow, sec, c)
+		if tmpStr != "" {
+			seconds, err := strconv.Atoi(tmpStr)
+			if err != nil || seconds <= 0 {
+				log.Fatalln("Config of " + keyNow + " must be seconds >0: " + tmpStr)
+			}
+			frequencyWindow = time.Duration(seconds) * time.Second
+		}
+
+		var categories []string
+		tmpStr = config.GetValueString("frequency.categories", sec, c)
+		if tmpStr != "" {
+			categories = strings.Split(tmpStr, ",")
+		}
+
+		env.FrequencyCap, err = lib.NewFrequencyCap(frequencyLimit, frequencyWindow, categories, config.GetValueString("frequency.path", sec, c))
+		if err != nil {
+			log.Fatalln("Create lib.NewFrequencyCap error: " + err.Error())
+		}
+	}
+
+	//can be empty for disabled
+	keyNow = "delivery.format"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		retention := lib.DELIVERY_DEFAULT_RETENTION
+		keyNow = "delivery.retention"
+		if days := config.GetValueString(keyNow, sec, c); days != "" {
+			retention, err = strconv.Atoi(days)
+			if err != nil || retention < 0 {
+				log.Fatalln("Config of " + keyNow + " must be days >=0: " + days)
+			}
+		}
+
+		env.DeliverySink, err = lib.NewDeliverySink(tmpStr, config.GetValueString("delivery.path", sec, c), retention)
+		if err != nil {
+			log.Fatalln("Create lib.NewDeliverySink error: " + err.Error())
+		}
+	}
+
+	env.ResultSinks, err = NewResultSinks(iniobj, env)
+	if err != nil {
+		log.Fatalln("Create result sinks error: " + err.Error())
+	}
+
+	callbackTimeout := lib.CALLBACK_DEFAULT_TIMEOUT
+	keyNow = "callback.timeout"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		seconds, err := strconv.Atoi(tmpStr)
+		if err != nil || seconds <= 0 {
+			log.Fatalln("Config of " + keyNow + " must be seconds >0: " + tmpStr)
+		}
+		callbackTimeout = time.Duration(seconds) * time.Second
+	}
+
+	callbackRetries := lib.CALLBACK_DEFAULT_RETRIES
+	keyNow = "callback.retries"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		callbackRetries, err = strconv.Atoi(tmpStr)
+		if err != nil || callbackRetries < 0 {
+			log.Fatalln("Config of " + keyNow + " must be an integer >=0: " + tmpStr)
+		}
+	}
+	//callbacks disabled without secret, send with callback_url rejected
+	keyNow = "callback.secret"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		env.CallbackSender, err = lib.NewCallbackSender(tmpStr, callbackTimeout, callbackRetries, lib.ParseCallbackHosts(config.GetValueString("callback.hosts", sec, c)))
+		if err != nil {
+			log.Fatalln("Config of callback.* error: " + err.Error())
+		}
+	}
+
+	//can be empty for disabled
+	keyNow = "trace.exporter"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		var exporter lib.SpanExporter
+		switch tmpStr {
+		case lib.TRACE_EXPORTER_OTLP:
+			exporter, err = lib.NewOtlpExporter(config.GetValueString("trace.endpoint", sec, c), env.Service)
+			if err != nil {
+				log.Fatalln("Create lib.NewOtlpExporter error: " + err.Error())
+			}
+		case lib.TRACE_EXPORTER_MEMORY:
+			exporter = lib.NewMemoryExporter()
+		default:
+			log.Fatalln("Config of " + keyNow + " must be " + lib.TRACE_EXPORTER_OTLP + " or " + lib.TRACE_EXPORTER_MEMORY + ": " + tmpStr)
+		}
+
+		sampleRate := lib.TRACE_DEFAULT_SAMPLE_RATE
+		keyNow = "trace.sample.rate"
+		tmpStr = config.GetValueString(keyNow, sec, c)
+		if tmpStr != "" {
+			sampleRate, err = strconv.ParseFloat(tmpStr, 64)
+			if err != nil {
+				log.Fatalln("Config of " + keyNow + " must be a number between 0 and 1: " + tmpStr)
+			}
+		}
+
+		env.Tracer, err = lib.NewTracer(env.Service, exporter, sampleRate)
+		if err != nil {
+			log.Fatalln("Create lib.NewTracer error: " + err.Error())
+		}
+	}
+
+	keyNow = "pool.autoscale"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		env.AutoScale, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			log.Fatalln("Config of " + keyNow + " must be true or false: " + tmpStr)
+		}
+	}
+
+	keyNow = "pool.autoscale.interval"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		seconds, err := strconv.Atoi(tmpStr)
+		if err != nil || seconds <= 0 {
+			log.Fatalln("Config of " + keyNow + " must be seconds >0: " + tmpStr)
+		}
+		env.AutoScaleInterval = time.Duration(seconds) * time.Second
+	}
+
+	env.ConnectionCount = lib.STREAM_DEFAULT_CONNECTIONS
+	keyNow = "connection.count"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		env.ConnectionCount, err = strconv.Atoi(tmpStr)
+		if err != nil || env.ConnectionCount <= 0 {
+			log.Fatalln("Config of " + keyNow + " must be an integer >0: " + tmpStr)
+		}
+	}
+
+	env.StreamsMax = lib.STREAM_DEFAULT_MAX
+	keyNow = "connection.streams.max"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		env.StreamsMax, err = strconv.Atoi(tmpStr)
+		if err != nil || env.StreamsMax <= 0 {
+			log.Fatalln("Config of " + keyNow + " must be an integer >0: " + tmpStr)
+		}
+	}
+
+	env.HealthInterval = HEALTH_DEFAULT_INTERVAL
+	keyNow = "connection.health.interval"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		seconds, err := strconv.Atoi(tmpStr)
+		if err != nil || seconds < 0 {
+			log.Fatalln("Config of " + keyNow + " must be seconds >=0: " + tmpStr)
+		}
+		env.HealthInterval = time.Duration(seconds) * time.Second
+	}
+
+	env.HealthTimeout = HEALTH_DEFAULT_TIMEOUT
+	keyNow = "connection.health.timeout"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		seconds, err := strconv.Atoi(tmpStr)
+		if err != nil || seconds <= 0 {
+			log.Fatalln("Config of " + keyNow + " must be seconds >0: " + tmpStr)
+		}
+		env.HealthTimeout = time.Duration(seconds) * time.Second
+	}
+
+	env.Connections, err = NewConnections(env)
+	if err != nil {
+		log.Fatalln("Create apns connections error: " + err.Error())
+	}
+
+	env.CertWarningDays = lib.CERT_DEFAULT_WARNING_DAYS
+	keyNow = "cert.expiry.warning"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		env.CertWarningDays, err = strconv.Atoi(tmpStr)
+		if err != nil || env.CertWarningDays < 0 {
+			log.Fatalln("Config of " + keyNow + " must be days >=0: " + tmpStr)
+		}
+	}
+
+	//default not beyond warning, eg. cert.expiry.warning = 3 alone
+	env.CertCriticalDays = lib.CERT_DEFAULT_CRITICAL_DAYS
+	if env.CertCriticalDays > env.CertWarningDays {
+		env.CertCriticalDays = env.CertWarningDays
+	}
+	keyNow = "cert.expiry.critical"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		env.CertCriticalDays, err = strconv.Atoi(tmpStr)
+		if err != nil || env.CertCriticalDays < 0 || env.CertCriticalDays > env.CertWarningDays {
+			log.Fatalln("Config of " + keyNow + " must be days >=0 and <=cert.expiry.warning: " + tmpStr)
+		}
+	}
+
+	readinessTimeout := lib.HEALTH_CHECK_DEFAULT_TIMEOUT
+	keyNow = "readiness.timeout"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		seconds, err := strconv.Atoi(tmpStr)
+		if err != nil || seconds <= 0 {
+			log.Fatalln("Config of " + keyNow + " must be seconds >0: " + tmpStr)
+		}
+		readinessTimeout = time.Duration(seconds) * time.Second
+	}
+
+	readinessCache := lib.HEALTH_CHECK_DEFAULT_CACHE
+	keyNow = "readiness.cache"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		seconds, err := strconv.Atoi(tmpStr)
+		if err != nil || seconds < 0 {
+			log.Fatalln("Config of " + keyNow + " must be seconds >=0: " + tmpStr)
+		}
+		readinessCache = time.Duration(seconds) * time.Second
+	}
+	env.Readiness = NewReadiness(env, readinessTimeout, readinessCache)
+
+	taskPools := lib.TASK_QUEUE_MAX_POOL
+	keyNow = "task.pools"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		taskPools, err = strconv.Atoi(tmpStr)
+		if err != nil || taskPools <= 0 {
+			log.Fatalln("Config of " + keyNow + " must be an integer >0: " + tmpStr)
+		}
+	}
+
+	taskWaiting := lib.TASK_QUEUE_MAX_WAITING
+	keyNow = "task.queue.size"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		taskWaiting, err = strconv.Atoi(tmpStr)
+		if err != nil || taskWaiting <= 0 {
+			log.Fatalln("Config of " + keyNow + " must be an integer >0: " + tmpStr)
+		}
+	}
+
+	var taskConcurrency int
+	keyNow = "task.concurrency"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		taskConcurrency, err = strconv.Atoi(tmpStr)
+		if err != nil || taskConcurrency < 0 {
+			log.Fatalln("Config of " + keyNow + " must be an integer >=0: " + tmpStr)
+		}
+	}
+
+	var taskShare bool
+	keyNow = "task.share"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		taskShare, err = strconv.ParseBool(tmpStr)
+		if err != nil {
+			log.Fatalln("Config of " + keyNow + " must be true or false: " + tmpStr)
+		}
+	}
+
+	env.TaskQueueConfig, err = lib.NewTaskQueueConfig(taskPools, taskWaiting, taskConcurrency, taskShare)
+	if err != nil {
+		log.Fatalln("Config of task.* error: " + err.Error())
+	}
+
+	maxWorkers := taskPools * lib.POOL_DEFAULT_CAPACITY
+	keyNow = "worker.max"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		maxWorkers, err = strconv.Atoi(tmpStr)
+		if err != nil || maxWorkers < 0 {
+			log.Fatalln("Config of " + keyNow + " must be an integer >=0: " + tmpStr)
+		}
 	}
 
-	keyNow = "cert.path"
-	env.CertPath = config.GetValueString(keyNow, sec, c)
-	if env.CertPath == "" {
-		log.Fatalln("Config of " + keyNow + " is empty.")
+	idleTimeout := lib.WORKER_POOL_DEFAULT_IDLE_TIMEOUT
+	keyNow = "worker.idle.timeout"
+	tmpStr = config.GetValueString(keyNow, sec, c)
+	if tmpStr != "" {
+		seconds, err := strconv.Atoi(tmpStr)
+		if err != nil || seconds < 0 {
+			log.Fatalln("Config of " + keyNow + " must be seconds >=0: " + tmpStr)
+		}
+		idleTimeout = time.Duration(seconds) * time.Second
 	}
 
-	keyNow = "cert.password"
-	env.CertPassword = config.GetValueString(keyNow, sec, c)
-	if env.CertPassword == "" {
-		log.Fatalln("Config of " + keyNow + " is empty.")
+	wp, err := lib.NewWorkerPool(env, maxWorkers, idleTimeout)
+	if err != nil {
+		log.Fatalln("Create lib.NewWorkerPool error: " + err.Error())
+	} else {
+		env.WorkerPool = wp
+		go wp.Run()
+	}
+
+	//create uuid
+	env.CreateUUID()
+
+	env.GuaranteeSingleRun()
+
+	//register signal watcher
+	env.RegisterSignalWatch()
+
+	return env
+}
+
+func (e *EnvInfo) CreateWorker() (lib.Worker, error) {
+	worker, err := NewWorker(e)
+	if err != nil {
+		return nil, err
 	}
 
-	keyNow = "cert.topic"
-	env.CertTopic = config.GetValueString(keyNow, sec, c)
-	if env.CertTopic == "" {
-		log.Fatalln("Config of " + keyNow + " is empty.")
+	return worker, nil
+}
+
+func (e *EnvInfo) DestroyWorker(worker lib.Worker) (error) {
+	return worker.Destroy()
+}
+
+func (e *EnvInfo) GetPoolConfig() (*lib.PoolConfig) {
+	e.configLock.RLock()
+	defer e.configLock.RUnlock()
+
+	return e.PoolConfig
+}
+
+func (e *EnvInfo) SetPoolConfig(config *lib.PoolConfig) {
+	e.configLock.Lock()
+	defer e.configLock.Unlock()
+
+	e.PoolConfig = config
+}
+
+func (e *EnvInfo) GetTaskQueueConfig() (*lib.TaskQueueConfig) {
+	return e.TaskQueueConfig
+}
+
+func (e *EnvInfo) GetWorkerPool() (*lib.WorkerPool) {
+	return e.WorkerPool
+}
+
+func (e *EnvInfo) GetQueueSourceConfig() (*lib.QueueSourceConfig) {
+	e.configLock.RLock()
+	defer e.configLock.RUnlock()
+
+	return e.QueueSourceConfig
+}
+
+func (e *EnvInfo) GetCredentials() (*Credentials) {
+	e.configLock.RLock()
+	defer e.configLock.RUnlock()
+
+	return e.credentials
+}
+
+func (e *EnvInfo) GetCertInfo() (*lib.CertInfo) {
+	creds := e.GetCredentials()
+	if creds == nil {
+		return nil
 	}
 
+	return creds.Info
+}
+
+func (e *EnvInfo) GetDeviceRegistry() (*lib.DeviceRegistry) {
+	return e.DeviceRegistry
+}
+
+func (e *EnvInfo) GetDefaultLocale() string {
+	return e.DefaultLocale
+}
+
+func (e *EnvInfo) GetIdempotencyStore() (*lib.IdempotencyStore) {
+	return e.IdempotencyStore
+}
+
+func (e *EnvInfo) GetApiKeyStore() (*lib.ApiKeyStore) {
+	return e.ApiKeyStore
+}
+
+func (e *EnvInfo) GetRateLimiter() (*lib.RateLimiter) {
+	return e.RateLimiter
+}
+
+func (e *EnvInfo) GetTokenValidator() (lib.TokenValidator) {
+	return e.TokenValidator
+}
+
+func (e *EnvInfo) GetFrequencyCap() (*lib.FrequencyCap) {
+	return e.FrequencyCap
+}
+
+func (e *EnvInfo) GetDeliverySink() (*lib.DeliverySink) {
+	return e.DeliverySink
+}
+
+func (e *EnvInfo) GetResultSinks() (*lib.ResultSinks) {
+	return e.ResultSinks
+}
+
+func (e *EnvInfo) GetCallbackSender() (*lib.CallbackSender) {
+	return e.CallbackSender
+}
+
+func (e *EnvInfo) GetReadiness() (*lib.Readiness) {
+	return e.Readiness
+}
+
+func (e *EnvInfo) GetTracer() (*lib.Tracer) {
+	return e.Tracer
+}
+
+func (e *EnvInfo) GetThrottle() (*lib.Throttle) {
+	return e.Throttle
+}
+
+// parse queue.* config of device queue data source
+func NewQueueSourceConfig(sec *ini.Section, c *cli.Context) (*lib.QueueSourceConfig, error) {
 	qsConfig:=&lib.QueueSourceConfig{}
-	keyNow = "queue.method"
+	keyNow := "queue.method"
 	tmpStr := config.GetValueString(keyNow, sec, c)
 	if tmpStr == "" {
-		log.Fatalln("Config of " + keyNow + " is empty.")
+		return nil, errors.New("Config of " + keyNow + " is empty.")
 	}
 	if tmpStr!=lib.QUEUE_SOURCE_METHOD_API && tmpStr!=lib.QUEUE_SOURCE_METHOD_FILE && tmpStr!=lib.QUEUE_SOURCE_METHOD_MYSQL {
-		log.Fatalln("Config of " + keyNow + " value is not allowed: "+tmpStr)
+		return nil, errors.New("Config of " + keyNow + " value is not allowed: "+tmpStr)
 	}
 	qsConfig.Method=tmpStr
 
 	keyNow = "queue.cache.path"
 	tmpStr = config.GetValueString(keyNow, sec, c)
 	if tmpStr == "" {
-		log.Fatalln("Config of " + keyNow + " is empty.")
+		return nil, errors.New("Config of " + keyNow + " is empty.")
 	}
 	qsConfig.CachePath=tmpStr
 
@@ -86,7 +672,7 @@ func NewEnvInfo(iniobj *ini.File, c *cli.Context) *EnvInfo {
 		keyNow = "queue.api.uri"
 		tmpStr = config.GetValueString(keyNow, sec, c)
 		if tmpStr == "" {
-			log.Fatalln("Config of " + keyNow + " is empty.")
+			return nil, errors.New("Config of " + keyNow + " is empty.")
 		}
 		qsConfig.ApiPrefix=tmpStr
 
@@ -98,7 +684,7 @@ func NewEnvInfo(iniobj *ini.File, c *cli.Context) *EnvInfo {
 		keyNow = "queue.mysql.dsn"
 		tmpStr = config.GetValueString(keyNow, sec, c)
 		if tmpStr == "" {
-			log.Fatalln("Config of " + keyNow + " is empty.")
+			return nil, errors.New("Config of " + keyNow + " is empty.")
 		}
 		qsConfig.MysqlDsn=tmpStr
 
@@ -110,7 +696,7 @@ func NewEnvInfo(iniobj *ini.File, c *cli.Context) *EnvInfo {
 		keyNow = "queue.file.path"
 		tmpStr = config.GetValueString(keyNow, sec, c)
 		if tmpStr == "" {
-			log.Fatalln("Config of " + keyNow + " is empty.")
+			return nil, errors.New("Config of " + keyNow + " is empty.")
 		}
 		qsConfig.FilePath=tmpStr
 
@@ -119,50 +705,153 @@ func NewEnvInfo(iniobj *ini.File, c *cli.Context) *EnvInfo {
 		tmpStr = config.GetValueString(keyNow, sec, c)
 		qsConfig.Value=tmpStr
 	}
-	//set qsconfig
-	env.QueueSourceConfig=qsConfig
-	wp, err := lib.NewWorkerPool(env)
-	if err != nil {
-		log.Fatalln("Create lib.NewWorkerPool error: " + err.Error())
-	} else {
-		env.WorkerPool = wp
-	}
 
-	//create uuid
-	env.CreateUUID()
+	return qsConfig, nil
+}
 
-	env.GuaranteeSingleRun()
+// parse limits config values, empty for unlimited
+func NewLimits(rps, broadcastsDaily, audienceMax string) (*lib.Limits, error) {
+	limits := &lib.Limits{}
 
-	//register signal watcher
-	env.RegisterSignalWatch()
+	var err error
+	if rps != "" {
+		limits.RPS, err = strconv.ParseFloat(rps, 64)
+		if err != nil || limits.RPS < 0 {
+			return nil, errors.New("rps must be a number >=0: " + rps)
+		}
+	}
+	if broadcastsDaily != "" {
+		limits.BroadcastsDaily, err = strconv.Atoi(broadcastsDaily)
+		if err != nil || limits.BroadcastsDaily < 0 {
+			return nil, errors.New("broadcasts.daily must be an integer >=0: " + broadcastsDaily)
+		}
+	}
+	if audienceMax != "" {
+		limits.AudienceMax, err = strconv.Atoi(audienceMax)
+		if err != nil || limits.AudienceMax < 0 {
+			return nil, errors.New("audience.max must be an integer >=0: " + audienceMax)
+		}
+	}
 
-	return env
+	return limits, nil
 }
 
-func (e *EnvInfo) CreateWorker() (lib.Worker, error) {
-	worker, err := NewWorker(e)
-	if err != nil {
-		return nil, err
+// api clients of config sections [client.name] and json file of auth.keys.path
+func NewApiKeyStore(iniobj *ini.File, sec *ini.Section, c *cli.Context) (*lib.ApiKeyStore, error) {
+	store := lib.NewApiKeyStore()
+
+	for _, section := range iniobj.Sections() {
+		if !strings.HasPrefix(section.Name(), CONFIG_SECTION_CLIENT_PREFIX) {
+			continue
+		}
+
+		client := &lib.ApiClient{Name:strings.TrimPrefix(section.Name(), CONFIG_SECTION_CLIENT_PREFIX)}
+		client.Key = section.Key("key").String()
+		client.Secret = section.Key("secret").String()
+		client.Scopes = lib.ParseApiScopes(section.Key("scopes").String())
+
+		limits, err := NewLimits(section.Key("rps").String(), section.Key("broadcasts.daily").String(), section.Key("audience.max").String())
+		if err != nil {
+			return nil, errors.New("Config of section " + section.Name() + " error: " + err.Error())
+		}
+		client.Limits = *limits
+
+		err = store.Add(client)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return worker, nil
+	//can be empty
+	path := config.GetValueString("auth.keys.path", sec, c)
+	if path != "" {
+		err := store.LoadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
 }
 
-// TODO destroy
-func (e *EnvInfo) DestroyWorker(worker lib.Worker) (error) {
+// result sinks of config sections [sink.name], nil if no section
+func NewResultSinks(iniobj *ini.File, env *EnvInfo) (*lib.ResultSinks, error) {
+	var sinks *lib.ResultSinks
 
+	for _, section := range iniobj.Sections() {
+		if !strings.HasPrefix(section.Name(), CONFIG_SECTION_SINK_PREFIX) {
+			continue
+		}
+		name := strings.TrimPrefix(section.Name(), CONFIG_SECTION_SINK_PREFIX)
+
+		var sink lib.ResultSink
+		var err error
+		switch section.Key("type").String() {
+		case lib.SINK_TYPE_MYSQL:
+			sink, err = lib.NewMysqlResultSink(section.Key("dsn").String(), section.Key("table").String())
+		case lib.SINK_TYPE_WEBHOOK:
+			var timeout int64
+			timeout, err = getSectionInt(section, "timeout")
+			if err == nil {
+				sink, err = lib.NewWebhookResultSink(section.Key("url").String(), time.Duration(timeout) * time.Second)
+			}
+		case lib.SINK_TYPE_FILE:
+			var segmentSize int64
+			segmentSize, err = getSectionInt(section, "segment.size")
+			if err == nil {
+				sink, err = lib.NewFileResultSink(section.Key("path").String(), segmentSize)
+			}
+		default:
+			err = errors.New("type must be mysql, webhook or file: " + section.Key("type").String())
+		}
+		if err != nil {
+			return nil, errors.New("Config of section " + section.Name() + " error: " + err.Error())
+		}
 
-	return nil
-}
+		var apps []string
+		if tmpStr := section.Key("apps").String(); tmpStr != "" {
+			apps = strings.Split(tmpStr, ",")
+		}
+		buffer, err := getSectionInt(section, "buffer")
+		if err != nil {
+			return nil, errors.New("Config of section " + section.Name() + " error: " + err.Error())
+		}
+		batch, err := getSectionInt(section, "batch.size")
+		if err != nil {
+			return nil, errors.New("Config of section " + section.Name() + " error: " + err.Error())
+		}
+		interval, err := getSectionInt(section, "flush.interval")
+		if err != nil {
+			return nil, errors.New("Config of section " + section.Name() + " error: " + err.Error())
+		}
 
-func (e *EnvInfo) GetPoolConfig() (*lib.PoolConfig) {
-	return e.PoolConfig
-}
+		bs, err := lib.NewBufferedSink(name, sink, apps, int(buffer), int(batch), time.Duration(interval) * time.Second, func(name string, err error) {
+			env.GetLogger().Println("Result sink " + name + " error: " + err.Error())
+		})
+		if err != nil {
+			return nil, err
+		}
 
-func (e *EnvInfo) GetWorkerPool() (*lib.WorkerPool) {
-	return e.WorkerPool
+		if sinks == nil {
+			sinks = lib.NewResultSinks()
+		}
+		sinks.Add(bs)
+	}
+
+	return sinks, nil
 }
 
-func (e *EnvInfo) GetQueueSourceConfig() (*lib.QueueSourceConfig) {
-	return e.QueueSourceConfig
-}
\ No newline at end of file
+// integer >=0 of section key, 0 if empty
+func getSectionInt(section *ini.Section, key string) (int64, error) {
+	tmpStr := section.Key(key).String()
+	if tmpStr == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseInt(tmpStr, 10, 64)
+	if err != nil || value < 0 {
+		return 0, errors.New(key + " must be an integer >=0: " + tmpStr)
+	}
+
+	return value, nil
+}
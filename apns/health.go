@@ -0,0 +1,272 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package apns
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopush/lib"
+)
+
+const (
+	HEALTH_DEFAULT_INTERVAL = 30 * time.Second
+	HEALTH_DEFAULT_TIMEOUT = 5 * time.Second
+	//ping disabled still retries unhealthy connections and follows GOAWAY
+	HEALTH_RECOVER_INTERVAL = 5 * time.Second
+
+	//in-flight pushes of a rotated connection finish within, then it is closed anyway
+	CONNECTION_DRAIN_TIMEOUT = 60 * time.Second
+
+	//push fails if no connection recovers within, instead of holding its worker forever
+	CONNECTION_ACQUIRE_TIMEOUT = 30 * time.Second
+
+	//cert expiry checks, critical and expired logged every check, warnings daily
+	CERT_CHECK_INTERVAL = time.Hour
+	CERT_WARNING_INTERVAL = 24 * time.Hour
+)
+
+// Ping idle connections, reconnect on ping failure, GOAWAY or push error.
+// idle connections behind NAT/LB die silently, first pushes of next campaign will fail without it.
+type HealthChecker struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+func NewHealthChecker(interval, timeout time.Duration) *HealthChecker {
+	return &HealthChecker{Interval:interval, Timeout:timeout}
+}
+
+// this is a goroutine run, Interval 0 disables ping only
+func (hc *HealthChecker) Run() {
+	interval := hc.Interval
+	if interval > 0 {
+		env.GetLogger().Println("Connection health check started, interval: " + interval.String())
+	} else {
+		interval = HEALTH_RECOVER_INTERVAL
+		env.GetLogger().Println("Connection health check ping disabled, recover unhealthy connections every " + interval.String())
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		hc.Check()
+	}
+}
+
+func (hc *HealthChecker) Check() {
+	maxStreams := env.StreamsMax
+	for _, conn := range env.Connections.Connections() {
+		connection := conn.Conn.(*Connection)
+
+		switch env.Connections.GetStatus(conn) {
+		case lib.STREAM_STATUS_HEALTHY:
+			if !connection.Usable() {
+				MarkConnectionUnhealthy(conn, "GOAWAY or closed")
+			} else if streams := connection.MaxStreams(); streams > 0 && streams < maxStreams {
+				maxStreams = streams
+			}
+		case lib.STREAM_STATUS_UNHEALTHY:
+			//last reconnect failed, try again
+			ReconnectConnection(conn, "retry")
+		}
+	}
+
+	//follow server MAX_CONCURRENT_STREAMS
+	if maxStreams != env.Connections.GetMaxStreams() {
+		env.GetLogger().Println("Connection max streams change to " + strconv.Itoa(maxStreams))
+		env.Connections.SetMaxStreams(maxStreams)
+	}
+
+	if hc.Interval <= 0 {
+		return
+	}
+	for _, conn := range env.Connections.Idle(hc.Interval) {
+		err := conn.Conn.(*Connection).Ping(hc.Timeout)
+		if err != nil {
+			MarkConnectionUnhealthy(conn, "ping error: " + err.Error())
+		}
+	}
+}
+
+// only the first caller reconnects, others return
+func MarkConnectionUnhealthy(conn *lib.StreamConn, reason string) {
+	if env.Connections.MarkUnhealthy(conn) {
+		go ReconnectConnection(conn, reason)
+	}
+}
+
+func ReconnectConnection(conn *lib.StreamConn, reason string) {
+	name := "connection_" + strconv.Itoa(conn.ID)
+	//health check retry and MarkConnectionUnhealthy may race, StreamPool.Reconnect lets only one dial
+	if status := env.Connections.GetStatus(conn); status == lib.STREAM_STATUS_RECONNECTING || status == lib.STREAM_STATUS_CLOSED {
+		return
+	}
+	env.GetLogger().Println(name + " reconnecting, reason: " + reason)
+
+	//credentials of dial time, a reload may swap them while reconnecting
+	_, err := env.Connections.Reconnect(conn, func() (interface{}, error) {
+		return DialConnection(env.GetCredentials())
+	})
+	if err != nil {
+		env.GetLogger().Println(name + " reconnect error: " + err.Error())
+		return
+	}
+
+	env.GetLogger().Println(name + " reconnected.")
+	go closeDrained(conn, name)
+}
+
+// close a replaced connection after its in-flight pushes done
+func closeDrained(conn *lib.StreamConn, name string) {
+	if !env.Connections.WaitDrained(conn, CONNECTION_DRAIN_TIMEOUT) {
+		env.GetLogger().Println(name + " drain timeout after " + CONNECTION_DRAIN_TIMEOUT.String() + ", closing.")
+	}
+	conn.Conn.(*Connection).Close()
+}
+
+// replace connections by ones of current credentials, eg. after reload.
+// new pushes go to the new connections, old ones closed after their in-flight pushes done.
+func RotateConnections(reason string) {
+	for _, conn := range env.Connections.Connections() {
+		name := "connection_" + strconv.Itoa(conn.ID)
+		env.GetLogger().Println(name + " rotating, reason: " + reason)
+
+		_, err := env.Connections.Reconnect(conn, func() (interface{}, error) {
+			return DialConnection(env.GetCredentials())
+		})
+		if err != nil {
+			//unhealthy, retried by health checker
+			env.GetLogger().Println(name + " rotate error: " + err.Error())
+			continue
+		}
+
+		env.GetLogger().Println(name + " rotated.")
+		go closeDrained(conn, name)
+	}
+}
+
+// Log escalating warnings as push certificate expiry approaches.
+// certificate of each check, so a reloaded one is followed, Reset by reload warns of it again.
+type CertMonitor struct {
+	WarningDays  int
+	CriticalDays int
+
+	warned       time.Time
+	lock         sync.Mutex
+}
+
+func NewCertMonitor(warningDays, criticalDays int) *CertMonitor {
+	return &CertMonitor{WarningDays:warningDays, CriticalDays:criticalDays}
+}
+
+// this is a goroutine run
+func (cm *CertMonitor) Run() {
+	ticker := time.NewTicker(CERT_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	cm.Check()
+	for range ticker.C {
+		cm.Check()
+	}
+}
+
+func (cm *CertMonitor) Check() {
+	info := env.GetCertInfo()
+	if info == nil {
+		return
+	}
+	days := info.DaysToExpiry(time.Now())
+	msg := "Cert " + info.Subject + " expires at " + info.NotAfter.Format(time.RFC3339) + ", " + strconv.Itoa(int(math.Floor(days))) + " days left."
+
+	switch lib.CertExpiryLevel(days, cm.WarningDays, cm.CriticalDays) {
+	case lib.CERT_EXPIRY_WARNING:
+		cm.lock.Lock()
+		warn := time.Since(cm.warned) >= CERT_WARNING_INTERVAL
+		if warn {
+			cm.warned = time.Now()
+		}
+		cm.lock.Unlock()
+		if warn {
+			env.GetLogger().Println("Warning: " + msg)
+		}
+	case lib.CERT_EXPIRY_CRITICAL:
+		env.GetLogger().Println("Critical: " + msg + " Rotate cert.path and reload.")
+	case lib.CERT_EXPIRY_EXPIRED:
+		env.GetLogger().Println("Expired: " + msg + " All pushes fail, rotate cert.path and reload.")
+	}
+}
+
+// forget the last warning, credentials reloaded
+func (cm *CertMonitor) Reset() {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	cm.warned = time.Time{}
+}
+
+// readiness checks of credentials, apns connections and queue source.
+// probes are unauthenticated, errors with path or dsn are logged, not returned.
+func NewReadiness(e *EnvInfo, timeout, cache time.Duration) *lib.Readiness {
+	readiness := lib.NewReadiness(timeout, cache)
+
+	readiness.Add(lib.NewHealthCheck("credentials", func(ctx context.Context) (string, error) {
+		creds := e.GetCredentials()
+		_, err := GetCerts(creds.Path, creds.Password)
+		if err != nil {
+			e.GetLogger().Println("Readiness credentials load " + creds.Path + " error: " + err.Error())
+			return "", errors.New("Load cert.path error, see log.")
+		}
+		return "certificate loaded", nil
+	}))
+
+	//not ready only when expired, warnings in detail and logs
+	readiness.Add(lib.NewHealthCheck("cert_expiry", func(ctx context.Context) (string, error) {
+		info := e.GetCertInfo()
+		if info == nil {
+			return "no certificate", nil
+		}
+		days := info.DaysToExpiry(time.Now())
+		detail := strconv.Itoa(int(math.Floor(days))) + " days to expiry at " + info.NotAfter.Format(time.RFC3339) + ", " + lib.CertExpiryLevel(days, e.CertWarningDays, e.CertCriticalDays)
+		if days <= 0 {
+			return detail, errors.New("Cert expired.")
+		}
+		return detail, nil
+	}))
+
+	//ping a healthy connection, no notification sent
+	readiness.Add(lib.NewHealthCheck("apns", func(ctx context.Context) (string, error) {
+		var healthy []*lib.StreamConn
+		for _, conn := range e.Connections.Connections() {
+			if e.Connections.GetStatus(conn) == lib.STREAM_STATUS_HEALTHY && conn.Conn.(*Connection).Usable() {
+				healthy = append(healthy, conn)
+			}
+		}
+		detail := strconv.Itoa(len(healthy)) + " of " + strconv.Itoa(e.Connections.Len()) + " connections healthy"
+		if len(healthy) == 0 {
+			return detail, errors.New("No healthy apns connection.")
+		}
+
+		err := healthy[0].Conn.(*Connection).PingContext(ctx)
+		if err != nil {
+			return detail, errors.New("Ping connection_" + strconv.Itoa(healthy[0].ID) + " error: " + err.Error())
+		}
+		return detail, nil
+	}))
+
+	readiness.Add(lib.NewHealthCheck("queue_source", func(ctx context.Context) (string, error) {
+		qsConfig := e.GetQueueSourceConfig()
+		_, err := lib.PingQueueSource(ctx, qsConfig)
+		if err != nil {
+			e.GetLogger().Println("Readiness queue_source error: " + err.Error())
+			return "", errors.New("Queue source " + qsConfig.Method + " unreachable, see log.")
+		}
+		return qsConfig.Method + " reachable", nil
+	}))
+
+	return readiness
+}
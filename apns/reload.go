@@ -0,0 +1,99 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package apns
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/go-ini/ini"
+
+	"zooinit/config"
+)
+
+const (
+	RELOAD_CREDENTIALS = "credentials"
+	RELOAD_QUEUE_SOURCE = "queue_source"
+)
+
+// Re-read credentials and queue source of config file, validate and swap them.
+// connections are replaced by ones of new credentials, old ones closed after in-flight pushes done.
+// other config needs a restart. nothing changed if error.
+func (e *EnvInfo) Reload() ([]string, error) {
+	e.reloadLock.Lock()
+	defer e.reloadLock.Unlock()
+
+	if e.configFile == "" {
+		return nil, errors.New("Config file unknown, can not reload.")
+	}
+
+	//a bad file should not exit by config.GetConfigInstance
+	_, err := ini.Load(e.configFile)
+	if err != nil {
+		return nil, errors.New("Load config " + e.configFile + " error: " + err.Error())
+	}
+	//same path of bootstrap, work.dir resolved as NewEnvInfo
+	iniobj := config.GetConfigInstance(e.configFile)
+	sec := iniobj.Section(CONFIG_SECTION)
+
+	creds, err := NewCredentials(sec, e.cliContext)
+	if err != nil {
+		return nil, err
+	}
+
+	qsConfig, err := NewQueueSourceConfig(sec, e.cliContext)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := []string{}
+	credsChanged := !creds.Equal(e.GetCredentials())
+	if credsChanged {
+		//apns must accept the new certificate before swap
+		conn, err := DialConnection(creds)
+		if err != nil {
+			return nil, errors.New("Dial apns with " + creds.Path + " error: " + err.Error())
+		}
+		conn.Close()
+
+		changed = append(changed, RELOAD_CREDENTIALS)
+	}
+	if *qsConfig != *e.GetQueueSourceConfig() {
+		changed = append(changed, RELOAD_QUEUE_SOURCE)
+	}
+
+	e.configLock.Lock()
+	e.credentials = creds
+	e.QueueSourceConfig = qsConfig
+	e.configLock.Unlock()
+
+	if credsChanged && e.Connections != nil {
+		RotateConnections("reload")
+	}
+	//expiry of new cert warned now, not a day after the old one
+	if credsChanged && e.CertMonitor != nil {
+		e.CertMonitor.Reset()
+		e.CertMonitor.Check()
+	}
+
+	return changed, nil
+}
+
+// reload on SIGHUP, this is a goroutine run
+func WatchReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		env.GetLogger().Println("Receive SIGHUP, reloading config " + env.configFile)
+
+		changed, err := env.Reload()
+		if err != nil {
+			env.GetLogger().Println("Reload error: " + err.Error())
+			continue
+		}
+		env.GetLogger().Println("Reload done, changed: [" + strings.Join(changed, ",") + "]")
+	}
+}
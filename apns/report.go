@@ -0,0 +1,66 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package apns
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"zooinit/config"
+
+	"github.com/codegangsta/cli"
+
+	"gopush/lib"
+)
+
+// Export delivery report of a push-id from delivery records, same as /api/v1/report/export.
+// Usage: gopush report -f config.ini --push-id id [--format csv] [--output report.csv]
+func Report(c *cli.Context) {
+	fname := config.GetConfigFileName(c.String("config"))
+	iniobj := config.GetConfigInstance(fname)
+	sec := iniobj.Section(CONFIG_SECTION)
+
+	pushID := c.String("push-id")
+	if pushID == "" {
+		log.Fatalln("Param push-id is required.")
+	}
+
+	format := c.String("format")
+	if format != lib.REPORT_FORMAT_JSON && format != lib.REPORT_FORMAT_CSV {
+		log.Fatalln("Param format must be json or csv: " + format)
+	}
+
+	path := config.GetValueString("delivery.path", sec, c)
+	if path == "" {
+		log.Fatalln("Config of delivery.path is empty.")
+	}
+
+	//task unknown out of server, all days kept
+	report, err := lib.ReadDeliveryReport(path, pushID, time.Time{}, time.Time{})
+	if err != nil {
+		log.Fatalln("Report error: " + err.Error())
+	}
+
+	var out io.Writer = os.Stdout
+	if c.String("output") != "" {
+		file, err := os.Create(c.String("output"))
+		if err != nil {
+			log.Fatalln("Create output error: " + err.Error())
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if format == lib.REPORT_FORMAT_CSV {
+		err = report.WriteCsv(out)
+	} else {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	}
+	if err != nil {
+		log.Fatalln("Write report error: " + err.Error())
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package apns
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// flush buffered records of delivery sink and result sinks on SIGINT or SIGTERM and exit, this is a goroutine run
+func WatchShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	env.GetLogger().Println("Receive " + sig.String() + ", flushing delivery records and result sinks...")
+
+	if sink := env.GetDeliverySink(); sink != nil {
+		sink.Close()
+	}
+	//buffered batches written, webhook and mysql may take their timeout
+	if sinks := env.GetResultSinks(); sinks != nil {
+		err := sinks.Close()
+		if err != nil {
+			env.GetLogger().Println(err.Error())
+		}
+	}
+
+	env.GetLogger().Println("Shutdown done.")
+	env.Logger.Sync()
+	os.Exit(0)
+}
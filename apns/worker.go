@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 	"strconv"
 
@@ -21,8 +22,8 @@ const(
 	WORKER_ENV_PRODUCTION="production"
 )
 
+// worker is an in-flight slot, pushes are multiplexed on env.Connections
 type Worker struct {
-	Client          *apns.Client
 	Status          int
 	WorkerID        int
 
@@ -39,32 +40,35 @@ type Worker struct {
 
 	//worker's uuid identify
 	UUID            string
+
+	//connection of last push, for status
+	conn            *lib.StreamConn
+	//Status and conn, Lock is held while pushing
+	statusLock      sync.RWMutex
+
+	//Run goroutine started and not stopped
+	running         bool
+	//atomic
+	pushes          int64
 }
 
 
 // create new worker
 func NewWorker(env *EnvInfo) (*Worker, error) {
-	cert, err := GetCerts(env.CertPath, env.CertPassword)
-	if err != nil {
-		return nil, err
+	if env.Connections == nil {
+		return nil, errors.New("No apns connections to create worker.")
 	}
 
-	client := apns.NewClient(cert)
-	if env.CertENV==WORKER_ENV_PRODUCTION {
-		client.Production()
-	}else if env.CertENV==WORKER_ENV_DEVELOPMENT {
-		client.Development()
-	}else{
-		return nil, errors.New("Unsupport worker environment: "+env.CertENV)
-	}
-
-	worker := &Worker{Client:client, Status:lib.WORKER_STATUS_SPARE, PushChannel:make(chan *lib.WorkerRequeset), ResponseChannel:make(chan *lib.WorkerResponse), UUID:uuid.NewV4().String()}
+	worker := &Worker{Status:lib.WORKER_STATUS_SPARE, PushChannel:make(chan *lib.WorkerRequeset), ResponseChannel:make(chan *lib.WorkerResponse), UUID:uuid.NewV4().String()}
 
 	return worker, nil
 }
 
 // this is a goroutine run
 func (w *Worker) Run() {
+	w.Lock.Lock()
+	w.running = true
+	w.Lock.Unlock()
 	env.GetLogger().Println(w.GetWorkerName() + " started, wait for push task...")
 
 	ForLoop:
@@ -74,6 +78,9 @@ func (w *Worker) Run() {
 		case request := <-w.PushChannel:
 			if request == nil || request.Cmd == lib.WORKER_COMMAND_STOP {
 				env.GetLogger().Println(w.GetWorkerName() + " receive Stop channel signal, will stop running.")
+				w.Lock.Lock()
+				w.running = false
+				w.Lock.Unlock()
 				w.ResponseChannel <- &lib.WorkerResponse{}
 				break ForLoop
 			}else {
@@ -100,15 +107,58 @@ func (w *Worker) Stop() {
 func (w *Worker) Subscribe(task *lib.Task) {
 	env.GetLogger().Println(w.GetWorkerName() + " started to Subscribe...")
 	for {
-		DeviceToken, more := <-task.GetList().Channel
+		Device, more := <-task.GetList().Channel
 		if more {
-			request := lib.NewWorkerRequeset(task.GetMessage(), DeviceToken, lib.WORKER_COMMAND_SEND)
+			msg := task.GetDeviceMessage(Device)
+
+			//cross task pushes per device, before throttle to not waste rate
+			fc := env.GetFrequencyCap()
+			capped := fc != nil && fc.Applies(msg.GetCategory())
+			if capped {
+				allowed, err := fc.Allow(Device.Token)
+				if err != nil {
+					env.GetLogger().Println(w.GetWorkerName() + " frequency cap persist error: " + err.Error())
+				}
+				if !allowed {
+					task.RecordCapped(Device)
+					continue
+				}
+			}
+
+			//global and task push rate
+			if !env.GetThrottle().Wait(task) {
+				task.RecordNotSent(Device)
+				if capped {
+					fc.Cancel(Device.Token)
+				}
+				continue
+			}
+
+			Device.Attempts++
+			request := lib.NewWorkerRequeset(msg.Localize(Device.Locale), Device.Token, lib.WORKER_COMMAND_SEND)
 			//for debug usage
-			//env.GetLogger().Println(w.GetWorkerName() + " fetch Device: "+DeviceToken)
+			//env.GetLogger().Println(w.GetWorkerName() + " fetch Device: "+Device.Token)
+			//autoscale in-flight limit of pool
+			w.Pool.AcquireSlot()
+			//sampled device push span
+			var span *lib.Span
+			if env.GetTracer().Sampled() {
+				span = task.GetTrace().Child("Worker.Push")
+			}
 			w.PushChannel <- request
 
 			//finish
-			<-w.ResponseChannel
+			resp := <-w.ResponseChannel
+			w.Pool.ReleaseSlot()
+			w.Pool.RecordPush(resp)
+			task.Record(Device, msg.ResolveLocale(Device.Locale), resp)
+			w.recordDelivery(task, Device, resp)
+			w.tracePush(span, Device, resp)
+
+			//not delivered, not counted
+			if capped && (resp.Error != nil || !resp.Sent) {
+				fc.Cancel(Device.Token)
+			}
 		}else {
 			break
 		}
@@ -123,7 +173,6 @@ func (w *Worker) Push(msg lib.MessageInterface, Device string) (*lib.WorkerRespo
 	msgLocal.DeviceToken = Device
 	msgLocal.ApnsID = msg.GetUuid()
 	msgLocal.Priority = 10
-	msgLocal.Topic = env.CertTopic
 	load := payload.NewPayload()
 
 	load.Badge(1)
@@ -143,17 +192,36 @@ func (w *Worker) Push(msg lib.MessageInterface, Device string) (*lib.WorkerRespo
 	msgLocal.Payload = load
 
 	// working now
-	w.Status = lib.WORKER_STATUS_RUNNING
+	w.setStatus(lib.WORKER_STATUS_RUNNING, nil)
 
 	env.GetLogger().Println(w.GetWorkerName() + " #start# to push for DeviceToken: " + msgLocal.DeviceToken)
 	start := time.Now().UnixNano()
 
-	resp, err := w.Client.Push(msgLocal)
+	//one stream of a shared connection
+	conn, err := env.Connections.Acquire(CONNECTION_ACQUIRE_TIMEOUT)
+	if err != nil {
+		w.setStatus(lib.WORKER_STATUS_SPARE, nil)
+
+		errMsg := w.GetWorkerName() + " Error while worker.Push():" + err.Error()
+		env.GetLogger().Println(errMsg)
+		w.Pool.GetFailLogger().Println(w.GetWorkerName() + " " + msgLocal.DeviceToken)
+		return &lib.WorkerResponse{Response:nil, Device:Device, Latency:time.Duration(time.Now().UnixNano() - start), Error:errors.New(errMsg)}
+	}
+	w.setStatus(lib.WORKER_STATUS_RUNNING, conn)
+	//topic of the certificate this connection dialed with, not of a reload since
+	topic := conn.Conn.(*Connection).Credentials.Topic
+	msgLocal.Topic = topic
+	atomic.AddInt64(&w.pushes, 1)
+	resp, err := conn.Conn.(*Connection).Client.Push(msgLocal)
+	env.Connections.Release(conn)
 	if err != nil {
+		w.setStatus(lib.WORKER_STATUS_SPARE, nil)
+		MarkConnectionUnhealthy(conn, "push error: " + err.Error())
+
 		errMsg := w.GetWorkerName() + " Error while worker.Push():" + err.Error()
 		env.GetLogger().Println(errMsg)
 		w.Pool.GetFailLogger().Println(w.GetWorkerName() + " " + msgLocal.DeviceToken)
-		return &lib.WorkerResponse{Response:nil, Error:errors.New(errMsg)}
+		return &lib.WorkerResponse{Response:nil, Device:Device, Latency:time.Duration(time.Now().UnixNano() - start), Topic:topic, Error:errors.New(errMsg)}
 	}
 
 	//in us
@@ -167,12 +235,63 @@ func (w *Worker) Push(msg lib.MessageInterface, Device string) (*lib.WorkerRespo
 		w.Pool.GetFailLogger().Println(w.GetWorkerName() + " " + msgLocal.DeviceToken + " -> " + strconv.Itoa(resp.StatusCode) + " -> " + resp.Reason + " -> " + strconv.Itoa(int(timeSpent)) + "us -> " + resp.Timestamp.Format(time.RFC3339))
 	}
 
-	w.Status = lib.WORKER_STATUS_SPARE
+	w.setStatus(lib.WORKER_STATUS_SPARE, nil)
 
-	return &lib.WorkerResponse{Response:resp, Error:err}
+	return &lib.WorkerResponse{Response:resp, Device:Device, Sent:resp.Sent(), Reason:resp.Reason, StatusCode:resp.StatusCode,
+		ApnsID:resp.ApnsID, Latency:time.Duration(timeSpent) * time.Microsecond, Topic:topic, Error:err}
+}
+
+// finish span of a push, nil if not sampled
+func (w *Worker) tracePush(span *lib.Span, Device *lib.Device, resp *lib.WorkerResponse) {
+	if span == nil {
+		return
+	}
+
+	span.SetAttribute("worker", w.GetWorkerName())
+	span.SetAttribute("token", Device.Token)
+	span.SetAttribute("attempt", Device.Attempts)
+	span.SetAttribute("status_code", resp.StatusCode)
+	span.SetAttribute("apns_id", resp.ApnsID)
+	if resp.Error == nil && !resp.Sent {
+		span.SetAttribute("reason", resp.Reason)
+		span.SetError(errors.New(resp.Reason))
+	} else {
+		span.SetError(resp.Error)
+	}
+	span.Finish()
+}
+
+// structured record of a push attempt, push-id is the task push-id
+// result sinks drop records when buffer full, a down sink never slows pushes.
+func (w *Worker) recordDelivery(task *lib.Task, Device *lib.Device, resp *lib.WorkerResponse) {
+	sink := env.GetDeliverySink()
+	sinks := env.GetResultSinks()
+	if sink == nil && sinks == nil {
+		return
+	}
+
+	topic := resp.Topic
+	if topic == "" {
+		topic = env.GetCredentials().Topic
+	}
+	record := lib.NewDeliveryRecord(task.GetMessage().GetUuid(), topic, env.GetTokenValidator().GetProvider(), w.GetWorkerName(), Device, resp)
+	if sink != nil {
+		err := sink.Write(record)
+		if err != nil {
+			env.GetLogger().Println(w.GetWorkerName() + " delivery record error: " + err.Error())
+		}
+	}
+	if sinks != nil {
+		sinks.Put(record)
+	}
 }
 
 func (w *Worker) GetWorkerName() (string) {
+	//harvested
+	if w.Pool == nil {
+		return "worker_" + w.UUID
+	}
+
 	return w.Pool.GetPoolName() + "_worker_" + strconv.Itoa(w.WorkerID)
 }
 
@@ -192,13 +311,64 @@ func (w *Worker) SetPool(pool *lib.Pool) (bool) {
 	return true
 }
 
+// stop Run goroutine and drop the connection reference
+// connections are shared by workers, closed only by health check reconnect.
 func (w *Worker) Destroy() (error) {
+	if w.GetStatus() == lib.WORKER_STATUS_RUNNING {
+		return errors.New(w.GetWorkerName() + " is pushing, can not be destroyed.")
+	}
+
+	w.Lock.Lock()
+	running := w.running
+	w.Lock.Unlock()
+	if running {
+		w.Stop()
+	}
+
+	w.Lock.Lock()
+	defer w.Lock.Unlock()
+
+	w.statusLock.Lock()
+	w.conn = nil
+	w.Status = lib.WORKER_STATUS_DESTROYED
+	w.statusLock.Unlock()
+	w.Pool = nil
+	env.GetLogger().Println(w.GetWorkerName() + " destroyed after " + strconv.FormatInt(w.GetPushes(), 10) + " pushes.")
 
 	return nil
 }
 
+func (w *Worker) GetPushes() int64 {
+	return atomic.LoadInt64(&w.pushes)
+}
+
+// conn nil to keep the connection of last push
+func (w *Worker) setStatus(status int, conn *lib.StreamConn) {
+	w.statusLock.Lock()
+	defer w.statusLock.Unlock()
+
+	w.Status = status
+	if conn != nil {
+		w.conn = conn
+	}
+}
+
+// spare worker reports status of its connection
 func (w *Worker) GetStatus() int {
-	return w.Status
+	w.statusLock.RLock()
+	status, conn := w.Status, w.conn
+	w.statusLock.RUnlock()
+
+	if status == lib.WORKER_STATUS_SPARE && conn != nil {
+		switch env.Connections.GetStatus(conn) {
+		case lib.STREAM_STATUS_UNHEALTHY:
+			return lib.WORKER_STATUS_UNHEALTHY
+		case lib.STREAM_STATUS_RECONNECTING:
+			return lib.WORKER_STATUS_RECONNECTING
+		}
+	}
+
+	return status
 }
 
 func (w *Worker) GetUUID() string {
@@ -0,0 +1,239 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//send to specified devices, batch, device registry
+	API_SCOPE_SEND = "send"
+	//send to a queue or default all users, rollout
+	API_SCOPE_BROADCAST = "broadcast"
+	//task and pool control
+	API_SCOPE_ADMIN = "admin"
+	//read only stats and reports
+	API_SCOPE_STATS = "stats"
+
+	//max clock skew of signed request
+	API_SIGNATURE_MAX_SKEW = 5 * time.Minute
+	//expired signatures of replay cache purged at most every interval
+	API_SIGNATURE_PURGE_INTERVAL = time.Minute
+
+	API_SCOPE_SEPARATOR = ","
+
+	//api.auth config, off only allowed without clients, admin api never served without authentication
+	API_AUTH_ON = "on"
+	API_AUTH_OFF = "off"
+)
+
+var (
+	apiScopes = []string{API_SCOPE_SEND, API_SCOPE_BROADCAST, API_SCOPE_ADMIN, API_SCOPE_STATS}
+)
+
+// An API caller, authenticated by api key or HMAC signature of secret
+type ApiClient struct {
+	Name   string `json:"name"`
+
+	//X-Api-Key header value
+	Key    string `json:"key"`
+
+	//HMAC-SHA256 signature secret
+	Secret string `json:"secret"`
+
+	Scopes []string `json:"scopes"`
+
+	//client limits, inline json fields
+	Limits
+}
+
+func (c *ApiClient) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// API clients from config sections or json key store file
+type ApiKeyStore struct {
+	clients  map[string]*ApiClient
+
+	lock     sync.RWMutex
+
+	//signatures accepted within skew window -> expire time, a signature is accepted once
+	seen     map[string]time.Time
+	purged   time.Time
+	seenLock sync.Mutex
+}
+
+func NewApiKeyStore() *ApiKeyStore {
+	return &ApiKeyStore{clients:make(map[string]*ApiClient), seen:make(map[string]time.Time), purged:time.Now()}
+}
+
+// json key store file, array of ApiClient
+func (ks *ApiKeyStore) LoadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New("ApiKeyStore.LoadFile(): " + err.Error())
+	}
+
+	var clients []*ApiClient
+	err = json.Unmarshal(content, &clients)
+	if err != nil {
+		return errors.New("ApiKeyStore.LoadFile() json parse failed: " + err.Error())
+	}
+
+	for _, client := range clients {
+		err = ks.Add(client)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ks *ApiKeyStore) Add(client *ApiClient) error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	if client == nil || client.Name == "" {
+		return errors.New("ApiKeyStore.Add(): client name is empty.")
+	}
+	if client.Key == "" && client.Secret == "" {
+		return errors.New("ApiKeyStore.Add(): client " + client.Name + " need key or secret.")
+	}
+	if _, ok := ks.clients[client.Name]; ok {
+		return errors.New("ApiKeyStore.Add(): client " + client.Name + " duplicated.")
+	}
+
+	for _, scope := range client.Scopes {
+		valid := false
+		for _, s := range apiScopes {
+			if s == scope {
+				valid = true
+			}
+		}
+		if !valid {
+			return errors.New("ApiKeyStore.Add(): client " + client.Name + " unsupport scope: " + scope)
+		}
+	}
+
+	ks.clients[client.Name] = client
+	return nil
+}
+
+// no client means authentication disabled
+func (ks *ApiKeyStore) Len() int {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+
+	return len(ks.clients)
+}
+
+func (ks *ApiKeyStore) AuthenticateKey(key string) (*ApiClient, error) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+
+	if key != "" {
+		for _, client := range ks.clients {
+			if client.Key != "" && hmac.Equal([]byte(client.Key), []byte(key)) {
+				return client, nil
+			}
+		}
+	}
+
+	return nil, errors.New("Invalid api key.")
+}
+
+// verify HMAC-SHA256 signature of ApiSignaturePayload()
+func (ks *ApiKeyStore) AuthenticateSignature(name, timestamp, signature, method, path string, body []byte) (*ApiClient, error) {
+	ks.lock.RLock()
+	client, ok := ks.clients[name]
+	ks.lock.RUnlock()
+
+	if !ok || client.Secret == "" {
+		return nil, errors.New("Invalid api client: " + name)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid signature timestamp: " + timestamp)
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > API_SIGNATURE_MAX_SKEW || skew < -API_SIGNATURE_MAX_SKEW {
+		return nil, errors.New("Signature timestamp expired: " + timestamp)
+	}
+
+	expected := ApiSignature(client.Secret, ApiSignaturePayload(method, path, timestamp, body))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return nil, errors.New("Invalid signature of client: " + name)
+	}
+
+	//captured request replayed within skew window
+	if !ks.markSeen(name + ":" + expected, time.Unix(unix, 0).Add(API_SIGNATURE_MAX_SKEW)) {
+		return nil, errors.New("Signature already used of client: " + name)
+	}
+
+	return client, nil
+}
+
+// false if signature seen before expire
+func (ks *ApiKeyStore) markSeen(key string, expire time.Time) bool {
+	ks.seenLock.Lock()
+	defer ks.seenLock.Unlock()
+
+	now := time.Now()
+	if now.Sub(ks.purged) >= API_SIGNATURE_PURGE_INTERVAL {
+		for seenKey, seenExpire := range ks.seen {
+			if now.After(seenExpire) {
+				delete(ks.seen, seenKey)
+			}
+		}
+		ks.purged = now
+	}
+
+	if seenExpire, ok := ks.seen[key]; ok && !now.After(seenExpire) {
+		return false
+	}
+	ks.seen[key] = expire
+
+	return true
+}
+
+// method \n path \n timestamp \n hex(sha256(body))
+func ApiSignaturePayload(method, path, timestamp string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return method + "\n" + path + "\n" + timestamp + "\n" + hex.EncodeToString(sum[:])
+}
+
+// hex(hmac-sha256(secret, payload))
+func ApiSignature(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func ParseApiScopes(str string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(str, API_SCOPE_SEPARATOR) {
+		scope = strings.TrimSpace(scope)
+		if scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return scopes
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestApiKeyStoreTesting(t *testing.T) {
+	store := NewApiKeyStore()
+	err := store.Add(&ApiClient{Name:"ops", Key:"key-ops", Secret:"secret-ops", Scopes:ParseApiScopes("send, stats")})
+	if err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+	if store.Add(&ApiClient{Name:"bad", Key:"key", Scopes:[]string{"root"}}) == nil {
+		t.Error("Add() unsupport scope should fail")
+	}
+
+	client, err := store.AuthenticateKey("key-ops")
+	if err != nil || client.Name != "ops" {
+		t.Fatalf("AuthenticateKey() error: %v", err)
+	}
+	if !client.HasScope(API_SCOPE_STATS) || client.HasScope(API_SCOPE_BROADCAST) {
+		t.Errorf("HasScope() error: %v", client.Scopes)
+	}
+	if _, err = store.AuthenticateKey("key-bad"); err == nil {
+		t.Error("AuthenticateKey() invalid key should fail")
+	}
+
+	body := []byte(`{"message": {"title": "t", "body": "b"}}`)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := ApiSignature("secret-ops", ApiSignaturePayload("POST", "/api/v2/send", timestamp, body))
+
+	_, err = store.AuthenticateSignature("ops", timestamp, signature, "POST", "/api/v2/send", body)
+	if err != nil {
+		t.Errorf("AuthenticateSignature() error: %v", err)
+	}
+	_, err = store.AuthenticateSignature("ops", timestamp, signature, "POST", "/api/v2/send", []byte("{}"))
+	if err == nil {
+		t.Error("AuthenticateSignature() changed body should fail")
+	}
+	_, err = store.AuthenticateSignature("ops", timestamp, signature, "POST", "/api/v2/send", body)
+	if err == nil {
+		t.Error("AuthenticateSignature() replayed signature should fail")
+	}
+
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	signature = ApiSignature("secret-ops", ApiSignaturePayload("POST", "/api/v2/send", expired, body))
+	_, err = store.AuthenticateSignature("ops", expired, signature, "POST", "/api/v2/send", body)
+	if err == nil {
+		t.Error("AuthenticateSignature() expired timestamp should fail")
+	}
+}
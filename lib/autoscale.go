@@ -0,0 +1,167 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//default decision interval
+	AUTOSCALE_DEFAULT_INTERVAL = 5 * time.Second
+
+	//shrink when errors of window above this rate
+	AUTOSCALE_ERROR_RATE = 0.05
+	//shrink when average latency above baseline multiple
+	AUTOSCALE_LATENCY_FACTOR = 2.0
+	//grow again only if throughput not dropped below this multiple of last window
+	AUTOSCALE_THROUGHPUT_FACTOR = 0.9
+
+	AUTOSCALE_ACTION_GROW = "grow"
+	AUTOSCALE_ACTION_SHRINK = "shrink"
+	AUTOSCALE_ACTION_HOLD = "hold"
+)
+
+// Push results of a pool in a window
+type PoolWindow struct {
+	Pushes    int
+	//connection or request errors
+	Errors    int
+	//provider 429 too many requests
+	Throttled int
+	Latency   time.Duration
+
+	Start     time.Time
+}
+
+// Push results recorded by workers of a sending pool
+type PoolMetrics struct {
+	window PoolWindow
+	lock   sync.Mutex
+}
+
+func NewPoolMetrics() *PoolMetrics {
+	return &PoolMetrics{window:PoolWindow{Start:time.Now()}}
+}
+
+func (m *PoolMetrics) Record(resp *WorkerResponse) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.window.Pushes++
+	if resp == nil {
+		return
+	}
+	if resp.Error != nil {
+		m.window.Errors++
+	} else if resp.StatusCode == http.StatusTooManyRequests {
+		m.window.Throttled++
+	}
+	m.window.Latency += resp.Latency
+}
+
+// window snapshot and start a new window
+func (m *PoolMetrics) Reset() PoolWindow {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	window := m.window
+	m.window = PoolWindow{Start:time.Now()}
+
+	return window
+}
+
+// pushes per second of window
+func (m PoolWindow) Throughput(end time.Time) float64 {
+	seconds := end.Sub(m.Start).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+
+	return float64(m.Pushes) / seconds
+}
+
+func (m PoolWindow) AvgLatency() time.Duration {
+	if m.Pushes <= 0 {
+		return 0
+	}
+
+	return m.Latency / time.Duration(m.Pushes)
+}
+
+func (m PoolWindow) ErrorRate() float64 {
+	if m.Pushes <= 0 {
+		return 0
+	}
+
+	return float64(m.Errors + m.Throttled) / float64(m.Pushes)
+}
+
+// Adaptive worker count of a sending pool by latency, throughput and error rate.
+// workers stay in [MiniSpare, Capacity], grow at most MaxSpare a step.
+type AutoScaler struct {
+	config         *PoolConfig
+
+	//lowest average latency observed, healthy latency
+	baseline       time.Duration
+	lastThroughput float64
+	lastAction     string
+}
+
+func NewAutoScaler(config *PoolConfig) *AutoScaler {
+	return &AutoScaler{config:config}
+}
+
+// decide new worker count by window, remaining is devices pending to send
+func (as *AutoScaler) Decide(current int, window PoolWindow, end time.Time, remaining int) (int, string, string) {
+	if window.Pushes <= 0 {
+		return current, AUTOSCALE_ACTION_HOLD, "no push in window"
+	}
+
+	throughput := window.Throughput(end)
+	latency := window.AvgLatency()
+	if as.baseline == 0 || latency < as.baseline {
+		as.baseline = latency
+	}
+
+	stats := "pushes:" + strconv.Itoa(window.Pushes) + " errors:" + strconv.Itoa(window.Errors) + " 429:" + strconv.Itoa(window.Throttled) +
+		" throughput:" + strconv.FormatFloat(throughput, 'f', 1, 64) + "/s latency:" + latency.String() + " baseline:" + as.baseline.String()
+
+	target, action := current, AUTOSCALE_ACTION_HOLD
+	if window.Throttled > 0 || window.ErrorRate() > AUTOSCALE_ERROR_RATE {
+		target, action = current - maxInt(1, current / 4), AUTOSCALE_ACTION_SHRINK
+	} else if as.baseline > 0 && float64(latency) > float64(as.baseline) * AUTOSCALE_LATENCY_FACTOR {
+		target, action = current - maxInt(1, current / 10), AUTOSCALE_ACTION_SHRINK
+	} else if remaining > current && (as.lastAction != AUTOSCALE_ACTION_GROW || throughput >= as.lastThroughput * AUTOSCALE_THROUGHPUT_FACTOR) {
+		step := maxInt(1, current / 2)
+		if as.config.MaxSpare > 0 && step > as.config.MaxSpare {
+			step = as.config.MaxSpare
+		}
+		target, action = current + step, AUTOSCALE_ACTION_GROW
+	}
+
+	if target < as.config.MiniSpare {
+		target = as.config.MiniSpare
+	}
+	if target > as.config.Capacity {
+		target = as.config.Capacity
+	}
+	if target == current {
+		action = AUTOSCALE_ACTION_HOLD
+	}
+
+	as.lastThroughput = throughput
+	as.lastAction = action
+
+	return target, action, stats
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
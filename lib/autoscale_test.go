@@ -0,0 +1,76 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAutoScaleTesting(t *testing.T) {
+	config, err := NewPoolConfig(4, 20, 2, 4)
+	if err != nil {
+		t.Fatalf("NewPoolConfig() error: %s", err.Error())
+	}
+	scaler := NewAutoScaler(config)
+	start := time.Now()
+	end := start.Add(time.Second)
+
+	metrics := NewPoolMetrics()
+	for iter := 0; iter < 100; iter++ {
+		metrics.Record(&WorkerResponse{Sent:true, StatusCode:http.StatusOK, Latency:10 * time.Millisecond})
+	}
+	window := metrics.Reset()
+	if window.Pushes != 100 || window.AvgLatency() != 10 * time.Millisecond || window.ErrorRate() != 0 {
+		t.Errorf("PoolMetrics window error: %+v", window)
+	}
+	window.Start = start
+
+	//healthy, grow limited by MaxSpare
+	target, action, _ := scaler.Decide(10, window, end, 1000)
+	if action != AUTOSCALE_ACTION_GROW || target != 14 {
+		t.Errorf("Decide() healthy expect grow to 14, got %s %d", action, target)
+	}
+
+	//healthy but near capacity
+	target, _, _ = scaler.Decide(18, window, end, 1000)
+	if target != 20 {
+		t.Errorf("Decide() expect capacity 20, got %d", target)
+	}
+
+	//nothing remaining, hold
+	target, action, _ = scaler.Decide(10, window, end, 5)
+	if action != AUTOSCALE_ACTION_HOLD || target != 10 {
+		t.Errorf("Decide() without remaining expect hold, got %s %d", action, target)
+	}
+
+	//429 shrink
+	throttled := window
+	throttled.Throttled = 1
+	target, action, _ = scaler.Decide(12, throttled, end, 1000)
+	if action != AUTOSCALE_ACTION_SHRINK || target != 9 {
+		t.Errorf("Decide() with 429 expect shrink to 9, got %s %d", action, target)
+	}
+
+	//errors shrink, not below MiniSpare
+	failed := window
+	failed.Errors = 50
+	target, action, _ = scaler.Decide(2, failed, end, 1000)
+	if target != 2 || action != AUTOSCALE_ACTION_HOLD {
+		t.Errorf("Decide() expect MiniSpare 2, got %s %d", action, target)
+	}
+
+	//latency above baseline
+	slow := window
+	slow.Latency = slow.Latency * 3
+	target, action, _ = scaler.Decide(10, slow, end, 1000)
+	if action != AUTOSCALE_ACTION_SHRINK || target != 9 {
+		t.Errorf("Decide() with slow latency expect shrink to 9, got %s %d", action, target)
+	}
+
+	//no push, hold
+	_, action, _ = scaler.Decide(10, PoolWindow{Start:start}, end, 1000)
+	if action != AUTOSCALE_ACTION_HOLD {
+		t.Errorf("Decide() without push expect hold, got %s", action)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"sync"
+)
+
+const (
+	BATCH_RESULT_PENDING = "pending"
+	BATCH_RESULT_SENT = "sent"
+	BATCH_RESULT_FAILED = "failed"
+)
+
+// One personalized push of a batch task, sent to a device or all devices of a user
+type BatchItem struct {
+	DeviceID string `json:"deviceid,omitempty"`
+	UserID   string `json:"userid,omitempty"`
+
+	//item own message, Uuid is the item push-id
+	Message  *Message `json:"message"`
+
+	//item resolve error, eg. user has no device
+	Error    string `json:"error,omitempty"`
+
+	//result of every resolved device
+	Results  []*BatchResult `json:"results"`
+
+	lock     sync.Mutex
+}
+
+type BatchResult struct {
+	DeviceID string `json:"deviceid"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+//add a pending device result
+func (item *BatchItem) addDevice(token string) {
+	item.lock.Lock()
+	defer item.lock.Unlock()
+
+	item.Results = append(item.Results, &BatchResult{DeviceID:token, Status:BATCH_RESULT_PENDING})
+}
+
+func (item *BatchItem) setError(err string) {
+	item.lock.Lock()
+	defer item.lock.Unlock()
+
+	item.Error = err
+}
+
+//record device push result
+func (item *BatchItem) Record(token string, resp *WorkerResponse) {
+	item.lock.Lock()
+	defer item.lock.Unlock()
+
+	for _, result := range item.Results {
+		if result.DeviceID != token || result.Status != BATCH_RESULT_PENDING {
+			continue
+		}
+
+		if resp != nil && resp.Error == nil && resp.Sent {
+			result.Status = BATCH_RESULT_SENT
+		} else {
+			result.Status = BATCH_RESULT_FAILED
+			if resp != nil && resp.Error != nil {
+				result.Reason = resp.Error.Error()
+			} else if resp != nil {
+				result.Reason = resp.Reason
+			}
+		}
+		break
+	}
+}
+
+//A copy for reading
+func (item *BatchItem) Snapshot() *BatchItem {
+	item.lock.Lock()
+	defer item.lock.Unlock()
+
+	snap := &BatchItem{DeviceID:item.DeviceID, UserID:item.UserID, Message:item.Message, Error:item.Error}
+	for _, result := range item.Results {
+		copied := *result
+		snap.Results = append(snap.Results, &copied)
+	}
+
+	return snap
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"testing"
+)
+
+func TestBatchItemsTesting(t *testing.T) {
+	token1 := "038a4c750809d70be26c7b8d9aaa5da32567147ddfb465ef6cf186c82e1a3461"
+	token2 := "038cdc3a81335cb2ebc670a115e026122f13803bc2fa59475d6b0ebd67d8f125"
+
+	registry, err := NewDeviceRegistry("")
+	if err != nil {
+		t.Fatalf("NewDeviceRegistry() error: %v", err)
+	}
+	registry.Register(token2, "zh-CN", "10086")
+
+	items := []*BatchItem{
+		{DeviceID:token1, Message:&Message{Title:"1", Body:"1", Uuid:"item-1"}},
+		{UserID:"10086", Message:&Message{Title:"2", Body:"2", Uuid:"item-2"}},
+		{UserID:"404", Message:&Message{Title:"3", Body:"3", Uuid:"item-3"}},
+		{DeviceID:"bad", Message:&Message{Title:"4", Body:"4", Uuid:"item-4"}},
+	}
+
+	q := NewQueue(nil)
+	q.AppendBatchItems(items, registry)
+	if q.Len() != 2 {
+		t.Fatalf("AppendBatchItems() devices error: %d", q.Len())
+	}
+	if items[2].Error == "" || items[3].Error == "" {
+		t.Errorf("AppendBatchItems() invalid items should be marked error: %v, %v", items[2], items[3])
+	}
+	if q.data[1].Locale != "zh-CN" || q.data[1].Item != items[1] {
+		t.Errorf("AppendBatchItems() user device error: %v", q.data[1])
+	}
+
+	task := &Task{list:q, message:&Message{Uuid:"batch"}, stats:NewTaskStats()}
+	if task.GetDeviceMessage(q.data[0]).GetUuid() != "item-1" {
+		t.Errorf("GetDeviceMessage() should use item message: %s", task.GetDeviceMessage(q.data[0]).GetUuid())
+	}
+
+	task.Record(q.data[0], "", &WorkerResponse{Sent:true})
+	task.Record(q.data[1], "", &WorkerResponse{Reason:"BadDeviceToken"})
+
+	results := task.GetBatchItems()
+	if results[0].Results[0].Status != BATCH_RESULT_SENT {
+		t.Errorf("Record() item 1 status error: %v", results[0].Results[0])
+	}
+	if results[1].Results[0].Status != BATCH_RESULT_FAILED || results[1].Results[0].Reason != "BadDeviceToken" {
+		t.Errorf("Record() item 2 status error: %v", results[1].Results[0])
+	}
+}
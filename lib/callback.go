@@ -0,0 +1,233 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	TASK_STATUS_WAITING = "waiting"
+	TASK_STATUS_SENDING = "sending"
+	TASK_STATUS_FINISHED = "finished"
+	//queue build failed, never sent
+	TASK_STATUS_FAILED = "failed"
+	//cancelled by admin while sending, see cancelled devices
+	TASK_STATUS_CANCELLED = "cancelled"
+
+	CALLBACK_DEFAULT_TIMEOUT = 10 * time.Second
+	CALLBACK_DEFAULT_RETRIES = 3
+	//wait before retry n is n * CALLBACK_RETRY_WAIT
+	CALLBACK_RETRY_WAIT = 2 * time.Second
+
+	CALLBACK_HEADER_TIMESTAMP = "X-Gopush-Timestamp"
+	//hex(hmac_sha256(callback.secret, timestamp\nbody))
+	CALLBACK_HEADER_SIGNATURE = "X-Gopush-Signature"
+)
+
+var (
+	//carrier grade nat, not covered by net.IP.IsPrivate()
+	callbackSharedNet = &net.IPNet{IP:net.IPv4(100, 64, 0, 0), Mask:net.CIDRMask(10, 32)}
+)
+
+// Completion callback body of a task
+type TaskSummary struct {
+	PushID   string `json:"push_id"`
+	Status   string `json:"status"`
+	//failure of task, eg. queue source error
+	Error    string `json:"error,omitempty"`
+
+	Total    int `json:"total"`
+	Success  int `json:"success"`
+	Fail     int `json:"fail"`
+	//skipped by frequency cap
+	Capped   int `json:"capped"`
+	//invalid devices skipped
+	Rejected int `json:"rejected"`
+	//devices not sent of cancel
+	Cancelled int `json:"cancelled"`
+	//failed devices by reason
+	Reasons  map[string]int `json:"reasons,omitempty"`
+
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished"`
+	//sending seconds, 0 if not sent
+	Duration float64 `json:"duration"`
+}
+
+// callback url must be absolute http or https
+func ValidateCallbackUrl(str string) error {
+	u, err := url.Parse(str)
+	if err != nil {
+		return errors.New("callback url parse error: " + err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback url must be http or https: " + str)
+	}
+
+	return nil
+}
+
+// POST signed task summary to callback url, retry on error or non 2xx.
+// without allowed hosts, callback urls must resolve to public addresses, checked again on dial.
+type CallbackSender struct {
+	Secret  string
+	Retries int
+
+	//host allowlist, eg. hooks.example.com or .example.com for subdomains, private addresses allowed then
+	hosts   []string
+	wait    time.Duration
+	client  *http.Client
+}
+
+func NewCallbackSender(secret string, timeout time.Duration, retries int, hosts []string) (*CallbackSender, error) {
+	if secret == "" {
+		return nil, errors.New("CallbackSender secret is required, callbacks are signed.")
+	}
+	if timeout <= 0 {
+		timeout = CALLBACK_DEFAULT_TIMEOUT
+	}
+	if retries < 0 {
+		retries = CALLBACK_DEFAULT_RETRIES
+	}
+
+	dialer := &net.Dialer{Timeout:timeout}
+	if len(hosts) == 0 {
+		//dns may change after CheckUrl
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+				return errors.New("callback address not public: " + address)
+			}
+			return nil
+		}
+	}
+	client := &http.Client{
+		Timeout:timeout,
+		//no proxy, dial checks the real address
+		Transport:&http.Transport{DialContext:dialer.DialContext},
+		//redirect may lead to a host not checked
+		CheckRedirect:func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return &CallbackSender{Secret:secret, Retries:retries, hosts:hosts, wait:CALLBACK_RETRY_WAIT, client:client}, nil
+}
+
+// public unicast address, not loopback, private, link-local, shared or unspecified
+func IsPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || callbackSharedNet.Contains(ip))
+}
+
+// check callback url of send request: allowed host, or resolved to public addresses only
+func (cs *CallbackSender) CheckUrl(str string) error {
+	err := ValidateCallbackUrl(str)
+	if err != nil {
+		return err
+	}
+	u, _ := url.Parse(str)
+	host := strings.ToLower(u.Hostname())
+
+	if len(cs.hosts) > 0 {
+		for _, allowed := range cs.hosts {
+			if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+				return nil
+			}
+		}
+		return errors.New("callback url host not allowed: " + host)
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return errors.New("callback url host lookup error: " + err.Error())
+		}
+	}
+	for _, ip := range ips {
+		if !IsPublicIP(ip) {
+			return errors.New("callback url host not public: " + host)
+		}
+	}
+
+	return nil
+}
+
+func ParseCallbackHosts(str string) []string {
+	var hosts []string
+	for _, host := range strings.Split(str, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
+// payload of signature, same to api signature: hex(hmac_sha256(secret, timestamp\nbody))
+func CallbackSignature(secret, timestamp string, body []byte) string {
+	return ApiSignature(secret, timestamp + "\n" + string(body))
+}
+
+// block until delivered or retries used up, return last error
+func (cs *CallbackSender) Send(callbackUrl string, summary *TaskSummary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return errors.New("CallbackSender.Send(): " + err.Error())
+	}
+
+	for attempt := 0; attempt <= cs.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * cs.wait)
+		}
+
+		err = cs.post(callbackUrl, body)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return errors.New("CallbackSender.Send() " + strconv.Itoa(cs.Retries + 1) + " attempts failed: " + err.Error())
+}
+
+func (cs *CallbackSender) post(callbackUrl string, body []byte) error {
+	req, err := http.NewRequest(HTTP_METHOD_POST, callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(CALLBACK_HEADER_TIMESTAMP, timestamp)
+	req.Header.Set(CALLBACK_HEADER_SIGNATURE, CallbackSignature(cs.Secret, timestamp, body))
+
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	//reuse connection
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("http status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCallbackSenderTesting(t *testing.T) {
+	if ValidateCallbackUrl("https://example.com/done") != nil {
+		t.Errorf("ValidateCallbackUrl() of https url should be valid")
+	}
+	if ValidateCallbackUrl("ftp://example.com") == nil || ValidateCallbackUrl("/done") == nil {
+		t.Errorf("ValidateCallbackUrl() of non http url should be error")
+	}
+
+	attempts := 0
+	var received *TaskSummary
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		//fail first attempt
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp := r.Header.Get(CALLBACK_HEADER_TIMESTAMP)
+		if r.Header.Get(CALLBACK_HEADER_SIGNATURE) != CallbackSignature("secret", timestamp, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		received = &TaskSummary{}
+		json.Unmarshal(body, received)
+	}))
+	defer server.Close()
+
+	if _, err := NewCallbackSender("", time.Second, 1, nil); err == nil {
+		t.Errorf("NewCallbackSender() without secret expect error")
+	}
+
+	//no allowlist, private addresses rejected on check and dial
+	public, _ := NewCallbackSender("secret", time.Second, 0, nil)
+	for _, callbackUrl := range []string{"http://169.254.169.254/latest/meta-data", "http://127.0.0.1:8080/api/v1/admin/reload", "http://10.0.0.1/", "http://[::1]/", "http://localhost/"} {
+		if public.CheckUrl(callbackUrl) == nil {
+			t.Errorf("CallbackSender.CheckUrl(%s) expect not public error", callbackUrl)
+		}
+	}
+	if public.CheckUrl("http://8.8.8.8/done") != nil {
+		t.Errorf("CallbackSender.CheckUrl() of public ip expect ok")
+	}
+	if public.Send(server.URL, &TaskSummary{PushID:"push0"}) == nil || attempts != 0 {
+		t.Errorf("CallbackSender.Send() to loopback expect dial error, got %d attempts", attempts)
+	}
+
+	sender, err := NewCallbackSender("secret", time.Second, 1, ParseCallbackHosts("127.0.0.1, .example.com"))
+	if err != nil {
+		t.Fatalf("NewCallbackSender() error: %v", err)
+	}
+	if sender.CheckUrl("https://hooks.example.com/done") != nil || sender.CheckUrl("https://example.org/done") == nil {
+		t.Errorf("CallbackSender.CheckUrl() expect allowlist only")
+	}
+	sender.wait = time.Millisecond
+	err = sender.Send(server.URL, &TaskSummary{PushID:"push1", Status:TASK_STATUS_FINISHED, Total:3})
+	if err != nil || attempts != 2 || received == nil || received.PushID != "push1" || received.Total != 3 {
+		t.Errorf("CallbackSender.Send() expect delivered on retry, got %d attempts %v", attempts, err)
+	}
+
+	attempts = 0
+	sender.Retries = 0
+	if sender.Send(server.URL, &TaskSummary{PushID:"push2"}) == nil || attempts != 1 {
+		t.Errorf("CallbackSender.Send() without retries expect error, got %d attempts", attempts)
+	}
+}
+
+func TestTaskSummaryTesting(t *testing.T) {
+	task := NewTask(NewQueueByCapacity(10, nil), &Message{Uuid:"push1"})
+	task.start()
+	task.Record(&Device{Token:"a"}, "", &WorkerResponse{Sent:true})
+	task.Record(&Device{Token:"b"}, "", &WorkerResponse{Reason:"Unregistered"})
+	task.Record(&Device{Token:"c"}, "", &WorkerResponse{Error:errors.New("broken")})
+
+	if !task.finish(nil) || task.finish(errors.New("late")) {
+		t.Errorf("Task.finish() should be done only once")
+	}
+	summary := task.Summary()
+	if summary.Status != TASK_STATUS_FINISHED || summary.Total != 3 || summary.Success != 1 || summary.Fail != 2 {
+		t.Errorf("Task.Summary() counts error: %+v", summary)
+	}
+	if summary.Reasons["Unregistered"] != 1 || summary.Reasons[REPORT_REASON_ERROR] != 1 || summary.Finished.IsZero() {
+		t.Errorf("Task.Summary() reasons error: %+v", summary)
+	}
+
+	failed := NewTask(NewQueueByCapacity(10, nil), &Message{Uuid:"push2"})
+	failed.finish(errors.New("queue source down"))
+	summary = failed.Summary()
+	if summary.Status != TASK_STATUS_FAILED || summary.Error != "queue source down" || summary.Duration != 0 {
+		t.Errorf("Task.Summary() of failed task error: %+v", summary)
+	}
+}
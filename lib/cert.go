@@ -0,0 +1,156 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CERT_ENV_PRODUCTION = "production"
+	CERT_ENV_DEVELOPMENT = "development"
+	//apns universal certificate, both production and development
+	CERT_ENV_UNIVERSAL = "universal"
+
+	CERT_EXPIRY_OK = "ok"
+	CERT_EXPIRY_WARNING = "warning"
+	CERT_EXPIRY_CRITICAL = "critical"
+	CERT_EXPIRY_EXPIRED = "expired"
+
+	CERT_DEFAULT_WARNING_DAYS = 30
+	CERT_DEFAULT_CRITICAL_DAYS = 7
+)
+
+var (
+	//apple push certificate extensions
+	oidApnsDevelopment = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}
+	oidApnsProduction = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 2}
+	oidApnsTopics = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 6}
+	//subject UID, bundle id of single topic certificate
+	oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+)
+
+// Info of a loaded push certificate
+type CertInfo struct {
+	Subject   string `json:"subject"`
+	//bundle id first, eg. com.app, com.app.voip
+	Topics    []string `json:"topics"`
+	//production, development, universal, empty if unknown
+	Env       string `json:"env"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// parse der of apns certificate, topics and env of apple extensions
+func ParseApnsCert(der []byte) (*CertInfo, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.New("Parse certificate error: " + err.Error())
+	}
+
+	info := &CertInfo{Subject:cert.Subject.CommonName, NotBefore:cert.NotBefore, NotAfter:cert.NotAfter}
+
+	var development, production bool
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidApnsDevelopment):
+			development = true
+		case ext.Id.Equal(oidApnsProduction):
+			production = true
+		case ext.Id.Equal(oidApnsTopics):
+			//sequence of topic, followed by sequence of its type, eg. app, voip
+			var values []asn1.RawValue
+			_, err := asn1.Unmarshal(ext.Value, &values)
+			if err != nil {
+				return nil, errors.New("Parse certificate topics error: " + err.Error())
+			}
+			for _, value := range values {
+				if value.Class == asn1.ClassUniversal && value.Tag == asn1.TagUTF8String {
+					info.Topics = append(info.Topics, string(value.Bytes))
+				}
+			}
+		}
+	}
+
+	if development && production {
+		info.Env = CERT_ENV_UNIVERSAL
+	} else if production {
+		info.Env = CERT_ENV_PRODUCTION
+	} else if development {
+		info.Env = CERT_ENV_DEVELOPMENT
+	}
+
+	if len(info.Topics) == 0 {
+		for _, name := range cert.Subject.Names {
+			if value, ok := name.Value.(string); ok && name.Type.Equal(oidUserID) {
+				info.Topics = append(info.Topics, value)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// error if certificate not usable for env or topic, unknown env or topics are not checked
+func (ci *CertInfo) Validate(env, topic string) error {
+	if ci.Env != "" && ci.Env != CERT_ENV_UNIVERSAL && ci.Env != env {
+		return errors.New("Certificate " + ci.Subject + " is for " + ci.Env + ", not " + env)
+	}
+
+	if len(ci.Topics) > 0 && !ci.HasTopic(topic) {
+		return errors.New("Certificate " + ci.Subject + " topics [" + strings.Join(ci.Topics, ",") + "] not include " + topic)
+	}
+
+	return nil
+}
+
+func (ci *CertInfo) HasTopic(topic string) bool {
+	for _, value := range ci.Topics {
+		if value == topic {
+			return true
+		}
+	}
+
+	return false
+}
+
+// days left at now, negative if expired
+func (ci *CertInfo) DaysToExpiry(now time.Time) float64 {
+	return ci.NotAfter.Sub(now).Hours() / 24
+}
+
+// expiry level of days left
+func CertExpiryLevel(days float64, warningDays, criticalDays int) string {
+	switch {
+	case days <= 0:
+		return CERT_EXPIRY_EXPIRED
+	case days <= float64(criticalDays):
+		return CERT_EXPIRY_CRITICAL
+	case days <= float64(warningDays):
+		return CERT_EXPIRY_WARNING
+	}
+
+	return CERT_EXPIRY_OK
+}
+
+// prometheus text format gauges of expiry
+func (ci *CertInfo) WriteMetrics(w io.Writer, now time.Time) {
+	topic := ""
+	if len(ci.Topics) > 0 {
+		topic = ci.Topics[0]
+	}
+	labels := "{topic=" + strconv.Quote(topic) + ",env=" + strconv.Quote(ci.Env) + "}"
+
+	fmt.Fprintln(w, "# HELP gopush_cert_expiry_days Days until the push certificate expires, negative if expired.")
+	fmt.Fprintln(w, "# TYPE gopush_cert_expiry_days gauge")
+	fmt.Fprintln(w, "gopush_cert_expiry_days" + labels + " " + strconv.FormatFloat(ci.DaysToExpiry(now), 'f', 2, 64))
+	fmt.Fprintln(w, "# HELP gopush_cert_not_after_seconds Unix time the push certificate expires.")
+	fmt.Fprintln(w, "# TYPE gopush_cert_not_after_seconds gauge")
+	fmt.Fprintln(w, "gopush_cert_not_after_seconds" + labels + " " + strconv.FormatInt(ci.NotAfter.Unix(), 10))
+}
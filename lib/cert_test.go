@@ -0,0 +1,104 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// self signed der with apple push extensions
+func newApnsTestCert(t *testing.T, uid string, notAfter time.Time, extensions []pkix.Extension) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:big.NewInt(1),
+		Subject:pkix.Name{CommonName:"Apple Push Services: " + uid, ExtraNames:[]pkix.AttributeTypeAndValue{{Type:oidUserID, Value:uid}}},
+		NotBefore:time.Now().Add(-time.Hour),
+		NotAfter:notAfter,
+		ExtraExtensions:extensions,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error: %v", err)
+	}
+
+	return der
+}
+
+func TestCertInfoTesting(t *testing.T) {
+	if _, err := ParseApnsCert([]byte("not a cert")); err == nil {
+		t.Errorf("ParseApnsCert() of bad der expect error")
+	}
+
+	utf8 := func(value string) asn1.RawValue {
+		return asn1.RawValue{Tag:asn1.TagUTF8String, Bytes:[]byte(value)}
+	}
+	topics, err := asn1.Marshal(struct {
+		App      asn1.RawValue
+		AppType  []asn1.RawValue
+		Voip     asn1.RawValue
+		VoipType []asn1.RawValue
+	}{utf8("com.app"), []asn1.RawValue{utf8("app")}, utf8("com.app.voip"), []asn1.RawValue{utf8("voip")}})
+	if err != nil {
+		t.Fatalf("asn1.Marshal() error: %v", err)
+	}
+	marker := []byte{0x05, 0x00}
+
+	universal := newApnsTestCert(t, "com.app", time.Now().Add(20 * 24 * time.Hour), []pkix.Extension{
+		{Id:oidApnsDevelopment, Value:marker}, {Id:oidApnsProduction, Value:marker}, {Id:oidApnsTopics, Value:topics}})
+	info, err := ParseApnsCert(universal)
+	if err != nil {
+		t.Fatalf("ParseApnsCert() error: %v", err)
+	}
+	if info.Env != CERT_ENV_UNIVERSAL || len(info.Topics) != 2 || info.Topics[1] != "com.app.voip" {
+		t.Errorf("ParseApnsCert() expect universal with 2 topics, got %s %v", info.Env, info.Topics)
+	}
+	if info.Validate(CERT_ENV_DEVELOPMENT, "com.app.voip") != nil {
+		t.Errorf("Validate() of universal cert and its topic expect ok")
+	}
+	if info.Validate(CERT_ENV_PRODUCTION, "com.other") == nil {
+		t.Errorf("Validate() of topic not in cert expect error")
+	}
+
+	//topic of subject UID without topics extension
+	production := newApnsTestCert(t, "com.prod", time.Now().Add(-time.Minute), []pkix.Extension{{Id:oidApnsProduction, Value:marker}})
+	info, err = ParseApnsCert(production)
+	if err != nil {
+		t.Fatalf("ParseApnsCert() error: %v", err)
+	}
+	if info.Env != CERT_ENV_PRODUCTION || len(info.Topics) != 1 || info.Topics[0] != "com.prod" {
+		t.Errorf("ParseApnsCert() expect production of subject uid, got %s %v", info.Env, info.Topics)
+	}
+	if info.Validate(CERT_ENV_DEVELOPMENT, "com.prod") == nil {
+		t.Errorf("Validate() of production cert for development expect error")
+	}
+	if info.DaysToExpiry(time.Now()) >= 0 {
+		t.Errorf("DaysToExpiry() of expired cert expect negative")
+	}
+
+	levels := map[float64]string{40:CERT_EXPIRY_OK, 20:CERT_EXPIRY_WARNING, 3:CERT_EXPIRY_CRITICAL, -1:CERT_EXPIRY_EXPIRED}
+	for days, level := range levels {
+		if got := CertExpiryLevel(days, 30, 7); got != level {
+			t.Errorf("CertExpiryLevel(%v) expect %s, got %s", days, level, got)
+		}
+	}
+
+	info = &CertInfo{Topics:[]string{"com.app"}, Env:CERT_ENV_PRODUCTION, NotAfter:time.Unix(1500000000, 0)}
+	buf := &bytes.Buffer{}
+	info.WriteMetrics(buf, time.Unix(1500000000, 0).Add(-36 * time.Hour))
+	if !strings.Contains(buf.String(), `gopush_cert_expiry_days{topic="com.app",env="production"} 1.50`) || !strings.Contains(buf.String(), " 1500000000\n") {
+		t.Errorf("WriteMetrics() expect expiry gauges, got %s", buf.String())
+	}
+}
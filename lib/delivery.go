@@ -0,0 +1,324 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"zooinit/log"
+)
+
+const (
+	DELIVERY_FORMAT_JSON = "json"
+	DELIVERY_FORMAT_CSV = "csv"
+	DELIVERY_FORMAT_BOTH = "both"
+
+	//provider accepted
+	DELIVERY_STATUS_SENT = "sent"
+	//provider rejected, see reason
+	DELIVERY_STATUS_FAILED = "failed"
+	//request error, eg. connection broken
+	DELIVERY_STATUS_ERROR = "error"
+
+	//daily file suffix, same rotation as pool logs
+	DELIVERY_FILE_DATE = "20060102"
+
+	//records buffered per file, flushed every interval and on close
+	DELIVERY_BUFFER_SIZE = 64 * 1024
+	DELIVERY_FLUSH_INTERVAL = time.Second
+
+	//days of files kept
+	DELIVERY_DEFAULT_RETENTION = 30
+)
+
+var deliveryCsvHeader = []string{"push_id", "app", "token", "provider", "status", "code", "reason", "apns_id", "latency_us", "attempt", "worker", "timestamp"}
+
+// One device push attempt
+type DeliveryRecord struct {
+	PushID    string `json:"push_id"`
+	//apns topic of app
+	App       string `json:"app"`
+	Token     string `json:"token"`
+	Provider  string `json:"provider"`
+	Status    string `json:"status"`
+	//provider http status, 0 if request error
+	Code      int `json:"code"`
+	Reason    string `json:"reason,omitempty"`
+	ApnsID    string `json:"apns_id,omitempty"`
+	//in us
+	Latency   int64 `json:"latency_us"`
+	//attempt of device within task, from 1
+	Attempt   int `json:"attempt"`
+	Worker    string `json:"worker"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// record of worker response, reason is the error if request failed
+func NewDeliveryRecord(pushID, app, provider, worker string, device *Device, resp *WorkerResponse) *DeliveryRecord {
+	record := &DeliveryRecord{PushID:pushID, App:app, Token:device.Token, Provider:provider, Attempt:device.Attempts,
+		Worker:worker, Timestamp:time.Now()}
+
+	record.Status = DELIVERY_STATUS_FAILED
+	if resp.Error != nil {
+		record.Status = DELIVERY_STATUS_ERROR
+		record.Reason = resp.Error.Error()
+	} else {
+		if resp.Sent {
+			record.Status = DELIVERY_STATUS_SENT
+		}
+		record.Reason = resp.Reason
+	}
+	record.Code = resp.StatusCode
+	record.ApnsID = resp.ApnsID
+	record.Latency = int64(resp.Latency / time.Microsecond)
+
+	return record
+}
+
+func (r *DeliveryRecord) csvRow() []string {
+	return []string{r.PushID, r.App, r.Token, r.Provider, r.Status, strconv.Itoa(r.Code), r.Reason, r.ApnsID,
+		strconv.FormatInt(r.Latency, 10), strconv.Itoa(r.Attempt), r.Worker, r.Timestamp.Format(time.RFC3339Nano)}
+}
+
+// Delivery records writer, one line per record, lines never interleave.
+// file of a day: path-20161010.jsonl and path-20161010.csv
+// writes are buffered, flushed every DELIVERY_FLUSH_INTERVAL, Close flushes the rest.
+type DeliverySink struct {
+	Format    string
+	//days of files kept, 0 for forever
+	Retention int
+
+	path    string
+	day     string
+	json    *os.File
+	csv     *os.File
+	jsonBuf *bufio.Writer
+	csvBuf  *bufio.Writer
+
+	lock    sync.Mutex
+	stop    chan bool
+	stopped bool
+}
+
+// files older than retention days removed at day rotation, 0 for never
+func NewDeliverySink(format, path string, retention int) (*DeliverySink, error) {
+	switch format {
+	case DELIVERY_FORMAT_JSON, DELIVERY_FORMAT_CSV, DELIVERY_FORMAT_BOTH:
+	default:
+		return nil, errors.New("Delivery format must be json, csv or both: " + format)
+	}
+	if path == "" {
+		return nil, errors.New("Delivery path is empty.")
+	}
+	if retention < 0 {
+		return nil, errors.New("Delivery retention must be days >=0.")
+	}
+
+	sink := &DeliverySink{Format:format, Retention:retention, path:path, stop:make(chan bool)}
+	go sink.flushLoop()
+
+	return sink, nil
+}
+
+// this is a goroutine run
+func (s *DeliverySink) flushLoop() {
+	ticker := time.NewTicker(DELIVERY_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *DeliverySink) Write(record *DeliveryRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.rotate(record.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	if s.jsonBuf != nil {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return errors.New("DeliverySink.Write(): " + err.Error())
+		}
+		_, err = s.jsonBuf.Write(append(line, '\n'))
+		if err != nil {
+			return errors.New("DeliverySink.Write(): " + err.Error())
+		}
+	}
+
+	if s.csvBuf != nil {
+		err = s.writeCsv(s.csvBuf, record.csvRow())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//open files of the day, need lock
+func (s *DeliverySink) rotate(now time.Time) error {
+	day := now.Format(DELIVERY_FILE_DATE)
+	if day == s.day {
+		return nil
+	}
+	s.close()
+
+	var err error
+	if s.Format != DELIVERY_FORMAT_CSV {
+		s.json, err = s.open(s.path + "-" + day + ".jsonl")
+		if err != nil {
+			return err
+		}
+		s.jsonBuf = bufio.NewWriterSize(s.json, DELIVERY_BUFFER_SIZE)
+	}
+	if s.Format != DELIVERY_FORMAT_JSON {
+		s.csv, err = s.open(s.path + "-" + day + ".csv")
+		if err != nil {
+			return err
+		}
+		s.csvBuf = bufio.NewWriterSize(s.csv, DELIVERY_BUFFER_SIZE)
+
+		//header of new file
+		info, err := s.csv.Stat()
+		if err != nil {
+			return errors.New("DeliverySink.rotate(): " + err.Error())
+		}
+		if info.Size() == 0 {
+			err = s.writeCsv(s.csvBuf, deliveryCsvHeader)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	s.day = day
+	s.prune(now)
+	return nil
+}
+
+//remove files of days before retention, errors ignored and retried next day
+func (s *DeliverySink) prune(now time.Time) {
+	if s.Retention <= 0 {
+		return
+	}
+
+	oldest := now.AddDate(0, 0, -s.Retention).Format(DELIVERY_FILE_DATE)
+	for _, pattern := range []string{s.path + "-*.jsonl", s.path + "-*.csv"} {
+		files, _ := filepath.Glob(pattern)
+		for _, name := range files {
+			day := deliveryFileDay(s.path, name)
+			if day != "" && day < oldest {
+				os.Remove(name)
+			}
+		}
+	}
+}
+
+func (s *DeliverySink) open(name string) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_CREATE | os.O_APPEND | os.O_WRONLY, log.DEFAULT_LOGFILE_MODE)
+	if err != nil {
+		return nil, errors.New("DeliverySink.open(): " + err.Error())
+	}
+
+	return file, nil
+}
+
+//a row in one write call
+func (s *DeliverySink) writeCsv(file io.Writer, row []string) error {
+	buf := &bytes.Buffer{}
+	writer := csv.NewWriter(buf)
+	writer.Write(row)
+	writer.Flush()
+	if writer.Error() != nil {
+		return errors.New("DeliverySink.writeCsv(): " + writer.Error().Error())
+	}
+
+	_, err := file.Write(buf.Bytes())
+	if err != nil {
+		return errors.New("DeliverySink.writeCsv(): " + err.Error())
+	}
+
+	return nil
+}
+
+//write buffered records to files, need lock
+func (s *DeliverySink) flush() error {
+	if s.jsonBuf != nil {
+		err := s.jsonBuf.Flush()
+		if err != nil {
+			return errors.New("DeliverySink.flush(): " + err.Error())
+		}
+	}
+	if s.csvBuf != nil {
+		err := s.csvBuf.Flush()
+		if err != nil {
+			return errors.New("DeliverySink.flush(): " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *DeliverySink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.flush()
+}
+
+func (s *DeliverySink) close() {
+	s.flush()
+	if s.json != nil {
+		s.json.Close()
+		s.json = nil
+		s.jsonBuf = nil
+	}
+	if s.csv != nil {
+		s.csv.Close()
+		s.csv = nil
+		s.csvBuf = nil
+	}
+	s.day = ""
+}
+
+// flush and close files, eg. on shutdown
+func (s *DeliverySink) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+	}
+	s.close()
+}
+
+func (s *DeliverySink) GetPath() string {
+	return s.path
+}
+
+// report of push-id from records written of days from..to, lines being written are skipped
+func (s *DeliverySink) Report(pushID string, from, to time.Time) (*DeliveryReport, error) {
+	s.Flush()
+
+	return ReadDeliveryReport(s.path, pushID, from, to)
+}
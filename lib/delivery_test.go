@@ -0,0 +1,125 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeliverySinkTesting(t *testing.T) {
+	if _, err := NewDeliverySink("xml", "/tmp/delivery", 0); err == nil {
+		t.Errorf("NewDeliverySink() of unknown format should be error")
+	}
+
+	dir, err := ioutil.TempDir("", "delivery")
+	if err != nil {
+		t.Fatalf("TempDir() error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := NewDeliverySink(DELIVERY_FORMAT_BOTH, filepath.Join(dir, "delivery"), 0)
+	if err != nil {
+		t.Fatalf("NewDeliverySink() error: %s", err.Error())
+	}
+
+	device := &Device{Token:"abcd", Attempts:1}
+	sent := NewDeliveryRecord("push1", "com.app", PROVIDER_APNS, "pool_0_worker_1", device,
+		&WorkerResponse{Sent:true, StatusCode:200, ApnsID:"apns1", Latency:1500 * time.Microsecond})
+	if sent.Status != DELIVERY_STATUS_SENT || sent.Latency != 1500 || sent.ApnsID != "apns1" || sent.Attempt != 1 {
+		t.Errorf("NewDeliveryRecord() of sent error: %+v", sent)
+	}
+	failed := NewDeliveryRecord("push1", "com.app", PROVIDER_APNS, "pool_0_worker_2", device, &WorkerResponse{StatusCode:410, Reason:"Unregistered"})
+	if failed.Status != DELIVERY_STATUS_FAILED || failed.Reason != "Unregistered" {
+		t.Errorf("NewDeliveryRecord() of failed error: %+v", failed)
+	}
+	broken := NewDeliveryRecord("push1", "com.app", PROVIDER_APNS, "pool_0_worker_3", device, &WorkerResponse{Error:errors.New("conn, broken")})
+	if broken.Status != DELIVERY_STATUS_ERROR || broken.Reason != "conn, broken" {
+		t.Errorf("NewDeliveryRecord() of error error: %+v", broken)
+	}
+
+	//lines of concurrent workers not interleaved
+	var wg sync.WaitGroup
+	for iter := 0; iter < 50; iter++ {
+		wg.Add(1)
+		go func(record *DeliveryRecord) {
+			defer wg.Done()
+			if err := sink.Write(record); err != nil {
+				t.Errorf("DeliverySink.Write() error: %s", err.Error())
+			}
+		}([]*DeliveryRecord{sent, failed, broken}[iter % 3])
+	}
+	wg.Wait()
+	sink.Close()
+
+	day := sent.Timestamp.Format(DELIVERY_FILE_DATE)
+	file, err := os.Open(filepath.Join(dir, "delivery-" + day + ".jsonl"))
+	if err != nil {
+		t.Fatalf("open json lines error: %s", err.Error())
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := &DeliveryRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil || record.PushID != "push1" {
+			t.Errorf("json line broken: %s", scanner.Text())
+		}
+		lines++
+	}
+	if lines != 50 {
+		t.Errorf("json lines expect 50, got %d", lines)
+	}
+
+	file, err = os.Open(filepath.Join(dir, "delivery-" + day + ".csv"))
+	if err != nil {
+		t.Fatalf("open csv error: %s", err.Error())
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("csv broken: %s", err.Error())
+	}
+	if len(rows) != 51 || rows[0][0] != "push_id" || len(rows[1]) != len(deliveryCsvHeader) {
+		t.Errorf("csv expect header and 50 rows, got %d", len(rows))
+	}
+}
+
+func TestDeliverySinkFlushTesting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delivery")
+	if err != nil {
+		t.Fatalf("TempDir() error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := NewDeliverySink(DELIVERY_FORMAT_JSON, filepath.Join(dir, "delivery"), 0)
+	if err != nil {
+		t.Fatalf("NewDeliverySink() error: %s", err.Error())
+	}
+	defer sink.Close()
+
+	record := NewDeliveryRecord("push1", "com.app", PROVIDER_APNS, "pool_0_worker_1", &Device{Token:"abcd", Attempts:1}, &WorkerResponse{Sent:true, StatusCode:200})
+	if err = sink.Write(record); err != nil {
+		t.Fatalf("DeliverySink.Write() error: %s", err.Error())
+	}
+
+	//buffered, not a file write per record
+	name := filepath.Join(dir, "delivery-" + record.Timestamp.Format(DELIVERY_FILE_DATE) + ".jsonl")
+	content, _ := ioutil.ReadFile(name)
+	if len(content) != 0 {
+		t.Errorf("DeliverySink.Write() expect buffered, got %s", content)
+	}
+
+	//report sees buffered records
+	report, err := sink.Report("push1", time.Time{}, time.Time{})
+	if err != nil || report.Sent != 1 {
+		t.Errorf("DeliverySink.Report() expect flushed record, got %+v %v", report, err)
+	}
+}
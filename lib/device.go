@@ -0,0 +1,251 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"zooinit/log"
+)
+
+const (
+	//column separator of a queue source line, eg. token|zh-CN
+	DEVICE_COLUMN_SEPARATOR = "|"
+
+	//replaced lines of registry file to trigger compact
+	DEVICE_REGISTRY_COMPACT_THRESHOLD = 1000
+)
+
+//A device pending to send, parsed from queue source line
+type Device struct {
+	Token  string
+
+	//device locale, empty will use message default locale
+	Locale string
+
+	//device owner, registered by /api/v1/add-device
+	UserID string
+
+	//A/B testing variant name, empty if no split
+	Variant string
+
+	//batch item of device, nil if not a batch task
+	Item   *BatchItem
+
+	//push attempts within task, set by worker
+	Attempts int
+}
+
+//parse a queue source line: token[|locale[|userid]]
+func NewDeviceByLine(line string) *Device {
+	columns := strings.Split(line, DEVICE_COLUMN_SEPARATOR)
+
+	device := &Device{Token:strings.Trim(columns[0], " ")}
+	if len(columns) > 1 {
+		device.Locale = strings.Trim(columns[1], " ")
+	}
+	if len(columns) > 2 {
+		device.UserID = strings.Trim(columns[2], " ")
+	}
+
+	return device
+}
+
+// queue source line format
+func (d *Device) String() string {
+	if d.UserID != "" {
+		return d.Token + DEVICE_COLUMN_SEPARATOR + d.Locale + DEVICE_COLUMN_SEPARATOR + d.UserID
+	}
+	if d.Locale != "" {
+		return d.Token + DEVICE_COLUMN_SEPARATOR + d.Locale
+	}
+
+	return d.Token
+}
+
+// Device registry, device token -> locale and user
+// registered by /api/v1/add-device, persist to append only file if path not empty, last line of token wins.
+// compact when loading, and once replaced lines pass DEVICE_REGISTRY_COMPACT_THRESHOLD.
+type DeviceRegistry struct {
+	devices map[string]*Device
+
+	//userid -> device tokens
+	users   map[string][]string
+
+	//persist file path, empty for memory only
+	path    string
+	file    *os.File
+	//lines of file, include replaced ones not compacted
+	lines   int
+
+	compactThreshold int
+
+	lock    sync.Mutex
+}
+
+func NewDeviceRegistry(path string) (*DeviceRegistry, error) {
+	dr := &DeviceRegistry{devices:make(map[string]*Device), users:make(map[string][]string), path:path, compactThreshold:DEVICE_REGISTRY_COMPACT_THRESHOLD}
+
+	err := dr.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return dr, nil
+}
+
+func (dr *DeviceRegistry) load() error {
+	if dr.path == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(dr.path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("DeviceRegistry.load(): " + err.Error())
+	}
+
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		device := NewDeviceByLine(string(line))
+		if device.Token != "" {
+			dr.set(device)
+		}
+	}
+
+	return dr.flush()
+}
+
+//need lock
+func (dr *DeviceRegistry) set(device *Device) {
+	if old, ok := dr.devices[device.Token]; ok && old.UserID != "" {
+		tokens := dr.users[old.UserID]
+		for iter, token := range tokens {
+			if token == device.Token {
+				dr.users[old.UserID] = append(tokens[:iter:iter], tokens[iter + 1:]...)
+				break
+			}
+		}
+	}
+
+	dr.devices[device.Token] = device
+	if device.UserID != "" {
+		dr.users[device.UserID] = append(dr.users[device.UserID], device.Token)
+	}
+}
+
+//register or update device locale and owner
+func (dr *DeviceRegistry) Register(token, locale, userid string) error {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+
+	if token == "" {
+		return errors.New("DeviceRegistry.Register(): device token is empty.")
+	}
+
+	old, ok := dr.devices[token]
+	if ok && old.Locale == locale && old.UserID == userid {
+		return nil
+	}
+	device := &Device{Token:token, Locale:locale, UserID:userid}
+	dr.set(device)
+
+	if dr.path == "" {
+		return nil
+	}
+	if dr.file == nil {
+		//reopen failed by last compact
+		return dr.flush()
+	}
+
+	_, err := dr.file.WriteString(device.String() + "\n")
+	if err != nil {
+		return errors.New("DeviceRegistry.Register(): " + err.Error())
+	}
+	dr.lines++
+
+	if dr.lines - len(dr.devices) >= dr.compactThreshold {
+		return dr.flush()
+	}
+
+	return nil
+}
+
+func (dr *DeviceRegistry) GetLocale(token string) (string, bool) {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+
+	device, ok := dr.devices[token]
+	if !ok {
+		return "", false
+	}
+
+	return device.Locale, true
+}
+
+// copies of devices registered by user
+func (dr *DeviceRegistry) GetUserDevices(userid string) []*Device {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+
+	var devices []*Device
+	for _, token := range dr.users[userid] {
+		device := *dr.devices[token]
+		devices = append(devices, &device)
+	}
+
+	return devices
+}
+
+func (dr *DeviceRegistry) Len() int {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+
+	return len(dr.devices)
+}
+
+//rewrite whole file and reopen for append, need lock
+func (dr *DeviceRegistry) flush() error {
+	var buf bytes.Buffer
+	for _, device := range dr.devices {
+		buf.WriteString(device.String() + "\n")
+	}
+
+	tmp := dr.path + ".tmp"
+	err := ioutil.WriteFile(tmp, buf.Bytes(), log.DEFAULT_LOGFILE_MODE)
+	if err != nil {
+		return errors.New("DeviceRegistry.flush(): " + err.Error())
+	}
+
+	err = os.Rename(tmp, dr.path)
+	if err != nil {
+		return errors.New("DeviceRegistry.flush(): " + err.Error())
+	}
+
+	if dr.file != nil {
+		dr.file.Close()
+	}
+	dr.file, err = os.OpenFile(dr.path, os.O_APPEND | os.O_WRONLY, log.DEFAULT_LOGFILE_MODE)
+	if err != nil {
+		dr.file = nil
+		return errors.New("DeviceRegistry.flush(): " + err.Error())
+	}
+	dr.lines = len(dr.devices)
+
+	return nil
+}
+
+func (dr *DeviceRegistry) Close() error {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+
+	if dr.file == nil {
+		return nil
+	}
+
+	err := dr.file.Close()
+	dr.file = nil
+	return err
+}
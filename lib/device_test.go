@@ -0,0 +1,56 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeviceRegistryTesting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "devices.txt")
+
+	dr, err := NewDeviceRegistry(path)
+	if err != nil {
+		t.Fatalf("NewDeviceRegistry() error: %v", err)
+	}
+	dr.compactThreshold = 3
+
+	//appended, last line of token wins
+	dr.Register("token1", "zh-CN", "user1")
+	dr.Register("token2", "en", "")
+	dr.Register("token1", "en", "user1")
+	content, _ := ioutil.ReadFile(path)
+	if strings.Count(string(content), "\n") != 3 {
+		t.Errorf("Register() expect 3 appended lines, got %q", content)
+	}
+	dr.Close()
+
+	dr, err = NewDeviceRegistry(path)
+	if err != nil {
+		t.Fatalf("NewDeviceRegistry() reload error: %v", err)
+	}
+	defer dr.Close()
+	dr.compactThreshold = 3
+	if locale, ok := dr.GetLocale("token1"); !ok || locale != "en" || len(dr.GetUserDevices("user1")) != 1 {
+		t.Errorf("NewDeviceRegistry() reload expect last locale en, got %s", locale)
+	}
+
+	//compacted when loading, then once 3 lines replaced
+	for _, locale := range []string{"fr", "de", "ja"} {
+		if err = dr.Register("token2", locale, ""); err != nil {
+			t.Fatalf("Register() error: %v", err)
+		}
+	}
+	content, _ = ioutil.ReadFile(path)
+	if strings.Count(string(content), "\n") != 2 || !strings.Contains(string(content), "token2|ja") {
+		t.Errorf("Register() expect compacted to 2 lines, got %q", content)
+	}
+}
@@ -15,7 +15,56 @@ type EnvInfo interface {
 
 	GetPoolConfig() (*PoolConfig)
 
+	//change defaults of pools created after, config must not be changed after set
+	SetPoolConfig(config *PoolConfig)
+
+	//pools, waiting tasks and concurrency policy
+	GetTaskQueueConfig() (*TaskQueueConfig)
+
 	GetWorkerPool() (*WorkerPool)
 
 	GetQueueSourceConfig() (*QueueSourceConfig)
+
+	GetDeviceRegistry() (*DeviceRegistry)
+
+	//fallback locale of localized message
+	GetDefaultLocale() string
+
+	GetIdempotencyStore() (*IdempotencyStore)
+
+	//api clients, empty for authentication disabled
+	GetApiKeyStore() (*ApiKeyStore)
+
+	//app and api client limits
+	GetRateLimiter() (*RateLimiter)
+
+	//outbound push throttle of all pools
+	GetThrottle() (*Throttle)
+
+	//device token format of provider
+	GetTokenValidator() (TokenValidator)
+
+	//cross task pushes per device limit, nil for disabled
+	GetFrequencyCap() (*FrequencyCap)
+
+	//per device push records, nil for disabled
+	GetDeliverySink() (*DeliverySink)
+
+	//delivery records to mysql, webhook or message log, nil for none
+	GetResultSinks() (*ResultSinks)
+
+	//task completion callbacks, nil if callback.secret not configured
+	GetCallbackSender() (*CallbackSender)
+
+	//traces of push-ids, nil for disabled
+	GetTracer() (*Tracer)
+
+	//checks of readiness probe
+	GetReadiness() (*Readiness)
+
+	//push certificate in use, nil if not a certificate provider
+	GetCertInfo() (*CertInfo)
+
+	//re-read credentials and queue source of config, return names of changed
+	Reload() ([]string, error)
 }
@@ -0,0 +1,292 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"zooinit/log"
+)
+
+const (
+	//default window of frequency cap, 24 hours
+	FREQUENCY_DEFAULT_WINDOW = 24 * time.Hour
+
+	//worker response reason of device skipped by frequency cap
+	FREQUENCY_REASON_CAPPED = "FrequencyCapped"
+
+	//expired or cancel lines of file to trigger compact
+	FREQUENCY_COMPACT_THRESHOLD = 10000
+	//expired windows checked at most once an interval
+	FREQUENCY_COMPACT_INTERVAL = time.Minute
+)
+
+// A push counted by frequency cap, cancel removes the latest push of token
+type FrequencyRecord struct {
+	Token  string `json:"token"`
+	//unix timestamp
+	Time   int64 `json:"time"`
+	Cancel bool `json:"cancel,omitempty"`
+}
+
+// At most Limit pushes per device within Window across tasks, eg. 3 marketing pushes per 24h.
+// persist to append only json lines file if path not empty, compact when loading,
+// and at runtime once expired lines pass FREQUENCY_COMPACT_THRESHOLD.
+type FrequencyCap struct {
+	Limit      int
+	Window     time.Duration
+
+	//message categories capped, empty for all messages
+	categories map[string]bool
+
+	//token -> push unix timestamps
+	pushes     map[string][]int64
+
+	//persist file path, empty for memory only
+	path       string
+	file       *os.File
+	//lines of file, pushes within window and expired or cancel ones not compacted
+	lines      int
+
+	compactThreshold int
+	compacted  time.Time
+
+	lock       sync.Mutex
+}
+
+func NewFrequencyCap(limit int, window time.Duration, categories []string, path string) (*FrequencyCap, error) {
+	if limit <= 0 {
+		return nil, errors.New("Frequency cap limit must >0.")
+	}
+	if window <= 0 {
+		window = FREQUENCY_DEFAULT_WINDOW
+	}
+
+	fc := &FrequencyCap{Limit:limit, Window:window, categories:make(map[string]bool), pushes:make(map[string][]int64), path:path,
+		compactThreshold:FREQUENCY_COMPACT_THRESHOLD, compacted:time.Now()}
+	for _, category := range categories {
+		category = strings.TrimSpace(category)
+		if category != "" {
+			fc.categories[category] = true
+		}
+	}
+
+	err := fc.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return fc, nil
+}
+
+//load pushes within window and rewrite file
+func (fc *FrequencyCap) load() error {
+	if fc.path == "" {
+		return nil
+	}
+
+	file, err := os.Open(fc.path)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			record := &FrequencyRecord{}
+			if json.Unmarshal(scanner.Bytes(), record) != nil || record.Token == "" {
+				//broken line, may crash when writing
+				continue
+			}
+			if record.Cancel {
+				fc.cancel(record.Token)
+			} else {
+				fc.pushes[record.Token] = append(fc.pushes[record.Token], record.Time)
+			}
+		}
+		file.Close()
+
+		if scanner.Err() != nil {
+			return errors.New("FrequencyCap.load(): " + scanner.Err().Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.New("FrequencyCap.load(): " + err.Error())
+	}
+
+	return fc.rewrite(time.Now())
+}
+
+//rewrite file of pushes within window and reopen for append, need lock
+func (fc *FrequencyCap) rewrite(now time.Time) error {
+	tmp := fc.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, log.DEFAULT_LOGFILE_MODE)
+	if err != nil {
+		return errors.New("FrequencyCap.rewrite(): " + err.Error())
+	}
+	lines := 0
+	for token := range fc.pushes {
+		for _, pushed := range fc.prune(token, now) {
+			err = fc.write(file, &FrequencyRecord{Token:token, Time:pushed})
+			if err != nil {
+				file.Close()
+				return err
+			}
+			lines++
+		}
+	}
+	file.Close()
+
+	err = os.Rename(tmp, fc.path)
+	if err != nil {
+		return errors.New("FrequencyCap.rewrite(): " + err.Error())
+	}
+
+	if fc.file != nil {
+		fc.file.Close()
+	}
+	fc.file, err = os.OpenFile(fc.path, os.O_APPEND | os.O_WRONLY, log.DEFAULT_LOGFILE_MODE)
+	if err != nil {
+		fc.file = nil
+		return errors.New("FrequencyCap.rewrite(): " + err.Error())
+	}
+	fc.lines = lines
+
+	return nil
+}
+
+//drop expired windows once an interval, rewrite file if too many lines are not live, need lock
+func (fc *FrequencyCap) compact(now time.Time) error {
+	if now.Sub(fc.compacted) < FREQUENCY_COMPACT_INTERVAL {
+		return nil
+	}
+	fc.compacted = now
+
+	live := 0
+	for token := range fc.pushes {
+		live += len(fc.prune(token, now))
+	}
+
+	if fc.file == nil || fc.lines - live < fc.compactThreshold {
+		return nil
+	}
+
+	return fc.rewrite(now)
+}
+
+//append record and compact if needed, need lock
+func (fc *FrequencyCap) append(record *FrequencyRecord, now time.Time) error {
+	if fc.file == nil {
+		return fc.compact(now)
+	}
+
+	err := fc.write(fc.file, record)
+	if err != nil {
+		return err
+	}
+	fc.lines++
+
+	return fc.compact(now)
+}
+
+func (fc *FrequencyCap) write(file *os.File, record *FrequencyRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.New("FrequencyCap.write(): " + err.Error())
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		return errors.New("FrequencyCap.write(): " + err.Error())
+	}
+
+	return nil
+}
+
+//drop pushes out of window, need lock
+func (fc *FrequencyCap) prune(token string, now time.Time) []int64 {
+	since := now.Add(-fc.Window).Unix()
+
+	pushes := fc.pushes[token]
+	iter := 0
+	for iter < len(pushes) && pushes[iter] <= since {
+		iter++
+	}
+	pushes = pushes[iter:]
+
+	if len(pushes) == 0 {
+		delete(fc.pushes, token)
+	} else {
+		fc.pushes[token] = pushes
+	}
+
+	return pushes
+}
+
+//need lock
+func (fc *FrequencyCap) cancel(token string) {
+	pushes := fc.pushes[token]
+	if len(pushes) == 0 {
+		return
+	}
+
+	if len(pushes) == 1 {
+		delete(fc.pushes, token)
+	} else {
+		fc.pushes[token] = pushes[:len(pushes) - 1]
+	}
+}
+
+// whether message category is capped
+func (fc *FrequencyCap) Applies(category string) bool {
+	return len(fc.categories) == 0 || fc.categories[category]
+}
+
+// count a push of token if under limit, false if capped
+// error is a persist failure, push is still counted in memory
+func (fc *FrequencyCap) Allow(token string) (bool, error) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	now := time.Now()
+	if len(fc.prune(token, now)) >= fc.Limit {
+		return false, nil
+	}
+
+	record := &FrequencyRecord{Token:token, Time:now.Unix()}
+	fc.pushes[token] = append(fc.pushes[token], record.Time)
+
+	return true, fc.append(record, now)
+}
+
+// cancel the latest counted push, eg. push failed
+func (fc *FrequencyCap) Cancel(token string) error {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	fc.cancel(token)
+
+	now := time.Now()
+	return fc.append(&FrequencyRecord{Token:token, Time:now.Unix(), Cancel:true}, now)
+}
+
+// pushes of token within window
+func (fc *FrequencyCap) Count(token string) int {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	return len(fc.prune(token, time.Now()))
+}
+
+func (fc *FrequencyCap) Close() error {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	if fc.file == nil {
+		return nil
+	}
+
+	err := fc.file.Close()
+	fc.file = nil
+	return err
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrequencyCapTesting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frequency.log")
+
+	if _, err = NewFrequencyCap(0, time.Hour, nil, ""); err == nil {
+		t.Errorf("NewFrequencyCap() limit 0 should be error")
+	}
+
+	fc, err := NewFrequencyCap(2, time.Hour, []string{"marketing", " "}, path)
+	if err != nil {
+		t.Fatalf("NewFrequencyCap() error: %v", err)
+	}
+	if !fc.Applies("marketing") || fc.Applies("transactional") || fc.Applies("") {
+		t.Errorf("Applies() should only cap marketing")
+	}
+
+	token := strings.Repeat("a", 64)
+	for iter := 0; iter < 2; iter++ {
+		if allowed, err := fc.Allow(token); !allowed || err != nil {
+			t.Fatalf("Allow() push %d should be allowed: %v", iter, err)
+		}
+	}
+	if allowed, _ := fc.Allow(token); allowed {
+		t.Errorf("Allow() should be capped after limit")
+	}
+
+	//failed push not counted
+	fc.Cancel(token)
+	if fc.Count(token) != 1 {
+		t.Errorf("Cancel() expect count 1, got %d", fc.Count(token))
+	}
+	fc.Close()
+
+	//reload from file
+	fc, err = NewFrequencyCap(2, time.Hour, nil, path)
+	if err != nil {
+		t.Fatalf("NewFrequencyCap() reload error: %v", err)
+	}
+	defer fc.Close()
+	if fc.Count(token) != 1 || !fc.Applies("") {
+		t.Errorf("reload expect count 1 and all categories capped, got %d", fc.Count(token))
+	}
+	if allowed, _ := fc.Allow(token); !allowed {
+		t.Errorf("Allow() after reload should be allowed")
+	}
+	if allowed, _ := fc.Allow(token); allowed {
+		t.Errorf("Allow() after reload should be capped")
+	}
+
+	//out of window
+	fc.pushes[token] = []int64{time.Now().Add(-2 * time.Hour).Unix()}
+	if fc.Count(token) != 0 {
+		t.Errorf("Count() should drop pushes out of window")
+	}
+}
+
+func TestFrequencyCapCompactTesting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frequency.log")
+
+	fc, err := NewFrequencyCap(10, time.Hour, nil, path)
+	if err != nil {
+		t.Fatalf("NewFrequencyCap() error: %v", err)
+	}
+	defer fc.Close()
+	fc.compactThreshold = 3
+
+	tokens := []string{strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64)}
+	for _, token := range tokens {
+		if _, err = fc.Allow(token); err != nil {
+			t.Fatalf("Allow() error: %v", err)
+		}
+	}
+
+	//expired windows of a and b, compact on next push once interval passed
+	for _, token := range tokens[:2] {
+		fc.pushes[token] = []int64{time.Now().Add(-2 * time.Hour).Unix()}
+	}
+	fc.Cancel(tokens[2])
+	fc.compacted = time.Time{}
+	if _, err = fc.Allow(tokens[2]); err != nil {
+		t.Fatalf("Allow() error: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines != 1 || len(fc.pushes) != 1 {
+		t.Errorf("Allow() expect compacted to 1 line, got %d lines %d tokens", lines, len(fc.pushes))
+	}
+	if _, err = fc.Allow(tokens[0]); err != nil || fc.Count(tokens[0]) != 1 {
+		t.Errorf("Allow() after compact error: %v", err)
+	}
+}
+
+func TestDeviceQueueDedupeTesting(t *testing.T) {
+	tokenA := strings.Repeat("a", 64)
+	tokenB := strings.Repeat("b", 64)
+
+	q := NewQueueByCapacity(10, nil)
+	err := q.AppendDataSource([]string{tokenA, tokenB + "|en", tokenA + "|zh"})
+	if err != nil {
+		t.Fatalf("AppendDataSource() error: %v", err)
+	}
+	q.AppendDataSource([]string{tokenB})
+
+	//same device in one item is deduped, across items kept
+	item1 := &BatchItem{DeviceID:tokenA}
+	item2 := &BatchItem{DeviceID:tokenA}
+	q.AppendBatchItems([]*BatchItem{item1, item2}, nil)
+
+	if removed := q.Dedupe(); removed != 2 {
+		t.Errorf("Dedupe() expect removed 2, got %d", removed)
+	}
+	tokens := strings.Join(q.Tokens(), ",")
+	if tokens != tokenA + "," + tokenB + "," + tokenA + "," + tokenA {
+		t.Errorf("Dedupe() keep first device and batch items, got %s", tokens)
+	}
+	if q.data[1].Locale != "en" {
+		t.Errorf("Dedupe() should keep the first device: %s", q.data[1].String())
+	}
+}
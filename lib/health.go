@@ -0,0 +1,175 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTH_STATUS_OK = "ok"
+	HEALTH_STATUS_FAIL = "fail"
+
+	//timeout of every readiness check
+	HEALTH_CHECK_DEFAULT_TIMEOUT = 5 * time.Second
+	//readiness results reused, probes should not hit mysql or decode cert every call
+	HEALTH_CHECK_DEFAULT_CACHE = 10 * time.Second
+)
+
+// A named probe check, detail for humans, error if not healthy.
+// check should return when ctx done, or it is reported as timeout.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) (string, error)
+}
+
+func NewHealthCheck(name string, check func(ctx context.Context) (string, error)) *HealthCheck {
+	return &HealthCheck{Name:name, Check:check}
+}
+
+type HealthResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Error    string `json:"error,omitempty"`
+	//milliseconds
+	Duration int64 `json:"duration_ms"`
+}
+
+type HealthReport struct {
+	//ok if all checks ok
+	Status string `json:"status"`
+	Checks []*HealthResult `json:"checks"`
+}
+
+func (hr *HealthReport) OK() bool {
+	return hr.Status == HEALTH_STATUS_OK
+}
+
+// Run checks concurrently, each with timeout, results in checks order.
+func RunHealthChecks(checks []*HealthCheck, timeout time.Duration) *HealthReport {
+	if timeout <= 0 {
+		timeout = HEALTH_CHECK_DEFAULT_TIMEOUT
+	}
+
+	report := &HealthReport{Status:HEALTH_STATUS_OK, Checks:make([]*HealthResult, len(checks))}
+	wg := sync.WaitGroup{}
+	for iter, check := range checks {
+		wg.Add(1)
+		go func(iter int, check *HealthCheck) {
+			report.Checks[iter] = runHealthCheck(check, timeout)
+			wg.Done()
+		}(iter, check)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status != HEALTH_STATUS_OK {
+			report.Status = HEALTH_STATUS_FAIL
+		}
+	}
+
+	return report
+}
+
+func runHealthCheck(check *HealthCheck, timeout time.Duration) *HealthResult {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type checkResult struct {
+		detail string
+		err    error
+	}
+	//buffered, a check ignoring ctx will not leak blocked
+	done := make(chan checkResult, 1)
+	start := time.Now()
+	go func() {
+		detail, err := check.Check(ctx)
+		done <- checkResult{detail, err}
+	}()
+
+	var detail string
+	var err error
+	select {
+	case result := <-done:
+		detail, err = result.detail, result.err
+	case <-ctx.Done():
+		err = errors.New("timeout after " + timeout.String())
+	}
+
+	result := &HealthResult{Name:check.Name, Status:HEALTH_STATUS_OK, Detail:detail, Duration:int64(time.Since(start) / time.Millisecond)}
+	if err != nil {
+		result.Status = HEALTH_STATUS_FAIL
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// Readiness checks of env, eg. credentials, provider and queue source.
+// results of env checks are cached for Cache, served to unauthenticated probes,
+// so details and errors of checks should not include paths or dsn.
+type Readiness struct {
+	Timeout  time.Duration
+	//0 for no cache
+	Cache    time.Duration
+
+	checks   []*HealthCheck
+	lock     sync.Mutex
+
+	//one run at a time, concurrent probes share its results
+	runLock  sync.Mutex
+	results  []*HealthResult
+	cachedAt time.Time
+}
+
+func NewReadiness(timeout, cache time.Duration) *Readiness {
+	if timeout <= 0 {
+		timeout = HEALTH_CHECK_DEFAULT_TIMEOUT
+	}
+	if cache < 0 {
+		cache = 0
+	}
+
+	return &Readiness{Timeout:timeout, Cache:cache}
+}
+
+func (r *Readiness) Add(check *HealthCheck) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.checks = append(r.checks, check)
+}
+
+// run env checks, cached, and extra ones, eg. checks of task queue
+func (r *Readiness) Run(extra ...*HealthCheck) *HealthReport {
+	report := RunHealthChecks(extra, r.Timeout)
+	report.Checks = append(r.envResults(), report.Checks...)
+
+	report.Status = HEALTH_STATUS_OK
+	for _, result := range report.Checks {
+		if result.Status != HEALTH_STATUS_OK {
+			report.Status = HEALTH_STATUS_FAIL
+		}
+	}
+
+	return report
+}
+
+func (r *Readiness) envResults() []*HealthResult {
+	r.runLock.Lock()
+	defer r.runLock.Unlock()
+
+	if r.results == nil || time.Since(r.cachedAt) >= r.Cache {
+		r.lock.Lock()
+		checks := append([]*HealthCheck{}, r.checks...)
+		r.lock.Unlock()
+
+		r.results = RunHealthChecks(checks, r.Timeout).Checks
+		r.cachedAt = time.Now()
+	}
+
+	return append([]*HealthResult{}, r.results...)
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthChecksTesting(t *testing.T) {
+	ok := NewHealthCheck("ok", func(ctx context.Context) (string, error) {
+		return "fine", nil
+	})
+	fail := NewHealthCheck("fail", func(ctx context.Context) (string, error) {
+		return "", errors.New("down")
+	})
+	//ignores ctx, reported as timeout
+	slow := NewHealthCheck("slow", func(ctx context.Context) (string, error) {
+		time.Sleep(time.Second)
+		return "late", nil
+	})
+
+	report := RunHealthChecks([]*HealthCheck{ok}, time.Second)
+	if !report.OK() || len(report.Checks) != 1 || report.Checks[0].Detail != "fine" {
+		t.Errorf("RunHealthChecks() of ok check expect ok, got %+v", report)
+	}
+
+	start := time.Now()
+	report = RunHealthChecks([]*HealthCheck{ok, fail, slow}, 50 * time.Millisecond)
+	if time.Since(start) > 500 * time.Millisecond {
+		t.Errorf("RunHealthChecks() expect slow check timeout, took %s", time.Since(start))
+	}
+	if report.OK() || report.Status != HEALTH_STATUS_FAIL {
+		t.Fatalf("RunHealthChecks() with failed check expect fail")
+	}
+	if report.Checks[0].Status != HEALTH_STATUS_OK || report.Checks[1].Error != "down" || report.Checks[2].Status != HEALTH_STATUS_FAIL {
+		t.Errorf("RunHealthChecks() results expect in checks order, got %+v %+v %+v", report.Checks[0], report.Checks[1], report.Checks[2])
+	}
+
+	readiness := NewReadiness(time.Second, 0)
+	readiness.Add(ok)
+	report = readiness.Run(fail)
+	if report.OK() || len(report.Checks) != 2 || report.Checks[1].Name != "fail" {
+		t.Errorf("Readiness.Run() expect env and extra checks, got %+v", report)
+	}
+}
+
+func TestReadinessCacheTesting(t *testing.T) {
+	runs := 0
+	counted := NewHealthCheck("counted", func(ctx context.Context) (string, error) {
+		runs++
+		return "", nil
+	})
+	extraRuns := 0
+	extra := NewHealthCheck("extra", func(ctx context.Context) (string, error) {
+		extraRuns++
+		return "", nil
+	})
+
+	readiness := NewReadiness(time.Second, 50 * time.Millisecond)
+	readiness.Add(counted)
+	for iter := 0; iter < 3; iter++ {
+		if report := readiness.Run(extra); !report.OK() || len(report.Checks) != 2 {
+			t.Fatalf("Readiness.Run() expect 2 ok checks, got %+v", report)
+		}
+	}
+	if runs != 1 || extraRuns != 3 {
+		t.Errorf("Readiness.Run() expect env check cached and extra run every time, got %d %d", runs, extraRuns)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	readiness.Run()
+	if runs != 2 {
+		t.Errorf("Readiness.Run() expect env check run after cache expired, got %d", runs)
+	}
+}
+
+func TestTaskQueueHealthTesting(t *testing.T) {
+	tq := &TaskQueue{tasks:make([]*Task, 2), taskChangeChannel:make(chan bool, TASK_QUEUE_MAX_WAITING)}
+
+	report := RunHealthChecks([]*HealthCheck{tq.PublishCheck(), tq.CapacityCheck()}, time.Second)
+	if report.Checks[0].Status != HEALTH_STATUS_FAIL || report.Checks[1].Status != HEALTH_STATUS_OK {
+		t.Errorf("TaskQueue expect publish not running and free capacity, got %+v %+v", report.Checks[0], report.Checks[1])
+	}
+
+	tq.setPublishing(true)
+	tq.setPublishState(TASK_QUEUE_STATE_IDLE)
+	tq.Add(NewQueueByCapacity(10, nil), &Message{Uuid:"push1"})
+	tq.Add(NewQueueByCapacity(10, nil), &Message{Uuid:"push2"})
+	if tq.GetFree() != 0 {
+		t.Errorf("TaskQueue.GetFree() expect 0, got %d", tq.GetFree())
+	}
+
+	report = RunHealthChecks([]*HealthCheck{tq.PublishCheck(), tq.CapacityCheck()}, time.Second)
+	if report.Checks[0].Status != HEALTH_STATUS_OK || report.Checks[1].Status != HEALTH_STATUS_FAIL {
+		t.Errorf("TaskQueue expect publish running and full, got %+v %+v", report.Checks[0], report.Checks[1])
+	}
+
+	//stuck out of idle without progress
+	tq.setPublishState(TASK_QUEUE_STATE_BUILDING)
+	tq.Lock.Lock()
+	tq.publishProgress = time.Now().Add(-2 * TASK_QUEUE_PUBLISH_STALE)
+	tq.Lock.Unlock()
+	report = RunHealthChecks([]*HealthCheck{tq.PublishCheck()}, time.Second)
+	if report.OK() {
+		t.Errorf("PublishCheck() without progress expect fail, got %+v", report.Checks[0])
+	}
+
+	//idle waits for tasks, never stale
+	tq.setPublishState(TASK_QUEUE_STATE_IDLE)
+	tq.Lock.Lock()
+	tq.publishProgress = time.Now().Add(-2 * TASK_QUEUE_PUBLISH_STALE)
+	tq.Lock.Unlock()
+	report = RunHealthChecks([]*HealthCheck{tq.PublishCheck()}, time.Second)
+	if !report.OK() {
+		t.Errorf("PublishCheck() of idle loop expect ok, got %+v", report.Checks[0])
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"zooinit/log"
+)
+
+const (
+	//default retention of idempotency keys, 24 hours
+	IDEMPOTENCY_DEFAULT_RETENTION = 24 * time.Hour
+
+	//max length of idempotency key
+	IDEMPOTENCY_KEY_MAX_LENGTH = 255
+
+	//expired or replaced lines of file to trigger compact
+	IDEMPOTENCY_COMPACT_THRESHOLD = 1000
+	//expired keys checked at most once an interval
+	IDEMPOTENCY_COMPACT_INTERVAL = time.Minute
+)
+
+// A task accepted with idempotency key
+type IdempotencyRecord struct {
+	Key         string `json:"key"`
+
+	//request fingerprint, same key with different request is conflict
+	Fingerprint string `json:"fingerprint"`
+
+	PushID      string `json:"push-id"`
+	Position    int `json:"position"`
+
+	//unix timestamp
+	Created     int64 `json:"created"`
+}
+
+// Same key used by another request within retention
+type IdempotencyConflictError struct {
+	Key    string
+	PushID string
+}
+
+func (e *IdempotencyConflictError) Error() string {
+	return "Idempotency key " + e.Key + " is used by another request: " + e.PushID
+}
+
+// Key blank or too long, a bad request
+type IdempotencyKeyError struct {
+	Key string
+}
+
+func (e *IdempotencyKeyError) Error() string {
+	return "Idempotency key length must be 1~" + strconv.Itoa(IDEMPOTENCY_KEY_MAX_LENGTH) + "."
+}
+
+// key of client, trimmed
+func CheckIdempotencyKey(key string) error {
+	if key == "" || len(key) > IDEMPOTENCY_KEY_MAX_LENGTH {
+		return &IdempotencyKeyError{Key:key}
+	}
+
+	return nil
+}
+
+// Idempotency keys store, repeat key within retention returns the original record.
+// persist to append only json lines file if path not empty, compact when loading,
+// and at runtime once expired lines pass IDEMPOTENCY_COMPACT_THRESHOLD.
+type IdempotencyStore struct {
+	records   map[string]*IdempotencyRecord
+
+	retention time.Duration
+
+	//persist file path, empty for memory only
+	path      string
+	file      *os.File
+	//lines of file, live records and expired ones not compacted
+	lines     int
+
+	compactThreshold int
+	compacted time.Time
+
+	lock      sync.Mutex
+}
+
+func NewIdempotencyStore(path string, retention time.Duration) (*IdempotencyStore, error) {
+	if retention <= 0 {
+		retention = IDEMPOTENCY_DEFAULT_RETENTION
+	}
+
+	is := &IdempotencyStore{records:make(map[string]*IdempotencyRecord), retention:retention, path:path, compactThreshold:IDEMPOTENCY_COMPACT_THRESHOLD, compacted:time.Now()}
+
+	err := is.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return is, nil
+}
+
+//load unexpired records and rewrite file
+func (is *IdempotencyStore) load() error {
+	if is.path == "" {
+		return nil
+	}
+
+	file, err := os.Open(is.path)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			record := &IdempotencyRecord{}
+			if json.Unmarshal(scanner.Bytes(), record) != nil || record.Key == "" {
+				//broken line, may crash when writing
+				continue
+			}
+			if !is.expired(record) {
+				is.records[record.Key] = record
+			}
+		}
+		file.Close()
+
+		if scanner.Err() != nil {
+			return errors.New("IdempotencyStore.load(): " + scanner.Err().Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.New("IdempotencyStore.load(): " + err.Error())
+	}
+
+	return is.rewrite()
+}
+
+//rewrite file of records in memory and reopen for append, need lock
+func (is *IdempotencyStore) rewrite() error {
+	tmp := is.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, log.DEFAULT_LOGFILE_MODE)
+	if err != nil {
+		return errors.New("IdempotencyStore.rewrite(): " + err.Error())
+	}
+	for _, record := range is.records {
+		err = is.write(file, record)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	file.Close()
+
+	err = os.Rename(tmp, is.path)
+	if err != nil {
+		return errors.New("IdempotencyStore.rewrite(): " + err.Error())
+	}
+
+	if is.file != nil {
+		is.file.Close()
+	}
+	is.file, err = os.OpenFile(is.path, os.O_APPEND | os.O_WRONLY, log.DEFAULT_LOGFILE_MODE)
+	if err != nil {
+		is.file = nil
+		return errors.New("IdempotencyStore.rewrite(): " + err.Error())
+	}
+	is.lines = len(is.records)
+
+	return nil
+}
+
+//drop expired keys once an interval, rewrite file if too many lines are not live, need lock
+func (is *IdempotencyStore) compact(now time.Time) error {
+	if now.Sub(is.compacted) < IDEMPOTENCY_COMPACT_INTERVAL {
+		return nil
+	}
+	is.compacted = now
+
+	for key, record := range is.records {
+		if is.expired(record) {
+			delete(is.records, key)
+		}
+	}
+
+	if is.file == nil || is.lines - len(is.records) < is.compactThreshold {
+		return nil
+	}
+
+	return is.rewrite()
+}
+
+func (is *IdempotencyStore) write(file *os.File, record *IdempotencyRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.New("IdempotencyStore.write(): " + err.Error())
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		return errors.New("IdempotencyStore.write(): " + err.Error())
+	}
+
+	return nil
+}
+
+func (is *IdempotencyStore) expired(record *IdempotencyRecord) bool {
+	return time.Since(time.Unix(record.Created, 0)) > is.retention
+}
+
+// Run add only once for a key within retention.
+// return the original record and true if key repeated, IdempotencyConflictError if fingerprint conflict.
+// record is not nil if task added, error with record is a persist failure, which only loses the key after restart.
+func (is *IdempotencyStore) Do(key, fingerprint string, add func() (string, int, error)) (*IdempotencyRecord, bool, error) {
+	if key == "" {
+		return nil, false, &IdempotencyKeyError{Key:key}
+	}
+
+	//lock until added, concurrent repeats wait for the first
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if record, ok := is.records[key]; ok && !is.expired(record) {
+		if record.Fingerprint != fingerprint {
+			return nil, false, &IdempotencyConflictError{Key:key, PushID:record.PushID}
+		}
+
+		copied := *record
+		return &copied, true, nil
+	}
+
+	pushID, position, err := add()
+	if err != nil {
+		return nil, false, err
+	}
+
+	record := &IdempotencyRecord{Key:key, Fingerprint:fingerprint, PushID:pushID, Position:position, Created:time.Now().Unix()}
+	is.records[key] = record
+
+	if is.file != nil {
+		err = is.write(is.file, record)
+		if err == nil {
+			is.lines++
+		}
+	}
+	if err == nil {
+		err = is.compact(time.Now())
+	}
+
+	copied := *record
+	return &copied, false, err
+}
+
+func (is *IdempotencyStore) Close() error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if is.file == nil {
+		return nil
+	}
+
+	err := is.file.Close()
+	is.file = nil
+	return err
+}
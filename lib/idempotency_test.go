@@ -0,0 +1,131 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStoreTesting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "idempotency.log")
+
+	is, err := NewIdempotencyStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("NewIdempotencyStore() error: %v", err)
+	}
+
+	added := 0
+	add := func() (string, int, error) {
+		added++
+		return "push-1", 3, nil
+	}
+
+	record, repeated, err := is.Do("key-1", "fp", add)
+	if err != nil || repeated || record.PushID != "push-1" {
+		t.Fatalf("Do() first error: %v %v %v", record, repeated, err)
+	}
+
+	record, repeated, err = is.Do("key-1", "fp", add)
+	if err != nil || !repeated || record.Position != 3 || added != 1 {
+		t.Fatalf("Do() repeat error: %v %v %v added:%d", record, repeated, err, added)
+	}
+
+	_, _, err = is.Do("key-1", "other", add)
+	if _, ok := err.(*IdempotencyConflictError); !ok {
+		t.Errorf("Do() fingerprint conflict error: %v", err)
+	}
+
+	_, _, err = is.Do("key-2", "fp", func() (string, int, error) {
+		return "", 0, errors.New("queue full")
+	})
+	if err == nil {
+		t.Error("Do() add failure should return error")
+	}
+	is.Close()
+
+	//restart
+	is, err = NewIdempotencyStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("NewIdempotencyStore() reload error: %v", err)
+	}
+	defer is.Close()
+
+	record, repeated, err = is.Do("key-1", "fp", add)
+	if err != nil || !repeated || record.PushID != "push-1" || added != 1 {
+		t.Errorf("Do() after reload error: %v %v %v added:%d", record, repeated, err, added)
+	}
+
+	_, repeated, _ = is.Do("key-2", "fp", add)
+	if repeated {
+		t.Error("Do() failed key should not be recorded")
+	}
+}
+
+func TestIdempotencyStoreCompactTesting(t *testing.T) {
+	if _, ok := CheckIdempotencyKey("").(*IdempotencyKeyError); !ok {
+		t.Error("CheckIdempotencyKey() blank key expect IdempotencyKeyError")
+	}
+	if CheckIdempotencyKey(strings.Repeat("k", IDEMPOTENCY_KEY_MAX_LENGTH + 1)) == nil || CheckIdempotencyKey("key") != nil {
+		t.Error("CheckIdempotencyKey() length check error")
+	}
+
+	dir, err := ioutil.TempDir("", "gopush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "idempotency.log")
+
+	is, err := NewIdempotencyStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("NewIdempotencyStore() error: %v", err)
+	}
+	defer is.Close()
+	is.compactThreshold = 3
+
+	add := func() (string, int, error) {
+		return "push", 1, nil
+	}
+	for iter := 0; iter < 5; iter++ {
+		if _, _, err = is.Do("key-" + strconv.Itoa(iter), "fp", add); err != nil {
+			t.Fatalf("Do() error: %v", err)
+		}
+	}
+
+	//4 expired, compact on next Do once interval passed
+	for iter := 0; iter < 4; iter++ {
+		is.records["key-" + strconv.Itoa(iter)].Created = time.Now().Add(-2 * time.Hour).Unix()
+	}
+	is.compacted = time.Time{}
+	if _, _, err = is.Do("key-5", "fp", add); err != nil {
+		t.Fatalf("Do() error: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines != 2 || len(is.records) != 2 {
+		t.Errorf("Do() expect compacted to 2 lines, got %d lines %d records", lines, len(is.records))
+	}
+
+	//appends to compacted file
+	if _, _, err = is.Do("key-6", "fp", add); err != nil {
+		t.Fatalf("Do() error: %v", err)
+	}
+	content, _ = ioutil.ReadFile(path)
+	if strings.Count(string(content), "\n") != 3 {
+		t.Errorf("Do() after compact expect 3 lines, got %s", content)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	LIMIT_TYPE_RATE = "rate"
+	LIMIT_TYPE_BROADCAST = "broadcast"
+	LIMIT_TYPE_AUDIENCE = "audience"
+
+	//limiter key of app level limits
+	LIMIT_KEY_APP = "app"
+)
+
+// Request and send limits, 0 means unlimited
+type Limits struct {
+	//requests per second
+	RPS             float64 `json:"rps"`
+
+	//broadcasts per day, reset at local midnight
+	BroadcastsDaily int `json:"broadcasts_daily"`
+
+	//max devices of a task
+	AudienceMax     int `json:"audience_max"`
+}
+
+// A request rejected by limits
+type LimitError struct {
+	//LIMIT_TYPE_*
+	Type       string
+
+	//client name or LIMIT_KEY_APP
+	Key        string
+
+	Message    string
+
+	//0 if retry will not help
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
+
+//Retry-After header seconds, round up
+func (e *LimitError) RetryAfterSeconds() int {
+	return int((e.RetryAfter + time.Second - 1) / time.Second)
+}
+
+type broadcastQuota struct {
+	day   string
+	count int
+}
+
+// Limits of app and every api client, app limits apply to all clients together
+type RateLimiter struct {
+	app     *Limits
+
+	buckets map[string]*TokenBucket
+	quotas  map[string]*broadcastQuota
+
+	lock    sync.Mutex
+	//buckets of a request checked and taken together
+	rateLock sync.Mutex
+}
+
+func NewRateLimiter(app *Limits) *RateLimiter {
+	if app == nil {
+		app = &Limits{}
+	}
+
+	return &RateLimiter{app:app, buckets:make(map[string]*TokenBucket), quotas:make(map[string]*broadcastQuota)}
+}
+
+func (rl *RateLimiter) GetAppLimits() *Limits {
+	return rl.app
+}
+
+func (rl *RateLimiter) bucket(key string, rps float64) *TokenBucket {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	tb, ok := rl.buckets[key]
+	if !ok {
+		tb = NewTokenBucket(rps, 0)
+		rl.buckets[key] = tb
+	}
+
+	return tb
+}
+
+// request rate of client, client nil for anonymous.
+// tokens taken only if both client and app buckets allow, a rejected request costs nothing.
+func (rl *RateLimiter) AllowRequest(client *ApiClient) error {
+	var clientBucket, appBucket *TokenBucket
+	if client != nil && client.Limits.RPS > 0 {
+		clientBucket = rl.bucket(client.Name, client.Limits.RPS)
+	}
+	if rl.app.RPS > 0 {
+		appBucket = rl.bucket(LIMIT_KEY_APP, rl.app.RPS)
+	}
+
+	rl.rateLock.Lock()
+	defer rl.rateLock.Unlock()
+
+	if clientBucket != nil {
+		if ok, wait := clientBucket.Available(); !ok {
+			return &LimitError{Type:LIMIT_TYPE_RATE, Key:client.Name, Message:"Client " + client.Name + " request rate exceeds " + strconv.FormatFloat(client.Limits.RPS, 'f', -1, 64) + "/s.", RetryAfter:wait}
+		}
+	}
+	if appBucket != nil {
+		if ok, wait := appBucket.Available(); !ok {
+			return &LimitError{Type:LIMIT_TYPE_RATE, Key:LIMIT_KEY_APP, Message:"App request rate exceeds " + strconv.FormatFloat(rl.app.RPS, 'f', -1, 64) + "/s.", RetryAfter:wait}
+		}
+	}
+
+	if clientBucket != nil {
+		clientBucket.Allow()
+	}
+	if appBucket != nil {
+		appBucket.Allow()
+	}
+
+	return nil
+}
+
+// count a broadcast of client, client nil for anonymous
+func (rl *RateLimiter) AllowBroadcast(client *ApiClient) error {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	if client != nil && client.Limits.BroadcastsDaily > 0 && rl.quota(client.Name, now).count >= client.Limits.BroadcastsDaily {
+		return &LimitError{Type:LIMIT_TYPE_BROADCAST, Key:client.Name, Message:"Client " + client.Name + " broadcasts exceed " + strconv.Itoa(client.Limits.BroadcastsDaily) + " per day.", RetryAfter:untilTomorrow(now)}
+	}
+	if rl.app.BroadcastsDaily > 0 && rl.quota(LIMIT_KEY_APP, now).count >= rl.app.BroadcastsDaily {
+		return &LimitError{Type:LIMIT_TYPE_BROADCAST, Key:LIMIT_KEY_APP, Message:"App broadcasts exceed " + strconv.Itoa(rl.app.BroadcastsDaily) + " per day.", RetryAfter:untilTomorrow(now)}
+	}
+
+	if client != nil {
+		rl.quota(client.Name, now).count++
+	}
+	rl.quota(LIMIT_KEY_APP, now).count++
+
+	return nil
+}
+
+// give back a broadcast counted by AllowBroadcast, eg. task not accepted
+func (rl *RateLimiter) RefundBroadcast(client *ApiClient) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	if client != nil && rl.quota(client.Name, now).count > 0 {
+		rl.quota(client.Name, now).count--
+	}
+	if rl.quota(LIMIT_KEY_APP, now).count > 0 {
+		rl.quota(LIMIT_KEY_APP, now).count--
+	}
+}
+
+//need lock
+func (rl *RateLimiter) quota(key string, now time.Time) *broadcastQuota {
+	day := now.Format("2006-01-02")
+
+	quota, ok := rl.quotas[key]
+	if !ok || quota.day != day {
+		quota = &broadcastQuota{day:day}
+		rl.quotas[key] = quota
+	}
+
+	return quota
+}
+
+// max devices of a task, 0 for unlimited
+func (rl *RateLimiter) GetAudienceMax(client *ApiClient) int {
+	max := rl.app.AudienceMax
+	if client != nil && client.Limits.AudienceMax > 0 && (max <= 0 || client.Limits.AudienceMax < max) {
+		max = client.Limits.AudienceMax
+	}
+
+	return max
+}
+
+func CheckAudience(size, max int) error {
+	if max > 0 && size > max {
+		return &LimitError{Type:LIMIT_TYPE_AUDIENCE, Message:"Audience size " + strconv.Itoa(size) + " exceeds max " + strconv.Itoa(max) + " per task."}
+	}
+
+	return nil
+}
+
+func untilTomorrow(now time.Time) time.Duration {
+	year, month, day := now.Date()
+	return time.Date(year, month, day + 1, 0, 0, 0, 0, now.Location()).Sub(now)
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTesting(t *testing.T) {
+	tb := NewTokenBucket(10, 2)
+	for iter := 0; iter < 2; iter++ {
+		if ok, _ := tb.Allow(); !ok {
+			t.Fatalf("Allow() burst token %d should be available", iter)
+		}
+	}
+
+	ok, wait := tb.Allow()
+	if ok || wait <= 0 || wait > 100 * time.Millisecond {
+		t.Fatalf("Allow() should be limited with wait <=100ms: %v %v", ok, wait)
+	}
+
+	start := time.Now()
+	tb.Wait(nil)
+	if time.Since(start) > 200 * time.Millisecond {
+		t.Errorf("Wait() too long: %v", time.Since(start))
+	}
+
+	unlimited := NewTokenBucket(0, 0)
+	for iter := 0; iter < 100; iter++ {
+		if ok, _ := unlimited.Allow(); !ok {
+			t.Fatal("Allow() rate 0 should be unlimited")
+		}
+	}
+}
+
+func TestRateLimiterTesting(t *testing.T) {
+	rl := NewRateLimiter(&Limits{BroadcastsDaily:3, AudienceMax:1000})
+	client := &ApiClient{Name:"ops", Limits:Limits{RPS:1, BroadcastsDaily:2, AudienceMax:100}}
+
+	if rl.AllowRequest(client) != nil {
+		t.Error("AllowRequest() first should pass")
+	}
+	err := rl.AllowRequest(client)
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Type != LIMIT_TYPE_RATE || limitErr.RetryAfterSeconds() != 1 {
+		t.Errorf("AllowRequest() second should be limited: %v", err)
+	}
+
+	rl.AllowBroadcast(client)
+	rl.AllowBroadcast(client)
+	err = rl.AllowBroadcast(client)
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Key != "ops" || limitErr.RetryAfter <= 0 {
+		t.Errorf("AllowBroadcast() client quota should exceed: %v", err)
+	}
+
+	//app quota is shared by clients
+	if rl.AllowBroadcast(nil) != nil {
+		t.Error("AllowBroadcast() app third should pass")
+	}
+	err = rl.AllowBroadcast(nil)
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Key != LIMIT_KEY_APP {
+		t.Errorf("AllowBroadcast() app quota should exceed: %v", err)
+	}
+
+	//refund gives back both client and app quota
+	rl.RefundBroadcast(client)
+	if rl.AllowBroadcast(client) != nil {
+		t.Error("AllowBroadcast() after RefundBroadcast() should pass")
+	}
+
+	//app bucket rejects, client token not taken
+	limited := NewRateLimiter(&Limits{RPS:1})
+	other := &ApiClient{Name:"other", Limits:Limits{RPS:1}}
+	if limited.AllowRequest(nil) != nil {
+		t.Error("AllowRequest() app first should pass")
+	}
+	err = limited.AllowRequest(other)
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Key != LIMIT_KEY_APP {
+		t.Errorf("AllowRequest() app rate should exceed: %v", err)
+	}
+	if ok, _ := limited.bucket("other", 1).Available(); !ok {
+		t.Error("AllowRequest() rejected by app should not take client token")
+	}
+
+	if rl.GetAudienceMax(client) != 100 || rl.GetAudienceMax(nil) != 1000 {
+		t.Errorf("GetAudienceMax() error: %d %d", rl.GetAudienceMax(client), rl.GetAudienceMax(nil))
+	}
+	if CheckAudience(101, 100) == nil || CheckAudience(100, 100) != nil || CheckAudience(101, 0) != nil {
+		t.Error("CheckAudience() error")
+	}
+}
@@ -3,6 +3,12 @@ package lib
 
 import (
 	"encoding/json"
+	"strings"
+)
+
+const (
+	//locale language and region separator, eg. zh-CN, zh_CN
+	MESSAGE_LOCALE_SEPARATOR = "-_"
 )
 
 type MessageInterface interface {
@@ -20,9 +26,39 @@ type MessageInterface interface {
 
 	GetUuid() string
 
+	// message category, eg. marketing, for frequency cap
+	GetCategory() string
+
+	// resolve variant locale key for device locale, empty if no variant matched
+	ResolveLocale(locale string) string
+
+	// fetch message variant for device locale
+	Localize(locale string) MessageInterface
+
+	// fetch A/B testing variant by name, same message if not found
+	Variant(name string) MessageInterface
+
 	MarshalJSON() (string, error)
 }
 
+//Localized title and body of a message
+type MessageLocale struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+//A/B testing copy of a message, sent to Percent of audience
+type MessageVariant struct {
+	Name    string `json:"name"`
+	Percent int `json:"percent"`
+
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+
+	//replace message locales, empty sends Title and Body to every locale
+	Locales map[string]*MessageLocale `json:"locales,omitempty"`
+}
+
 type Message struct {
 	Title  string `json:"title"`
 	Body   string `json:"body"`
@@ -33,6 +69,18 @@ type Message struct {
 	Sound  string `json:"sound"`
 
 	Uuid   string `json:"uuid"`
+
+	//eg. marketing, transactional, empty for uncategorized
+	Category      string `json:"category,omitempty"`
+
+	//locale -> title and body variant, eg. {"zh-CN": {"title":"", "body":""}, "en":{...}}
+	Locales       map[string]*MessageLocale `json:"locales,omitempty"`
+
+	//fallback locale when device locale not matched
+	DefaultLocale string `json:"default_locale,omitempty"`
+
+	//A/B testing variants, rest of audience is holdout
+	Variants      []*MessageVariant `json:"variants,omitempty"`
 }
 
 func (m *Message)MarshalJSON() (string, error) {
@@ -67,4 +115,75 @@ func (m *Message)GetCustom() map[string]string {
 // fetch sound info
 func (m *Message)GetUuid() string {
 	return m.Uuid
+}
+
+func (m *Message)GetCategory() string {
+	return m.Category
+}
+
+// Match order: exact locale, language part of locale, default locale.
+func (m *Message)ResolveLocale(locale string) string {
+	if len(m.Locales) == 0 {
+		return ""
+	}
+
+	if locale != "" {
+		if _, ok := m.Locales[locale]; ok {
+			return locale
+		}
+
+		//zh-CN -> zh
+		if index := strings.IndexAny(locale, MESSAGE_LOCALE_SEPARATOR); index > 0 {
+			if _, ok := m.Locales[locale[:index]]; ok {
+				return locale[:index]
+			}
+		}
+	}
+
+	if _, ok := m.Locales[m.DefaultLocale]; ok {
+		return m.DefaultLocale
+	}
+
+	return ""
+}
+
+// A shallow copy with title and body replaced, same message if no variant matched
+func (m *Message)Localize(locale string) MessageInterface {
+	key := m.ResolveLocale(locale)
+	if key == "" {
+		return m
+	}
+
+	variant := *m
+	variant.Title = m.Locales[key].Title
+	variant.Body = m.Locales[key].Body
+
+	return &variant
+}
+
+func (m *Message)GetVariant(name string) *MessageVariant {
+	for _, variant := range m.Variants {
+		if variant.Name == name {
+			return variant
+		}
+	}
+
+	return nil
+}
+
+// A shallow copy with title, body and locales replaced by variant
+func (m *Message)Variant(name string) MessageInterface {
+	variant := m.GetVariant(name)
+	if variant == nil {
+		return m
+	}
+
+	copied := *m
+	copied.Title = variant.Title
+	copied.Body = variant.Body
+	//message locales are copy of base, not of variant
+	copied.Locales = variant.Locales
+	copied.Variants = nil
+
+	return &copied
 }
\ No newline at end of file
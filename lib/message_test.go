@@ -0,0 +1,68 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"testing"
+)
+
+func TestMessageLocalizeTesting(t *testing.T) {
+	msg := &Message{Title:"title", Body:"body", DefaultLocale:"en", Locales:map[string]*MessageLocale{
+		"zh-CN": {Title:"标题", Body:"内容"},
+		"en": {Title:"Title", Body:"Body"},
+	}}
+
+	cases := map[string]string{"zh-CN":"zh-CN", "en-US":"en", "fr":"en", "":"en"}
+	for locale, expected := range cases {
+		if key := msg.ResolveLocale(locale); key != expected {
+			t.Errorf("ResolveLocale(%s) error: %s, expected: %s", locale, key, expected)
+		}
+	}
+
+	variant := msg.Localize("zh-CN")
+	if variant.GetTitle() != "标题" || variant.GetBody() != "内容" {
+		t.Errorf("Localize(zh-CN) error: %s %s", variant.GetTitle(), variant.GetBody())
+	}
+	if msg.GetTitle() != "title" {
+		t.Errorf("Localize() changed origin message title: %s", msg.GetTitle())
+	}
+
+	plain := &Message{Title:"title", Body:"body"}
+	if plain.Localize("zh-CN") != plain {
+		t.Error("Localize() without locales should return origin message")
+	}
+}
+
+func TestMessageVariantLocalesTesting(t *testing.T) {
+	msg := &Message{Title:"title", Body:"body", DefaultLocale:"en", Locales:map[string]*MessageLocale{"en": {Title:"Title", Body:"Body"}},
+		Variants:[]*MessageVariant{{Name:"a", Percent:50, Title:"A", Body:"A body"},
+			{Name:"b", Percent:50, Title:"B", Body:"B body", Locales:map[string]*MessageLocale{"zh": {Title:"乙", Body:"乙内容"}}}}}
+	task := NewTask(NewQueue(nil), msg)
+
+	//localized as worker does, base locales must not replace variant copy
+	for _, locale := range []string{"en", "fr", ""} {
+		sent := task.GetDeviceMessage(&Device{Variant:"a"}).(*Message).Localize(locale)
+		if sent.GetTitle() != "A" || sent.GetBody() != "A body" {
+			t.Errorf("Variant(a) Localize(%s) expect variant copy, got %s %s", locale, sent.GetTitle(), sent.GetBody())
+		}
+	}
+
+	variant := msg.Variant("b").(*Message)
+	if variant.Localize("zh-CN").GetTitle() != "乙" || variant.Localize("en").GetTitle() != "B" {
+		t.Errorf("Variant(b) expect own locales, got %s %s", variant.Localize("zh-CN").GetTitle(), variant.Localize("en").GetTitle())
+	}
+	if msg.Variant("none") != msg {
+		t.Error("Variant() of unknown name should return origin message")
+	}
+}
+
+func TestDeviceByLineTesting(t *testing.T) {
+	device := NewDeviceByLine("038a4c750809d70be26c7b8d9aaa5da32567147ddfb465ef6cf186c82e1a3461|zh-CN")
+	if device.Token != "038a4c750809d70be26c7b8d9aaa5da32567147ddfb465ef6cf186c82e1a3461" || device.Locale != "zh-CN" {
+		t.Errorf("NewDeviceByLine() error: %v", device)
+	}
+
+	device = NewDeviceByLine("038a4c750809d70be26c7b8d9aaa5da32567147ddfb465ef6cf186c82e1a3461")
+	if device.Locale != "" {
+		t.Errorf("NewDeviceByLine() error locale: %v", device)
+	}
+}
@@ -2,10 +2,11 @@
 package lib
 
 import (
+	"encoding/json"
 	"sync"
 	"log"
 	"errors"
-	//"time"
+	"time"
 
 	loglocal "zooinit/log"
 	"strconv"
@@ -28,7 +29,7 @@ const (
 //pool automatic resize if needed
 //fixed can use workers globally for connection saving. @see initWorkers()
 type Pool struct {
-	//worker pool
+	//worker pool, resized by autoscale while sending, read and write with Lock
 	Workers    []Worker
 
 	//Pool status
@@ -49,26 +50,69 @@ type Pool struct {
 
 	Env        EnvInfo
 
-	//sending wg
-	sendWg     sync.WaitGroup
-
 	//Every related to a Task, which can be changed every run.
 	task       *Task
+
+	//tasks sending, more than one if shared
+	tasks      []*Task
+	//tasks allocated, include not started
+	sending    int
+	//autoscale running
+	scaling    bool
+
+	//in-flight push slots, workers beyond limit idle while sending, changed by autoscale
+	slotLimit  int
+	slotActive int
+	slotCond   *sync.Cond
+
+	//push results of current autoscale window
+	metrics    *PoolMetrics
 }
 
 type PoolConfig struct {
 	//worker poll size
 	//MiniSpare <= now <= Capacity
-	Size      int
+	Size      int `json:"size"`
 
 	//pool capacity
-	Capacity  int
+	Capacity  int `json:"capacity"`
 
 	//mini spare worker
-	MiniSpare int
+	MiniSpare int `json:"spare_mini"`
 
 	//max spare worker
-	MaxSpare  int
+	MaxSpare  int `json:"spare_max"`
+
+	//adjust workers by latency and errors while sending
+	AutoScale         bool `json:"autoscale"`
+	//seconds in json
+	AutoScaleInterval time.Duration `json:"autoscale_interval"`
+}
+
+// autoscale_interval in seconds, same to config and admin param
+func (pc PoolConfig) MarshalJSON() ([]byte, error) {
+	type plain PoolConfig
+	return json.Marshal(&struct {
+		plain
+		AutoScaleInterval int64 `json:"autoscale_interval"`
+	}{plain(pc), int64(pc.AutoScaleInterval / time.Second)})
+}
+
+// pool snapshot for admin api
+type PoolInfo struct {
+	PoolID    int `json:"pool_id"`
+	Name      string `json:"name"`
+	//POOL_STATUS_SPARE, POOL_STATUS_RUNNING or POOL_STATUS_SENDING
+	Status    int `json:"status"`
+	Workers   int `json:"workers"`
+	Config    PoolConfig `json:"config"`
+
+	//push-id of current task, empty if spare
+	Task      string `json:"task"`
+	//push-ids sending, more than one if shared
+	Tasks     []string `json:"tasks"`
+	//in-flight push limit of autoscale
+	SlotLimit int `json:"slot_limit"`
 }
 
 
@@ -83,13 +127,15 @@ func NewPool(Size, Capacity, MiniSpare, MaxSpare int, Env EnvInfo) (*Pool, error
 }
 
 func NewPoolByConfig(config *PoolConfig, Env EnvInfo) (*Pool, error) {
-	pool := &Pool{Config:config}
+	pool := &Pool{Config:config, metrics:NewPoolMetrics()}
+	pool.slotCond = sync.NewCond(&sync.Mutex{})
 	pool.Env = Env
 
 	err := pool.initWorkers(pool.Config.Size)
 	if err != nil {
 		return nil, errors.New("Error when NewPoolByConfig():" + err.Error())
 	}
+	pool.logSelected()
 
 	return pool, nil
 }
@@ -109,6 +155,8 @@ func (p *Pool) initWorkers(NewCount int) error {
 		} else {
 			worker, err = p.Env.GetWorkerPool().CreateWorker()
 			if err != nil {
+				//eg. worker.max reached, release workers created by this call
+				p.releaseWorkers(workers[len(oldWorkers):iter])
 				return err
 			}
 
@@ -131,7 +179,6 @@ func (p *Pool) initWorkers(NewCount int) error {
 	// edit new count
 	p.Config.Size = NewCount
 	p.Workers = workers
-	p.Env.GetLogger().Println("PoolSelected " + p.GetPoolName() + " with workers size:" + strconv.Itoa(len(workers)) + " config: " + strconv.Itoa(p.Config.Size))
 
 	// need to destroy old workers
 	// fixed: This workers can be reusable, but have to related to Env for multi certs.
@@ -152,6 +199,18 @@ func (p *Pool) initWorkers(NewCount int) error {
 	return nil
 }
 
+// stop and harvest workers not added to pool
+func (p *Pool) releaseWorkers(workers []Worker) {
+	for _, worker := range workers {
+		worker.Stop()
+
+		err := p.Env.GetWorkerPool().HarvestWorker(worker)
+		if err != nil {
+			p.Env.GetLogger().Println(p.GetPoolName() + " release worker " + worker.GetWorkerName() + " error: " + err.Error())
+		}
+	}
+}
+
 // Lock and check can fetch the pool
 func (p *Pool) TryLockAndAllocate() bool {
 	p.Lock.Lock()
@@ -160,23 +219,64 @@ func (p *Pool) TryLockAndAllocate() bool {
 	if p.Status == POOL_STATUS_SPARE {
 
 		p.Status = POOL_STATUS_RUNNING
+		p.sending = 1
 		return true
 	}
 
 	return false
 }
 
-// finish, taskqueue's finish channel
-func (p *Pool) Send(task *Task, finish chan int) {
+// Lock and check can share the busy pool with a new task.
+// only when all tasks of pool are published, workers become idle after draining and push the new task.
+func (p *Pool) TryShare() bool {
 	p.Lock.Lock()
 	defer p.Lock.Unlock()
 
-	if p.Status != POOL_STATUS_RUNNING {
-		p.Env.GetLogger().Println(p.GetPoolName() + " p.Status != POOL_STATUS_RUNNING, please check TaskQueue.getSparePool() ")
+	if p.Status != POOL_STATUS_SENDING || p.sending != len(p.tasks) {
+		return false
+	}
+	for _, task := range p.tasks {
+		if task.list.GetStatus() != DEVICE_QUEUE_STATUS_FINISH {
+			return false
+		}
+	}
+
+	p.sending++
+	return true
+}
+
+// send a task allocated by TryLockAndAllocate or TryShare, return when task finished
+func (p *Pool) Send(task *Task) {
+	p.Lock.Lock()
+	if p.Status != POOL_STATUS_RUNNING && p.Status != POOL_STATUS_SENDING {
+		p.Lock.Unlock()
+		p.Env.GetLogger().Println(p.GetPoolName() + " p.Status is not allocated, please check TaskQueue.selectPool() ")
 		return
 	}
 	p.Status = POOL_STATUS_SENDING
 
+	//first task of pool
+	if len(p.tasks) == 0 {
+		p.setSlotLimit(len(p.Workers))
+		p.metrics.Reset()
+	}
+	p.task = task
+	p.tasks = append(p.tasks, task)
+
+	//only one autoscale of pool, the shared task uses its workers
+	scale := p.Config.AutoScale && !p.scaling
+	p.scaling = p.scaling || scale
+
+	workers := p.Workers
+	p.Lock.Unlock()
+
+	defer p.finishTask(task)
+
+	span := task.trace.Child("Pool.Send")
+	span.SetAttribute("pool", p.GetPoolName())
+	span.SetAttribute("workers", len(workers))
+	defer span.Finish()
+
 	con, err := task.message.MarshalJSON()
 	if err != nil {
 		p.Env.GetLogger().Println(p.GetPoolName() + " msg.MarshalJSON() found error:", err)
@@ -184,30 +284,170 @@ func (p *Pool) Send(task *Task, finish chan int) {
 	}
 	p.Env.GetLogger().Println(p.GetPoolName() + " receive new push task: " + string(con))
 
-	p.sendWg.Add(1)
+	//sending wg of this task
+	sendWg := &sync.WaitGroup{}
+	sendWg.Add(1)
 	// Queue data publish
 	go func() {
 		task.list.Publish()
 
-		p.sendWg.Done()
+		sendWg.Done()
 	}()
 
-	for _, worker := range p.Workers {
-		p.sendWg.Add(1)
+	p.subscribe(sendWg, task, workers)
+
+	if scale {
+		sendWg.Add(1)
+		go func() {
+			p.autoScale(sendWg, task)
+
+			p.Lock.Lock()
+			p.scaling = false
+			p.Lock.Unlock()
+			sendWg.Done()
+		}()
+	}
+
+	sendWg.Wait()
+
+	stats := task.stats.Snapshot()
+	span.SetAttribute("total", stats.Total)
+	span.SetAttribute("success", stats.Success)
+	span.SetAttribute("fail", stats.Fail)
+	p.Env.GetLogger().Println(p.GetPoolName() + " finish push task " + task.message.GetUuid() + ": " + task.stats.String())
+
+	//test, pools iter
+	//time.Sleep(5*time.Second)
+}
+
+// update status, pool spare after the last task
+func (p *Pool) finishTask(task *Task) {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+
+	for iter, taskTmp := range p.tasks {
+		if taskTmp == task {
+			p.tasks = append(p.tasks[:iter], p.tasks[iter + 1:]...)
+			break
+		}
+	}
+
+	p.sending--
+	if p.sending <= 0 {
+		p.sending = 0
+		p.Status = POOL_STATUS_SPARE
+	}
+}
+
+// tasks sending or allocated
+func (p *Pool) GetSending() int {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+
+	return p.sending
+}
+
+func (p *Pool) subscribe(sendWg *sync.WaitGroup, task *Task, workers []Worker) {
+	for _, worker := range workers {
+		sendWg.Add(1)
 		go func(worker Worker) {
 			worker.Subscribe(task)
-			p.sendWg.Done()
+			sendWg.Done()
 		}(worker)
 	}
+}
+
+// autoscale goroutine of Send, counted in sendWg so new subscribers can be added safely
+// expanded workers only subscribe the task scaling, not the shared task.
+func (p *Pool) autoScale(sendWg *sync.WaitGroup, task *Task) {
+	interval := p.Config.AutoScaleInterval
+	if interval <= 0 {
+		interval = AUTOSCALE_DEFAULT_INTERVAL
+	}
+	scaler := NewAutoScaler(p.Config)
 
-	p.sendWg.Wait()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-	//test, pools iter
-	//time.Sleep(5*time.Second)
+	last := time.Now()
+	for range ticker.C {
+		if task.list.GetStatus() == DEVICE_QUEUE_STATUS_FINISH {
+			return
+		}
+		if time.Since(last) < interval {
+			continue
+		}
+		last = time.Now()
+
+		current := p.getSlotLimit()
+		target, action, stats := scaler.Decide(current, p.metrics.Reset(), last, task.list.Remaining())
+		p.Env.GetLogger().Println(p.GetPoolName() + " autoscale " + action + " " + strconv.Itoa(current) + "->" + strconv.Itoa(target) + " workers, " + stats)
+
+		//only changes traced
+		var span *Span
+		if target != current {
+			span = task.trace.Child("Pool.Resize")
+			span.SetAttribute("pool", p.GetPoolName())
+			span.SetAttribute("action", action)
+			span.SetAttribute("workers.old", current)
+		}
+
+		p.Lock.Lock()
+		if target > len(p.Workers) {
+			old := len(p.Workers)
+			err := p.expand(target)
+			if err != nil {
+				p.Env.GetLogger().Println(p.GetPoolName() + " autoscale expand error:" + err.Error())
+				target = len(p.Workers)
+				span.SetError(err)
+			}
+			p.subscribe(sendWg, task, p.Workers[old:])
+		}
+		p.Lock.Unlock()
+		p.setSlotLimit(target)
 
-	//update status
-	p.Status = POOL_STATUS_SPARE
-	finish <- p.PoolID
+		span.SetAttribute("workers.new", target)
+		span.Finish()
+	}
+}
+
+// block until an in-flight push slot available, called by worker before push
+func (p *Pool) AcquireSlot() {
+	p.slotCond.L.Lock()
+	defer p.slotCond.L.Unlock()
+
+	for p.slotLimit > 0 && p.slotActive >= p.slotLimit {
+		p.slotCond.Wait()
+	}
+	p.slotActive++
+}
+
+func (p *Pool) ReleaseSlot() {
+	p.slotCond.L.Lock()
+	defer p.slotCond.L.Unlock()
+
+	p.slotActive--
+	p.slotCond.Signal()
+}
+
+// record worker push result for autoscale
+func (p *Pool) RecordPush(resp *WorkerResponse) {
+	p.metrics.Record(resp)
+}
+
+func (p *Pool) setSlotLimit(limit int) {
+	p.slotCond.L.Lock()
+	defer p.slotCond.L.Unlock()
+
+	p.slotLimit = limit
+	p.slotCond.Broadcast()
+}
+
+func (p *Pool) getSlotLimit() int {
+	p.slotCond.L.Lock()
+	defer p.slotCond.L.Unlock()
+
+	return p.slotLimit
 }
 
 func (p *Pool) GetOKLogger() (loglocal.ILogger) {
@@ -230,6 +470,97 @@ func (p *Pool) GetTask() (*Task) {
 	return p.task
 }
 
+// copy of workers, safe while autoscale resizing
+func (p *Pool) GetWorkers() []Worker {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+
+	return append([]Worker{}, p.Workers...)
+}
+
+func (p *Pool) GetWorkerCount() int {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+
+	return len(p.Workers)
+}
+
+func (p *Pool) Info() *PoolInfo {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+
+	info := &PoolInfo{PoolID:p.PoolID, Name:p.GetPoolName(), Status:p.Status, Workers:len(p.Workers), Config:*p.Config, Tasks:[]string{}}
+	if p.Status != POOL_STATUS_SPARE && p.task != nil {
+		info.Task = p.task.message.GetUuid()
+	}
+	for _, task := range p.tasks {
+		info.Tasks = append(info.Tasks, task.message.GetUuid())
+	}
+	info.SlotLimit = p.getSlotLimit()
+
+	return info
+}
+
+// resize to workers count by admin, MiniSpare <= size <= Capacity
+// can not shrink when sending, workers expanded while sending join from next task.
+func (p *Pool) ResizeTo(size int) (error) {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+
+	if size < p.Config.MiniSpare || size > p.Config.Capacity {
+		return errors.New("Pool size must between " + strconv.Itoa(p.Config.MiniSpare) + " and " + strconv.Itoa(p.Config.Capacity) + ": " + strconv.Itoa(size))
+	}
+
+	if size < len(p.Workers) {
+		return p.harvest(size)
+	} else if size > len(p.Workers) {
+		return p.expand(size)
+	}
+
+	return nil
+}
+
+// release all workers to worker pool, only when spare.
+// stopped pool is still spare, workers created again by Resize when allocated.
+func (p *Pool) Stop() (error) {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+
+	if p.Status != POOL_STATUS_SPARE {
+		return errors.New("Pool " + p.GetPoolName() + " can't stop when allocated or sending.")
+	}
+
+	return p.initWorkers(0)
+}
+
+// cancel tasks sending, workers return after pushes in flight and pool becomes spare.
+// devices not sent by push-id, error if none cancelled.
+func (p *Pool) Cancel() (map[string]int, error) {
+	p.Lock.Lock()
+	if p.Status != POOL_STATUS_SENDING {
+		p.Lock.Unlock()
+		return nil, errors.New("Pool " + p.GetPoolName() + " is not sending.")
+	}
+	tasks := append([]*Task{}, p.tasks...)
+	p.Lock.Unlock()
+
+	notSent := map[string]int{}
+	var err error
+	for _, task := range tasks {
+		count, cancelErr := task.Cancel()
+		if cancelErr != nil {
+			err = cancelErr
+			continue
+		}
+		notSent[task.message.GetUuid()] = count
+	}
+	if len(notSent) == 0 && err != nil {
+		return nil, err
+	}
+
+	return notSent, nil
+}
+
 //Resize pool worker pools
 func (p *Pool) Resize(size int) (error) {
 	p.Lock.Lock()
@@ -242,14 +573,24 @@ func (p *Pool) Resize(size int) (error) {
 	pCfgNew.SetSizeByQueueLength(size)
 
 	//new<old
+	var err error
 	if pCfgNew.Size < p.Config.Size {
-		return p.harvest(pCfgNew.Size)
-
+		err = p.harvest(pCfgNew.Size)
 	} else if pCfgNew.Size > p.Config.Size {
-		return p.expand(pCfgNew.Size)
+		err = p.expand(pCfgNew.Size)
+	} else {
+		return nil
+	}
+	if err == nil {
+		p.logSelected()
 	}
 
-	return nil
+	return err
+}
+
+//need lock, workers of initWorkers
+func (p *Pool) logSelected() {
+	p.Env.GetLogger().Println("PoolSelected " + p.GetPoolName() + " with workers size:" + strconv.Itoa(len(p.Workers)) + " config: " + strconv.Itoa(p.Config.Size))
 }
 
 //can add when running
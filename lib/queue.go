@@ -24,16 +24,18 @@ const (
 	DEVICE_QUEUE_STATUS_SUSPEND = "suspend"
 	//finish sending
 	DEVICE_QUEUE_STATUS_FINISH = "finish"
+	//build failed, eg. queue source error, never sent
+	DEVICE_QUEUE_STATUS_FAILED = "failed"
 )
 
 type DeviceQueue struct {
 	//channel is a synchronization
-	Channel            chan string
+	Channel            chan *Device
 
 	//发送文件位置
 	Position           int
 
-	data               []string
+	data               []*Device
 	//data locker
 	lock               sync.Mutex
 
@@ -45,6 +47,25 @@ type DeviceQueue struct {
 
 	//logger
 	server             Server
+
+	//A/B testing split and devices not sent
+	split              *AudienceSplit
+	holdout            []*Device
+	//variant of devices sent by split, holdout excluded
+	assigned           map[string]string
+
+	//batch items, nil if not a batch queue
+	items              []*BatchItem
+
+	//token format of provider, nil for apns
+	validator          TokenValidator
+	//invalid devices skipped
+	rejections         *RejectionReport
+	//source lines appended so far, line numbers of rejections go on over appends
+	lines              int
+
+	//reason of failed status
+	err                error
 }
 
 func NewQueueByPool(p *Pool, server Server) (*DeviceQueue) {
@@ -54,7 +75,7 @@ func NewQueueByPool(p *Pool, server Server) (*DeviceQueue) {
 
 func NewQueueByCapacity(Capacity int, server Server) (*DeviceQueue) {
 	//Capacity equal to pool
-	chanCreate := make(chan string, Capacity)
+	chanCreate := make(chan *Device, Capacity)
 
 	return &DeviceQueue{Channel:chanCreate, Position:0, status:DEVICE_QUEUE_STATUS_INIT, queueChangeChannel:make(chan bool, Capacity), CloseAfterSended:false, server:server}
 }
@@ -93,7 +114,7 @@ func (q *DeviceQueue) Publish() {
 		q.sendToChannel()
 
 		//finish work
-		if q.status == DEVICE_QUEUE_STATUS_FINISH {
+		if q.status == DEVICE_QUEUE_STATUS_FINISH || q.status == DEVICE_QUEUE_STATUS_FAILED {
 			break
 		}
 	}
@@ -114,7 +135,7 @@ func (q *DeviceQueue) sendToChannel() {
 			q.status = DEVICE_QUEUE_STATUS_FINISH
 		}
 
-		if q.status == DEVICE_QUEUE_STATUS_FINISH {
+		if q.status == DEVICE_QUEUE_STATUS_FINISH || q.status == DEVICE_QUEUE_STATUS_FAILED {
 			//finish work
 			close(q.Channel)
 		}
@@ -141,8 +162,8 @@ func (q *DeviceQueue) TriggerChange() {
 
 // Status
 // init->pending->finish(can goback to init)
-//        ⬇️⬆️
-//       suspend
+//  ⬇️     ⬇️⬆️
+// failed  suspend
 func (q *DeviceQueue) SetStatus(status string) (bool, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
@@ -177,6 +198,8 @@ func (q *DeviceQueue) SetStatus(status string) (bool, error) {
 			//rewind pos
 			q.Position = 0
 		}
+	} else if q.status == DEVICE_QUEUE_STATUS_FAILED {
+		return false, errors.New("Not allowed to set status to " + status + ", NOW: " + q.status)
 	} else {
 		return false, errors.New("Not support DeviceQueue status code.")
 	}
@@ -185,6 +208,63 @@ func (q *DeviceQueue) SetStatus(status string) (bool, error) {
 	return true, nil
 }
 
+// build failed, only from init, task waiting for the queue will be skipped
+func (q *DeviceQueue) Fail(err error) (bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.status != DEVICE_QUEUE_STATUS_INIT {
+		return false, errors.New("Not allowed to set status to " + DEVICE_QUEUE_STATUS_FAILED + ", NOW: " + q.status)
+	}
+	q.status = DEVICE_QUEUE_STATUS_FAILED
+	q.err = err
+
+	q.TriggerChange()
+	return true, nil
+}
+
+// stop publishing, devices not published and buffered in channel are not sent, their count returned.
+// workers finish pushes in flight and return when channel closed by Publish.
+func (q *DeviceQueue) Cancel() (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.status == DEVICE_QUEUE_STATUS_INIT || q.status == DEVICE_QUEUE_STATUS_FAILED {
+		return 0, errors.New("Not allowed to cancel, NOW: " + q.status)
+	}
+
+	notSent := len(q.data) - q.Position
+	q.Position = len(q.data)
+	if q.status != DEVICE_QUEUE_STATUS_FINISH {
+		//wake Publish waiting in suspend, a full channel already wakes it
+		q.status = DEVICE_QUEUE_STATUS_FINISH
+		select {
+		case q.queueChangeChannel <- true:
+		default:
+		}
+	}
+
+	for {
+		select {
+		case _, more := <-q.Channel:
+			if !more {
+				return notSent, nil
+			}
+			notSent++
+		default:
+			return notSent, nil
+		}
+	}
+}
+
+// reason of failed status, nil if not failed
+func (q *DeviceQueue) GetError() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.err
+}
+
 func (q *DeviceQueue) ChangePosition(posNew int) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
@@ -213,53 +293,283 @@ func (q *DeviceQueue) AppendFileDataSource(filename string) error {
 	}
 
 	list := bytes.Split(content, []byte("\n"))
+	//newline of last line is not another line
+	if len(list) > 0 && len(list[len(list) - 1]) == 0 {
+		list = list[:len(list) - 1]
+	}
 
+	added, rejected := 0, 0
 	for key, value := range list {
 		//least string conversion
-		err := q.appendInternalData(key, string(value))
-		if err != nil {
-			return err
+		ok, err := q.appendInternalData(q.lines + key, string(value))
+		if ok {
+			added++
+		} else if err != nil {
+			rejected++
 		}
 	}
+	q.lines += len(list)
 
 	q.TriggerChange()
 
+	if added == 0 && rejected > 0 {
+		return errors.New("DeviceQueue.AppendFileDataSource() all devices rejected: " + strconv.Itoa(rejected))
+	}
+
 	return nil
 }
 
 //publish goroutine
+// invalid devices are skipped and counted in rejections, error only if all devices rejected.
 func (q *DeviceQueue) AppendDataSource(list []string) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
+
+	added, rejected := 0, 0
 	for key, value := range list {
-		err := q.appendInternalData(key, value)
-		if err != nil {
-			return err
+		ok, err := q.appendInternalData(q.lines + key, value)
+		if ok {
+			added++
+		} else if err != nil {
+			rejected++
 		}
 	}
+	q.lines += len(list)
 
 	q.TriggerChange()
 
+	if added == 0 && rejected > 0 {
+		return errors.New("DeviceQueue.AppendDataSource() all devices rejected: " + strconv.Itoa(rejected))
+	}
+
 	return nil
 }
 
-func (q *DeviceQueue) appendInternalData(key int, value string) error {
+// true if added, error if rejected, empty line neither
+func (q *DeviceQueue) appendInternalData(key int, value string) (bool, error) {
 	value = strings.Trim(value, "\n\r ")
-
-	//TODO different platfrom device token length is different
-	if len(value) == 64 {
-		q.data = append(q.data, value)
-	} else if len(value) == 0 {
+	if len(value) == 0 {
 		//may last line
+		return false, nil
+	}
+
+	device := NewDeviceByLine(value)
+	err := q.validate(device.Token)
+	if err != nil {
+		q.reject(key + 1, device.Token, err.Error())
+		return false, errors.New("DeviceQueue.appendInternalData() error device token: line " + strconv.Itoa(key + 1) + " -> " + err.Error())
+	}
+
+	q.data = append(q.data, device)
+	return true, nil
+}
+
+func (q *DeviceQueue) validate(token string) error {
+	if q.validator == nil {
+		q.validator = &ApnsTokenValidator{}
+	}
+
+	return q.validator.Validate(token)
+}
+
+//need lock
+func (q *DeviceQueue) reject(line int, token, reason string) {
+	if q.rejections == nil {
+		q.rejections = NewRejectionReport()
+	}
+
+	q.rejections.add(line, token, reason)
+}
+
+// token validator of provider, before appending data
+func (q *DeviceQueue) SetValidator(validator TokenValidator) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.validator = validator
+}
+
+// invalid devices skipped, nil if none
+func (q *DeviceQueue) GetRejections() *RejectionReport {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.rejections == nil {
 		return nil
-	} else {
-		return errors.New("DeviceQueue.appendInternalData() error device token length: line " + strconv.Itoa(key + 1) + " -> " + value)
 	}
-	return nil
+
+	return q.rejections.Snapshot()
+}
+
+// batch items devices, resolve user by registry, invalid item will be marked error instead of failing all.
+func (q *DeviceQueue) AppendBatchItems(items []*BatchItem, registry *DeviceRegistry) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	//item number over all appends, as line of rejections
+	offset := len(q.items)
+	q.items = append(q.items, items...)
+	for iter, item := range items {
+		var devices []*Device
+		if item.DeviceID != "" {
+			devices = append(devices, NewDeviceByLine(item.DeviceID))
+		}
+		if item.UserID != "" {
+			if registry != nil {
+				devices = append(devices, registry.GetUserDevices(item.UserID)...)
+			}
+			if len(devices) == 0 {
+				item.setError("User has no registered device: " + item.UserID)
+				continue
+			}
+		}
+
+		seen := make(map[string]bool, len(devices))
+		for _, device := range devices {
+			//same device of user and deviceid
+			if seen[device.Token] {
+				continue
+			}
+			seen[device.Token] = true
+
+			err := q.validate(device.Token)
+			if err != nil {
+				q.reject(offset + iter + 1, device.Token, err.Error())
+				item.setError("Error device token " + device.Token + ": " + err.Error())
+				continue
+			}
+
+			device.Item = item
+			item.addDevice(device.Token)
+			q.data = append(q.data, device)
+		}
+	}
+
+	q.TriggerChange()
+}
+
+// remove repeated devices of queue and deviceids, keep the first, return removed count
+// batch item devices are not deduped across items, every item has own message.
+func (q *DeviceQueue) Dedupe() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	seen := make(map[string]bool, len(q.data))
+	data := q.data[:0]
+	for _, device := range q.data {
+		if device.Item == nil {
+			if seen[device.Token] {
+				continue
+			}
+			seen[device.Token] = true
+		}
+		data = append(data, device)
+	}
+
+	removed := len(q.data) - len(data)
+	q.data = data
+
+	return removed
+}
+
+// fill empty device locale from registry
+func (q *DeviceQueue) ResolveLocales(registry *DeviceRegistry) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if registry == nil {
+		return
+	}
+
+	for _, device := range q.data {
+		if device.Locale == "" {
+			device.Locale, _ = registry.GetLocale(device.Token)
+		}
+	}
+}
+
+// assign A/B testing variants, holdout devices are removed from data
+func (q *DeviceQueue) Partition(split *AudienceSplit) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if split == nil {
+		return
+	}
+
+	data := make([]*Device, 0, len(q.data))
+	assigned := make(map[string]string, len(q.data))
+	for _, device := range q.data {
+		device.Variant = split.Assign(device.Token)
+		if device.Variant == SPLIT_HOLDOUT {
+			q.holdout = append(q.holdout, device)
+		} else {
+			data = append(data, device)
+			assigned[device.Token] = device.Variant
+		}
+	}
+
+	q.data = data
+	q.split = split
+	q.assigned = assigned
+}
+
+func (q *DeviceQueue) GetSplit() *AudienceSplit {
+	return q.split
+}
+
+// variant of device partitioned, false if not in split audience or holdout
+func (q *DeviceQueue) GetVariant(token string) (string, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	variant, ok := q.assigned[token]
+	return variant, ok
+}
+
+// holdout devices in queue source line format
+func (q *DeviceQueue) Holdout() []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	lines := make([]string, len(q.holdout))
+	for iter, device := range q.holdout {
+		lines[iter] = device.String()
+	}
+
+	return lines
+}
+
+func (q *DeviceQueue) GetStatus() string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.status
+}
+
+// devices not published yet
+func (q *DeviceQueue) Remaining() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.data) - q.Position
 }
 
 func (q *DeviceQueue) Len() int {
 	return len(q.data)
 }
 
+// device tokens of queue data
+func (q *DeviceQueue) Tokens() []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	tokens := make([]string, len(q.data))
+	for iter, device := range q.data {
+		tokens[iter] = device.Token
+	}
+
+	return tokens
+}
+
 
@@ -9,6 +9,27 @@ type QueueBuilder struct {
 	//DeviceIDs for working, if not empty, will merge with queue
 	DeviceIDs []string
 
+	//A/B testing split, nil for all devices
+	Split     *AudienceSplit
+
+	//batch items, every item has own message, not merge with queue
+	Items     []*BatchItem
+
+	//max devices of task, 0 for unlimited
+	MaxAudience int
+
+	//task pushes per second, 0 for throttle default
+	Rate      float64
+
+	//task completion callback url, empty for none
+	CallbackUrl string
+
+	//called if async processData failed
+	OnError   func(err error)
+
+	//root span of push-id, nil for no trace
+	Trace     *Span
+
 	//logger
 	server Server
 }
@@ -17,6 +38,10 @@ func NewQueueBuilder(q string, d []string, server Server) (*QueueBuilder) {
 	return &QueueBuilder{QueueName:q, DeviceIDs:d, server:server}
 }
 
+func NewBatchQueueBuilder(items []*BatchItem, server Server) (*QueueBuilder) {
+	return &QueueBuilder{Items:items, server:server}
+}
+
 func (q *QueueBuilder) ToDeviceQueue(Capacity int) (*DeviceQueue, error) {
 	queue := NewQueueByCapacity(Capacity, q.server)
 
@@ -33,38 +58,79 @@ func (q *QueueBuilder) AsyncToDeviceQueue(Capacity int) (*DeviceQueue, error) {
 	queue := NewQueueByCapacity(Capacity, q.server)
 
 	//async process data
-	go q.processData(queue)
+	go q.process(queue)
 
 	return queue, nil
 }
 
-func (q *QueueBuilder) processData(queue *DeviceQueue) (error) {
+// async processData, queue failed and error reported to OnError
+func (q *QueueBuilder) process(queue *DeviceQueue) {
+	err := q.processData(queue)
+	if err == nil {
+		return
+	}
+
+	_, failErr := queue.Fail(err)
+	if failErr != nil {
+		q.server.GetEnv().GetLogger().Println("Error when queue.Fail(): " + failErr.Error())
+	}
+	if q.OnError != nil {
+		q.OnError(err)
+	}
+}
+
+func (q *QueueBuilder) processData(queue *DeviceQueue) (err error) {
+	span := q.Trace.Child("QueueBuilder.processData")
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	queue.SetValidator(q.server.GetEnv().GetTokenValidator())
+
+	if q.Items != nil {
+		q.server.GetEnv().GetLogger().Println("Init DeviceQueue data from batch items:", len(q.Items))
+		queue.AppendBatchItems(q.Items, q.server.GetEnv().GetDeviceRegistry())
+	}
+
+	//one config for whole build, may be swapped by reload
+	qsConfig := q.server.GetEnv().GetQueueSourceConfig()
+
 	//use default
-	if q.DeviceIDs==nil && q.QueueName == "" {
-		q.QueueName=q.server.GetEnv().GetQueueSourceConfig().Value
+	if q.DeviceIDs==nil && q.QueueName == "" && q.Items == nil {
+		q.QueueName=qsConfig.Value
 	}
 
 	if q.QueueName != "" {
 		q.server.GetEnv().GetLogger().Println("Init DeviceQueue data from QueueSource: "+q.QueueName)
 
-		qs, err:=NewQueueSource(q.QueueName, *q.server.GetEnv().GetQueueSourceConfig())
+		sourceSpan := span.Child("QueueSource.GetData")
+		sourceSpan.SetAttribute("method", qsConfig.Method)
+		sourceSpan.SetAttribute("queue", q.QueueName)
+
+		qs, err:=NewQueueSource(q.QueueName, *qsConfig)
 		if err != nil {
+			sourceSpan.SetError(err)
+			sourceSpan.Finish()
+
 			msg:="Error when NewQueueSource(): " + err.Error()
 			q.server.GetEnv().GetLogger().Println(msg)
 			return errors.New(msg)
 		}
 
 		data, err:=qs.GetData()
+		sourceSpan.SetAttribute("devices", len(data))
+		sourceSpan.SetError(err)
+		sourceSpan.Finish()
 		if err != nil {
 			msg:="Error when qs.GetData(): " + err.Error()
 			q.server.GetEnv().GetLogger().Println(msg)
 			return errors.New(msg)
 		}
+		//invalid devices skipped, no device left is checked below
 		err = queue.AppendDataSource(data)
 		if err != nil {
-			msg:="Error when queue.AppendDataSource(): " + err.Error()
-			q.server.GetEnv().GetLogger().Println(msg)
-			return errors.New(msg)
+			q.server.GetEnv().GetLogger().Println("Error when queue.AppendDataSource(): " + err.Error())
 		}
 	}
 
@@ -72,12 +138,24 @@ func (q *QueueBuilder) processData(queue *DeviceQueue) (error) {
 		q.server.GetEnv().GetLogger().Println("Init DeviceQueue data from DeviceIDs parameter.")
 		err := queue.AppendDataSource(q.DeviceIDs)
 		if err != nil {
-			msg:="Error when queue.AppendDataSource(): " + err.Error()
-			q.server.GetEnv().GetLogger().Println(msg)
-			return errors.New(msg)
+			q.server.GetEnv().GetLogger().Println("Error when queue.AppendDataSource(): " + err.Error())
 		}
 	}
 
+	if rejections := queue.GetRejections(); rejections != nil {
+		span.SetAttribute("rejected", rejections.Total)
+		q.server.GetEnv().GetLogger().Println("DeviceQueue rejected invalid devices:", rejections.Total, rejections.Reasons)
+	}
+
+	if removed := queue.Dedupe(); removed > 0 {
+		span.SetAttribute("duplicated", removed)
+		q.server.GetEnv().GetLogger().Println("DeviceQueue removed repeated devices:", removed)
+	}
+
+	//device locale from registry if source has no locale column
+	queue.ResolveLocales(q.server.GetEnv().GetDeviceRegistry())
+
+	span.SetAttribute("devices", len(queue.data))
 	if len(queue.data)<=0 {
 		msg:="Error when qb.processData: No final device queue data available."
 		q.server.GetEnv().GetLogger().Println(msg)
@@ -86,6 +164,18 @@ func (q *QueueBuilder) processData(queue *DeviceQueue) (error) {
 		q.server.GetEnv().GetLogger().Println("Queue data build finish, devices pending to send:", len(queue.data))
 	}
 
+	err = CheckAudience(len(queue.data), q.MaxAudience)
+	if err != nil {
+		msg:="Error when qb.processData: " + err.Error()
+		q.server.GetEnv().GetLogger().Println(msg)
+		return errors.New(msg)
+	}
+
+	if q.Split != nil {
+		queue.Partition(q.Split)
+		q.server.GetEnv().GetLogger().Println("Queue data split by seed " + q.Split.Seed + ", devices pending to send:", len(queue.data), "holdout:", len(queue.holdout))
+	}
+
 	//send pending
 	queue.SetStatus(DEVICE_QUEUE_STATUS_PENDING)
 
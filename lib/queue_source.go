@@ -2,10 +2,14 @@
 package lib
 
 import (
+	"context"
 	"errors"
+	"strconv"
 	"strings"
 	"os"
 	"fmt"
+	"net"
+	"net/url"
 
 	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
@@ -86,6 +90,56 @@ func (qs *QueueSource) GetData() (list []string, err error) {
 	return
 }
 
+// connectivity of queue source for readiness, no data fetched
+// mysql: ping dsn; api: dial api host; file: default queue file readable.
+func PingQueueSource(ctx context.Context, config *QueueSourceConfig) (string, error) {
+	switch config.Method {
+	case QUEUE_SOURCE_METHOD_MYSQL:
+		db, err := sql.Open("mysql", config.MysqlDsn)
+		if err != nil {
+			return "", errors.New("Error when sql.Open(): " + err.Error())
+		}
+		defer db.Close()
+
+		err = db.PingContext(ctx)
+		if err != nil {
+			return "", errors.New("Error when db.Ping(): " + err.Error())
+		}
+		return "mysql connected", nil
+	case QUEUE_SOURCE_METHOD_API:
+		u, err := url.Parse(config.ApiPrefix)
+		if err != nil || u.Host == "" {
+			return "", errors.New("queue.api.uri is not a url: " + config.ApiPrefix)
+		}
+		host := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+
+		dialer := &net.Dialer{}
+		conn, err := dialer.DialContext(ctx, "tcp", host)
+		if err != nil {
+			return "", errors.New("Dial api host error: " + err.Error())
+		}
+		conn.Close()
+		return "api host " + host + " reachable", nil
+	case QUEUE_SOURCE_METHOD_FILE:
+		filename := fmt.Sprintf(config.FilePath, config.Value)
+		file, err := os.Open(filename)
+		if err != nil {
+			return "", err
+		}
+		file.Close()
+		return "file " + filename + " readable", nil
+	}
+
+	return "", errors.New("Unsupport QueueSource method.")
+}
+
 func (qs *QueueSource) geneMysqlSouce() (list []string, err error) {
 	db, err := sql.Open("mysql", qs.config.MysqlDsn)
 	if err != nil {
@@ -94,6 +148,7 @@ func (qs *QueueSource) geneMysqlSouce() (list []string, err error) {
 	defer db.Close()
 
 	var PushID string
+	var Locale sql.NullString
 	var PushList []string
 	rows, err := db.Query(qs.config.Value)
 	if err != nil {
@@ -101,12 +156,31 @@ func (qs *QueueSource) geneMysqlSouce() (list []string, err error) {
 	}
 
 	defer rows.Close()
+
+	//second column is device locale if selected, eg. select PushID, Locale from ..., more columns are an error
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.New("Error when rows.Columns(): " + err.Error())
+	}
+	if len(columns) > 2 {
+		return nil, errors.New("QueueSource mysql query must select device token and optional locale, got " + strconv.Itoa(len(columns)) + " columns: " + strings.Join(columns, ","))
+	}
+
 	for rows.Next() {
-		err := rows.Scan(&PushID)
+		if len(columns) > 1 {
+			err = rows.Scan(&PushID, &Locale)
+		} else {
+			err = rows.Scan(&PushID)
+		}
 		if err != nil {
 			return nil, errors.New("Error when rows.Scan(&PushID): " + err.Error())
 		}
-		PushList = append(PushList, PushID)
+
+		if Locale.Valid && Locale.String != "" {
+			PushList = append(PushList, PushID + DEVICE_COLUMN_SEPARATOR + Locale.String)
+		} else {
+			PushList = append(PushList, PushID)
+		}
 	}
 	err = rows.Err()
 	if err != nil {
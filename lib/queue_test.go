@@ -23,13 +23,13 @@ func TestDeviceQueueTest(t *testing.T) {
 	if err != nil {
 		t.Error("Error in q.AppendDataSource: " + err.Error())
 	}
-	t.Log("q.data: len " + strconv.Itoa(len(q.data)) + ":" + strings.Join(q.data, ", "))
+	t.Log("q.data: len " + strconv.Itoa(len(q.data)) + ":" + strings.Join(q.Tokens(), ", "))
 
 	err = q.AppendFileDataSource("/Users/bruce/project/godev/src/gopush/apns/test_data/test.txt")
 	if err != nil {
 		t.Error("Error in q.AppendDataSource: " + err.Error())
 	}
-	t.Log("q.data: len " + strconv.Itoa(len(q.data)) + ":" + strings.Join(q.data, ", "))
+	t.Log("q.data: len " + strconv.Itoa(len(q.data)) + ":" + strings.Join(q.Tokens(), ", "))
 
 	str:="3523544012e5491b3fe8cf6627eddd123d6aa4191fbebf371191a3ce7d4c02ac\nefdd029e3e62ab46bf089bfe7084d3261471b6f9e0e4225f9851b4e5b8e7f57e"
 	qs:=&QueueSource{}
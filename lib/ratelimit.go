@@ -0,0 +1,143 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Token bucket limiter, rate tokens per second and burst capacity.
+// rate <= 0 means unlimited.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+
+	tokens float64
+	last   time.Time
+
+	lock   sync.Mutex
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	tb := &TokenBucket{}
+	tb.SetRate(rate, burst)
+	tb.tokens = tb.burst
+
+	return tb
+}
+
+// change rate at runtime, burst <= 0 will use max(1, rate)
+func (tb *TokenBucket) SetRate(rate float64, burst int) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill(time.Now())
+
+	tb.rate = rate
+	if burst > 0 {
+		tb.burst = float64(burst)
+	} else {
+		tb.burst = math.Max(1, rate)
+	}
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+func (tb *TokenBucket) GetRate() float64 {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	return tb.rate
+}
+
+//need lock
+func (tb *TokenBucket) refill(now time.Time) {
+	if !tb.last.IsZero() && tb.rate > 0 {
+		tb.tokens = math.Min(tb.burst, tb.tokens + now.Sub(tb.last).Seconds() * tb.rate)
+	}
+	tb.last = now
+}
+
+// a token available, or the duration until next token, not taken
+func (tb *TokenBucket) Available() (bool, time.Duration) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	if tb.rate <= 0 {
+		return true, 0
+	}
+
+	tb.refill(time.Now())
+	if tb.tokens >= 1 {
+		return true, 0
+	}
+
+	return false, time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// take a token if available, or the duration until next token
+func (tb *TokenBucket) Allow() (bool, time.Duration) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	if tb.rate <= 0 {
+		return true, 0
+	}
+
+	tb.refill(time.Now())
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// take a token, block for its deficit. false if stop closed first, token given back.
+// stop nil never stops.
+func (tb *TokenBucket) Wait(stop <-chan struct{}) bool {
+	wait := tb.reserve()
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		tb.refund()
+		return false
+	}
+}
+
+// give back a taken token, never over burst
+func (tb *TokenBucket) refund() {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill(time.Now())
+	tb.tokens = math.Min(tb.burst, tb.tokens + 1)
+}
+
+// take a token in advance, tokens may go negative, duration until it is due
+func (tb *TokenBucket) reserve() time.Duration {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	if tb.rate <= 0 {
+		return 0
+	}
+
+	tb.refill(time.Now())
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
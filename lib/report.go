@@ -0,0 +1,349 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	REPORT_FORMAT_JSON = "json"
+	REPORT_FORMAT_CSV = "csv"
+
+	//reason of failed device without provider reason, eg. connection broken
+	REPORT_REASON_ERROR = "RequestError"
+)
+
+type DeliveryLatency struct {
+	P50 int64 `json:"p50_us"`
+	P90 int64 `json:"p90_us"`
+	P99 int64 `json:"p99_us"`
+	Max int64 `json:"max_us"`
+}
+
+type DeliveryFailure struct {
+	Token  string `json:"token"`
+	Reason string `json:"reason"`
+}
+
+// Delivery report of a push-id, devices are counted by the last attempt
+type DeliveryReport struct {
+	PushID     string `json:"push_id"`
+
+	Devices    int `json:"devices"`
+	Attempts   int `json:"attempts"`
+	Sent       int `json:"sent"`
+	Failed     int `json:"failed"`
+
+	//failed devices by reason
+	Reasons    map[string]int `json:"reasons"`
+
+	//of all attempts
+	Latency    DeliveryLatency `json:"latency"`
+
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	//in seconds
+	Duration   float64 `json:"duration"`
+	//attempts per second
+	Throughput float64 `json:"throughput"`
+
+	//failed devices for re-targeting, sorted by token
+	Failures   []*DeliveryFailure `json:"failures"`
+}
+
+// Collect delivery records of a push-id, others ignored
+type DeliveryReportBuilder struct {
+	pushID    string
+	attempts  int
+	latencies []int64
+	start     time.Time
+	end       time.Time
+
+	//token -> last attempt
+	last      map[string]*DeliveryRecord
+}
+
+func NewDeliveryReportBuilder(pushID string) *DeliveryReportBuilder {
+	return &DeliveryReportBuilder{pushID:pushID, last:make(map[string]*DeliveryRecord)}
+}
+
+func (b *DeliveryReportBuilder) Add(record *DeliveryRecord) {
+	if record.PushID != b.pushID {
+		return
+	}
+
+	b.attempts++
+	b.latencies = append(b.latencies, record.Latency)
+	if b.start.IsZero() || record.Timestamp.Before(b.start) {
+		b.start = record.Timestamp
+	}
+	if record.Timestamp.After(b.end) {
+		b.end = record.Timestamp
+	}
+
+	last, ok := b.last[record.Token]
+	if !ok || record.Attempt > last.Attempt || (record.Attempt == last.Attempt && !record.Timestamp.Before(last.Timestamp)) {
+		b.last[record.Token] = record
+	}
+}
+
+func (b *DeliveryReportBuilder) Report() *DeliveryReport {
+	report := &DeliveryReport{PushID:b.pushID, Devices:len(b.last), Attempts:b.attempts, Reasons:make(map[string]int),
+		Start:b.start, End:b.end, Failures:[]*DeliveryFailure{}}
+
+	for token, record := range b.last {
+		if record.Status == DELIVERY_STATUS_SENT {
+			report.Sent++
+			continue
+		}
+
+		reason := record.Reason
+		if record.Status == DELIVERY_STATUS_ERROR || reason == "" {
+			reason = REPORT_REASON_ERROR
+		}
+		report.Failed++
+		report.Reasons[reason]++
+		report.Failures = append(report.Failures, &DeliveryFailure{Token:token, Reason:reason})
+	}
+	sort.Slice(report.Failures, func(i, j int) bool {
+		return report.Failures[i].Token < report.Failures[j].Token
+	})
+
+	latencies := make([]int64, len(b.latencies))
+	copy(latencies, b.latencies)
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	report.Latency = DeliveryLatency{P50:percentile(latencies, 50), P90:percentile(latencies, 90),
+		P99:percentile(latencies, 99), Max:percentile(latencies, 100)}
+
+	report.Duration = b.end.Sub(b.start).Seconds()
+	if report.Duration > 0 {
+		report.Throughput = float64(b.attempts) / report.Duration
+	} else {
+		report.Throughput = float64(b.attempts)
+	}
+
+	return report
+}
+
+//nearest rank of sorted values
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(float64(p) / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank - 1]
+}
+
+// Report of push-id from delivery record files of path, json lines preferred if both written.
+// only files of days from..to scanned, records of a push-id may cross midnight.
+// zero from scans all days kept, zero to is today.
+func ReadDeliveryReport(path, pushID string, from, to time.Time) (*DeliveryReport, error) {
+	builder := NewDeliveryReportBuilder(pushID)
+
+	files, err := filepath.Glob(path + "-*.jsonl")
+	if err != nil {
+		return nil, errors.New("ReadDeliveryReport(): " + err.Error())
+	}
+	read := readDeliveryJson
+	if len(files) == 0 {
+		files, err = filepath.Glob(path + "-*.csv")
+		if err != nil {
+			return nil, errors.New("ReadDeliveryReport(): " + err.Error())
+		}
+		read = readDeliveryCsv
+	}
+	if len(files) == 0 {
+		return nil, errors.New("No delivery record files of " + path)
+	}
+	if !from.IsZero() {
+		files = deliveryFilesOfDays(path, files, from, to)
+	}
+
+	for _, name := range files {
+		err = read(name, builder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report := builder.Report()
+	if report.Attempts == 0 {
+		return nil, errors.New("No delivery records of push-id: " + pushID)
+	}
+
+	return report, nil
+}
+
+// day of delivery file name, eg. 20161010 of path-20161010.jsonl, empty if not
+func deliveryFileDay(path, name string) string {
+	day := strings.TrimPrefix(filepath.Base(name), filepath.Base(path) + "-")
+	day = strings.TrimSuffix(strings.TrimSuffix(day, ".jsonl"), ".csv")
+	if _, err := time.ParseInLocation(DELIVERY_FILE_DATE, day, time.Local); err != nil {
+		return ""
+	}
+
+	return day
+}
+
+func deliveryFilesOfDays(path string, files []string, from, to time.Time) []string {
+	if to.IsZero() || to.Before(from) {
+		to = time.Now()
+	}
+	first, last := from.Format(DELIVERY_FILE_DATE), to.Format(DELIVERY_FILE_DATE)
+
+	selected := []string{}
+	for _, name := range files {
+		day := deliveryFileDay(path, name)
+		if day != "" && day >= first && day <= last {
+			selected = append(selected, name)
+		}
+	}
+
+	return selected
+}
+
+func readDeliveryJson(name string, builder *DeliveryReportBuilder) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return errors.New("readDeliveryJson(): " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := &DeliveryRecord{}
+		if json.Unmarshal(scanner.Bytes(), record) != nil {
+			//broken line, may crash when writing
+			continue
+		}
+		builder.Add(record)
+	}
+	if scanner.Err() != nil {
+		return errors.New("readDeliveryJson(): " + scanner.Err().Error())
+	}
+
+	return nil
+}
+
+func readDeliveryCsv(name string, builder *DeliveryReportBuilder) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return errors.New("readDeliveryCsv(): " + err.Error())
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//broken line, may crash when writing
+			continue
+		}
+
+		record, err := parseDeliveryCsvRow(row)
+		if err != nil {
+			//header or broken line
+			continue
+		}
+		builder.Add(record)
+	}
+
+	return nil
+}
+
+//reverse of DeliveryRecord.csvRow()
+func parseDeliveryCsvRow(row []string) (*DeliveryRecord, error) {
+	if len(row) != len(deliveryCsvHeader) {
+		return nil, errors.New("Delivery csv row columns error.")
+	}
+
+	record := &DeliveryRecord{PushID:row[0], App:row[1], Token:row[2], Provider:row[3], Status:row[4], Reason:row[6],
+		ApnsID:row[7], Worker:row[10]}
+
+	var err error
+	record.Code, err = strconv.Atoi(row[5])
+	if err != nil {
+		return nil, err
+	}
+	record.Latency, err = strconv.ParseInt(row[8], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	record.Attempt, err = strconv.Atoi(row[9])
+	if err != nil {
+		return nil, err
+	}
+	record.Timestamp, err = time.Parse(time.RFC3339Nano, row[11])
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// csv of report, rows of section,name,value: summary metrics, reason counts and failed tokens
+func (r *DeliveryReport) WriteCsv(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"section", "name", "value"})
+
+	summary := [][]string{
+		{"push_id", r.PushID},
+		{"devices", strconv.Itoa(r.Devices)},
+		{"attempts", strconv.Itoa(r.Attempts)},
+		{"sent", strconv.Itoa(r.Sent)},
+		{"failed", strconv.Itoa(r.Failed)},
+		{"latency_p50_us", strconv.FormatInt(r.Latency.P50, 10)},
+		{"latency_p90_us", strconv.FormatInt(r.Latency.P90, 10)},
+		{"latency_p99_us", strconv.FormatInt(r.Latency.P99, 10)},
+		{"latency_max_us", strconv.FormatInt(r.Latency.Max, 10)},
+		{"start", r.Start.Format(time.RFC3339Nano)},
+		{"end", r.End.Format(time.RFC3339Nano)},
+		{"duration", strconv.FormatFloat(r.Duration, 'f', 3, 64)},
+		{"throughput", strconv.FormatFloat(r.Throughput, 'f', 2, 64)},
+	}
+	for _, row := range summary {
+		writer.Write(append([]string{"summary"}, row...))
+	}
+
+	reasons := make([]string, 0, len(r.Reasons))
+	for reason := range r.Reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		writer.Write([]string{"reason", reason, strconv.Itoa(r.Reasons[reason])})
+	}
+
+	for _, failure := range r.Failures {
+		writer.Write([]string{"failed", failure.Token, failure.Reason})
+	}
+
+	writer.Flush()
+	if writer.Error() != nil {
+		return errors.New("DeliveryReport.WriteCsv(): " + writer.Error().Error())
+	}
+
+	return nil
+}
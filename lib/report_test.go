@@ -0,0 +1,123 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeliveryReportTesting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "delivery")
+
+	for _, format := range []string{DELIVERY_FORMAT_CSV, DELIVERY_FORMAT_JSON} {
+		sink, err := NewDeliverySink(format, path + format, 0)
+		if err != nil {
+			t.Fatalf("NewDeliverySink() error: %s", err.Error())
+		}
+
+		//100 sent with latency 1..100ms, 2 unregistered, 1 connection error retried and sent, 1 error
+		write := func(token string, attempt int, resp *WorkerResponse) {
+			record := NewDeliveryRecord("push1", "com.app", PROVIDER_APNS, "pool_0_worker_0", &Device{Token:token, Attempts:attempt}, resp)
+			if err := sink.Write(record); err != nil {
+				t.Fatalf("DeliverySink.Write() error: %s", err.Error())
+			}
+		}
+		for iter := 1; iter <= 100; iter++ {
+			write("sent" + strconv.Itoa(iter), 1, &WorkerResponse{Sent:true, StatusCode:200, Latency:time.Duration(iter) * time.Millisecond})
+		}
+		write("gone1", 1, &WorkerResponse{StatusCode:410, Reason:"Unregistered"})
+		write("gone2", 1, &WorkerResponse{StatusCode:410, Reason:"Unregistered"})
+		write("retry", 1, &WorkerResponse{Error:errors.New("broken")})
+		write("retry", 2, &WorkerResponse{Sent:true, StatusCode:200})
+		write("broken", 1, &WorkerResponse{Error:errors.New("broken")})
+		write("other", 1, &WorkerResponse{Sent:true})
+		sink.Write(&DeliveryRecord{PushID:"push2", Token:"other", Status:DELIVERY_STATUS_SENT, Timestamp:time.Now()})
+		sink.Close()
+
+		report, err := ReadDeliveryReport(path + format, "push1", time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatalf("%s ReadDeliveryReport() error: %s", format, err.Error())
+		}
+		if report.Devices != 105 || report.Attempts != 106 || report.Sent != 102 || report.Failed != 3 {
+			t.Errorf("%s report totals error: %+v", format, report)
+		}
+		if report.Reasons["Unregistered"] != 2 || report.Reasons[REPORT_REASON_ERROR] != 1 {
+			t.Errorf("%s report reasons error: %v", format, report.Reasons)
+		}
+		if len(report.Failures) != 3 || report.Failures[0].Token != "broken" || report.Failures[1].Token != "gone1" {
+			t.Errorf("%s report failures error: %v", format, report.Failures)
+		}
+		if report.Latency.P99 != 99000 || report.Latency.Max != 100000 {
+			t.Errorf("%s report latency error: %+v", format, report.Latency)
+		}
+		if report.Start.IsZero() || report.End.Before(report.Start) || report.Throughput <= 0 {
+			t.Errorf("%s report duration error: %+v", format, report)
+		}
+
+		buf := &bytes.Buffer{}
+		err = report.WriteCsv(buf)
+		if err != nil {
+			t.Fatalf("WriteCsv() error: %s", err.Error())
+		}
+		rows, err := csv.NewReader(buf).ReadAll()
+		if err != nil || len(rows) != 1 + 13 + 2 + 3 || rows[len(rows) - 1][0] != "failed" {
+			t.Errorf("WriteCsv() rows error: %v %v", err, rows)
+		}
+	}
+
+	if _, err := ReadDeliveryReport(path + DELIVERY_FORMAT_JSON, "push3", time.Time{}, time.Time{}); err == nil {
+		t.Errorf("ReadDeliveryReport() of unknown push-id should be error")
+	}
+}
+
+func TestDeliveryReportDaysTesting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatalf("TempDir() error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "delivery")
+
+	//push-id of an old day out of task days and retention
+	old := &DeliveryRecord{PushID:"push1", Token:"old", Status:DELIVERY_STATUS_SENT, Timestamp:time.Now().AddDate(0, 0, -40)}
+	line, _ := json.Marshal(old)
+	oldName := path + "-" + old.Timestamp.Format(DELIVERY_FILE_DATE) + ".jsonl"
+	if err = ioutil.WriteFile(oldName, append(line, '\n'), 0644); err != nil {
+		t.Fatalf("WriteFile() error: %s", err.Error())
+	}
+
+	report, err := ReadDeliveryReport(path, "push1", time.Time{}, time.Time{})
+	if err != nil || report.Devices != 1 {
+		t.Fatalf("ReadDeliveryReport() of all days expect old record, got %+v %v", report, err)
+	}
+
+	sink, err := NewDeliverySink(DELIVERY_FORMAT_JSON, path, DELIVERY_DEFAULT_RETENTION)
+	if err != nil {
+		t.Fatalf("NewDeliverySink() error: %s", err.Error())
+	}
+	created := time.Now()
+	sink.Write(&DeliveryRecord{PushID:"push1", Token:"new", Status:DELIVERY_STATUS_SENT, Timestamp:created})
+	if _, err = os.Stat(oldName); !os.IsNotExist(err) {
+		t.Errorf("DeliverySink expect file out of retention removed, got %v", err)
+	}
+	ioutil.WriteFile(oldName, append(line, '\n'), 0644)
+
+	report, err = sink.Report("push1", created, time.Time{})
+	sink.Close()
+	if err != nil || report.Devices != 1 {
+		t.Errorf("DeliverySink.Report() expect only days of task, got %+v %v", report, err)
+	}
+}
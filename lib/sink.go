@@ -0,0 +1,259 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SINK_TYPE_MYSQL = "mysql"
+	SINK_TYPE_WEBHOOK = "webhook"
+	SINK_TYPE_FILE = "file"
+
+	//records buffered, dropped when full
+	SINK_DEFAULT_BUFFER = 10000
+	SINK_DEFAULT_BATCH = 500
+	SINK_DEFAULT_FLUSH_INTERVAL = time.Second
+	//batch dropped after retries
+	SINK_DEFAULT_RETRIES = 3
+	SINK_RETRY_WAIT = 500 * time.Millisecond
+)
+
+// Destination of delivery records, eg. mysql table, webhook, message log file
+type ResultSink interface {
+	GetType() string
+
+	// write records at once, called by one goroutine
+	WriteBatch(records []*DeliveryRecord) error
+
+	Close() error
+}
+
+type ResultSinkStats struct {
+	Written   int64 `json:"written"`
+	//records of batches failed after retries
+	Dropped   int64 `json:"dropped"`
+	LastError string `json:"last_error,omitempty"`
+	//records dropped of buffer full, included in Dropped
+	Overflow  int64 `json:"overflow"`
+}
+
+// Buffer records of a sink and write in batches.
+// Put never blocks, a down sink must not stall workers, records are dropped when buffer full.
+type BufferedSink struct {
+	Name      string
+	Sink      ResultSink
+
+	//apps accepted, empty for all apps
+	apps      map[string]bool
+
+	batch     int
+	interval  time.Duration
+	retries   int
+
+	//called when batch dropped, eg. logging, can be nil
+	onError   func(name string, err error)
+
+	records   chan *DeliveryRecord
+	done      chan bool
+	stats     ResultSinkStats
+	//buffer full reported, until a batch written
+	overflow  bool
+	lock      sync.Mutex
+
+	//Put of workers after Close on shutdown ignored
+	closed    bool
+	closeLock sync.RWMutex
+}
+
+func NewBufferedSink(name string, sink ResultSink, apps []string, buffer, batch int, interval time.Duration, onError func(name string, err error)) (*BufferedSink, error) {
+	if sink == nil {
+		return nil, errors.New("Result sink " + name + " is nil.")
+	}
+	if buffer <= 0 {
+		buffer = SINK_DEFAULT_BUFFER
+	}
+	if batch <= 0 {
+		batch = SINK_DEFAULT_BATCH
+	}
+	if batch > buffer {
+		batch = buffer
+	}
+	if interval <= 0 {
+		interval = SINK_DEFAULT_FLUSH_INTERVAL
+	}
+
+	bs := &BufferedSink{Name:name, Sink:sink, apps:make(map[string]bool), batch:batch, interval:interval, retries:SINK_DEFAULT_RETRIES,
+		onError:onError, records:make(chan *DeliveryRecord, buffer), done:make(chan bool)}
+	for _, app := range apps {
+		app = strings.TrimSpace(app)
+		if app != "" {
+			bs.apps[app] = true
+		}
+	}
+
+	go bs.run()
+	return bs, nil
+}
+
+func (bs *BufferedSink) Accept(app string) bool {
+	return len(bs.apps) == 0 || bs.apps[app]
+}
+
+// dropped if buffer full, error reported once until sink recovers
+func (bs *BufferedSink) Put(record *DeliveryRecord) {
+	bs.closeLock.RLock()
+	if bs.closed {
+		bs.closeLock.RUnlock()
+		return
+	}
+	select {
+	case bs.records <- record:
+		bs.closeLock.RUnlock()
+		return
+	default:
+	}
+	bs.closeLock.RUnlock()
+
+	bs.lock.Lock()
+	bs.stats.Dropped++
+	bs.stats.Overflow++
+	report := !bs.overflow
+	bs.overflow = true
+	bs.lock.Unlock()
+
+	if report && bs.onError != nil {
+		bs.onError(bs.Name, errors.New("buffer of " + bs.Sink.GetType() + " full, dropping records."))
+	}
+}
+
+// records waiting in buffer
+func (bs *BufferedSink) Pending() int {
+	return len(bs.records)
+}
+
+func (bs *BufferedSink) GetStats() ResultSinkStats {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	return bs.stats
+}
+
+func (bs *BufferedSink) run() {
+	ticker := time.NewTicker(bs.interval)
+	defer ticker.Stop()
+
+	batch := make([]*DeliveryRecord, 0, bs.batch)
+	for {
+		select {
+		case record, more := <-bs.records:
+			if !more {
+				bs.flush(batch)
+				close(bs.done)
+				return
+			}
+
+			batch = append(batch, record)
+			if len(batch) >= bs.batch {
+				bs.flush(batch)
+				batch = make([]*DeliveryRecord, 0, bs.batch)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				bs.flush(batch)
+				batch = make([]*DeliveryRecord, 0, bs.batch)
+			}
+		}
+	}
+}
+
+func (bs *BufferedSink) flush(batch []*DeliveryRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	for attempt := 0; attempt <= bs.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * SINK_RETRY_WAIT)
+		}
+
+		err = bs.Sink.WriteBatch(batch)
+		if err == nil {
+			break
+		}
+	}
+
+	bs.lock.Lock()
+	if err == nil {
+		bs.stats.Written += int64(len(batch))
+		bs.overflow = false
+	} else {
+		bs.stats.Dropped += int64(len(batch))
+		bs.stats.LastError = err.Error()
+	}
+	bs.lock.Unlock()
+
+	if err != nil && bs.onError != nil {
+		bs.onError(bs.Name, errors.New("batch of " + bs.Sink.GetType() + " dropped: " + err.Error()))
+	}
+}
+
+// flush buffered records and close sink, Put after Close ignored
+func (bs *BufferedSink) Close() error {
+	bs.closeLock.Lock()
+	if bs.closed {
+		bs.closeLock.Unlock()
+		return nil
+	}
+	bs.closed = true
+	close(bs.records)
+	bs.closeLock.Unlock()
+	<-bs.done
+
+	return bs.Sink.Close()
+}
+
+// All result sinks, record put to sinks of its app
+type ResultSinks struct {
+	sinks []*BufferedSink
+}
+
+func NewResultSinks() *ResultSinks {
+	return &ResultSinks{}
+}
+
+func (rs *ResultSinks) Add(sink *BufferedSink) {
+	rs.sinks = append(rs.sinks, sink)
+}
+
+func (rs *ResultSinks) Put(record *DeliveryRecord) {
+	for _, sink := range rs.sinks {
+		if sink.Accept(record.App) {
+			sink.Put(record)
+		}
+	}
+}
+
+func (rs *ResultSinks) Len() int {
+	return len(rs.sinks)
+}
+
+func (rs *ResultSinks) List() []*BufferedSink {
+	return rs.sinks
+}
+
+func (rs *ResultSinks) Close() error {
+	var last error
+	for _, sink := range rs.sinks {
+		err := sink.Close()
+		if err != nil {
+			last = errors.New("Close result sink " + sink.Name + " error: " + err.Error())
+		}
+	}
+
+	return last
+}
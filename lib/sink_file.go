@@ -0,0 +1,209 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"zooinit/log"
+)
+
+const (
+	//segment file rolled after size
+	SINK_FILE_DEFAULT_SEGMENT_SIZE = 128 * 1024 * 1024
+	SINK_FILE_SEGMENT_SUFFIX = ".log"
+)
+
+// A line of message log
+type FileResultMessage struct {
+	Offset int64 `json:"offset"`
+	Record *DeliveryRecord `json:"record"`
+}
+
+// Append only message log in dir for downstream ETL, a json line per record with increasing offset.
+// segments named by first offset like kafka, eg. 00000000000000000000.log, consumers keep their offset
+// and read segments in name order, finished segments never change.
+type FileResultSink struct {
+	Dir         string
+	SegmentSize int64
+
+	//offset of next record
+	offset      int64
+	size        int64
+	file        *os.File
+}
+
+func NewFileResultSink(dir string, segmentSize int64) (*FileResultSink, error) {
+	if dir == "" {
+		return nil, errors.New("File result sink dir is empty.")
+	}
+	if segmentSize <= 0 {
+		segmentSize = SINK_FILE_DEFAULT_SEGMENT_SIZE
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.New("NewFileResultSink(): " + err.Error())
+	}
+
+	s := &FileResultSink{Dir:dir, SegmentSize:segmentSize}
+	err = s.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func segmentName(offset int64) string {
+	return fmt.Sprintf("%020d", offset) + SINK_FILE_SEGMENT_SUFFIX
+}
+
+// segment first offsets in order
+func (s *FileResultSink) segments() ([]int64, error) {
+	names, err := filepath.Glob(filepath.Join(s.Dir, "*" + SINK_FILE_SEGMENT_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := []int64{}
+	for _, name := range names {
+		offset, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), SINK_FILE_SEGMENT_SUFFIX), 10, 64)
+		if err == nil {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+
+	return offsets, nil
+}
+
+//continue offset of last segment
+func (s *FileResultSink) recover() error {
+	offsets, err := s.segments()
+	if err != nil {
+		return errors.New("FileResultSink.recover(): " + err.Error())
+	}
+	if len(offsets) == 0 {
+		return s.roll(0)
+	}
+
+	last := offsets[len(offsets) - 1]
+	file, err := os.Open(filepath.Join(s.Dir, segmentName(last)))
+	if err != nil {
+		return errors.New("FileResultSink.recover(): " + err.Error())
+	}
+	s.offset = last
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+	for scanner.Scan() {
+		message := &FileResultMessage{}
+		//broken line, may crash when writing
+		if json.Unmarshal(scanner.Bytes(), message) == nil && message.Offset >= s.offset {
+			s.offset = message.Offset + 1
+		}
+	}
+	file.Close()
+	if scanner.Err() != nil {
+		return errors.New("FileResultSink.recover(): " + scanner.Err().Error())
+	}
+
+	file, err = os.OpenFile(filepath.Join(s.Dir, segmentName(last)), os.O_CREATE | os.O_APPEND | os.O_WRONLY, log.DEFAULT_LOGFILE_MODE)
+	if err != nil {
+		return errors.New("FileResultSink.recover(): " + err.Error())
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.New("FileResultSink.recover(): " + err.Error())
+	}
+	s.file = file
+	s.size = info.Size()
+
+	return nil
+}
+
+//start a new segment from offset
+func (s *FileResultSink) roll(offset int64) error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	file, err := os.OpenFile(filepath.Join(s.Dir, segmentName(offset)), os.O_CREATE | os.O_APPEND | os.O_WRONLY, log.DEFAULT_LOGFILE_MODE)
+	if err != nil {
+		return errors.New("FileResultSink.roll(): " + err.Error())
+	}
+
+	s.file = file
+	s.offset = offset
+	s.size = 0
+	return nil
+}
+
+func (s *FileResultSink) GetType() string {
+	return SINK_TYPE_FILE
+}
+
+// a batch in one write, offsets advanced only if written
+func (s *FileResultSink) WriteBatch(records []*DeliveryRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	if s.size >= s.SegmentSize {
+		err := s.roll(s.offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := []byte{}
+	for iter, record := range records {
+		line, err := json.Marshal(&FileResultMessage{Offset:s.offset + int64(iter), Record:record})
+		if err != nil {
+			return errors.New("FileResultSink.WriteBatch(): " + err.Error())
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	n, err := s.file.Write(buf)
+	if err != nil {
+		//drop partial lines, a retry of batch writes them again
+		if n > 0 {
+			terr := s.file.Truncate(s.size)
+			if terr != nil {
+				return errors.New("FileResultSink.WriteBatch(): " + err.Error() + ", truncate error: " + terr.Error())
+			}
+		}
+		return errors.New("FileResultSink.WriteBatch(): " + err.Error())
+	}
+	s.size += int64(n)
+	s.offset += int64(len(records))
+
+	return nil
+}
+
+// offset of next record
+func (s *FileResultSink) GetOffset() int64 {
+	return s.offset
+}
+
+func (s *FileResultSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"database/sql"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+const (
+	SINK_MYSQL_DEFAULT_TABLE = "push_delivery"
+	//mysql prepared statement limit
+	SINK_MYSQL_MAX_PLACEHOLDERS = 65535
+)
+
+var (
+	sinkMysqlTablePattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)?$`)
+
+	sinkMysqlColumns = []string{"push_id", "app", "token", "provider", "status", "code", "reason", "apns_id", "latency_us", "attempt", "worker", "created_at"}
+)
+
+// Batched insert into mysql table, table need to be created:
+// CREATE TABLE push_delivery (id bigint auto_increment primary key, push_id varchar(64), app varchar(255), token varchar(4096),
+// provider varchar(16), status varchar(16), code int, reason varchar(255), apns_id varchar(64), latency_us bigint, attempt int,
+// worker varchar(64), created_at datetime(6), key(push_id));
+type MysqlResultSink struct {
+	Table string
+
+	db    *sql.DB
+}
+
+func NewMysqlResultSink(dsn, table string) (*MysqlResultSink, error) {
+	if dsn == "" {
+		return nil, errors.New("Mysql result sink dsn is empty.")
+	}
+	if table == "" {
+		table = SINK_MYSQL_DEFAULT_TABLE
+	}
+	if !sinkMysqlTablePattern.MatchString(table) {
+		return nil, errors.New("Mysql result sink table name invalid: " + table)
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, errors.New("Error when sql.Open(): " + err.Error())
+	}
+
+	return &MysqlResultSink{Table:table, db:db}, nil
+}
+
+func (s *MysqlResultSink) GetType() string {
+	return SINK_TYPE_MYSQL
+}
+
+// insert statements of batch within placeholders limit, in one transaction so a retry never duplicates rows
+func (s *MysqlResultSink) WriteBatch(records []*DeliveryRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.New("Error when db.Begin: " + err.Error())
+	}
+	for _, chunk := range s.chunks(records) {
+		query, args := s.insert(chunk)
+		_, err = tx.Exec(query, args...)
+		if err != nil {
+			tx.Rollback()
+			return errors.New("Error when db.Exec: " + err.Error())
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.New("Error when tx.Commit: " + err.Error())
+	}
+
+	return nil
+}
+
+// records split by max rows of a statement
+func (s *MysqlResultSink) chunks(records []*DeliveryRecord) [][]*DeliveryRecord {
+	size := SINK_MYSQL_MAX_PLACEHOLDERS / len(sinkMysqlColumns)
+
+	chunks := [][]*DeliveryRecord{}
+	for len(records) > size {
+		chunks = append(chunks, records[:size])
+		records = records[size:]
+	}
+
+	return append(chunks, records)
+}
+
+func (s *MysqlResultSink) insert(records []*DeliveryRecord) (string, []interface{}) {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?,", len(sinkMysqlColumns)), ",") + ")"
+	rows := make([]string, len(records))
+	args := make([]interface{}, 0, len(records) * len(sinkMysqlColumns))
+	for iter, r := range records {
+		rows[iter] = row
+		args = append(args, r.PushID, r.App, r.Token, r.Provider, r.Status, r.Code, r.Reason, r.ApnsID, r.Latency, r.Attempt, r.Worker, r.Timestamp)
+	}
+
+	return "INSERT INTO " + s.Table + " (" + strings.Join(sinkMysqlColumns, ",") + ") VALUES " + strings.Join(rows, ","), args
+}
+
+func (s *MysqlResultSink) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,237 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testResultSink struct {
+	batches [][]*DeliveryRecord
+	fail    bool
+	//block WriteBatch until closed
+	block   chan bool
+	lock    sync.Mutex
+}
+
+func (s *testResultSink) GetType() string {
+	return "test"
+}
+
+func (s *testResultSink) WriteBatch(records []*DeliveryRecord) error {
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.fail {
+		return errors.New("sink down")
+	}
+	s.batches = append(s.batches, records)
+	return nil
+}
+
+func (s *testResultSink) Close() error {
+	return nil
+}
+
+func (s *testResultSink) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+	for _, batch := range s.batches {
+		count += len(batch)
+	}
+	return count
+}
+
+func testDeliveryRecords(app string, count int) []*DeliveryRecord {
+	records := make([]*DeliveryRecord, count)
+	for iter := range records {
+		records[iter] = &DeliveryRecord{PushID:"push1", App:app, Token:"token" + strconv.Itoa(iter), Status:DELIVERY_STATUS_SENT, Timestamp:time.Now()}
+	}
+	return records
+}
+
+func TestResultSinksTesting(t *testing.T) {
+	//batch by size and app filter
+	all := &testResultSink{}
+	one := &testResultSink{}
+	allSink, _ := NewBufferedSink("all", all, nil, 100, 10, time.Hour, nil)
+	oneSink, _ := NewBufferedSink("one", one, []string{"com.one"}, 100, 10, time.Hour, nil)
+	sinks := NewResultSinks()
+	sinks.Add(allSink)
+	sinks.Add(oneSink)
+	for _, record := range append(testDeliveryRecords("com.one", 25), testDeliveryRecords("com.two", 10)...) {
+		sinks.Put(record)
+	}
+	if err := sinks.Close(); err != nil {
+		t.Fatalf("ResultSinks.Close() error: %s", err.Error())
+	}
+	if all.count() != 35 || one.count() != 25 || len(all.batches[0]) != 10 {
+		t.Errorf("ResultSinks expect all 35 and one 25 in batches of 10, got %d %d", all.count(), one.count())
+	}
+	if allSink.GetStats().Written != 35 {
+		t.Errorf("BufferedSink stats error: %+v", allSink.GetStats())
+	}
+
+	//flush by interval
+	ticked := &testResultSink{}
+	tickedSink, _ := NewBufferedSink("ticked", ticked, nil, 100, 10, 10 * time.Millisecond, nil)
+	tickedSink.Put(testDeliveryRecords("com.one", 1)[0])
+	time.Sleep(100 * time.Millisecond)
+	if ticked.count() != 1 {
+		t.Errorf("BufferedSink expect flush by interval, got %d", ticked.count())
+	}
+	tickedSink.Close()
+
+	//down sink: put never blocks, overflow dropped
+	var overflow error
+	slow := &testResultSink{block:make(chan bool)}
+	slowSink, _ := NewBufferedSink("slow", slow, nil, 2, 1, time.Hour, func(name string, err error) {
+		overflow = err
+	})
+	put := make(chan bool)
+	go func() {
+		for _, record := range testDeliveryRecords("com.one", 5) {
+			slowSink.Put(record)
+		}
+		close(put)
+	}()
+	select {
+	case <-put:
+	case <-time.After(time.Second):
+		t.Fatalf("BufferedSink.Put() should not block when buffer full")
+	}
+	if overflow == nil || slowSink.GetStats().Overflow == 0 || slowSink.GetStats().Overflow != slowSink.GetStats().Dropped {
+		t.Errorf("BufferedSink expect overflow dropped and reported, got %+v", slowSink.GetStats())
+	}
+	close(slow.block)
+	slowSink.Close()
+	if int64(slow.count()) + slowSink.GetStats().Overflow != 5 {
+		t.Errorf("BufferedSink expect written and overflow 5, got %d %+v", slow.count(), slowSink.GetStats())
+	}
+	//ignored after close
+	slowSink.Put(testDeliveryRecords("com.one", 1)[0])
+	if slowSink.Close() != nil {
+		t.Errorf("BufferedSink.Close() twice expect nil")
+	}
+
+	//dropped after retries
+	var dropped error
+	down := &testResultSink{fail:true}
+	downSink, _ := NewBufferedSink("down", down, nil, 10, 10, time.Hour, func(name string, err error) {
+		dropped = err
+	})
+	downSink.retries = 0
+	for _, record := range testDeliveryRecords("com.one", 3) {
+		downSink.Put(record)
+	}
+	downSink.Close()
+	if dropped == nil || downSink.GetStats().Dropped != 3 {
+		t.Errorf("BufferedSink expect 3 dropped with error, got %+v", downSink.GetStats())
+	}
+}
+
+func TestWebhookResultSinkTesting(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		batch := &WebhookResultBatch{}
+		if err := json.NewDecoder(r.Body).Decode(batch); err != nil || len(batch.Records) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received += len(batch.Records)
+		if batch.Records[0].App == "com.fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookResultSink(server.URL, time.Second)
+	if err != nil {
+		t.Fatalf("NewWebhookResultSink() error: %s", err.Error())
+	}
+	if err = sink.WriteBatch(testDeliveryRecords("com.one", 3)); err != nil || received != 3 {
+		t.Errorf("WebhookResultSink.WriteBatch() expect 3 received, got %d %v", received, err)
+	}
+	if err = sink.WriteBatch(testDeliveryRecords("com.fail", 1)); err == nil {
+		t.Errorf("WebhookResultSink.WriteBatch() of http 500 should be error")
+	}
+}
+
+func TestFileResultSinkTesting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := NewFileResultSink(dir, 100)
+	if err != nil {
+		t.Fatalf("NewFileResultSink() error: %s", err.Error())
+	}
+	sink.WriteBatch(testDeliveryRecords("com.one", 3))
+	sink.WriteBatch(testDeliveryRecords("com.one", 2))
+	sink.Close()
+	if sink.GetOffset() != 5 {
+		t.Errorf("FileResultSink offset expect 5, got %d", sink.GetOffset())
+	}
+
+	//continue offset after restart
+	sink, err = NewFileResultSink(dir, 100)
+	if err != nil || sink.GetOffset() != 5 {
+		t.Fatalf("NewFileResultSink() recover expect offset 5, got %d %v", sink.GetOffset(), err)
+	}
+	sink.WriteBatch(testDeliveryRecords("com.one", 1))
+	sink.Close()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*" + SINK_FILE_SEGMENT_SUFFIX))
+	if len(names) != 3 || filepath.Base(names[2]) != segmentName(5) {
+		t.Fatalf("FileResultSink segments error: %v", names)
+	}
+	content, _ := ioutil.ReadFile(names[2])
+	message := &FileResultMessage{}
+	if err = json.Unmarshal(content, message); err != nil || message.Offset != 5 || message.Record.Token != "token0" {
+		t.Errorf("FileResultSink message error: %s", string(content))
+	}
+}
+
+func TestMysqlResultSinkTesting(t *testing.T) {
+	if _, err := NewMysqlResultSink("user:pass@tcp(localhost:3306)/db", "push;drop"); err == nil {
+		t.Errorf("NewMysqlResultSink() of invalid table should be error")
+	}
+
+	sink, err := NewMysqlResultSink("user:pass@tcp(localhost:3306)/db", "")
+	if err != nil {
+		t.Fatalf("NewMysqlResultSink() error: %s", err.Error())
+	}
+	defer sink.Close()
+
+	query, args := sink.insert(testDeliveryRecords("com.one", 2))
+	if !strings.HasPrefix(query, "INSERT INTO push_delivery (push_id,") || strings.Count(query, "?") != 24 || len(args) != 24 {
+		t.Errorf("MysqlResultSink insert error: %s %d", query, len(args))
+	}
+
+	//placeholders of a statement within mysql limit
+	chunks := sink.chunks(testDeliveryRecords("com.one", 12000))
+	if len(chunks) != 3 || len(chunks[2]) != 12000 - 2 * len(chunks[0]) {
+		t.Fatalf("MysqlResultSink chunks expect 3, got %d", len(chunks))
+	}
+	if _, args = sink.insert(chunks[0]); len(args) > SINK_MYSQL_MAX_PLACEHOLDERS {
+		t.Errorf("MysqlResultSink chunk placeholders expect <=%d, got %d", SINK_MYSQL_MAX_PLACEHOLDERS, len(args))
+	}
+}
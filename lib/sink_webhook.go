@@ -0,0 +1,73 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	SINK_WEBHOOK_DEFAULT_TIMEOUT = 10 * time.Second
+)
+
+// POST body of webhook result sink
+type WebhookResultBatch struct {
+	Records []*DeliveryRecord `json:"records"`
+}
+
+// POST batched records as json to url, 2xx for success
+type WebhookResultSink struct {
+	Url    string
+
+	client *http.Client
+}
+
+func NewWebhookResultSink(url string, timeout time.Duration) (*WebhookResultSink, error) {
+	if url == "" {
+		return nil, errors.New("Webhook result sink url is empty.")
+	}
+	if timeout <= 0 {
+		timeout = SINK_WEBHOOK_DEFAULT_TIMEOUT
+	}
+
+	return &WebhookResultSink{Url:url, client:&http.Client{Timeout:timeout}}, nil
+}
+
+func (s *WebhookResultSink) GetType() string {
+	return SINK_TYPE_WEBHOOK
+}
+
+func (s *WebhookResultSink) WriteBatch(records []*DeliveryRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(&WebhookResultBatch{Records:records})
+	if err != nil {
+		return errors.New("WebhookResultSink.WriteBatch(): " + err.Error())
+	}
+
+	resp, err := s.client.Post(s.Url, "application/json; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		return errors.New("WebhookResultSink.WriteBatch(): " + err.Error())
+	}
+	//reuse connection
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("WebhookResultSink.WriteBatch(): http status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	return nil
+}
+
+func (s *WebhookResultSink) Close() error {
+	return nil
+}
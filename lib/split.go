@@ -0,0 +1,106 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+)
+
+const (
+	SPLIT_BUCKETS = 100
+
+	//variant name of devices not sent, waiting for winner rollout
+	SPLIT_HOLDOUT = "holdout"
+)
+
+// A/B testing audience split, randomized by seed and deterministic for a device.
+// buckets [0, SPLIT_BUCKETS) are assigned to variants in order by percent, the rest are holdout.
+type AudienceSplit struct {
+	//same seed and token always get the same bucket
+	Seed     string
+
+	Variants []*MessageVariant
+}
+
+func NewAudienceSplit(seed string, variants []*MessageVariant) (*AudienceSplit, error) {
+	if seed == "" {
+		return nil, errors.New("AudienceSplit seed is empty.")
+	}
+	if len(variants) < 1 {
+		return nil, errors.New("AudienceSplit need at least one variant.")
+	}
+
+	total := 0
+	names := make(map[string]bool, len(variants))
+	for _, variant := range variants {
+		if variant == nil || variant.Name == "" || variant.Name == SPLIT_HOLDOUT {
+			return nil, errors.New("AudienceSplit variant name is empty or reserved: " + SPLIT_HOLDOUT)
+		}
+		if names[variant.Name] {
+			return nil, errors.New("AudienceSplit variant name duplicated: " + variant.Name)
+		}
+		if variant.Percent <= 0 {
+			return nil, errors.New("AudienceSplit variant " + variant.Name + " percent must >0")
+		}
+		if variant.Title == "" || variant.Body == "" {
+			return nil, errors.New("AudienceSplit variant " + variant.Name + " title and body are required.")
+		}
+
+		names[variant.Name] = true
+		total += variant.Percent
+	}
+
+	if total > SPLIT_BUCKETS {
+		return nil, errors.New("AudienceSplit variants percent sum must <=" + strconv.Itoa(SPLIT_BUCKETS) + ", now: " + strconv.Itoa(total))
+	}
+
+	return &AudienceSplit{Seed:seed, Variants:variants}, nil
+}
+
+func (s *AudienceSplit) Bucket(token string) int {
+	h := fnv.New32a()
+	h.Write([]byte(s.Seed + ":" + token))
+
+	return int(h.Sum32() % SPLIT_BUCKETS)
+}
+
+// variant name of device, SPLIT_HOLDOUT if not in any variant
+func (s *AudienceSplit) Assign(token string) string {
+	bucket := s.Bucket(token)
+
+	upper := 0
+	for _, variant := range s.Variants {
+		upper += variant.Percent
+		if bucket < upper {
+			return variant.Name
+		}
+	}
+
+	return SPLIT_HOLDOUT
+}
+
+func (s *AudienceSplit) HoldoutPercent() int {
+	total := 0
+	for _, variant := range s.Variants {
+		total += variant.Percent
+	}
+
+	return SPLIT_BUCKETS - total
+}
+
+// Message sent to holdout audience with the winner variant
+func NewRolloutMessage(msg MessageInterface, variant, uuid string) (*Message, error) {
+	origin, ok := msg.(*Message)
+	if !ok {
+		return nil, errors.New("Rollout only support lib.Message.")
+	}
+	if origin.GetVariant(variant) == nil {
+		return nil, errors.New("Rollout variant not found: " + variant)
+	}
+
+	rollout := *(origin.Variant(variant).(*Message))
+	rollout.Uuid = uuid
+
+	return &rollout, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAudienceSplitTesting(t *testing.T) {
+	variants := []*MessageVariant{{Name:"a", Percent:30, Title:"A", Body:"A"}, {Name:"b", Percent:30, Title:"B", Body:"B"}}
+	split, err := NewAudienceSplit("seed", variants)
+	if err != nil {
+		t.Fatalf("NewAudienceSplit() error: %v", err)
+	}
+	if split.HoldoutPercent() != 40 {
+		t.Errorf("HoldoutPercent() error: %d", split.HoldoutPercent())
+	}
+
+	q := NewQueue(nil)
+	var list []string
+	for iter := 0; iter < 10000; iter++ {
+		list = append(list, fmt.Sprintf("%064x", iter))
+	}
+	err = q.AppendDataSource(list)
+	if err != nil {
+		t.Fatalf("AppendDataSource() error: %v", err)
+	}
+
+	q.Partition(split)
+	if q.Len() + len(q.Holdout()) != len(list) {
+		t.Errorf("Partition() lost devices: %d + %d", q.Len(), len(q.Holdout()))
+	}
+	if len(q.Holdout()) < 3500 || len(q.Holdout()) > 4500 {
+		t.Errorf("Partition() holdout not close to 40%%: %d", len(q.Holdout()))
+	}
+
+	for _, device := range q.data {
+		if split.Assign(device.Token) != device.Variant {
+			t.Fatalf("Assign() not deterministic: %s", device.Token)
+		}
+	}
+
+	_, err = NewAudienceSplit("seed", []*MessageVariant{{Name:"a", Percent:60, Title:"A", Body:"A"}, {Name:"b", Percent:60, Title:"B", Body:"B"}})
+	if err == nil {
+		t.Error("NewAudienceSplit() percent sum >100 should fail")
+	}
+}
+
+func TestStatsBestVariantTesting(t *testing.T) {
+	stats := NewTaskStats()
+	for iter := 0; iter < 10; iter++ {
+		stats.Record(&Device{Variant:"a"}, "", &WorkerResponse{Sent:true})
+		stats.Record(&Device{Variant:"b"}, "", &WorkerResponse{Sent:true})
+	}
+	stats.RecordOpen("a")
+	stats.RecordOpen("b")
+	stats.RecordOpen("b")
+
+	if stats.BestVariant() != "b" {
+		t.Errorf("BestVariant() error: %s, %s", stats.BestVariant(), stats)
+	}
+}
+
+func TestTaskRecordOpenTesting(t *testing.T) {
+	split, err := NewAudienceSplit("seed", []*MessageVariant{{Name:"a", Percent:50, Title:"A", Body:"A"}})
+	if err != nil {
+		t.Fatalf("NewAudienceSplit() error: %v", err)
+	}
+
+	q := NewQueue(nil)
+	var list []string
+	for iter := 0; iter < 100; iter++ {
+		list = append(list, fmt.Sprintf("%064x", iter))
+	}
+	err = q.AppendDataSource(list)
+	if err != nil {
+		t.Fatalf("AppendDataSource() error: %v", err)
+	}
+	q.Partition(split)
+
+	sent, holdout := "", ""
+	for _, token := range list {
+		if split.Assign(token) == SPLIT_HOLDOUT {
+			holdout = token
+		} else {
+			sent = token
+		}
+	}
+
+	task := NewTask(q, nil)
+	if !task.RecordOpen(sent) || task.RecordOpen(sent) {
+		t.Error("RecordOpen() expect counted once a device")
+	}
+	if task.RecordOpen(holdout) || task.RecordOpen(fmt.Sprintf("%064x", 1000)) {
+		t.Error("RecordOpen() of holdout or unknown device expect ignored")
+	}
+	if stats := task.stats.Snapshot(); stats.Open != 1 || stats.Variants["a"].Open != 1 {
+		t.Errorf("RecordOpen() expect 1 open of variant a, got %d", stats.Open)
+	}
+}
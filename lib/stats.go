@@ -0,0 +1,176 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"strconv"
+	"sync"
+)
+
+const (
+	//stats key of devices sent without locale variant
+	STATS_LOCALE_NONE = "none"
+)
+
+type StatsCounter struct {
+	Total   int `json:"total"`
+	Success int `json:"success"`
+	Fail    int `json:"fail"`
+
+	//opened callback count
+	Open    int `json:"open"`
+}
+
+//Delivery stats of a task, updated by workers
+type TaskStats struct {
+	StatsCounter
+
+	//locale variant -> counter
+	Locales  map[string]*StatsCounter `json:"locales"`
+
+	//A/B testing variant -> counter
+	Variants map[string]*StatsCounter `json:"variants,omitempty"`
+
+	//devices skipped by frequency cap, not in Total
+	Capped   int `json:"capped"`
+
+	//failed devices by provider reason, RequestError if no reason
+	Reasons  map[string]int `json:"reasons,omitempty"`
+
+	lock    sync.Mutex
+}
+
+func NewTaskStats() *TaskStats {
+	return &TaskStats{Locales:make(map[string]*StatsCounter), Variants:make(map[string]*StatsCounter), Reasons:make(map[string]int)}
+}
+
+func getCounter(counters map[string]*StatsCounter, key string) *StatsCounter {
+	counter, ok := counters[key]
+	if !ok {
+		counter = &StatsCounter{}
+		counters[key] = counter
+	}
+
+	return counter
+}
+
+func (c *StatsCounter) record(success bool) {
+	c.Total++
+	if success {
+		c.Success++
+	} else {
+		c.Fail++
+	}
+}
+
+//record one device push result, locale is the resolved variant
+func (s *TaskStats) Record(device *Device, locale string, resp *WorkerResponse) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	success := resp != nil && resp.Error == nil && resp.Sent
+
+	if locale == "" {
+		locale = STATS_LOCALE_NONE
+	}
+	getCounter(s.Locales, locale).record(success)
+
+	if device.Variant != "" {
+		getCounter(s.Variants, device.Variant).record(success)
+	}
+
+	s.StatsCounter.record(success)
+
+	if !success {
+		reason := REPORT_REASON_ERROR
+		if resp != nil && resp.Error == nil && resp.Reason != "" {
+			reason = resp.Reason
+		}
+		s.Reasons[reason]++
+	}
+}
+
+//record one device skipped by frequency cap
+func (s *TaskStats) RecordCapped() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Capped++
+}
+
+//record one opened callback, variant empty if no split
+func (s *TaskStats) RecordOpen(variant string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if variant != "" {
+		getCounter(s.Variants, variant).Open++
+	}
+
+	s.Open++
+}
+
+// variant with best open rate of delivered, holdout excluded
+func (s *TaskStats) BestVariant() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	best := ""
+	bestRate := -1.0
+	for name, counter := range s.Variants {
+		if name == SPLIT_HOLDOUT || counter.Success <= 0 {
+			continue
+		}
+
+		rate := float64(counter.Open) / float64(counter.Success)
+		if rate > bestRate || (rate == bestRate && name < best) {
+			best = name
+			bestRate = rate
+		}
+	}
+
+	return best
+}
+
+//A copy for reading
+func (s *TaskStats) Snapshot() *TaskStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	snap := NewTaskStats()
+	snap.StatsCounter = s.StatsCounter
+	snap.Capped = s.Capped
+	for reason, count := range s.Reasons {
+		snap.Reasons[reason] = count
+	}
+	for locale, counter := range s.Locales {
+		copied := *counter
+		snap.Locales[locale] = &copied
+	}
+	for variant, counter := range s.Variants {
+		copied := *counter
+		snap.Variants[variant] = &copied
+	}
+
+	return snap
+}
+
+func (s *TaskStats) String() string {
+	snap := s.Snapshot()
+
+	str := snap.StatsCounter.String()
+	for locale, counter := range snap.Locales {
+		str += " [locale " + locale + " " + counter.String() + "]"
+	}
+	for variant, counter := range snap.Variants {
+		str += " [variant " + variant + " " + counter.String() + "]"
+	}
+	if snap.Capped > 0 {
+		str += " capped:" + strconv.Itoa(snap.Capped)
+	}
+
+	return str
+}
+
+func (c StatsCounter) String() string {
+	return "total:" + strconv.Itoa(c.Total) + " success:" + strconv.Itoa(c.Success) + " fail:" + strconv.Itoa(c.Fail) + " open:" + strconv.Itoa(c.Open)
+}
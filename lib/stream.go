@@ -0,0 +1,258 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//apns default SETTINGS_MAX_CONCURRENT_STREAMS
+	STREAM_DEFAULT_MAX = 1000
+	STREAM_DEFAULT_CONNECTIONS = 2
+
+	STREAM_STATUS_HEALTHY = iota
+	//ping failed, GOAWAY or push error, not used by Acquire
+	STREAM_STATUS_UNHEALTHY
+	STREAM_STATUS_RECONNECTING
+	//replaced by a reconnected one
+	STREAM_STATUS_CLOSED
+
+	//poll interval of WaitDrained
+	STREAM_DRAIN_POLL = 100 * time.Millisecond
+)
+
+// A multiplexed http2 connection, carry many concurrent streams
+// Conn never changes, reconnect replaces the StreamConn with same ID.
+type StreamConn struct {
+	//provider client, eg. *apns.Connection
+	Conn     interface{}
+	ID       int
+
+	//fields below protected by StreamPool lock
+	Status   int
+	LastUsed time.Time
+
+	inflight int
+}
+
+// Few connections shared by all workers, worker is only an in-flight slot.
+// Acquire picks the least busy connection, blocks when all connections reach max streams.
+type StreamPool struct {
+	conns      []*StreamConn
+	maxStreams int
+
+	cond       *sync.Cond
+}
+
+func NewStreamPool(maxStreams int, conns []interface{}) (*StreamPool, error) {
+	if len(conns) == 0 {
+		return nil, errors.New("StreamPool needs at least one connection.")
+	}
+	if maxStreams <= 0 {
+		return nil, errors.New("StreamPool max streams must >0.")
+	}
+
+	sp := &StreamPool{maxStreams:maxStreams, cond:sync.NewCond(&sync.Mutex{})}
+	for iter, conn := range conns {
+		sp.conns = append(sp.conns, &StreamConn{Conn:conn, ID:iter, Status:STREAM_STATUS_HEALTHY, LastUsed:time.Now()})
+	}
+
+	return sp, nil
+}
+
+// block until a stream available, error when no connection is healthy for timeout.
+// all connections busy is backpressure and keeps waiting, none healthy may never recover if nothing reconnects.
+func (sp *StreamPool) Acquire(timeout time.Duration) (*StreamConn, error) {
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	var deadline time.Time
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		var selected *StreamConn
+		healthy := false
+		for _, conn := range sp.conns {
+			if conn.Status != STREAM_STATUS_HEALTHY {
+				continue
+			}
+			healthy = true
+			if conn.inflight < sp.maxStreams && (selected == nil || conn.inflight < selected.inflight) {
+				selected = conn
+			}
+		}
+
+		if selected != nil {
+			selected.inflight++
+			return selected, nil
+		}
+
+		if healthy {
+			deadline = time.Time{}
+		} else if deadline.IsZero() {
+			deadline = time.Now().Add(timeout)
+			if timer != nil {
+				timer.Stop()
+			}
+			//cond has no timed wait, wake waiters at deadline
+			timer = time.AfterFunc(timeout, sp.wakeup)
+		} else if !time.Now().Before(deadline) {
+			return nil, errors.New("StreamPool no healthy connection in " + timeout.String() + ".")
+		}
+		sp.cond.Wait()
+	}
+}
+
+func (sp *StreamPool) wakeup() {
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	sp.cond.Broadcast()
+}
+
+func (sp *StreamPool) Release(conn *StreamConn) {
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	conn.inflight--
+	conn.LastUsed = time.Now()
+	sp.cond.Signal()
+}
+
+// mark a connection unhealthy, return false if already marked or replaced
+func (sp *StreamPool) MarkUnhealthy(conn *StreamConn) bool {
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	if sp.conns[conn.ID] != conn || conn.Status != STREAM_STATUS_HEALTHY {
+		return false
+	}
+	conn.Status = STREAM_STATUS_UNHEALTHY
+
+	return true
+}
+
+// replace conn by a new dialed one, old Conn need to be closed by caller after success.
+// acquire waits while reconnecting, in-flight streams of old Conn release to the old StreamConn.
+func (sp *StreamPool) Reconnect(conn *StreamConn, dial func() (interface{}, error)) (*StreamConn, error) {
+	sp.cond.L.Lock()
+	if sp.conns[conn.ID] != conn || conn.Status == STREAM_STATUS_RECONNECTING {
+		sp.cond.L.Unlock()
+		return nil, errors.New("StreamPool connection " + strconv.Itoa(conn.ID) + " is reconnecting or replaced.")
+	}
+	conn.Status = STREAM_STATUS_RECONNECTING
+	sp.cond.L.Unlock()
+
+	client, err := dial()
+
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	if err != nil {
+		conn.Status = STREAM_STATUS_UNHEALTHY
+		return nil, err
+	}
+
+	connNew := &StreamConn{Conn:client, ID:conn.ID, Status:STREAM_STATUS_HEALTHY, LastUsed:time.Now()}
+	sp.conns[conn.ID] = connNew
+	conn.Status = STREAM_STATUS_CLOSED
+	sp.cond.Broadcast()
+
+	return connNew, nil
+}
+
+func (sp *StreamPool) GetStatus(conn *StreamConn) int {
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	return conn.Status
+}
+
+// current connections
+func (sp *StreamPool) Connections() []*StreamConn {
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	conns := make([]*StreamConn, len(sp.conns))
+	copy(conns, sp.conns)
+
+	return conns
+}
+
+// healthy connections without stream longer than idle
+func (sp *StreamPool) Idle(idle time.Duration) []*StreamConn {
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	conns := []*StreamConn{}
+	for _, conn := range sp.conns {
+		if conn.Status == STREAM_STATUS_HEALTHY && conn.inflight == 0 && time.Since(conn.LastUsed) >= idle {
+			conns = append(conns, conn)
+		}
+	}
+
+	return conns
+}
+
+// follow server's MAX_CONCURRENT_STREAMS
+func (sp *StreamPool) SetMaxStreams(maxStreams int) {
+	if maxStreams <= 0 {
+		return
+	}
+
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	sp.maxStreams = maxStreams
+	sp.cond.Broadcast()
+}
+
+func (sp *StreamPool) GetMaxStreams() int {
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	return sp.maxStreams
+}
+
+// streams in flight of all connections
+func (sp *StreamPool) InFlight() int {
+	sp.cond.L.Lock()
+	defer sp.cond.L.Unlock()
+
+	inflight := 0
+	for _, conn := range sp.conns {
+		inflight += conn.inflight
+	}
+
+	return inflight
+}
+
+// wait in-flight streams of a replaced conn released, false on timeout
+func (sp *StreamPool) WaitDrained(conn *StreamConn, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		sp.cond.L.Lock()
+		inflight := conn.inflight
+		sp.cond.L.Unlock()
+
+		if inflight <= 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(STREAM_DRAIN_POLL)
+	}
+}
+
+func (sp *StreamPool) Len() int {
+	return len(sp.conns)
+}
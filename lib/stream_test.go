@@ -0,0 +1,278 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamPoolTesting(t *testing.T) {
+	_, err := NewStreamPool(10, nil)
+	if err == nil {
+		t.Errorf("NewStreamPool() without connection should be error")
+	}
+
+	sp, err := NewStreamPool(2, []interface{}{"conn0", "conn1"})
+	if err != nil {
+		t.Fatalf("NewStreamPool() error: %s", err.Error())
+	}
+
+	//least busy connection first
+	first := streamTestAcquire(t, sp)
+	second := streamTestAcquire(t, sp)
+	if first.ID == second.ID {
+		t.Errorf("Acquire() should spread streams over connections, got %d and %d", first.ID, second.ID)
+	}
+	streamTestAcquire(t, sp)
+	streamTestAcquire(t, sp)
+	if sp.InFlight() != 4 {
+		t.Errorf("InFlight() expect 4, got %d", sp.InFlight())
+	}
+
+	//all connections full, block until release
+	acquired := make(chan *StreamConn)
+	go func() {
+		acquired <- streamTestAcquire(t, sp)
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("Acquire() should block when all streams in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sp.Release(first)
+	select {
+	case conn := <-acquired:
+		if conn.ID != first.ID {
+			t.Errorf("Acquire() expect released connection %d, got %d", first.ID, conn.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Acquire() should return after Release()")
+	}
+
+	//raise max streams, unblock waiters
+	go func() {
+		acquired <- streamTestAcquire(t, sp)
+	}()
+	sp.SetMaxStreams(3)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("Acquire() should return after SetMaxStreams()")
+	}
+	if sp.GetMaxStreams() != 3 || sp.InFlight() != 5 {
+		t.Errorf("expect max streams 3 and 5 in flight, got %d %d", sp.GetMaxStreams(), sp.InFlight())
+	}
+}
+
+func TestStreamPoolReconnectTesting(t *testing.T) {
+	sp, err := NewStreamPool(10, []interface{}{"conn0", "conn1"})
+	if err != nil {
+		t.Fatalf("NewStreamPool() error: %s", err.Error())
+	}
+
+	if len(sp.Idle(0)) != 2 || len(sp.Idle(time.Hour)) != 0 {
+		t.Errorf("Idle() expect 2 connections idle now and 0 idle an hour")
+	}
+
+	conns := sp.Connections()
+	if !sp.MarkUnhealthy(conns[0]) || sp.MarkUnhealthy(conns[0]) {
+		t.Errorf("MarkUnhealthy() should only be true the first time")
+	}
+	for iter := 0; iter < 3; iter++ {
+		conn := streamTestAcquire(t, sp)
+		if conn.ID != 1 {
+			t.Errorf("Acquire() should skip unhealthy connection, got %d", conn.ID)
+		}
+	}
+
+	_, err = sp.Reconnect(conns[0], func() (interface{}, error) {
+		return nil, errors.New("dial error")
+	})
+	if err == nil || sp.GetStatus(conns[0]) != STREAM_STATUS_UNHEALTHY {
+		t.Errorf("Reconnect() with dial error should keep unhealthy")
+	}
+
+	connNew, err := sp.Reconnect(conns[0], func() (interface{}, error) {
+		return "conn0-new", nil
+	})
+	if err != nil {
+		t.Fatalf("Reconnect() error: %s", err.Error())
+	}
+	if connNew.ID != 0 || connNew.Conn != "conn0-new" || sp.GetStatus(conns[0]) != STREAM_STATUS_CLOSED {
+		t.Errorf("Reconnect() should replace connection 0, got %d %v", connNew.ID, connNew.Conn)
+	}
+	if sp.MarkUnhealthy(conns[0]) {
+		t.Errorf("MarkUnhealthy() of replaced connection should be false")
+	}
+	if conn := streamTestAcquire(t, sp); conn != connNew {
+		t.Errorf("Acquire() expect reconnected least busy connection, got %d", conn.ID)
+	}
+
+	//rotated connection drains when its streams released
+	sp.Release(connNew)
+	old := streamTestAcquire(t, sp)
+	if _, err = sp.Reconnect(old, func() (interface{}, error) {
+		return "rotated", nil
+	}); err != nil {
+		t.Fatalf("Reconnect() error: %s", err.Error())
+	}
+	if sp.WaitDrained(old, 50 * time.Millisecond) {
+		t.Errorf("WaitDrained() expect timeout with stream in flight")
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sp.Release(old)
+	}()
+	if !sp.WaitDrained(old, time.Second) {
+		t.Errorf("WaitDrained() expect true after Release()")
+	}
+}
+
+func TestStreamPoolAcquireTimeoutTesting(t *testing.T) {
+	sp, err := NewStreamPool(1, []interface{}{"conn0", "conn1"})
+	if err != nil {
+		t.Fatalf("NewStreamPool() error: %s", err.Error())
+	}
+
+	//busy but healthy keeps waiting past timeout
+	first := streamTestAcquire(t, sp)
+	streamTestAcquire(t, sp)
+	acquired := make(chan error)
+	go func() {
+		_, err := sp.Acquire(20 * time.Millisecond)
+		acquired <- err
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("Acquire() should wait while connections are healthy")
+	case <-time.After(100 * time.Millisecond):
+	}
+	sp.Release(first)
+	if err := <-acquired; err != nil {
+		t.Errorf("Acquire() error after Release(): %s", err.Error())
+	}
+
+	//no healthy connection, fail after timeout
+	for _, conn := range sp.Connections() {
+		sp.MarkUnhealthy(conn)
+	}
+	start := time.Now()
+	if _, err = sp.Acquire(20 * time.Millisecond); err == nil {
+		t.Errorf("Acquire() without healthy connection should be error")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Acquire() expect error in timeout, took %s", time.Since(start).String())
+	}
+
+	//recovered before timeout
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sp.Reconnect(sp.Connections()[1], func() (interface{}, error) {
+			return "conn1-new", nil
+		})
+	}()
+	conn, err := sp.Acquire(time.Second)
+	if err != nil || conn.Conn != "conn1-new" {
+		t.Errorf("Acquire() expect reconnected connection, got %v", err)
+	}
+}
+
+func streamTestAcquire(tb testing.TB, sp *StreamPool) *StreamConn {
+	conn, err := sp.Acquire(time.Second)
+	if err != nil {
+		tb.Errorf("Acquire() error: %s", err.Error())
+	}
+
+	return conn
+}
+
+// local http2 stand-in of apns, 2ms each push
+func newStreamTestServer() *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		time.Sleep(2 * time.Millisecond)
+		w.Header().Set("apns-id", r.Header.Get("apns-id"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	return server
+}
+
+// every client is a separate http2 connection
+func newStreamTestClient(server *httptest.Server) *http.Client {
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+	return &http.Client{Transport:&http.Transport{TLSClientConfig:tlsConfig, ForceAttemptHTTP2:true}}
+}
+
+func streamTestPush(b *testing.B, client *http.Client, url string) {
+	resp, err := client.Post(url, "application/json", nil)
+	if err != nil {
+		b.Errorf("push error: %s", err.Error())
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		b.Errorf("expect http2, got %s", resp.Proto)
+	}
+}
+
+func benchmarkStreamPool(b *testing.B, connections, slots, maxStreams int) {
+	server := newStreamTestServer()
+	defer server.Close()
+
+	conns := make([]interface{}, connections)
+	for iter := range conns {
+		conns[iter] = newStreamTestClient(server)
+	}
+	sp, err := NewStreamPool(maxStreams, conns)
+	if err != nil {
+		b.Fatalf("NewStreamPool() error: %s", err.Error())
+	}
+
+	devices := make(chan int, slots)
+	var wg sync.WaitGroup
+	for iter := 0; iter < slots; iter++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range devices {
+				conn := streamTestAcquire(b, sp)
+				streamTestPush(b, conn.Conn.(*http.Client), server.URL)
+				sp.Release(conn)
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for iter := 0; iter < b.N; iter++ {
+		devices <- iter
+	}
+	close(devices)
+	wg.Wait()
+
+	b.ReportMetric(float64(b.N) / time.Since(start).Seconds(), "pushes/s")
+}
+
+// old model, one blocking request per worker connection
+func BenchmarkStreamBlockingTesting(b *testing.B) {
+	benchmarkStreamPool(b, 2, 2, 1)
+}
+
+// 2 connections multiplex 200 in-flight slots
+func BenchmarkStreamMultiplexedTesting(b *testing.B) {
+	benchmarkStreamPool(b, 2, 200, 100)
+}
+
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"errors"
 	"strconv"
 	"sync"
@@ -10,14 +11,106 @@ import (
 const (
 	TASK_QUEUE_MAX_WAITING = 100
 	TASK_QUEUE_MAX_POOL = 5
+	//tasks kept for stats query by push-id
+	TASK_QUEUE_MAX_HISTORY = 1000
+
+	//publish loop states, blocked in idle, building and allocating
+	TASK_QUEUE_STATE_RUNNING = "running"
+	TASK_QUEUE_STATE_IDLE = "idle"
+	//waiting queue of next task built
+	TASK_QUEUE_STATE_BUILDING = "building"
+	//waiting a pool finish
+	TASK_QUEUE_STATE_ALLOCATING = "allocating"
+
+	//retry pool select without pool finish, eg. pool creation failed at worker.max and nothing sending
+	TASK_QUEUE_ALLOCATE_RETRY = time.Second
+	//publish loop out of idle without progress this long is stuck
+	TASK_QUEUE_PUBLISH_STALE = time.Minute
 )
 
+// TaskQueue size and concurrency policy
+type TaskQueueConfig struct {
+	//max pools
+	Pools       int
+	//max waiting tasks
+	Waiting     int
+	//max tasks sending in parallel, include tasks sharing a pool
+	Concurrency int
+	//new task can share a busy pool whose tasks are all published, see Pool.TryShare()
+	Share       bool
+}
+
+// concurrency 0 for equal to pools
+func NewTaskQueueConfig(pools, waiting, concurrency int, share bool) (*TaskQueueConfig, error) {
+	if pools <= 0 || waiting <= 0 {
+		return nil, errors.New("TaskQueue pools and waiting must >0")
+	}
+	if concurrency < 0 {
+		return nil, errors.New("TaskQueue concurrency must >=0")
+	}
+	if concurrency == 0 {
+		concurrency = pools
+	}
+	if concurrency > pools && !share {
+		return nil, errors.New("TaskQueue concurrency > pools needs share enabled")
+	}
+
+	return &TaskQueueConfig{Pools:pools, Waiting:waiting, Concurrency:concurrency, Share:share}, nil
+}
+
 type Task struct {
 	// task device queue
 	list    *DeviceQueue
 
 	// sending message
 	message MessageInterface
+
+	// delivery stats
+	stats   *TaskStats
+
+	// push-id of A/B testing winner rollout task
+	rolloutID string
+
+	// task push rate limit, nil for throttle default
+	bucket    *TokenBucket
+	lock      sync.Mutex
+
+	// completion callback url, empty for none
+	callback  string
+
+	created   time.Time
+	started   time.Time
+	finished  time.Time
+	// failure of task, nil if finished normally
+	err       error
+	// cancelled while sending, devices not sent
+	cancelled bool
+	notSent   int
+	// closed when cancelled, wakes workers waiting for throttle
+	stop      chan struct{}
+
+	// devices counted opened, once a device
+	opened    map[string]bool
+
+	// root span of push-id, nil for no trace
+	trace     *Span
+}
+
+// waiting task snapshot for admin api
+type TaskInfo struct {
+	//0 is the next to send
+	Position int `json:"position"`
+	PushID   string `json:"push-id"`
+	Status   string `json:"status"`
+	//devices built, 0 if queue building
+	Devices  int `json:"devices"`
+	//pushes per second, 0 for throttle default
+	Rate     float64 `json:"rate"`
+	Created  time.Time `json:"created"`
+}
+
+func NewTask(list *DeviceQueue, msg MessageInterface) *Task {
+	return &Task{list:list, message:msg, stats:NewTaskStats(), created:time.Now(), stop:make(chan struct{})}
 }
 
 // task queue, cycle array
@@ -41,12 +134,32 @@ type TaskQueue struct {
 	writeIndex        int
 
 	wg                sync.WaitGroup
+
+	//push-id -> task, include finished
+	history           map[string]*Task
+	historyOrder      []string
+
+	config            *TaskQueueConfig
+	//tasks sending now
+	sending           int
+
+	//publish loop running and its state
+	publishing        bool
+	publishState      string
+	publishSince      time.Time
+	//last loop step or wait wakeup
+	publishProgress   time.Time
 }
 
 func NewTaskQueue(server Server) *TaskQueue {
+	config := server.GetEnv().GetTaskQueueConfig()
+	if config == nil {
+		config = &TaskQueueConfig{Pools:TASK_QUEUE_MAX_POOL, Waiting:TASK_QUEUE_MAX_WAITING, Concurrency:TASK_QUEUE_MAX_POOL}
+	}
+
 	//PublishChannel no buffer
-	return &TaskQueue{pools:make([]*Pool, TASK_QUEUE_MAX_POOL), tasks:make([]*Task, TASK_QUEUE_MAX_WAITING),
-		taskChangeChannel:make(chan bool, TASK_QUEUE_MAX_WAITING), poolFinishChannel:make(chan int, TASK_QUEUE_MAX_WAITING), server:server}
+	return &TaskQueue{pools:make([]*Pool, config.Pools), tasks:make([]*Task, config.Waiting), config:config,
+		taskChangeChannel:make(chan bool, config.Waiting), poolFinishChannel:make(chan int, config.Concurrency), server:server}
 }
 
 func (tq *TaskQueue)nextID(index int) (int) {
@@ -80,19 +193,23 @@ func (tq *TaskQueue)NextWriteIndex() (int, error) {
 
 // add a new task
 func (tq *TaskQueue)Add(list *DeviceQueue, msg MessageInterface) (int, error) {
+	return tq.AddTask(NewTask(list, msg))
+}
+
+// add a new task
+func (tq *TaskQueue)AddTask(task *Task) (int, error) {
 	tq.Lock.Lock()
 	defer tq.Lock.Unlock()
 
-	if list == nil {
+	if task.list == nil {
 		return 0, errors.New("Failed, invalid DeviceQueue.")
 	}
 
 	index, err := tq.NextWriteIndex()
 	if err != nil {
-		return 0, errors.New("Failed, " + err.Error() + ", limit: " + strconv.Itoa(TASK_QUEUE_MAX_WAITING))
+		return 0, errors.New("Failed, " + err.Error() + ", limit: " + strconv.Itoa(len(tq.tasks)))
 	}
 
-	task := &Task{list:list, message:msg}
 	tq.tasks[index] = task
 
 	//edit index
@@ -103,20 +220,117 @@ func (tq *TaskQueue)Add(list *DeviceQueue, msg MessageInterface) (int, error) {
 		pos += len(tq.tasks)
 	}
 
+	tq.remember(task)
+
 	tq.taskChangeChannel <- true
 
 	return pos, nil
 }
 
+//keep task for query, need lock
+func (tq *TaskQueue) remember(task *Task) {
+	if task.message == nil {
+		return
+	}
+	if tq.history == nil {
+		tq.history = make(map[string]*Task, TASK_QUEUE_MAX_HISTORY)
+	}
+
+	if len(tq.historyOrder) >= TASK_QUEUE_MAX_HISTORY {
+		delete(tq.history, tq.historyOrder[0])
+		tq.historyOrder = tq.historyOrder[1:]
+	}
+
+	tq.history[task.message.GetUuid()] = task
+	tq.historyOrder = append(tq.historyOrder, task.message.GetUuid())
+}
+
+// fetch a task by push-id, waiting, sending or finished
+func (tq *TaskQueue) GetTaskByPushID(pushID string) (*Task, error) {
+	tq.Lock.Lock()
+	defer tq.Lock.Unlock()
+
+	if task, ok := tq.history[pushID]; ok {
+		return task, nil
+	}
+
+	return nil, errors.New("Task not found: " + pushID)
+}
+
 // add a new task
 func (tq *TaskQueue)AddByQueueBuilder(qb *QueueBuilder, msg MessageInterface, server Server) (int, error) {
-	devicequeue, err := qb.AsyncToDeviceQueue(server.GetEnv().GetPoolConfig().Capacity)
+	devicequeue := NewQueueByCapacity(server.GetEnv().GetPoolConfig().Capacity, server)
+
+	task := NewTask(devicequeue, msg)
+	if qb.Rate > 0 {
+		task.SetRate(qb.Rate)
+	}
+	task.callback = qb.CallbackUrl
+	task.trace = qb.Trace
+
+	// will fetch lock
+	pos, err := tq.AddTask(task)
 	if err != nil {
+		//not accepted, no audience fetch and no failure callback of push-id unknown by client
 		return 0, err
 	}
 
-	// will fetch lock
-	return tq.Add(devicequeue, msg)
+	//queue build failed, task will never be sent
+	qb.OnError = func(err error) {
+		tq.complete(task, err)
+	}
+	//async process data
+	go qb.process(devicequeue)
+
+	return pos, nil
+}
+
+// send A/B testing winner variant to holdout audience, variant empty will use best open rate.
+func (tq *TaskQueue)AddRollout(pushID, variant, uuid string) (int, *Message, error) {
+	task, err := tq.GetTaskByPushID(pushID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if task.list.GetSplit() == nil {
+		return 0, nil, errors.New("Task is not an A/B testing task: " + pushID)
+	}
+
+	if variant == "" {
+		variant = task.stats.BestVariant()
+		if variant == "" {
+			return 0, nil, errors.New("No winner variant available, none delivered yet: " + pushID)
+		}
+	}
+
+	holdout := task.list.Holdout()
+	if len(holdout) <= 0 {
+		return 0, nil, errors.New("Task has no holdout audience: " + pushID)
+	}
+
+	msg, err := NewRolloutMessage(task.message, variant, uuid)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	//rollout only once
+	tq.Lock.Lock()
+	if task.rolloutID != "" {
+		tq.Lock.Unlock()
+		return 0, nil, errors.New("Task already rollout: " + task.rolloutID)
+	}
+	task.rolloutID = uuid
+	tq.Lock.Unlock()
+
+	pos, err := tq.AddByQueueBuilder(NewQueueBuilder("", holdout, tq.server), msg, tq.server)
+	if err != nil {
+		tq.Lock.Lock()
+		task.rolloutID = ""
+		tq.Lock.Unlock()
+
+		return 0, nil, err
+	}
+
+	return pos, msg, nil
 }
 
 // pop now read task
@@ -166,10 +380,13 @@ func (tq *TaskQueue) getSparePool() (*Pool) {
 //channel push and pop need to be consist.
 func (tq *TaskQueue) publish() {
 	for {
+		tq.setPublishState(TASK_QUEUE_STATE_RUNNING)
+
 		task, err := tq.Read()
 		if err != nil {
 			tq.server.GetEnv().GetLogger().Println("TaskQueue is empty, wait for taskChangeChannel...")
 			// empty, read the first
+			tq.setPublishState(TASK_QUEUE_STATE_IDLE)
 			<-tq.taskChangeChannel
 
 			continue
@@ -181,94 +398,363 @@ func (tq *TaskQueue) publish() {
 			}
 
 			//Wait task to be ready
-			if task.list.status != DEVICE_QUEUE_STATUS_PENDING {
+			if task.list.GetStatus() != DEVICE_QUEUE_STATUS_PENDING && task.list.GetStatus() != DEVICE_QUEUE_STATUS_FAILED {
+				tq.setPublishState(TASK_QUEUE_STATE_BUILDING)
+				tq.server.GetEnv().GetLogger().Println("DeviceQueue status is " + task.list.status + ", will block q.queueChangeChannel for correct init workers...")
 				for {
-					tq.server.GetEnv().GetLogger().Println("DeviceQueue status is " + task.list.status + ", will block q.queueChangeChannel for correct init workers...")
-
-					//block
-					<-task.list.queueChangeChannel
+					//wake up to record progress, a long build is not a stuck loop
+					timer := time.NewTimer(TASK_QUEUE_ALLOCATE_RETRY)
+					select {
+					case <-task.list.queueChangeChannel:
+					case <-timer.C:
+					}
+					timer.Stop()
+					tq.setPublishState(TASK_QUEUE_STATE_BUILDING)
 
-					if task.list.status == DEVICE_QUEUE_STATUS_PENDING {
+					if task.list.GetStatus() == DEVICE_QUEUE_STATUS_PENDING || task.list.GetStatus() == DEVICE_QUEUE_STATUS_FAILED {
 						//need to break loop
 						break
 					}
 				}
 			}
 
+			//queue build failed, skip to next task
+			if task.list.GetStatus() == DEVICE_QUEUE_STATUS_FAILED {
+				tq.server.GetEnv().GetLogger().Println("DeviceQueue status is failed, skip task " + task.message.GetUuid() + ": " + task.list.GetError().Error())
+				tq.complete(task, task.list.GetError())
+				tq.Pop()
+				continue
+			}
+
 			tq.server.GetEnv().GetLogger().Println("DeviceQueue status is " + task.list.status + ", begin pool initiation.")
 
-			//select pool or create
-			//spare pool -> create pool -> wait
+			//select pool, wait for a pool finish if none
 			var poolSelected *Pool
-			// fetch spare pool
-			pool := tq.getSparePool()
+			for {
+				//finish signals before select are stale, pools are checked below
+				tq.drainPoolFinish()
 
-			if pool != nil {
-				poolSelected = pool
-
-				// Pool resize action
-				err:=poolSelected.Resize(task.list.Len())
-				if err!=nil {
-					tq.server.GetEnv().GetLogger().Println("Resize workers while poolSelected.Resize():" + err.Error())
+				poolSelected = tq.selectPool(task)
+				if poolSelected != nil {
+					break
 				}
-			}else {
-				//pools created by TASK_QUEUE_MAX_POOL limit
-				for iter, pool := range tq.pools {
-					if (pool == nil) {
-						//need a clone's pointer
-						cfgInstance:=*tq.server.GetEnv().GetPoolConfig()
-						config := &(cfgInstance)
-
-						config.SetSizeByQueueLength(task.list.Len())
-						pool, err = NewPoolByConfig(config, tq.server.GetEnv())
-						if err != nil {
-							tq.server.GetEnv().GetLogger().Println("Create pool failed:" + err.Error())
-						}else {
-							//update poolid
-							pool.PoolID = iter
-							tq.pools[iter] = pool
-
-							//select and update status
-							if !pool.TryLockAndAllocate() {
-								tq.server.GetEnv().GetLogger().Println(pool.GetPoolName() + " pool.TryLockAndAllocate() failed after created.")
-							}
-							poolSelected = pool
-							break
-						}
-					}
+
+				tq.server.GetEnv().GetLogger().Println("No pool available, " + strconv.Itoa(tq.GetSending()) + " tasks sending, wait for poolFinishChannel...")
+				tq.setPublishState(TASK_QUEUE_STATE_ALLOCATING)
+				timer := time.NewTimer(TASK_QUEUE_ALLOCATE_RETRY)
+				select {
+				case <-tq.poolFinishChannel:
+				case <-timer.C:
 				}
+				timer.Stop()
 			}
 
-			if poolSelected != nil {
-				go func() {
-					//triger sending
-					poolSelected.Send(task, tq.poolFinishChannel)
+			//queue build and waiting for pool
+			waitSpan := task.trace.ChildAt("TaskQueue.wait", task.created)
+			waitSpan.SetAttribute("pool", poolSelected.GetPoolName())
+			waitSpan.Finish()
 
-				}()
+			tq.Lock.Lock()
+			tq.sending++
+			tq.Lock.Unlock()
 
-				//pop task when started, or will resend
-				//TODO if send failed, can add a sending list, can do with finish send result.
-				tq.Pop()
+			task.start()
+			go func(pool *Pool, task *Task) {
+				//triger sending
+				pool.Send(task)
+
+				tq.finishSending(pool)
+				tq.complete(task, nil)
+			}(poolSelected, task)
+
+			//pop task when started, or will resend
+			//TODO if send failed, can add a sending list, can do with finish send result.
+			tq.Pop()
+		}
+	}
+}
+
+//spare pool -> create pool -> share busy pool -> nil
+func (tq *TaskQueue) selectPool(task *Task) (selected *Pool) {
+	if tq.GetSending() >= tq.config.Concurrency {
+		return nil
+	}
+
+	//only allocated pool traced
+	span := task.trace.Child("TaskQueue.selectPool")
+	defer func() {
+		if selected != nil {
+			span.SetAttribute("pool", selected.GetPoolName())
+			span.Finish()
+		}
+	}()
+
+	// fetch spare pool
+	pool := tq.getSparePool()
+	if pool != nil {
+		span.SetAttribute("allocation", "spare")
 
-				//free channel buf
-				if len(tq.poolFinishChannel) >= 1 {
-					<-tq.poolFinishChannel
+		// Pool resize action
+		resizeSpan := span.Child("Pool.Resize")
+		resizeSpan.SetAttribute("workers.old", pool.GetWorkerCount())
+		err := pool.Resize(task.list.Len())
+		if err != nil {
+			tq.server.GetEnv().GetLogger().Println("Resize workers while poolSelected.Resize():" + err.Error())
+		}
+		resizeSpan.SetAttribute("workers.new", pool.GetWorkerCount())
+		resizeSpan.SetError(err)
+		resizeSpan.Finish()
+
+		return pool
+	}
+
+	//pools created by config Pools limit
+	for iter, pool := range tq.pools {
+		if (pool == nil) {
+			//need a clone's pointer
+			cfgInstance := *tq.server.GetEnv().GetPoolConfig()
+			config := &(cfgInstance)
+
+			config.SetSizeByQueueLength(task.list.Len())
+			pool, err := NewPoolByConfig(config, tq.server.GetEnv())
+			if err != nil {
+				tq.server.GetEnv().GetLogger().Println("Create pool failed:" + err.Error())
+			}else {
+				//update poolid
+				pool.PoolID = iter
+				//read by admin api
+				tq.Lock.Lock()
+				tq.pools[iter] = pool
+				tq.Lock.Unlock()
+
+				span.SetAttribute("allocation", "created")
+				span.SetAttribute("workers", pool.GetWorkerCount())
+
+				//select and update status
+				if !pool.TryLockAndAllocate() {
+					tq.server.GetEnv().GetLogger().Println(pool.GetPoolName() + " pool.TryLockAndAllocate() failed after created.")
 				}
+				return pool
 			}
+		}
+	}
+
+	if tq.config.Share {
+		for _, pool := range tq.pools {
+			if pool != nil && pool.TryShare() {
+				tq.server.GetEnv().GetLogger().Println(pool.GetPoolName() + " shared with new task " + task.message.GetUuid())
+				span.SetAttribute("allocation", "shared")
+				return pool
+			}
+		}
+	}
+
+	return nil
+}
+
+func (tq *TaskQueue) finishSending(pool *Pool) {
+	tq.Lock.Lock()
+	tq.sending--
+	tq.Lock.Unlock()
+
+	//a pending signal is enough to wake publish
+	select {
+	case tq.poolFinishChannel <- pool.PoolID:
+	default:
+	}
+}
+
+// task finished or failed, post summary to callback url once
+func (tq *TaskQueue) complete(task *Task, err error) {
+	if !task.finish(err) {
+		return
+	}
+
+	summary := task.Summary()
+	if err != nil {
+		tq.server.GetEnv().GetLogger().Println("Task " + summary.PushID + " failed: " + err.Error())
+	}
+	sender := tq.server.GetEnv().GetCallbackSender()
+	if task.callback == "" || sender == nil {
+		return
+	}
+
+	go func() {
+		err := sender.Send(task.callback, summary)
+		if err != nil {
+			tq.server.GetEnv().GetLogger().Println("Task " + summary.PushID + " callback " + task.callback + " error: " + err.Error())
+		} else {
+			tq.server.GetEnv().GetLogger().Println("Task " + summary.PushID + " callback " + task.callback + " delivered.")
+		}
+	}()
+}
+
+func (tq *TaskQueue) drainPoolFinish() {
+	for {
+		select {
+		case <-tq.poolFinishChannel:
+		default:
+			return
+		}
+	}
+}
+
+// waiting tasks in sending order
+func (tq *TaskQueue) List() []*TaskInfo {
+	tq.Lock.Lock()
+	defer tq.Lock.Unlock()
+
+	list := []*TaskInfo{}
+	for iter := 0; iter < len(tq.tasks); iter++ {
+		task := tq.tasks[(tq.readIndex + iter) % len(tq.tasks)]
+		if task == nil {
+			break
+		}
+
+		info := &TaskInfo{Position:iter, Status:task.GetStatus(), Devices:task.list.Remaining(), Rate:task.GetRate(), Created:task.created}
+		if task.message != nil {
+			info.PushID = task.message.GetUuid()
+		}
+		list = append(list, info)
+	}
+
+	return list
+}
+
+// pools created, ordered by pool id
+func (tq *TaskQueue) ListPools() []*PoolInfo {
+	tq.Lock.Lock()
+	pools := make([]*Pool, 0, len(tq.pools))
+	for _, pool := range tq.pools {
+		if pool != nil {
+			pools = append(pools, pool)
+		}
+	}
+	tq.Lock.Unlock()
+
+	list := make([]*PoolInfo, 0, len(pools))
+	for _, pool := range pools {
+		list = append(list, pool.Info())
+	}
+
+	return list
+}
+
+// created pool by id
+func (tq *TaskQueue) GetPool(poolID int) (*Pool, error) {
+	tq.Lock.Lock()
+	defer tq.Lock.Unlock()
+
+	if poolID < 0 || poolID >= len(tq.pools) || tq.pools[poolID] == nil {
+		return nil, errors.New("Pool not found: " + strconv.Itoa(poolID))
+	}
 
-			//sleep and wait another loop
-			time.Sleep(time.Second);
+	return tq.pools[poolID], nil
+}
+
+func (tq *TaskQueue) setPublishing(publishing bool) {
+	tq.Lock.Lock()
+	defer tq.Lock.Unlock()
+
+	tq.publishing = publishing
+}
+
+func (tq *TaskQueue) setPublishState(state string) {
+	tq.Lock.Lock()
+	defer tq.Lock.Unlock()
+
+	now := time.Now()
+	tq.publishProgress = now
+	if tq.publishState != state {
+		tq.publishState = state
+		tq.publishSince = now
+	}
+}
+
+// publish loop running, its state and since when
+func (tq *TaskQueue) GetPublishState() (bool, string, time.Time) {
+	tq.Lock.Lock()
+	defer tq.Lock.Unlock()
+
+	return tq.publishing, tq.publishState, tq.publishSince
+}
+
+// last progress of publish loop
+func (tq *TaskQueue) GetPublishProgress() time.Time {
+	tq.Lock.Lock()
+	defer tq.Lock.Unlock()
+
+	return tq.publishProgress
+}
+
+// waiting tasks can be added
+func (tq *TaskQueue) GetFree() int {
+	tq.Lock.Lock()
+	defer tq.Lock.Unlock()
+
+	waiting := 0
+	for _, task := range tq.tasks {
+		if task != nil {
+			waiting++
 		}
 	}
+
+	return len(tq.tasks) - waiting
+}
+
+// liveness of publish loop, error if not running or stuck out of idle
+func (tq *TaskQueue) PublishCheck() *HealthCheck {
+	return NewHealthCheck("publish", func(ctx context.Context) (string, error) {
+		publishing, state, since := tq.GetPublishState()
+		if !publishing {
+			return "", errors.New("TaskQueue publish loop is not running.")
+		}
+
+		detail := state + " for " + time.Since(since).Truncate(time.Second).String()
+		//idle waits for new task, no progress expected
+		stale := time.Since(tq.GetPublishProgress())
+		if state != TASK_QUEUE_STATE_IDLE && stale > TASK_QUEUE_PUBLISH_STALE {
+			return detail, errors.New("TaskQueue publish loop no progress for " + stale.Truncate(time.Second).String() + ".")
+		}
+
+		return detail, nil
+	})
+}
+
+// readiness of free waiting slots, error if full
+func (tq *TaskQueue) CapacityCheck() *HealthCheck {
+	return NewHealthCheck("taskqueue", func(ctx context.Context) (string, error) {
+		free := tq.GetFree()
+		detail := strconv.Itoa(free) + " of " + strconv.Itoa(len(tq.tasks)) + " waiting slots free, " + strconv.Itoa(tq.GetSending()) + " tasks sending"
+		if free <= 0 {
+			return detail, errors.New("TaskQueue is full.")
+		}
+
+		return detail, nil
+	})
+}
+
+// tasks sending now
+func (tq *TaskQueue) GetSending() int {
+	tq.Lock.Lock()
+	defer tq.Lock.Unlock()
+
+	return tq.sending
+}
+
+func (tq *TaskQueue) GetConfig() *TaskQueueConfig {
+	return tq.config
 }
 
 // run task queue dispatch run
 func (tq *TaskQueue) Run() {
 	//initilize pools and pick one to run
 	tq.wg.Add(1)
+	tq.setPublishing(true)
 	go func() {
 		tq.publish()
 
+		tq.setPublishing(false)
 		tq.wg.Done()
 	}()
 
@@ -282,3 +768,247 @@ func (t *Task) GetList() *DeviceQueue {
 func (t *Task) GetMessage() MessageInterface {
 	return t.message
 }
+
+// root span of push-id, nil for no trace
+func (t *Task) GetTrace() *Span {
+	return t.trace
+}
+
+// created and finished time, finished zero if not done
+func (t *Task) GetPeriod() (time.Time, time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.created, t.finished
+}
+
+func (t *Task) GetStats() *TaskStats {
+	return t.stats
+}
+
+// message of device: batch item message or A/B testing variant, not localized
+func (t *Task) GetDeviceMessage(device *Device) MessageInterface {
+	if device.Item != nil {
+		return device.Item.Message
+	}
+
+	return t.message.Variant(device.Variant)
+}
+
+// record device push result, locale is the resolved variant
+func (t *Task) Record(device *Device, locale string, resp *WorkerResponse) {
+	t.stats.Record(device, locale, resp)
+
+	if device.Item != nil {
+		device.Item.Record(device.Token, resp)
+	}
+}
+
+// device skipped by frequency cap
+func (t *Task) RecordCapped(device *Device) {
+	t.stats.RecordCapped()
+
+	if device.Item != nil {
+		device.Item.Record(device.Token, &WorkerResponse{Device:device.Token, Reason:FREQUENCY_REASON_CAPPED})
+	}
+}
+
+// batch items of task, nil if not a batch task
+func (t *Task) GetBatchItems() []*BatchItem {
+	if t.list.items == nil {
+		return nil
+	}
+
+	items := make([]*BatchItem, len(t.list.items))
+	for iter, item := range t.list.items {
+		items[iter] = item.Snapshot()
+	}
+
+	return items
+}
+
+// opened callback of a device, counted once a device.
+// false if repeated, or not assigned a variant of split task.
+func (t *Task) RecordOpen(token string) bool {
+	variant := ""
+	if t.list.GetSplit() != nil {
+		var ok bool
+		variant, ok = t.list.GetVariant(token)
+		if !ok {
+			return false
+		}
+	}
+
+	t.lock.Lock()
+	if t.opened[token] {
+		t.lock.Unlock()
+		return false
+	}
+	if t.opened == nil {
+		t.opened = make(map[string]bool)
+	}
+	t.opened[token] = true
+	t.lock.Unlock()
+
+	t.stats.RecordOpen(variant)
+	return true
+}
+
+// sending started
+func (t *Task) start() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.started = time.Now()
+}
+
+// mark task done, false if already done
+func (t *Task) finish(err error) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.finished.IsZero() {
+		return false
+	}
+	t.finished = time.Now()
+	t.err = err
+
+	return true
+}
+
+// cancel a sending task, devices not sent returned.
+// queue cancelled out of task lock, workers in throttle need it to drain the channel.
+func (t *Task) Cancel() (int, error) {
+	t.lock.Lock()
+	if t.started.IsZero() || !t.finished.IsZero() || t.cancelled {
+		t.lock.Unlock()
+		return 0, errors.New("Task " + t.message.GetUuid() + " is not sending.")
+	}
+	t.cancelled = true
+	t.lock.Unlock()
+
+	notSent, err := t.list.Cancel()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err != nil {
+		t.cancelled = false
+		return 0, err
+	}
+	t.notSent += notSent
+	close(t.stop)
+
+	return notSent, nil
+}
+
+// closed when task cancelled
+func (t *Task) Done() <-chan struct{} {
+	return t.stop
+}
+
+// device taken by worker but not pushed, task cancelled
+func (t *Task) RecordNotSent(device *Device) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.notSent++
+}
+
+// waiting, sending, finished, failed or cancelled
+func (t *Task) GetStatus() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.err != nil || t.list.GetStatus() == DEVICE_QUEUE_STATUS_FAILED {
+		return TASK_STATUS_FAILED
+	}
+	if t.cancelled {
+		return TASK_STATUS_CANCELLED
+	}
+	if !t.finished.IsZero() {
+		return TASK_STATUS_FINISHED
+	}
+	if !t.started.IsZero() {
+		return TASK_STATUS_SENDING
+	}
+
+	return TASK_STATUS_WAITING
+}
+
+// failure reason, nil if not failed
+func (t *Task) GetError() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.err != nil {
+		return t.err
+	}
+
+	return t.list.GetError()
+}
+
+// summary of callback, status failed if task failed
+func (t *Task) Summary() *TaskSummary {
+	stats := t.stats.Snapshot()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	summary := &TaskSummary{PushID:t.message.GetUuid(), Status:TASK_STATUS_FINISHED, Total:stats.Total, Success:stats.Success,
+		Fail:stats.Fail, Capped:stats.Capped, Reasons:stats.Reasons, Created:t.created, Finished:t.finished}
+	if t.err != nil {
+		summary.Status = TASK_STATUS_FAILED
+		summary.Error = t.err.Error()
+	} else if t.cancelled {
+		summary.Status = TASK_STATUS_CANCELLED
+		summary.Cancelled = t.notSent
+	}
+	if rejections := t.list.GetRejections(); rejections != nil {
+		summary.Rejected = rejections.Total
+	}
+	if !t.started.IsZero() && !t.finished.IsZero() {
+		summary.Duration = t.finished.Sub(t.started).Seconds()
+	}
+
+	return summary
+}
+
+func (t *Task) GetRolloutID() string {
+	return t.rolloutID
+}
+
+// change task push rate at runtime, rate 0 means unlimited
+func (t *Task) SetRate(rate float64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.bucket == nil {
+		t.bucket = NewTokenBucket(rate, 0)
+	} else {
+		t.bucket.SetRate(rate, 0)
+	}
+}
+
+// task push rate, 0 for unlimited or throttle default not applied yet
+func (t *Task) GetRate() float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.bucket == nil {
+		return 0
+	}
+
+	return t.bucket.GetRate()
+}
+
+// task bucket, create by default rate if not set, nil for unlimited
+func (t *Task) getBucket(defaultRate float64) *TokenBucket {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.bucket == nil && defaultRate > 0 {
+		t.bucket = NewTokenBucket(defaultRate, 0)
+	}
+
+	return t.bucket
+}
@@ -4,6 +4,11 @@ import (
 	"testing"
 	"strconv"
 	"fmt"
+	"errors"
+	"sync"
+	"encoding/json"
+	"strings"
+	"time"
 )
 
 func TestTaskQueueCycleOperation(t *testing.T) {
@@ -59,4 +64,231 @@ func TestTaskQueueCycleOperation(t *testing.T) {
 	}else {
 		t.Log("Task position:" + strconv.Itoa(task.list.Position))
 	}
-}
\ No newline at end of file
+}
+
+// only pool config of env used to add task
+type testTaskEnv struct {
+	EnvInfo
+}
+
+func (e *testTaskEnv) GetPoolConfig() *PoolConfig {
+	config, _ := NewPoolConfig(2, 10, 2, 5)
+	return config
+}
+
+type testTaskServer struct {
+	tq *TaskQueue
+}
+
+func (s *testTaskServer) GetTaskQueue() *TaskQueue { return s.tq }
+func (s *testTaskServer) GetEnv() EnvInfo { return &testTaskEnv{} }
+
+func TestTaskQueueAddFullTesting(t *testing.T) {
+	tq := &TaskQueue{tasks:make([]*Task, 2), taskChangeChannel:make(chan bool, TASK_QUEUE_MAX_WAITING)}
+	server := &testTaskServer{tq:tq}
+	for {
+		if _, err := tq.Add(NewQueueByCapacity(10, nil), &Message{Uuid:"push" + strconv.Itoa(len(tq.history))}); err != nil {
+			break
+		}
+	}
+
+	//rejected task neither builds its audience nor reports failure
+	qb := NewQueueBuilder("", []string{strings.Repeat("a", 64)}, server)
+	qb.CallbackUrl = "https://example.com/callback"
+	if _, err := tq.AddByQueueBuilder(qb, &Message{Uuid:"rejected"}, server); err == nil {
+		t.Fatalf("AddByQueueBuilder() of full taskqueue expect error")
+	}
+	if qb.OnError != nil {
+		t.Errorf("AddByQueueBuilder() rejected expect no OnError hook")
+	}
+	if _, err := tq.GetTaskByPushID("rejected"); err == nil {
+		t.Errorf("AddByQueueBuilder() rejected task should not be remembered")
+	}
+}
+
+func TestTaskQueueConfigTesting(t *testing.T) {
+	config, err := NewTaskQueueConfig(3, 10, 0, false)
+	if err != nil || config.Concurrency != 3 {
+		t.Errorf("NewTaskQueueConfig() concurrency default to pools, got %v %v", config, err)
+	}
+
+	if _, err = NewTaskQueueConfig(3, 10, 5, false); err == nil {
+		t.Errorf("NewTaskQueueConfig() concurrency > pools without share should be error")
+	}
+	if _, err = NewTaskQueueConfig(3, 10, 5, true); err != nil {
+		t.Errorf("NewTaskQueueConfig() concurrency > pools with share error: %s", err.Error())
+	}
+	if _, err = NewTaskQueueConfig(0, 10, 0, false); err == nil {
+		t.Errorf("NewTaskQueueConfig() pools 0 should be error")
+	}
+}
+
+func TestPoolShareTesting(t *testing.T) {
+	publishing := &Task{list:&DeviceQueue{status:DEVICE_QUEUE_STATUS_PENDING}}
+	pool := &Pool{Status:POOL_STATUS_SPARE}
+	if pool.TryShare() {
+		t.Errorf("TryShare() of spare pool should be false")
+	}
+	if !pool.TryLockAndAllocate() || pool.GetSending() != 1 {
+		t.Fatalf("TryLockAndAllocate() of spare pool should be true")
+	}
+
+	pool.Status = POOL_STATUS_SENDING
+	pool.tasks = []*Task{publishing}
+	if pool.TryShare() {
+		t.Errorf("TryShare() should be false while task publishing")
+	}
+
+	publishing.list.status = DEVICE_QUEUE_STATUS_FINISH
+	if !pool.TryShare() || pool.GetSending() != 2 {
+		t.Errorf("TryShare() should be true after tasks published")
+	}
+	//shared task not started yet
+	if pool.TryShare() {
+		t.Errorf("TryShare() should be false before shared task started")
+	}
+
+	pool.finishTask(publishing)
+	if pool.Status != POOL_STATUS_SENDING || pool.GetSending() != 1 {
+		t.Errorf("finishTask() pool should keep sending shared task")
+	}
+	pool.finishTask(&Task{})
+	if pool.Status != POOL_STATUS_SPARE || pool.GetSending() != 0 {
+		t.Errorf("finishTask() pool should be spare after the last task")
+	}
+}
+
+func TestTaskFailedTesting(t *testing.T) {
+	list := NewQueueByCapacity(10, nil)
+	task := NewTask(list, &Message{Uuid:"push1"})
+	if task.GetStatus() != TASK_STATUS_WAITING {
+		t.Errorf("Task status expect waiting, got %s", task.GetStatus())
+	}
+
+	ok, err := list.Fail(errors.New("queue source down"))
+	if !ok || err != nil || list.GetStatus() != DEVICE_QUEUE_STATUS_FAILED {
+		t.Fatalf("DeviceQueue.Fail() error: %v", err)
+	}
+	if _, err = list.SetStatus(DEVICE_QUEUE_STATUS_PENDING); err == nil {
+		t.Errorf("DeviceQueue failed status should not be changed")
+	}
+	if _, err = list.Fail(errors.New("again")); err == nil {
+		t.Errorf("DeviceQueue.Fail() only allowed from init")
+	}
+
+	if task.GetStatus() != TASK_STATUS_FAILED || task.GetError() == nil || task.GetError().Error() != "queue source down" {
+		t.Errorf("Task of failed queue expect failed with reason, got %s %v", task.GetStatus(), task.GetError())
+	}
+	task.finish(list.GetError())
+	if summary := task.Summary(); summary.Status != TASK_STATUS_FAILED || summary.Error != "queue source down" {
+		t.Errorf("Task.Summary() of failed queue error: %+v", summary)
+	}
+
+	sent := NewTask(NewQueueByCapacity(10, nil), &Message{Uuid:"push2"})
+	sent.start()
+	if sent.GetStatus() != TASK_STATUS_SENDING {
+		t.Errorf("Task status expect sending, got %s", sent.GetStatus())
+	}
+	sent.finish(nil)
+	if sent.GetStatus() != TASK_STATUS_FINISHED || sent.GetError() != nil {
+		t.Errorf("Task status expect finished, got %s", sent.GetStatus())
+	}
+}
+
+func TestTaskQueueListTesting(t *testing.T) {
+	tq := &TaskQueue{tasks:make([]*Task, 3), pools:make([]*Pool, 2), taskChangeChannel:make(chan bool, TASK_QUEUE_MAX_WAITING)}
+	tq.AddTask(NewTask(NewQueueByCapacity(10, nil), &Message{Uuid:"push1"}))
+	tq.AddTask(NewTask(NewQueueByCapacity(10, nil), &Message{Uuid:"push2"}))
+	tq.Pop()
+	tq.AddTask(NewTask(NewQueueByCapacity(10, nil), &Message{Uuid:"push3"}))
+
+	list := tq.List()
+	if len(list) != 2 || list[0].PushID != "push2" || list[0].Position != 0 || list[1].PushID != "push3" || list[1].Position != 1 {
+		t.Fatalf("TaskQueue.List() expect push2, push3 in order, got %d", len(list))
+	}
+	if list[0].Status != TASK_STATUS_WAITING {
+		t.Errorf("TaskQueue.List() task status expect waiting, got %s", list[0].Status)
+	}
+
+	if _, err := tq.GetPool(0); err == nil {
+		t.Errorf("TaskQueue.GetPool() of not created pool should be error")
+	}
+	config, _ := NewPoolConfig(2, 10, 2, 5)
+	pool := &Pool{PoolID:1, Status:POOL_STATUS_SENDING, Config:config, slotCond:sync.NewCond(&sync.Mutex{}), task:tq.tasks[1], tasks:[]*Task{tq.tasks[1]}}
+	tq.pools[1] = pool
+	if found, err := tq.GetPool(1); err != nil || found != pool {
+		t.Errorf("TaskQueue.GetPool() error: %v", err)
+	}
+
+	pools := tq.ListPools()
+	if len(pools) != 1 || pools[0].Name != "pool_1" || pools[0].Task != "push2" || len(pools[0].Tasks) != 1 || pools[0].Config.Capacity != 10 {
+		t.Errorf("TaskQueue.ListPools() expect pool_1 sending push2, got %+v", pools)
+	}
+
+	if pool.ResizeTo(1) == nil || pool.ResizeTo(11) == nil {
+		t.Errorf("Pool.ResizeTo() out of spare.mini and capacity should be error")
+	}
+	if pool.Stop() == nil {
+		t.Errorf("Pool.Stop() of sending pool should be error")
+	}
+}
+
+func TestTaskCancelTesting(t *testing.T) {
+	list := NewQueueByCapacity(2, nil)
+	tokens := []string{}
+	for iter := 0; iter < 5; iter++ {
+		tokens = append(tokens, strings.Repeat(strconv.Itoa(iter), 64))
+	}
+	if err := list.AppendDataSource(tokens); err != nil || list.Len() != 5 {
+		t.Fatalf("AppendDataSource() expect 5 devices, got %d %v", list.Len(), err)
+	}
+	task := NewTask(list, &Message{Uuid:"push1"})
+	if _, err := task.Cancel(); err == nil {
+		t.Errorf("Task.Cancel() of waiting task should be error")
+	}
+
+	list.SetStatus(DEVICE_QUEUE_STATUS_PENDING)
+	list.EnableCloseAfterSended()
+	task.start()
+	//2 buffered in channel, 1 in flight of worker
+	list.sendToChannel()
+	list.sendToChannel()
+	<-list.Channel
+	list.sendToChannel()
+
+	pool := &Pool{PoolID:1, Status:POOL_STATUS_SENDING, tasks:[]*Task{task}}
+	cancelled, err := pool.Cancel()
+	if err != nil || cancelled["push1"] != 4 {
+		t.Fatalf("Pool.Cancel() expect 4 devices not sent, got %v %v", cancelled, err)
+	}
+	if list.Remaining() != 0 || list.GetStatus() != DEVICE_QUEUE_STATUS_FINISH || task.GetStatus() != TASK_STATUS_CANCELLED {
+		t.Errorf("Task.Cancel() expect queue finished and task cancelled, got %d %s %s", list.Remaining(), list.GetStatus(), task.GetStatus())
+	}
+	if _, err = task.Cancel(); err == nil {
+		t.Errorf("Task.Cancel() twice should be error")
+	}
+
+	//channel closed, workers return
+	list.sendToChannel()
+	if _, more := <-list.Channel; more {
+		t.Errorf("DeviceQueue channel expect closed after cancel")
+	}
+	task.finish(nil)
+	if summary := task.Summary(); summary.Status != TASK_STATUS_CANCELLED || summary.Cancelled != 4 {
+		t.Errorf("Task.Summary() of cancelled task error: %+v", summary)
+	}
+
+	spare := &Pool{PoolID:2, Status:POOL_STATUS_SPARE}
+	if _, err = spare.Cancel(); err == nil {
+		t.Errorf("Pool.Cancel() of spare pool should be error")
+	}
+}
+
+func TestPoolConfigJsonTesting(t *testing.T) {
+	config, _ := NewPoolConfig(2, 10, 2, 5)
+	config.AutoScaleInterval = 30 * time.Second
+	content, err := json.Marshal(config)
+	if err != nil || !strings.Contains(string(content), `"autoscale_interval":30`) || !strings.Contains(string(content), `"capacity":10`) {
+		t.Errorf("PoolConfig json expect autoscale_interval seconds, got %s %v", content, err)
+	}
+}
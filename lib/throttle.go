@@ -0,0 +1,67 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"sync"
+)
+
+// Outbound push throttle shared by all pools and workers.
+// a push waits for the task token first, then the global token, rate 0 means unlimited.
+type Throttle struct {
+	global   *TokenBucket
+
+	//default rate of task without own rate
+	taskRate float64
+
+	lock     sync.Mutex
+}
+
+func NewThrottle(rate float64, burst int, taskRate float64) *Throttle {
+	return &Throttle{global:NewTokenBucket(rate, burst), taskRate:taskRate}
+}
+
+// block worker until task and global rate allow a push, false if task cancelled while waiting
+func (th *Throttle) Wait(task *Task) bool {
+	var stop <-chan struct{}
+	var bucket *TokenBucket
+	if task != nil {
+		stop = task.Done()
+		if bucket = task.getBucket(th.GetTaskRate()); bucket != nil && !bucket.Wait(stop) {
+			return false
+		}
+	}
+
+	if !th.global.Wait(stop) {
+		//not sent, task token given back too
+		if bucket != nil {
+			bucket.refund()
+		}
+		return false
+	}
+
+	return true
+}
+
+// change global rate at runtime
+func (th *Throttle) SetRate(rate float64, burst int) {
+	th.global.SetRate(rate, burst)
+}
+
+func (th *Throttle) GetRate() float64 {
+	return th.global.GetRate()
+}
+
+// change default task rate at runtime, tasks already sending keep their rate
+func (th *Throttle) SetTaskRate(rate float64) {
+	th.lock.Lock()
+	defer th.lock.Unlock()
+
+	th.taskRate = rate
+}
+
+func (th *Throttle) GetTaskRate() float64 {
+	th.lock.Lock()
+	defer th.lock.Unlock()
+
+	return th.taskRate
+}
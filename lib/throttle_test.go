@@ -0,0 +1,107 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottleTesting(t *testing.T) {
+	th := NewThrottle(0, 0, 20)
+	task := NewTask(NewQueue(nil), nil)
+
+	start := time.Now()
+	for iter := 0; iter < 3; iter++ {
+		th.Wait(task)
+	}
+	//burst 20 of default task rate
+	if time.Since(start) > 50 * time.Millisecond {
+		t.Errorf("Wait() burst should not block: %v", time.Since(start))
+	}
+	if task.GetRate() != 20 {
+		t.Errorf("Task default rate error: %v", task.GetRate())
+	}
+
+	task.SetRate(1)
+	th.SetRate(100, 1)
+	if th.GetRate() != 100 || task.GetRate() != 1 {
+		t.Errorf("SetRate() error: %v %v", th.GetRate(), task.GetRate())
+	}
+}
+
+func TestThrottleRateTesting(t *testing.T) {
+	//global 50/s without burst, 6 pushes wait 5 deficits of 20ms
+	th := NewThrottle(50, 1, 0)
+	start := time.Now()
+	for iter := 0; iter < 6; iter++ {
+		if !th.Wait(nil) {
+			t.Fatalf("Wait() without task should not stop")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90 * time.Millisecond || elapsed > 500 * time.Millisecond {
+		t.Errorf("Wait() global rate 50/s expect ~100ms for 6 pushes, got %v", elapsed)
+	}
+
+	//task rate limits below global
+	th = NewThrottle(0, 0, 0)
+	task := NewTask(NewQueue(nil), nil)
+	task.SetRate(20)
+	start = time.Now()
+	for iter := 0; iter < 23; iter++ {
+		th.Wait(task)
+	}
+	if elapsed := time.Since(start); elapsed < 130 * time.Millisecond {
+		t.Errorf("Wait() task rate 20/s expect ~150ms after burst, got %v", elapsed)
+	}
+
+	//stopped while waiting, token given back
+	tb := NewTokenBucket(1, 1)
+	tb.Wait(nil)
+	stop := make(chan struct{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(stop)
+	}()
+	start = time.Now()
+	if tb.Wait(stop) || time.Since(start) > 500 * time.Millisecond {
+		t.Errorf("Wait() expect false soon after stop, waited %v", time.Since(start))
+	}
+	if ok, wait := tb.Available(); ok || wait < 500 * time.Millisecond {
+		t.Errorf("Wait() stopped expect token given back, next in %v", wait)
+	}
+}
+
+func TestThrottleCancelTesting(t *testing.T) {
+	//global 1/s, second push waits on global with task token taken
+	th := NewThrottle(1, 1, 0)
+	task := NewTask(NewQueue(nil), nil)
+	task.SetRate(2)
+	if !th.Wait(task) {
+		t.Fatalf("Wait() first push should not stop")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		//as Cancel does
+		close(task.stop)
+	}()
+	if th.Wait(task) {
+		t.Errorf("Wait() expect false after task cancelled")
+	}
+
+	bucket := task.getBucket(0)
+	bucket.lock.Lock()
+	tokens, burst := bucket.tokens, bucket.burst
+	bucket.lock.Unlock()
+	//burst 2, one taken by first push
+	if tokens < burst - 1 {
+		t.Errorf("Wait() cancelled on global expect task token given back, got %v of %v", tokens, burst)
+	}
+
+	//refund never over burst
+	tb := NewTokenBucket(1, 1)
+	tb.refund()
+	if tb.tokens != 1 {
+		t.Errorf("refund() expect tokens clamped to burst 1, got %v", tb.tokens)
+	}
+}
@@ -0,0 +1,447 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TRACE_EXPORTER_OTLP = "otlp"
+	TRACE_EXPORTER_MEMORY = "memory"
+
+	TRACE_DEFAULT_ENDPOINT = "http://localhost:4318/v1/traces"
+	//sampled Worker.Push spans per device
+	TRACE_DEFAULT_SAMPLE_RATE = 0.01
+
+	//spans buffered by otlp exporter, dropped when full, tracing never blocks pushes
+	TRACE_OTLP_BUFFER = 10000
+	TRACE_OTLP_BATCH = 512
+	TRACE_OTLP_FLUSH_INTERVAL = 5 * time.Second
+	TRACE_OTLP_TIMEOUT = 10 * time.Second
+
+	//otlp status code
+	TRACE_STATUS_UNSET = 0
+	TRACE_STATUS_OK = 1
+	TRACE_STATUS_ERROR = 2
+)
+
+// A finished span is exported, must not block
+type SpanExporter interface {
+	Export(span *Span)
+
+	// flush and stop
+	Shutdown() error
+}
+
+// Traces of push-ids, a nil tracer and its nil spans do nothing, so call sites need no check.
+type Tracer struct {
+	Service    string
+	//Worker.Push spans per device, 0-1
+	SampleRate float64
+
+	exporter   SpanExporter
+}
+
+func NewTracer(service string, exporter SpanExporter, sampleRate float64) (*Tracer, error) {
+	if exporter == nil {
+		return nil, errors.New("Tracer exporter is nil.")
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, errors.New("Tracer sample rate must between 0 and 1: " + strconv.FormatFloat(sampleRate, 'f', -1, 64))
+	}
+
+	return &Tracer{Service:service, SampleRate:sampleRate, exporter:exporter}, nil
+}
+
+// root span of a push-id, trace id is the push-id uuid, or hash of it
+func (tr *Tracer) StartTrace(pushID, name string, start time.Time) *Span {
+	if tr == nil {
+		return nil
+	}
+
+	return &Span{TraceID:TraceIDOf(pushID), SpanID:newSpanID(), Name:name, Start:start, Attributes:map[string]interface{}{"push_id":pushID}, tracer:tr}
+}
+
+// whether a per device span is sampled
+func (tr *Tracer) Sampled() bool {
+	if tr == nil || tr.SampleRate <= 0 {
+		return false
+	}
+
+	return tr.SampleRate >= 1 || mathrand.Float64() < tr.SampleRate
+}
+
+func (tr *Tracer) Shutdown() error {
+	if tr == nil {
+		return nil
+	}
+
+	return tr.exporter.Shutdown()
+}
+
+func TraceIDOf(pushID string) string {
+	id := strings.ToLower(strings.Replace(pushID, "-", "", -1))
+	if _, err := hex.DecodeString(id); err == nil && len(id) == 32 {
+		return id
+	}
+
+	sum := sha256.Sum256([]byte(pushID))
+	return hex.EncodeToString(sum[:16])
+}
+
+func newSpanID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Status     int
+	//error message if status error
+	Message    string
+
+	tracer     *Tracer
+	lock       sync.Mutex
+	ended      bool
+}
+
+// child span started now
+func (s *Span) Child(name string) *Span {
+	return s.ChildAt(name, time.Now())
+}
+
+func (s *Span) ChildAt(name string, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+
+	return &Span{TraceID:s.TraceID, SpanID:newSpanID(), ParentID:s.SpanID, Name:name, Start:start, Attributes:map[string]interface{}{}, tracer:s.tracer}
+}
+
+// value string, bool, int, int64 or float64
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Attributes[key] = value
+}
+
+// status error if err not nil, else ok
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err == nil {
+		s.Status = TRACE_STATUS_OK
+		return
+	}
+	s.Status = TRACE_STATUS_ERROR
+	s.Message = err.Error()
+}
+
+// end now and export, only once
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.lock.Unlock()
+
+	s.tracer.exporter.Export(s)
+}
+
+// Keep spans in memory, for testing
+type MemoryExporter struct {
+	spans []*Span
+	lock  sync.Mutex
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (e *MemoryExporter) Export(span *Span) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.spans = append(e.spans, span)
+}
+
+func (e *MemoryExporter) GetSpans() []*Span {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	spans := make([]*Span, len(e.spans))
+	copy(spans, e.spans)
+	return spans
+}
+
+// first span of name, nil if not found
+func (e *MemoryExporter) Find(name string) *Span {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, span := range e.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+
+	return nil
+}
+
+func (e *MemoryExporter) Reset() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.spans = nil
+}
+
+func (e *MemoryExporter) Shutdown() error {
+	return nil
+}
+
+// OTLP/HTTP json exporter, eg. endpoint http://collector:4318/v1/traces
+type OtlpExporter struct {
+	Endpoint string
+	Service  string
+
+	client   *http.Client
+	spans    chan *Span
+	done     chan bool
+	interval time.Duration
+
+	//spans dropped when buffer full or post failed
+	dropped  int64
+	lock     sync.Mutex
+}
+
+func NewOtlpExporter(endpoint, service string) (*OtlpExporter, error) {
+	if endpoint == "" {
+		endpoint = TRACE_DEFAULT_ENDPOINT
+	}
+	if err := ValidateCallbackUrl(endpoint); err != nil {
+		return nil, errors.New("Otlp endpoint error: " + err.Error())
+	}
+
+	e := &OtlpExporter{Endpoint:endpoint, Service:service, client:&http.Client{Timeout:TRACE_OTLP_TIMEOUT},
+		spans:make(chan *Span, TRACE_OTLP_BUFFER), done:make(chan bool), interval:TRACE_OTLP_FLUSH_INTERVAL}
+	go e.run()
+
+	return e, nil
+}
+
+func (e *OtlpExporter) Export(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+		e.drop(1)
+	}
+}
+
+func (e *OtlpExporter) drop(count int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.dropped += int64(count)
+}
+
+func (e *OtlpExporter) GetDropped() int64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.dropped
+}
+
+func (e *OtlpExporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, TRACE_OTLP_BATCH)
+	for {
+		select {
+		case span, more := <-e.spans:
+			if !more {
+				e.flush(batch)
+				close(e.done)
+				return
+			}
+
+			batch = append(batch, span)
+			if len(batch) >= TRACE_OTLP_BATCH {
+				e.flush(batch)
+				batch = make([]*Span, 0, TRACE_OTLP_BATCH)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.flush(batch)
+				batch = make([]*Span, 0, TRACE_OTLP_BATCH)
+			}
+		}
+	}
+}
+
+func (e *OtlpExporter) flush(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	err := e.post(batch)
+	if err != nil {
+		e.drop(len(batch))
+	}
+}
+
+func (e *OtlpExporter) post(batch []*Span) error {
+	body, err := json.Marshal(NewOtlpTraces(e.Service, batch))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	//reuse connection
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("http status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	return nil
+}
+
+// flush buffered spans, no Export after Shutdown
+func (e *OtlpExporter) Shutdown() error {
+	close(e.spans)
+	<-e.done
+
+	return nil
+}
+
+// OTLP json encoding, ids in hex, nanos as string
+type OtlpTraces struct {
+	ResourceSpans []*OtlpResourceSpans `json:"resourceSpans"`
+}
+
+type OtlpResourceSpans struct {
+	Resource   OtlpResource `json:"resource"`
+	ScopeSpans []*OtlpScopeSpans `json:"scopeSpans"`
+}
+
+type OtlpResource struct {
+	Attributes []*OtlpKeyValue `json:"attributes"`
+}
+
+type OtlpScopeSpans struct {
+	Scope OtlpScope `json:"scope"`
+	Spans []*OtlpSpan `json:"spans"`
+}
+
+type OtlpScope struct {
+	Name string `json:"name"`
+}
+
+type OtlpSpan struct {
+	TraceID           string `json:"traceId"`
+	SpanID            string `json:"spanId"`
+	ParentSpanID      string `json:"parentSpanId,omitempty"`
+	Name              string `json:"name"`
+	//internal
+	Kind              int `json:"kind"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string `json:"endTimeUnixNano"`
+	Attributes        []*OtlpKeyValue `json:"attributes"`
+	Status            OtlpStatus `json:"status"`
+}
+
+type OtlpStatus struct {
+	Code    int `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type OtlpKeyValue struct {
+	Key   string `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func NewOtlpTraces(service string, spans []*Span) *OtlpTraces {
+	scope := &OtlpScopeSpans{Scope:OtlpScope{Name:"gopush"}}
+	for _, span := range spans {
+		scope.Spans = append(scope.Spans, span.toOtlp())
+	}
+
+	resource := OtlpResource{Attributes:[]*OtlpKeyValue{newOtlpKeyValue("service.name", service)}}
+	return &OtlpTraces{ResourceSpans:[]*OtlpResourceSpans{{Resource:resource, ScopeSpans:[]*OtlpScopeSpans{scope}}}}
+}
+
+func (s *Span) toOtlp() *OtlpSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	span := &OtlpSpan{TraceID:s.TraceID, SpanID:s.SpanID, ParentSpanID:s.ParentID, Name:s.Name, Kind:1,
+		StartTimeUnixNano:strconv.FormatInt(s.Start.UnixNano(), 10), EndTimeUnixNano:strconv.FormatInt(s.End.UnixNano(), 10),
+		Attributes:[]*OtlpKeyValue{}, Status:OtlpStatus{Code:s.Status, Message:s.Message}}
+	for key, value := range s.Attributes {
+		span.Attributes = append(span.Attributes, newOtlpKeyValue(key, value))
+	}
+
+	return span
+}
+
+func newOtlpKeyValue(key string, value interface{}) *OtlpKeyValue {
+	kv := &OtlpKeyValue{Key:key}
+	switch v := value.(type) {
+	case bool:
+		kv.Value = map[string]interface{}{"boolValue":v}
+	case int:
+		kv.Value = map[string]interface{}{"intValue":strconv.Itoa(v)}
+	case int64:
+		kv.Value = map[string]interface{}{"intValue":strconv.FormatInt(v, 10)}
+	case float64:
+		kv.Value = map[string]interface{}{"doubleValue":v}
+	case string:
+		kv.Value = map[string]interface{}{"stringValue":v}
+	default:
+		kv.Value = map[string]interface{}{"stringValue":""}
+	}
+
+	return kv
+}
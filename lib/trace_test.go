@@ -0,0 +1,109 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTracerTesting(t *testing.T) {
+	var tracer *Tracer
+	//disabled tracer, spans do nothing
+	span := tracer.StartTrace("push1", "PushApi.Send", time.Now())
+	span.SetAttribute("client", "ops")
+	span.Child("QueueBuilder.processData").Finish()
+	span.Finish()
+	if span != nil || tracer.Sampled() {
+		t.Errorf("nil Tracer expect nil span and not sampled")
+	}
+
+	if _, err := NewTracer("gopush", NewMemoryExporter(), 2); err == nil {
+		t.Errorf("NewTracer() with sample rate 2 expect error")
+	}
+
+	exporter := NewMemoryExporter()
+	tracer, err := NewTracer("gopush", exporter, 1)
+	if err != nil {
+		t.Fatalf("NewTracer() error: %v", err)
+	}
+
+	pushID := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	root := tracer.StartTrace(pushID, "PushApi.Send", time.Now())
+	child := root.Child("QueueBuilder.processData")
+	child.SetAttribute("devices", 3)
+	child.SetError(errors.New("no device"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("MemoryExporter expect 2 spans exported once, got %d", len(spans))
+	}
+	if root.TraceID != "6ba7b8109dad11d180b400c04fd430c8" || child.TraceID != root.TraceID || child.ParentID != root.SpanID {
+		t.Errorf("span expect trace id of push-id and parent root, got %s %s %s", child.TraceID, child.ParentID, root.SpanID)
+	}
+	found := exporter.Find("QueueBuilder.processData")
+	if found == nil || found.Status != TRACE_STATUS_ERROR || found.Message != "no device" || found.Attributes["devices"] != 3 {
+		t.Errorf("MemoryExporter.Find() expect error span with devices, got %+v", found)
+	}
+	if TraceIDOf("push1") != TraceIDOf("push1") || len(TraceIDOf("push1")) != 32 {
+		t.Errorf("TraceIDOf() of non uuid expect stable 32 hex, got %s", TraceIDOf("push1"))
+	}
+	if !tracer.Sampled() {
+		t.Errorf("Tracer.Sampled() of rate 1 expect true")
+	}
+}
+
+func TestOtlpExporterTesting(t *testing.T) {
+	received := make(chan *OtlpTraces, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traces := &OtlpTraces{}
+		err := json.NewDecoder(r.Body).Decode(traces)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- traces
+	}))
+	defer server.Close()
+
+	if _, err := NewOtlpExporter("localhost:4318", "gopush"); err == nil {
+		t.Errorf("NewOtlpExporter() of endpoint without scheme expect error")
+	}
+
+	exporter, err := NewOtlpExporter(server.URL + "/v1/traces", "gopush")
+	if err != nil {
+		t.Fatalf("NewOtlpExporter() error: %v", err)
+	}
+	tracer, _ := NewTracer("gopush", exporter, 0)
+
+	root := tracer.StartTrace("push1", "PushApi.Send", time.Now())
+	root.Child("TaskQueue.wait").Finish()
+	root.Finish()
+	//flush on shutdown
+	exporter.Shutdown()
+
+	select {
+	case traces := <-received:
+		if len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans) != 1 {
+			t.Fatalf("OTLP body expect one resource and scope, got %+v", traces)
+		}
+		spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+		if len(spans) != 2 || spans[0].ParentSpanID != root.SpanID || spans[1].TraceID != TraceIDOf("push1") {
+			t.Errorf("OTLP spans expect child and root of push1, got %d", len(spans))
+		}
+		if traces.ResourceSpans[0].Resource.Attributes[0].Value["stringValue"] != "gopush" {
+			t.Errorf("OTLP resource expect service.name gopush")
+		}
+	default:
+		t.Errorf("OtlpExporter.Shutdown() expect spans posted")
+	}
+	if exporter.GetDropped() != 0 {
+		t.Errorf("OtlpExporter expect no dropped spans, got %d", exporter.GetDropped())
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+const (
+	PROVIDER_APNS = "apns"
+	PROVIDER_FCM = "fcm"
+	PROVIDER_WEBPUSH = "webpush"
+
+	//apns token is 32 bytes now, apple says it may grow up to 100 bytes
+	APNS_TOKEN_MIN_LENGTH = 64
+	APNS_TOKEN_MAX_LENGTH = 200
+
+	FCM_TOKEN_MIN_LENGTH = 100
+	FCM_TOKEN_MAX_LENGTH = 4096
+
+	//rejections kept as samples of report, all counted
+	REJECTION_MAX_SAMPLES = 100
+)
+
+var (
+	apnsTokenRegexp = regexp.MustCompile("^([0-9a-fA-F]{2})+$")
+	fcmTokenRegexp = regexp.MustCompile("^[0-9A-Za-z_:-]+$")
+
+	tokenValidators = make(map[string]TokenValidator)
+	tokenValidatorsLock sync.Mutex
+)
+
+// Device token format check of a push provider
+type TokenValidator interface {
+	GetProvider() string
+
+	// nil if token valid
+	Validate(token string) error
+}
+
+func init() {
+	RegisterTokenValidator(&ApnsTokenValidator{})
+	RegisterTokenValidator(&FcmTokenValidator{})
+	RegisterTokenValidator(&WebPushTokenValidator{})
+}
+
+// register or replace the validator of provider
+func RegisterTokenValidator(validator TokenValidator) {
+	tokenValidatorsLock.Lock()
+	defer tokenValidatorsLock.Unlock()
+
+	tokenValidators[validator.GetProvider()] = validator
+}
+
+func GetTokenValidator(provider string) (TokenValidator, error) {
+	tokenValidatorsLock.Lock()
+	defer tokenValidatorsLock.Unlock()
+
+	validator, ok := tokenValidators[provider]
+	if !ok {
+		return nil, errors.New("No token validator of provider: " + provider)
+	}
+
+	return validator, nil
+}
+
+// Apns hex token, variable length
+type ApnsTokenValidator struct{}
+
+func (v *ApnsTokenValidator) GetProvider() string {
+	return PROVIDER_APNS
+}
+
+func (v *ApnsTokenValidator) Validate(token string) error {
+	if len(token) < APNS_TOKEN_MIN_LENGTH || len(token) > APNS_TOKEN_MAX_LENGTH {
+		return errors.New("apns token length must be " + strconv.Itoa(APNS_TOKEN_MIN_LENGTH) + "~" + strconv.Itoa(APNS_TOKEN_MAX_LENGTH))
+	}
+	if !apnsTokenRegexp.MatchString(token) {
+		return errors.New("apns token must be hex")
+	}
+
+	return nil
+}
+
+// FCM registration token
+type FcmTokenValidator struct{}
+
+func (v *FcmTokenValidator) GetProvider() string {
+	return PROVIDER_FCM
+}
+
+func (v *FcmTokenValidator) Validate(token string) error {
+	if len(token) < FCM_TOKEN_MIN_LENGTH || len(token) > FCM_TOKEN_MAX_LENGTH {
+		return errors.New("fcm token length must be " + strconv.Itoa(FCM_TOKEN_MIN_LENGTH) + "~" + strconv.Itoa(FCM_TOKEN_MAX_LENGTH))
+	}
+	if !fcmTokenRegexp.MatchString(token) {
+		return errors.New("fcm token has invalid character")
+	}
+
+	return nil
+}
+
+// Web push subscription json, or the https endpoint only if keys stored elsewhere
+// eg. {"endpoint": "https://fcm.googleapis.com/fcm/send/...", "keys": {"p256dh": "...", "auth": "..."}}
+type WebPushTokenValidator struct{}
+
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+func (v *WebPushTokenValidator) GetProvider() string {
+	return PROVIDER_WEBPUSH
+}
+
+func (v *WebPushTokenValidator) Validate(token string) error {
+	endpoint := token
+	if len(token) > 0 && token[0] == '{' {
+		subscription := &WebPushSubscription{}
+		err := json.Unmarshal([]byte(token), subscription)
+		if err != nil {
+			return errors.New("webpush subscription is not valid json")
+		}
+		if subscription.Keys.P256dh == "" || subscription.Keys.Auth == "" {
+			return errors.New("webpush subscription keys p256dh and auth are required")
+		}
+		endpoint = subscription.Endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("webpush endpoint must be a https url")
+	}
+
+	return nil
+}
+
+// A device line skipped by validation
+type TokenRejection struct {
+	//line number in source counted over all appends, item number for batch items, both from 1
+	Line   int `json:"line"`
+	Token  string `json:"token"`
+	Reason string `json:"reason"`
+}
+
+// Invalid devices of a queue, counted by reason
+type RejectionReport struct {
+	Total   int `json:"total"`
+	Reasons map[string]int `json:"reasons"`
+
+	//first REJECTION_MAX_SAMPLES rejections
+	Samples []*TokenRejection `json:"samples"`
+}
+
+func NewRejectionReport() *RejectionReport {
+	return &RejectionReport{Reasons:make(map[string]int), Samples:[]*TokenRejection{}}
+}
+
+// reason is the counting key, detail only in sample
+func (r *RejectionReport) add(line int, token, reason string) {
+	r.Total++
+	r.Reasons[reason]++
+	if len(r.Samples) < REJECTION_MAX_SAMPLES {
+		r.Samples = append(r.Samples, &TokenRejection{Line:line, Token:token, Reason:reason})
+	}
+}
+
+//A copy for reading
+func (r *RejectionReport) Snapshot() *RejectionReport {
+	snap := NewRejectionReport()
+	snap.Total = r.Total
+	for reason, count := range r.Reasons {
+		snap.Reasons[reason] = count
+	}
+	for _, rejection := range r.Samples {
+		copied := *rejection
+		snap.Samples = append(snap.Samples, &copied)
+	}
+
+	return snap
+}
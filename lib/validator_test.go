@@ -0,0 +1,81 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenValidatorTesting(t *testing.T) {
+	apns, err := GetTokenValidator(PROVIDER_APNS)
+	if err != nil {
+		t.Fatalf("GetTokenValidator(apns) error: %v", err)
+	}
+	if _, err = GetTokenValidator("unknown"); err == nil {
+		t.Errorf("GetTokenValidator() of unknown provider should be error")
+	}
+
+	cases := []struct {
+		provider string
+		token    string
+		valid    bool
+	}{
+		{PROVIDER_APNS, strings.Repeat("a1", 32), true},
+		{PROVIDER_APNS, strings.Repeat("A1", 50), true},
+		{PROVIDER_APNS, strings.Repeat("a", 65), false},
+		{PROVIDER_APNS, strings.Repeat("g", 64), false},
+		{PROVIDER_APNS, "fdas", false},
+		{PROVIDER_FCM, "dQw4w9WgXcQ:APA91b" + strings.Repeat("Ab_-9", 30), true},
+		{PROVIDER_FCM, "short", false},
+		{PROVIDER_FCM, strings.Repeat("a/", 60), false},
+		{PROVIDER_WEBPUSH, "https://fcm.googleapis.com/fcm/send/abc", true},
+		{PROVIDER_WEBPUSH, `{"endpoint": "https://updates.push.services.mozilla.com/wpush/v2/x", "keys": {"p256dh": "BNc", "auth": "tBH"}}`, true},
+		{PROVIDER_WEBPUSH, `{"endpoint": "https://updates.push.services.mozilla.com/wpush/v2/x", "keys": {"p256dh": "BNc"}}`, false},
+		{PROVIDER_WEBPUSH, "http://insecure.example.com/push", false},
+		{PROVIDER_WEBPUSH, "{broken", false},
+	}
+	for _, c := range cases {
+		validator, err := GetTokenValidator(c.provider)
+		if err != nil {
+			t.Fatalf("GetTokenValidator(%s) error: %v", c.provider, err)
+		}
+		err = validator.Validate(c.token)
+		if (err == nil) != c.valid {
+			t.Errorf("%s Validate(%s) expect valid %v, got %v", c.provider, c.token, c.valid, err)
+		}
+	}
+
+	//invalid lines skipped and reported
+	q := NewQueueByCapacity(10, nil)
+	q.SetValidator(apns)
+	err = q.AppendDataSource([]string{"fdas", strings.Repeat("a", 64), "", strings.Repeat("g", 64), "bad"})
+	if err != nil {
+		t.Fatalf("AppendDataSource() with valid devices should not be error: %v", err)
+	}
+	report := q.GetRejections()
+	if q.Len() != 1 || report == nil || report.Total != 3 || len(report.Samples) != 3 || report.Samples[0].Line != 1 || report.Samples[1].Line != 4 {
+		t.Errorf("AppendDataSource() expect 1 device and 3 rejections, got %d %+v", q.Len(), report)
+	}
+	if report.Reasons["apns token must be hex"] != 1 {
+		t.Errorf("RejectionReport reasons error: %v", report.Reasons)
+	}
+
+	if err = q.AppendDataSource([]string{"bad"}); err == nil {
+		t.Errorf("AppendDataSource() all rejected should be error")
+	}
+	//lines go on after 5 lines of first append
+	report = q.GetRejections()
+	if report.Total != 4 || report.Samples[3].Line != 6 {
+		t.Errorf("AppendDataSource() expect line 6 of second append, got %+v", report.Samples[3])
+	}
+
+	//batch item number instead of line
+	q = NewQueueByCapacity(10, nil)
+	q.SetValidator(apns)
+	q.AppendBatchItems([]*BatchItem{{DeviceID:strings.Repeat("a", 64)}}, nil)
+	q.AppendBatchItems([]*BatchItem{{DeviceID:strings.Repeat("b", 64)}, {DeviceID:"bad"}}, nil)
+	report = q.GetRejections()
+	if report == nil || report.Total != 1 || report.Samples[0].Line != 3 {
+		t.Errorf("AppendBatchItems() expect rejection of item 3, got %+v", report)
+	}
+}
@@ -1,11 +1,19 @@
 // Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
 package lib
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 const (
 	WORKER_STATUS_SPARE = iota
 	WORKER_STATUS_RUNNING
+	//connection of worker failed health check, GOAWAY or push error
+	WORKER_STATUS_UNHEALTHY
+	WORKER_STATUS_RECONNECTING
+	//stopped by Destroy, can not be used again
+	WORKER_STATUS_DESTROYED
 
 	WORKER_COMMAND_SEND = iota
 	WORKER_COMMAND_STOP
@@ -33,8 +41,12 @@ type Worker interface {
 	SetPool(pool *Pool) (bool)
 	GetPool() (*Pool)
 
+	// Stop running and release resources
 	Destroy() (error)
 
+	// pushes sent by worker
+	GetPushes() int64
+
 	GetStatus() int
 
 	//worker's uuid identify
@@ -58,10 +70,24 @@ func NewWorkerRequeset(msg MessageInterface, device string, cmd int) *WorkerRequ
 }
 
 type WorkerResponse struct {
-	Response interface{}
+	Response   interface{}
 
 	//the specified device send to
-	Device   string
+	Device     string
+
+	//whether provider accepted the notification
+	Sent       bool
+
+	//provider reason if not sent, eg. BadDeviceToken
+	Reason     string
+
+	//provider http status, 0 if request error
+	StatusCode int
+	//provider notification id, eg. apns-id
+	ApnsID     string
+	Latency    time.Duration
+	//topic of credentials the push connection dialed with
+	Topic      string
 
-	Error    error
+	Error      error
 }
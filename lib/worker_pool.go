@@ -3,64 +3,229 @@ package lib
 
 import (
 	"errors"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
+)
+
+const (
+	//harvested worker destroyed after idle timeout
+	WORKER_POOL_DEFAULT_IDLE_TIMEOUT = 5 * time.Minute
+	//max workers of all pools
+	WORKER_POOL_DEFAULT_MAX = POOL_DEFAULT_CAPACITY * TASK_QUEUE_MAX_POOL
+
+	//pool id of harvested worker
+	WORKER_POOL_HARVESTED = -1
 )
 
 // A global worker env related management
 // worker identify use uuid
 type WorkerPool struct {
 	//string is uuid field
-	workers map[string]Worker
+	workers     map[string]Worker
+
+	//created and harvested time of workers
+	created     map[string]time.Time
+	harvested   map[string]time.Time
+
+	maxWorkers  int
+	idleTimeout time.Duration
 
 	//Env related workers
-	env     EnvInfo
+	env         EnvInfo
+
+	lock        sync.Mutex
+}
 
-	lock    sync.Mutex
+// Worker introspection
+type WorkerInfo struct {
+	UUID     string `json:"uuid"`
+	Name     string `json:"name"`
+	Status   int `json:"status"`
+	//WORKER_POOL_HARVESTED if harvested
+	PoolID   int `json:"pool_id"`
+	WorkerID int `json:"worker_id"`
+	//seconds since created
+	Age      int64 `json:"age"`
+	//seconds since harvested, 0 if in a pool
+	Idle     int64 `json:"idle"`
+	Pushes   int64 `json:"pushes"`
 }
 
-func NewWorkerPool(env EnvInfo) (*WorkerPool, error) {
-	// Max workers controlled by poolNum*pool.Capacity
+// maxWorkers<=0 for unlimited, idleTimeout<=0 never destroy harvested workers
+func NewWorkerPool(env EnvInfo, maxWorkers int, idleTimeout time.Duration) (*WorkerPool, error) {
 	// make map: an optional capacity hint, The initial capacity does not bound its size: maps grow to accommodate the number of items stored in them, with the exception of nil maps.
-	return &WorkerPool{env:env, workers:make(map[string]Worker, POOL_DEFAULT_CAPACITY * TASK_QUEUE_MAX_POOL)}, nil
+	return &WorkerPool{env:env, workers:make(map[string]Worker, POOL_DEFAULT_CAPACITY * TASK_QUEUE_MAX_POOL),
+		created:make(map[string]time.Time), harvested:make(map[string]time.Time), maxWorkers:maxWorkers, idleTimeout:idleTimeout}, nil
 }
 
+// reuse a harvested worker or create one, the worker is claimed by caller only.
+// harvested workers of unhealthy connection are destroyed, not reused or counted.
 func (wp *WorkerPool) CreateWorker() (Worker, error) {
+	worker, unhealthy, err := wp.claimWorker()
+
+	//stop outside lock, worker may wait on its channel
+	for _, wkTmp := range unhealthy {
+		destroyErr := wp.env.DestroyWorker(wkTmp)
+		if destroyErr != nil {
+			wp.env.GetLogger().Println("Destroy unhealthy worker " + wkTmp.GetUUID() + " error: " + destroyErr.Error())
+		}
+	}
+
+	return worker, err
+}
+
+//harvested worker removed from harvested under lock, so concurrent calls never share one
+func (wp *WorkerPool) claimWorker() (Worker, []Worker, error) {
 	wp.lock.Lock()
 	defer wp.lock.Unlock()
 
 	var worker Worker
-	for _, wkTmp := range wp.workers {
-		if wkTmp.GetPool() == nil && wkTmp.GetWorkerID() == 0 && wkTmp.GetStatus() == WORKER_STATUS_SPARE {
-			worker = wkTmp
+	unhealthy := []Worker{}
+	for uuid := range wp.harvested {
+		wkTmp := wp.workers[uuid]
+		switch wkTmp.GetStatus() {
+		case WORKER_STATUS_UNHEALTHY:
+			unhealthy = append(unhealthy, wkTmp)
+			delete(wp.workers, uuid)
+			delete(wp.created, uuid)
+			delete(wp.harvested, uuid)
+			continue
+		case WORKER_STATUS_SPARE:
+			if wkTmp.GetPool() == nil {
+				worker = wkTmp
+			}
+		}
+		if worker != nil {
+			break
 		}
 	}
 
 	if worker == nil {
+		if wp.maxWorkers > 0 && len(wp.workers) >= wp.maxWorkers {
+			return nil, unhealthy, errors.New("Error when WorkerPool.CreateWorker(): reach max workers " + strconv.Itoa(wp.maxWorkers))
+		}
+
 		var err error
 		worker, err = wp.env.CreateWorker()
 		if err != nil {
-			return nil, err
+			return nil, unhealthy, err
 		}
 
 		wp.workers[worker.GetUUID()] = worker
+		wp.created[worker.GetUUID()] = time.Now()
 	}
+	delete(wp.harvested, worker.GetUUID())
 
-	return worker, nil
+	return worker, unhealthy, nil
 }
 
 //reset Worker ownership
 func (wp *WorkerPool) HarvestWorker(worker Worker) (error) {
-	if worker.GetStatus() != WORKER_STATUS_SPARE {
-		return errors.New("Error when WorkerPool.HarvestWorker(): worker.GetStatus!=WORKER_STATUS_SPARE")
+	//unhealthy or reconnecting worker is not pushing, can be harvested
+	if worker.GetStatus() == WORKER_STATUS_RUNNING {
+		return errors.New("Error when WorkerPool.HarvestWorker(): worker.GetStatus==WORKER_STATUS_RUNNING")
 	}
 
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
 	if wk, ok := wp.workers[worker.GetUUID()]; ok {
 		wk.SetPool(nil)
 		wk.SetWorkerID(0)
+		wp.harvested[worker.GetUUID()] = time.Now()
 	}
 
 	return nil
 }
 
+// this is a goroutine run, destroy workers harvested longer than idle timeout
+func (wp *WorkerPool) Run() {
+	if wp.idleTimeout <= 0 {
+		return
+	}
+
+	interval := wp.idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if destroyed := wp.DestroyIdle(); destroyed > 0 {
+			wp.env.GetLogger().Println("WorkerPool destroyed " + strconv.Itoa(destroyed) + " idle workers, remain " + strconv.Itoa(wp.Len()))
+		}
+	}
+}
+
+// destroy idle harvested workers, return destroyed count
+func (wp *WorkerPool) DestroyIdle() int {
+	wp.lock.Lock()
+	idle := []Worker{}
+	for uuid, harvested := range wp.harvested {
+		worker := wp.workers[uuid]
+		if time.Since(harvested) >= wp.idleTimeout && worker.GetPool() == nil && worker.GetStatus() != WORKER_STATUS_RUNNING {
+			idle = append(idle, worker)
+			delete(wp.workers, uuid)
+			delete(wp.created, uuid)
+			delete(wp.harvested, uuid)
+		}
+	}
+	wp.lock.Unlock()
+
+	//stop outside lock, worker may wait on its channel
+	for _, worker := range idle {
+		err := wp.env.DestroyWorker(worker)
+		if err != nil {
+			wp.env.GetLogger().Println("Destroy idle worker " + worker.GetUUID() + " error: " + err.Error())
+		}
+	}
+
+	return len(idle)
+}
+
+func (wp *WorkerPool) Len() int {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
 
+	return len(wp.workers)
+}
 
+func (wp *WorkerPool) GetMaxWorkers() int {
+	return wp.maxWorkers
+}
+
+// workers ordered by pool and worker id, harvested last
+func (wp *WorkerPool) List() []*WorkerInfo {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+
+	now := time.Now()
+	list := make([]*WorkerInfo, 0, len(wp.workers))
+	for uuid, worker := range wp.workers {
+		info := &WorkerInfo{UUID:uuid, Name:worker.GetWorkerName(), Status:worker.GetStatus(), PoolID:WORKER_POOL_HARVESTED,
+			WorkerID:worker.GetWorkerID(), Age:int64(now.Sub(wp.created[uuid]).Seconds()), Pushes:worker.GetPushes()}
+		if pool := worker.GetPool(); pool != nil {
+			info.PoolID = pool.PoolID
+		}
+		if harvested, ok := wp.harvested[uuid]; ok {
+			info.Idle = int64(now.Sub(harvested).Seconds())
+		}
+		list = append(list, info)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].PoolID != list[j].PoolID {
+			return list[j].PoolID == WORKER_POOL_HARVESTED || (list[i].PoolID != WORKER_POOL_HARVESTED && list[i].PoolID < list[j].PoolID)
+		}
+		if list[i].WorkerID != list[j].WorkerID {
+			return list[i].WorkerID < list[j].WorkerID
+		}
+		return list[i].UUID < list[j].UUID
+	})
+
+	return list
+}
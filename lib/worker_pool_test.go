@@ -0,0 +1,234 @@
+// Copyright 2016 祝景法(Bruce)@haimi.com. www.haimi.com All rights reserved.
+package lib
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testWorker struct {
+	uuid      string
+	id        int
+	pool      *Pool
+	status    int
+	destroyed bool
+	lock      sync.Mutex
+}
+
+func (w *testWorker) Run() {}
+func (w *testWorker) Stop() {}
+func (w *testWorker) Subscribe(task *Task) {}
+func (w *testWorker) Push(msg MessageInterface, Device string) (*WorkerResponse) { return &WorkerResponse{Device:Device, Sent:true} }
+func (w *testWorker) GetWorkerName() string { return "worker_" + w.uuid }
+func (w *testWorker) SetWorkerID(id int) bool { w.id = id; return true }
+func (w *testWorker) GetWorkerID() int { return w.id }
+func (w *testWorker) SetPool(pool *Pool) bool { w.pool = pool; return true }
+func (w *testWorker) GetPool() *Pool { return w.pool }
+func (w *testWorker) Destroy() error { w.destroyed = true; w.status = WORKER_STATUS_DESTROYED; return nil }
+func (w *testWorker) GetPushes() int64 { return int64(w.id) }
+func (w *testWorker) GetStatus() int { return w.status }
+func (w *testWorker) GetUUID() string { return w.uuid }
+func (w *testWorker) GetLockPtr() *sync.Mutex { return &w.lock }
+
+// only worker methods of env used by WorkerPool
+type testWorkerEnv struct {
+	EnvInfo
+
+	created int
+	wp      *WorkerPool
+}
+
+func (e *testWorkerEnv) GetWorkerPool() *WorkerPool {
+	return e.wp
+}
+
+func (e *testWorkerEnv) CreateWorker() (Worker, error) {
+	e.created++
+	return &testWorker{uuid:"uuid" + strconv.Itoa(e.created)}, nil
+}
+
+func (e *testWorkerEnv) DestroyWorker(worker Worker) error {
+	return worker.Destroy()
+}
+
+func TestWorkerPoolTesting(t *testing.T) {
+	env := &testWorkerEnv{}
+	wp, err := NewWorkerPool(env, 3, time.Hour)
+	if err != nil {
+		t.Fatalf("NewWorkerPool() error: %s", err.Error())
+	}
+
+	pool := &Pool{PoolID:1}
+	workers := []Worker{}
+	for iter := 0; iter < 3; iter++ {
+		worker, err := wp.CreateWorker()
+		if err != nil {
+			t.Fatalf("CreateWorker() error: %s", err.Error())
+		}
+		worker.SetWorkerID(iter)
+		worker.SetPool(pool)
+		workers = append(workers, worker)
+	}
+
+	_, err = wp.CreateWorker()
+	if err == nil || wp.Len() != 3 {
+		t.Errorf("CreateWorker() should fail beyond max workers, len %d", wp.Len())
+	}
+
+	//running worker can not be harvested
+	workers[2].(*testWorker).status = WORKER_STATUS_RUNNING
+	if wp.HarvestWorker(workers[2]) == nil {
+		t.Errorf("HarvestWorker() of running worker should be error")
+	}
+	workers[2].(*testWorker).status = WORKER_STATUS_SPARE
+	if err = wp.HarvestWorker(workers[2]); err != nil {
+		t.Fatalf("HarvestWorker() error: %s", err.Error())
+	}
+
+	list := wp.List()
+	if len(list) != 3 || list[0].WorkerID != 0 || list[1].WorkerID != 1 || list[2].PoolID != WORKER_POOL_HARVESTED || list[2].UUID != workers[2].GetUUID() {
+		t.Errorf("List() expect pool workers ordered and harvested last, got %+v %+v %+v", list[0], list[1], list[2])
+	}
+	if list[1].PoolID != 1 || list[1].Pushes != 1 {
+		t.Errorf("List() worker info error: %+v", list[1])
+	}
+
+	//harvested worker reused within max
+	worker, err := wp.CreateWorker()
+	if err != nil || worker != workers[2] || env.created != 3 {
+		t.Errorf("CreateWorker() should reuse harvested worker")
+	}
+
+	//not idle long enough
+	wp.HarvestWorker(worker)
+	if wp.DestroyIdle() != 0 || workers[2].(*testWorker).destroyed {
+		t.Errorf("DestroyIdle() should keep worker within idle timeout")
+	}
+}
+
+func TestWorkerPoolDestroyIdleTesting(t *testing.T) {
+	env := &testWorkerEnv{}
+	wp, _ := NewWorkerPool(env, 0, 10 * time.Millisecond)
+
+	//in a pool while busy is created, not reused
+	idle, _ := wp.CreateWorker()
+	idle.SetPool(&Pool{PoolID:1})
+	busy, _ := wp.CreateWorker()
+	busy.SetPool(&Pool{PoolID:1})
+	wp.HarvestWorker(idle)
+
+	time.Sleep(20 * time.Millisecond)
+	if destroyed := wp.DestroyIdle(); destroyed != 1 || wp.Len() != 1 {
+		t.Errorf("DestroyIdle() expect 1 destroyed and 1 remain, got %d %d", destroyed, wp.Len())
+	}
+	if !idle.(*testWorker).destroyed || busy.(*testWorker).destroyed {
+		t.Errorf("DestroyIdle() expect only idle harvested worker destroyed")
+	}
+	if len(wp.List()) != 1 || wp.List()[0].UUID != busy.GetUUID() {
+		t.Errorf("List() expect destroyed worker removed")
+	}
+}
+
+func TestWorkerPoolClaimTesting(t *testing.T) {
+	env := &testWorkerEnv{}
+	wp, _ := NewWorkerPool(env, 3, time.Hour)
+
+	harvested, _ := wp.CreateWorker()
+	harvested.SetPool(&Pool{PoolID:1})
+	wp.HarvestWorker(harvested)
+
+	//claimed before SetPool of caller, concurrent initWorkers never share it
+	first, err := wp.CreateWorker()
+	second, err2 := wp.CreateWorker()
+	if err != nil || err2 != nil || first != harvested || second == harvested {
+		t.Fatalf("CreateWorker() expect harvested worker claimed once: %v %v", err, err2)
+	}
+
+	//unhealthy harvested worker destroyed, not counted against max
+	first.SetPool(&Pool{PoolID:1})
+	wp.HarvestWorker(first)
+	first.(*testWorker).status = WORKER_STATUS_UNHEALTHY
+	third, err := wp.CreateWorker()
+	if err != nil || third == first || !first.(*testWorker).destroyed || wp.Len() != 2 {
+		t.Errorf("CreateWorker() expect unhealthy harvested worker destroyed, got %v len %d", err, wp.Len())
+	}
+}
+
+func TestPoolInitWorkersReleaseTesting(t *testing.T) {
+	env := &testWorkerEnv{}
+	env.wp, _ = NewWorkerPool(env, 2, time.Hour)
+
+	config, err := NewPoolConfig(3, 5, 1, 4)
+	if err != nil {
+		t.Fatalf("NewPoolConfig() error: %s", err.Error())
+	}
+	pool := &Pool{Config:config, Env:env}
+	if pool.initWorkers(3) == nil {
+		t.Fatalf("initWorkers() beyond max workers expect error")
+	}
+
+	//workers created before error are harvested, not leaked in the pool
+	for _, info := range env.wp.List() {
+		if info.PoolID != WORKER_POOL_HARVESTED {
+			t.Errorf("initWorkers() error expect created workers harvested, got %+v", info)
+		}
+	}
+	if len(pool.Workers) != 0 {
+		t.Errorf("initWorkers() error expect no pool workers, got %d", len(pool.Workers))
+	}
+	if _, err := env.wp.CreateWorker(); err != nil {
+		t.Errorf("CreateWorker() expect released worker reused, got %v", err)
+	}
+}
+
+// run with -race, autoscale expands workers while admin and stats read them
+func TestPoolWorkersRaceTesting(t *testing.T) {
+	env := &testWorkerEnv{}
+	env.wp, _ = NewWorkerPool(env, 40, time.Hour)
+
+	config, err := NewPoolConfig(1, 40, 1, 10)
+	if err != nil {
+		t.Fatalf("NewPoolConfig() error: %s", err.Error())
+	}
+	pool := &Pool{Config:config, Env:env, Status:POOL_STATUS_SENDING, slotCond:sync.NewCond(&sync.Mutex{})}
+
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	for iter := 0; iter < 3; iter++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				pool.Info()
+				var pushes int64
+				for _, worker := range pool.GetWorkers() {
+					pushes += worker.GetPushes()
+				}
+				pool.GetWorkerCount()
+			}
+		}()
+	}
+
+	for size := 2; size <= 40; size++ {
+		pool.Lock.Lock()
+		err := pool.expand(size)
+		pool.Lock.Unlock()
+		if err != nil {
+			t.Errorf("expand() error: %s", err.Error())
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if pool.GetWorkerCount() != 40 || pool.Info().Workers != 40 {
+		t.Errorf("expand() expect 40 workers, got %d", pool.GetWorkerCount())
+	}
+}
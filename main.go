@@ -72,13 +72,70 @@ func main() {
 		Usage: "Worker pool maxSpare worker.",
 	}
 
+	throttleRate := &cli.StringFlag{
+		Name:  "throttle.rate",
+		Value: "",
+		Usage: "Outbound pushes per second of all pools, 0 for unlimited.",
+	}
+
+	taskPools := &cli.StringFlag{
+		Name:  "task.pools",
+		Value: "",
+		Usage: "Max worker pools, default 5.",
+	}
+
+	taskQueueSize := &cli.StringFlag{
+		Name:  "task.queue.size",
+		Value: "",
+		Usage: "Max waiting tasks, default 100.",
+	}
+
+	taskConcurrency := &cli.StringFlag{
+		Name:  "task.concurrency",
+		Value: "",
+		Usage: "Max tasks sending in parallel, default equal to task.pools.",
+	}
+
+	taskShare := &cli.StringFlag{
+		Name:  "task.share",
+		Value: "",
+		Usage: "Whether new task can share idle workers of a busy pool, true or false.",
+	}
+
+	pushID := &cli.StringFlag{
+		Name:  "push-id",
+		Value: "",
+		Usage: "Push-id of report.",
+	}
+
+	reportFormat := &cli.StringFlag{
+		Name:  "format",
+		Value: lib.REPORT_FORMAT_JSON,
+		Usage: "Report format: json or csv.",
+	}
+
+	reportOutput := &cli.StringFlag{
+		Name:  "output, o",
+		Value: "",
+		Usage: "Report output file, default stdout.",
+	}
+
 	app.Commands = []cli.Command{
 		{
 			Name:    "apns",
 			Usage:   "Usage: " + os.Args[0] + " apns -f config.ini \nSend apns push notificatioins.",
 			Action:  apns.Bootstrap,
 			Flags: []cli.Flag{
-				cfgFlag, logChannel, logPath, pidPath, size, capacity, miniSpare, maxSpare, queueFlag,
+				cfgFlag, logChannel, logPath, pidPath, size, capacity, miniSpare, maxSpare, queueFlag, throttleRate,
+				taskPools, taskQueueSize, taskConcurrency, taskShare,
+			},
+		},
+		{
+			Name:    "report",
+			Usage:   "Usage: " + os.Args[0] + " report -f config.ini --push-id id --format csv \nExport delivery report of a push-id from delivery records.",
+			Action:  apns.Report,
+			Flags: []cli.Flag{
+				cfgFlag, pushID, reportFormat, reportOutput,
 			},
 		},
 	}